@@ -0,0 +1,274 @@
+// Package client talks to a postfile server.
+//
+// Small files can be sent with Upload.  Larger files and unreliable networks
+// are better served by UploadStream, which sends the file in checksummed
+// parts using a chunked session, or Prepare, which starts a session which
+// can be used piecemeal.  Chunked sessions need a server started with
+// -chunked.  A failed UploadStream can be finished with Session.Resume.
+// Search lists stored files, if the server allows it.
+//
+// Requests are retried with backoff on network errors and 5xx responses.
+// Servers with self-signed certificates can be pinned by the SHA256 hash of
+// their certificate's public key.
+package client
+
+/*
+ * client.go
+ * Client for postfile servers
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	/* DefaultRetries is the number of times a request is retried */
+	DefaultRetries = 5
+	/* DefaultListPath is the usual path for Search */
+	DefaultListPath = "/_list"
+	/* maxBackoff is the longest we wait between retries */
+	maxBackoff = time.Minute
+	/* checksumHeader holds an upload's hex-encoded SHA256 hash */
+	checksumHeader = "X-Checksum-Sha256"
+	/* idempotencyHeader holds an upload's idempotency key */
+	idempotencyHeader = "Idempotency-Key"
+)
+
+// ErrPinMismatch is returned when the server's certificate doesn't match
+// any of the client's pins.
+var ErrPinMismatch = errors.New("server certificate does not match pin")
+
+// StatusError is returned when the server responds with an unexpected
+// status.
+type StatusError struct {
+	Code int    /* HTTP status code */
+	Body string /* Start of the response body */
+}
+
+/* Error implements the error interface. */
+func (err StatusError) Error() string {
+	return fmt.Sprintf(
+		"unexpected status %d %s: %s",
+		err.Code,
+		http.StatusText(err.Code),
+		err.Body,
+	)
+}
+
+// Client sends files to a postfile server.  Its fields should not be
+// changed after it's first used.
+type Client struct {
+	// URL is the server's base URL, e.g. https://example.com:443.
+	URL string
+
+	// Token, if set, is sent as a bearer token.
+	Token string
+
+	// Retries is the number of times a failed request is retried.
+	// Negative values disable retries.
+	Retries int
+
+	// ListPath is the path used by Search.
+	ListPath string
+
+	// PartSize is the size of the parts UploadStream sends.
+	PartSize int
+
+	// HTTPClient is used to make requests.
+	HTTPClient *http.Client
+}
+
+// New returns a new Client for the server at u.  If pins are given, the
+// server's certificate is accepted if the hex-encoded SHA256 hash of its
+// public key (as in a PKIX SubjectPublicKeyInfo) matches one of the pins,
+// even if the certificate isn't otherwise trusted.
+func New(u, token string, pins ...string) *Client {
+	c := &Client{
+		URL:        strings.TrimSuffix(u, "/"),
+		Token:      token,
+		Retries:    DefaultRetries,
+		ListPath:   DefaultListPath,
+		PartSize:   DefaultPartSize,
+		HTTPClient: http.DefaultClient,
+	}
+	if 0 != len(pins) {
+		t := http.DefaultTransport.(*http.Transport).Clone()
+		t.TLSClientConfig = &tls.Config{
+			InsecureSkipVerify:    true, /* We check the pin. */
+			VerifyPeerCertificate: verifyPins(pins),
+		}
+		c.HTTPClient = &http.Client{Transport: t}
+	}
+	return c
+}
+
+// verifyPins returns a function suitable for use as a tls.Config's
+// VerifyPeerCertificate which checks the leaf certificate against pins.
+func verifyPins(
+	pins []string,
+) func([][]byte, [][]*x509.Certificate) error {
+	ps := make([][]byte, 0, len(pins))
+	for _, p := range pins {
+		if b, err := hex.DecodeString(p); nil == err {
+			ps = append(ps, b)
+		}
+	}
+	return func(raw [][]byte, _ [][]*x509.Certificate) error {
+		if 0 == len(raw) {
+			return ErrPinMismatch
+		}
+		cert, err := x509.ParseCertificate(raw[0])
+		if nil != err {
+			return err
+		}
+		h := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		for _, p := range ps {
+			if 1 == subtle.ConstantTimeCompare(h[:], p) {
+				return nil
+			}
+		}
+		return ErrPinMismatch
+	}
+}
+
+// PinFor returns the pin for cert, for use with New.
+func PinFor(cert *x509.Certificate) string {
+	h := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return hex.EncodeToString(h[:])
+}
+
+// Upload sends data to the server, which stores it based on path.  It
+// returns the number of bytes the server stored.  The data's SHA256 hash is
+// sent for the server to check, as well as a random idempotency key so
+// retries aren't stored twice by servers which remember keys.
+func (c *Client) Upload(
+	ctx context.Context,
+	path string,
+	data []byte,
+) (int64, error) {
+	h := sha256.Sum256(data)
+	hdr := http.Header{checksumHeader: {hex.EncodeToString(h[:])}}
+	key := make([]byte, 16)
+	if _, err := rand.Read(key); nil != err {
+		return 0, fmt.Errorf("generating idempotency key: %w", err)
+	}
+	hdr.Set(idempotencyHeader, hex.EncodeToString(key))
+	b, err := c.request(ctx, http.MethodPost, path, nil, hdr, data, nil)
+	if nil != err {
+		return 0, err
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+	if nil != err {
+		return 0, fmt.Errorf("unexpected response %q", b)
+	}
+	return n, nil
+}
+
+// request makes a request, retrying as necessary.  If hdrs isn't nil, the
+// response's headers are put in it.
+func (c *Client) request(
+	ctx context.Context,
+	method string,
+	path string,
+	q url.Values,
+	h http.Header,
+	body []byte,
+	hdrs *http.Header,
+) ([]byte, error) {
+	var (
+		backoff = time.Second
+		err     error
+		b       []byte
+	)
+	for try := 0; ; try++ {
+		var retry bool
+		b, retry, err = c.once(ctx, method, path, q, h, body, hdrs)
+		if nil == err || !retry || try >= c.Retries {
+			return b, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, maxBackoff)
+	}
+}
+
+// once makes a single request.  If the request failed, once returns true if
+// it should be retried.
+func (c *Client) once(
+	ctx context.Context,
+	method string,
+	path string,
+	q url.Values,
+	h http.Header,
+	body []byte,
+	hdrs *http.Header,
+) ([]byte, bool, error) {
+	/* Roll the request */
+	u := c.URL + "/" + strings.TrimPrefix(path, "/")
+	if 0 != len(q) {
+		u += "?" + q.Encode()
+	}
+	req, err := http.NewRequestWithContext(
+		ctx,
+		method,
+		u,
+		bytes.NewReader(body),
+	)
+	if nil != err {
+		return nil, false, err
+	}
+	for k, vs := range h {
+		req.Header[k] = vs
+	}
+	if "" != c.Token {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+
+	/* Send it off */
+	res, err := c.HTTPClient.Do(req)
+	if nil != err {
+		return nil, !errors.Is(err, ErrPinMismatch) &&
+			nil == ctx.Err(), err
+	}
+	defer res.Body.Close()
+	b, err := io.ReadAll(res.Body)
+	if nil != err {
+		return nil, true, err
+	}
+	if nil != hdrs {
+		*hdrs = res.Header
+	}
+	if 2 != res.StatusCode/100 {
+		if 256 < len(b) {
+			b = b[:256]
+		}
+		return b, 5 == res.StatusCode/100 ||
+				http.StatusTooManyRequests == res.StatusCode,
+			StatusError{
+				Code: res.StatusCode,
+				Body: strings.TrimSpace(string(b)),
+			}
+	}
+	return b, false, nil
+}
@@ -0,0 +1,71 @@
+package client
+
+/*
+ * search.go
+ * List stored files
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"time"
+)
+
+/* nextLinkRE finds the next page in a Link header */
+var nextLinkRE = regexp.MustCompile(`<([^>]*)>;\s*rel="next"`)
+
+// File describes a file stored on the server.
+type File struct {
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+	Source  string    `json:"source"`
+	Path    string    `json:"path"`
+}
+
+// Search returns the stored files whose names start with prefix, newest
+// first.  The server must have been started with -list.
+func (c *Client) Search(ctx context.Context, prefix string) ([]File, error) {
+	var (
+		fs   []File
+		path = c.ListPath
+		q    = url.Values{}
+	)
+	if "" == path {
+		path = DefaultListPath
+	}
+	if "" != prefix {
+		q.Set("prefix", prefix)
+	}
+	for {
+		/* Get a page */
+		var hdrs http.Header
+		b, err := c.request(ctx, http.MethodGet, path, q, nil, nil, &hdrs)
+		if nil != err {
+			return nil, err
+		}
+		var page []File
+		if err := json.Unmarshal(b, &page); nil != err {
+			return nil, fmt.Errorf("decoding response: %w", err)
+		}
+		fs = append(fs, page...)
+
+		/* Work out if there's another */
+		m := nextLinkRE.FindStringSubmatch(hdrs.Get("Link"))
+		if nil == m {
+			return fs, nil
+		}
+		next, err := url.Parse(m[1])
+		if nil != err {
+			return nil, fmt.Errorf("invalid next link %q: %w", m[1], err)
+		}
+		q = next.Query()
+	}
+}
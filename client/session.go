@@ -0,0 +1,236 @@
+package client
+
+/*
+ * session.go
+ * Chunked upload sessions
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const (
+	/* DefaultPartSize is the size of the parts UploadStream sends */
+	DefaultPartSize = 8 << 20
+	/* partHeader holds a part's hex-encoded SHA256 hash */
+	partHeader = "X-Part-Sha256"
+	/* sessionParam is the query parameter which holds a session's ID */
+	sessionParam = "chunk-session"
+)
+
+// Part describes a part of a chunked upload the server's received.
+type Part struct {
+	Part   int    `json:"part"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+	Status string `json:"status"`
+}
+
+// Result describes a finished chunked upload.
+type Result struct {
+	Bytes int64  `json:"bytes"`
+	Name  string `json:"name"`
+	Parts []Part `json:"parts"`
+}
+
+// Session is a chunked upload session.  Parts may be sent in any order and
+// more than once, and are stored as a single file by Complete.
+type Session struct {
+	c    *Client
+	path string
+
+	// ID is the session's ID, which may be used with Client.Session to
+	// resume the session later.
+	ID string
+}
+
+// Prepare starts a new chunked upload session, which will be stored based
+// on path.
+func (c *Client) Prepare(ctx context.Context, path string) (*Session, error) {
+	b, err := c.request(
+		ctx,
+		http.MethodPost,
+		path,
+		url.Values{sessionParam: {"new"}},
+		nil,
+		nil,
+		nil,
+	)
+	if nil != err {
+		return nil, err
+	}
+	id := strings.TrimSpace(string(b))
+	if "" == id {
+		return nil, errors.New("empty session ID")
+	}
+	return c.Session(path, id), nil
+}
+
+// Session returns a Session for an existing chunked upload session with the
+// given path and ID.
+func (c *Client) Session(path, id string) *Session {
+	return &Session{c: c, path: path, ID: id}
+}
+
+// UploadStream sends everything read from r as a chunked upload, stored
+// based on path, in parts of c.PartSize bytes.
+func (c *Client) UploadStream(
+	ctx context.Context,
+	path string,
+	r io.Reader,
+) (*Result, error) {
+	s, err := c.Prepare(ctx, path)
+	if nil != err {
+		return nil, fmt.Errorf("starting session: %w", err)
+	}
+	return s.send(ctx, r, nil)
+}
+
+// Resume sends everything read from r in parts of the Client's PartSize
+// bytes, skipping parts the server already has, and completes the session.
+// It's meant for finishing an UploadStream which failed partway, and r
+// should read the same data.
+func (s *Session) Resume(ctx context.Context, r io.Reader) (*Result, error) {
+	ps, err := s.Status(ctx)
+	if nil != err {
+		return nil, fmt.Errorf("getting status: %w", err)
+	}
+	have := make(map[int]string, len(ps))
+	for _, p := range ps {
+		have[p.Part] = p.SHA256
+	}
+	return s.send(ctx, r, have)
+}
+
+// send sends r in parts, except for those with hashes in have, and
+// completes the session.
+func (s *Session) send(
+	ctx context.Context,
+	r io.Reader,
+	have map[int]string,
+) (*Result, error) {
+	ps := s.c.PartSize
+	if 0 >= ps {
+		ps = DefaultPartSize
+	}
+	buf := make([]byte, ps)
+	for pn := 0; ; pn++ {
+		n, err := io.ReadFull(r, buf)
+		if io.EOF == err && 0 != pn {
+			break
+		} else if nil != err && io.ErrUnexpectedEOF != err &&
+			io.EOF != err {
+			return nil, fmt.Errorf("reading part %d: %w", pn, err)
+		}
+		h := sha256.Sum256(buf[:n])
+		if hex.EncodeToString(h[:]) != have[pn] {
+			if _, err := s.UploadPart(
+				ctx,
+				pn,
+				buf[:n],
+			); nil != err {
+				return nil, fmt.Errorf(
+					"sending part %d: %w",
+					pn,
+					err,
+				)
+			}
+		}
+		if n < len(buf) {
+			break
+		}
+	}
+	return s.Complete(ctx)
+}
+
+// UploadPart sends part n of the upload.  The part is resent if the server
+// reports a checksum mismatch.
+func (s *Session) UploadPart(
+	ctx context.Context,
+	n int,
+	data []byte,
+) (Part, error) {
+	var (
+		p Part
+		h = sha256.Sum256(data)
+	)
+	for try := 0; ; try++ {
+		b, err := s.c.request(
+			ctx,
+			http.MethodPost,
+			s.path,
+			url.Values{
+				sessionParam: {s.ID},
+				"part":       {strconv.Itoa(n)},
+			},
+			http.Header{partHeader: {hex.EncodeToString(h[:])}},
+			data,
+			nil,
+		)
+		var se StatusError
+		if errors.As(err, &se) &&
+			http.StatusUnprocessableEntity == se.Code &&
+			try < s.c.Retries {
+			continue
+		} else if nil != err {
+			return p, err
+		}
+		if err := json.Unmarshal(b, &p); nil != err {
+			return p, fmt.Errorf("decoding response: %w", err)
+		}
+		return p, nil
+	}
+}
+
+// Status returns the parts the server has received.
+func (s *Session) Status(ctx context.Context) ([]Part, error) {
+	var ps []Part
+	if err := s.call(ctx, "status", &ps); nil != err {
+		return nil, err
+	}
+	return ps, nil
+}
+
+// Complete asks the server to store the parts it's received as a single
+// file, ending the session.  If parts are missing, a StatusError with Code
+// 409 is returned and the session may be continued.
+func (s *Session) Complete(ctx context.Context) (*Result, error) {
+	var res Result
+	if err := s.call(ctx, "complete", &res); nil != err {
+		return nil, err
+	}
+	return &res, nil
+}
+
+/* call makes a bodyless request for the session and unmarshals the reply. */
+func (s *Session) call(ctx context.Context, what string, v any) error {
+	b, err := s.c.request(
+		ctx,
+		http.MethodPost,
+		s.path,
+		url.Values{sessionParam: {s.ID}, what: {""}},
+		nil,
+		nil,
+		nil,
+	)
+	if nil != err {
+		return err
+	}
+	if err := json.Unmarshal(b, v); nil != err {
+		return fmt.Errorf("decoding response: %w", err)
+	}
+	return nil
+}
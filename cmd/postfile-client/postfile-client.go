@@ -0,0 +1,247 @@
+// Program postfile-client sends files to a postfile server.
+package main
+
+/*
+ * postfile-client.go
+ * Send files to a postfile server
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/magisterquis/postfile/client"
+)
+
+/* tokenEnv is the environment variable which may hold the token. */
+const tokenEnv = "POSTFILE_TOKEN"
+
+/* sender sends files with a client. */
+type sender struct {
+	c        *client.Client
+	compress bool
+	resume   string
+	timeout  time.Duration
+}
+
+func main() {
+	var (
+		serverURL = flag.String(
+			"url",
+			"",
+			"Server's base `URL` (e.g. https://example.com:4433)",
+		)
+		tokenFile = flag.String(
+			"token-file",
+			"",
+			"Optional `file` with the token to send (default "+
+				"$"+tokenEnv+")",
+		)
+		pins = flag.String(
+			"pin",
+			"",
+			"Comma-separated hex-encoded SHA256 `hashes` of public "+
+				"keys to trust in the server's certificate, "+
+				"for self-signed certificates",
+		)
+		remotePath = flag.String(
+			"path",
+			"",
+			"Upload `path` (default the file's name)",
+		)
+		partSize = flag.Int(
+			"part-size",
+			client.DefaultPartSize,
+			"Send files larger than this many `bytes` in parts of "+
+				"this size",
+		)
+		compress = flag.Bool(
+			"gzip",
+			false,
+			"Compress files with gzip before sending them, and add "+
+				".gz to the path",
+		)
+		retries = flag.Int(
+			"retries",
+			client.DefaultRetries,
+			"Retry failed requests this many `times`",
+		)
+		resume = flag.String(
+			"resume",
+			"",
+			"Resume the chunked upload with this session `ID`, "+
+				"with the same file and options",
+		)
+		timeout = flag.Duration(
+			"timeout",
+			0,
+			"Give up on each file after this `period` (0 to wait "+
+				"forever)",
+		)
+	)
+	flag.Usage = func() {
+		fmt.Fprintf(
+			os.Stderr,
+			`Usage: %v -url URL [options] file [file...]
+
+Sends files to a postfile server.  Files no larger than -part-size are sent
+in one request, with a checksum and an idempotency key.  Larger files are
+sent in checksummed parts in a chunked upload session, which needs a server
+started with -chunked and can be resumed with -resume if sending fails.
+Failed requests are retried with backoff.  A file named - is read from the
+standard input.
+
+Options:
+`,
+			os.Args[0],
+		)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	/* Work out what to send where */
+	if "" == *serverURL {
+		log.Fatalf("Need a server URL (-url)")
+	}
+	if 0 == flag.NArg() {
+		log.Fatalf("Need at least one file to send")
+	}
+	if 1 < flag.NArg() && "" != *remotePath {
+		log.Fatalf("-path only works with one file")
+	}
+	if 1 < flag.NArg() && "" != *resume {
+		log.Fatalf("-resume only works with one file")
+	}
+	if 0 >= *partSize {
+		log.Fatalf("Part size must be positive")
+	}
+
+	/* Roll a client */
+	token := os.Getenv(tokenEnv)
+	if "" != *tokenFile {
+		b, err := os.ReadFile(*tokenFile)
+		if nil != err {
+			log.Fatalf("Unable to read token: %v", err)
+		}
+		token = strings.TrimSpace(string(b))
+	}
+	var ps []string
+	for _, p := range strings.Split(*pins, ",") {
+		if p = strings.TrimSpace(p); "" != p {
+			ps = append(ps, p)
+		}
+	}
+	c := client.New(*serverURL, token, ps...)
+	c.Retries = *retries
+	c.PartSize = *partSize
+	s := sender{
+		c:        c,
+		compress: *compress,
+		resume:   *resume,
+		timeout:  *timeout,
+	}
+
+	/* Send ALL the files */
+	var failed bool
+	for _, fn := range flag.Args() {
+		p := *remotePath
+		if "" == p {
+			p = "/" + filepath.Base(fn)
+			if "-" == fn {
+				p = "/stdin"
+			}
+		}
+		if err := s.send(fn, p); nil != err {
+			log.Printf("Unable to send %s: %v", fn, err)
+			failed = true
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// send sends the file named fn, or the standard input if fn is -, to the
+// given path.
+func (s sender) send(fn, path string) error {
+	ctx := context.Background()
+	if 0 != s.timeout {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.timeout)
+		defer cancel()
+	}
+
+	/* Get hold of the file */
+	var r io.Reader = os.Stdin
+	if "-" != fn {
+		f, err := os.Open(fn)
+		if nil != err {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	if s.compress {
+		pr, pw := io.Pipe()
+		defer pr.Close() /* Unblocks the compressor if we fail */
+		go func(r io.Reader) {
+			gw := gzip.NewWriter(pw)
+			_, err := io.Copy(gw, r)
+			if nil == err {
+				err = gw.Close()
+			}
+			pw.CloseWithError(err)
+		}(r)
+		r = pr
+		path += ".gz"
+	}
+
+	/* Finish an old session, if we're resuming */
+	if "" != s.resume {
+		res, err := s.c.Session(path, s.resume).Resume(ctx, r)
+		if nil != err {
+			return err
+		}
+		log.Printf("Sent %s as %s (%d bytes)", fn, res.Name, res.Bytes)
+		return nil
+	}
+
+	/* Small files go in one request */
+	buf := make([]byte, s.c.PartSize)
+	n, err := io.ReadFull(r, buf)
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		stored, err := s.c.Upload(ctx, path, buf[:n])
+		if nil != err {
+			return err
+		}
+		log.Printf("Sent %s (%d bytes stored)", fn, stored)
+		return nil
+	} else if nil != err {
+		return err
+	}
+
+	/* Bigger ones go in parts */
+	sess, err := s.c.Prepare(ctx, path)
+	if nil != err {
+		return fmt.Errorf("starting session: %w", err)
+	}
+	res, err := sess.Resume(ctx, io.MultiReader(bytes.NewReader(buf), r))
+	if nil != err {
+		return fmt.Errorf("%w (session %s, try -resume)", err, sess.ID)
+	}
+	log.Printf("Sent %s as %s (%d bytes)", fn, res.Name, res.Bytes)
+	return nil
+}
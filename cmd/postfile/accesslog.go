@@ -0,0 +1,161 @@
+package main
+
+/*
+ * accesslog.go
+ * Apache-style combined access log
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+/* accessTimeLayout is Apache's %t */
+const accessTimeLayout = "02/Jan/2006:15:04:05 -0700"
+
+// accessLog writes Combined Log Format lines to a file, which is reopened on
+// SIGHUP to play nicely with logrotate and friends.
+type accessLog struct {
+	sync.Mutex
+	fn string
+	f  *os.File
+}
+
+// openAccessLog opens the named file for access logging and arranges for it
+// to be reopened on SIGHUP.
+func openAccessLog(fn string) (*accessLog, error) {
+	/* Absolute, as we may chdir later */
+	afn, err := filepath.Abs(fn)
+	if nil != err {
+		return nil, err
+	}
+	a := &accessLog{fn: afn}
+	if err := a.reopen(); nil != err {
+		return nil, err
+	}
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	go func() {
+		for range ch {
+			if err := a.reopen(); nil != err {
+				log.Printf(
+					"Unable to reopen access log %v: %v",
+					a.fn,
+					err,
+				)
+				continue
+			}
+			log.Printf("Reopened access log %v", a.fn)
+		}
+	}()
+	return a, nil
+}
+
+/* reopen (re)opens the log file, closing the old one if we had one. */
+func (a *accessLog) reopen() error {
+	f, err := os.OpenFile(a.fn, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if nil != err {
+		return err
+	}
+	a.Lock()
+	defer a.Unlock()
+	if nil != a.f {
+		a.f.Close()
+	}
+	a.f = f
+	return nil
+}
+
+/* Wrap wraps h to log every request. */
+func (a *accessLog) Wrap(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w}
+		h.ServeHTTP(sw, r)
+		if 0 == sw.status {
+			sw.status = http.StatusOK
+		}
+		a.write(r, start, sw.status, sw.n)
+	})
+}
+
+/* write writes a log line for a request. */
+func (a *accessLog) write(r *http.Request, t time.Time, status int, n int64) {
+	rd := redactorFor(redactAccess)
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if nil != err {
+		host = r.RemoteAddr
+	}
+	host = rd.IPs(host)
+	user := tokenName(r)
+	if "" == user {
+		user = "-"
+	}
+	size := "-"
+	if 0 != n {
+		size = fmt.Sprintf("%d", n)
+	}
+	line := fmt.Sprintf(
+		"%s - %s [%s] %s %d %s %s %s\n",
+		host,
+		clfField(user),
+		t.Format(accessTimeLayout),
+		clfQuote(r.Method+" "+rd.Path(r.RequestURI)+" "+r.Proto),
+		status,
+		size,
+		clfQuote(rd.Line(r.Referer(), r.Referer())),
+		clfQuote(r.UserAgent()),
+	)
+	a.Lock()
+	defer a.Unlock()
+	if _, err := a.f.WriteString(line); nil != err {
+		log.Printf("Error writing to access log %v: %v", a.fn, err)
+	}
+}
+
+// clfQuote double-quotes s the way Apache does, escaping quotes, backslashes,
+// and nonprintable bytes.  Empty strings become "-".
+func clfQuote(s string) string {
+	if "" == s {
+		return `"-"`
+	}
+	return `"` + clfEscape(s) + `"`
+}
+
+/* clfField escapes s for use as an unquoted field. */
+func clfField(s string) string {
+	b := []byte(clfEscape(s))
+	for i, c := range b {
+		if ' ' == c {
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
+
+/* clfEscape escapes s like Apache's ap_escape_logitem. */
+func clfEscape(s string) string {
+	var b []byte
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case '"' == c, '\\' == c:
+			b = append(b, '\\', c)
+		case ' ' > c, 0x7f <= c:
+			b = fmt.Appendf(b, `\x%02x`, c)
+		default:
+			b = append(b, c)
+		}
+	}
+	return string(b)
+}
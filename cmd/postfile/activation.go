@@ -0,0 +1,46 @@
+package main
+
+/*
+ * activation.go
+ * systemd socket activation
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+)
+
+/* sdListenFDsStart is the first file descriptor passed by systemd */
+const sdListenFDsStart = 3
+
+// activatedListener returns the listening socket passed to us by systemd,
+// as in sd_listen_fds(3), or nil if we weren't socket-activated.  Only one
+// socket is supported.  The environment variables are unset so child
+// processes don't get confused.
+func activatedListener() (net.Listener, error) {
+	if strconv.Itoa(os.Getpid()) != os.Getenv("LISTEN_PID") {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	if nil != err || 0 == n {
+		return nil, nil
+	}
+	if 1 != n {
+		return nil, fmt.Errorf("got %d sockets, expected 1", n)
+	}
+	f := os.NewFile(sdListenFDsStart, "systemd socket")
+	l, err := net.FileListener(f)
+	f.Close() /* FileListener dups it. */
+	if nil != err {
+		return nil, fmt.Errorf("using systemd socket: %w", err)
+	}
+	return l, nil
+}
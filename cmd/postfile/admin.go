@@ -0,0 +1,190 @@
+package main
+
+/*
+ * admin.go
+ * Local-only admin API
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// adminHeader must be set on every admin API request.  Browsers won't send
+// it cross-origin without a preflight request we don't answer, which stops
+// CSRF.
+const adminHeader = "X-Postfile-Admin"
+
+var (
+	/* adminMux routes admin API requests */
+	adminMux = http.NewServeMux()
+
+	/* adminToken, if set, is the value adminHeader must have */
+	adminToken string
+)
+
+func init() {
+	adminMux.HandleFunc("/features", adminListFeatures)
+	adminMux.HandleFunc("/features/", adminSetFeature)
+}
+
+// listenAdmin listens for admin API requests on addr, which is either a path
+// to a unix socket or a loopback TCP address, and serves them in a new
+// goroutine.
+func listenAdmin(addr string) (net.Listener, error) {
+	l, err := adminListener(addr)
+	if nil != err {
+		return nil, err
+	}
+	go func() {
+		log.Fatalf(
+			"Admin API error: %v",
+			http.Serve(l, withAdminAuth(adminMux)),
+		)
+	}()
+	return l, nil
+}
+
+// adminListener listens on addr, which is either a path to a unix socket
+// only we can use or a loopback TCP address.
+func adminListener(addr string) (net.Listener, error) {
+	var (
+		l   net.Listener
+		err error
+	)
+	if strings.Contains(addr, "/") {
+		/* Remove a stale socket, but nothing else */
+		if fi, err := os.Lstat(addr); nil == err &&
+			0 != fi.Mode()&os.ModeSocket {
+			os.Remove(addr)
+		}
+		/* Nobody else gets a chance to connect */
+		err = withUmask(0177, func() error {
+			var err error
+			l, err = net.Listen("unix", addr)
+			return err
+		})
+	} else {
+		/* Make sure we're only listening locally */
+		host, _, serr := net.SplitHostPort(addr)
+		if nil != serr {
+			return nil, serr
+		}
+		if ip := net.ParseIP(host); "localhost" != host &&
+			(nil == ip || !ip.IsLoopback()) {
+			return nil, fmt.Errorf(
+				"%v is not a loopback address",
+				host,
+			)
+		}
+		l, err = net.Listen("tcp", addr)
+	}
+	return l, err
+}
+
+// withAdminAuth refuses requests without adminHeader or, if adminToken is
+// set, with the wrong value in adminHeader.
+func withAdminAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := r.Header.Get(adminHeader)
+		if "" == h || ("" != adminToken && 1 != subtle.ConstantTimeCompare(
+			[]byte(h),
+			[]byte(adminToken),
+		)) {
+			log.Printf(
+				"Admin API: unauthorized %s %s from %v",
+				r.Method,
+				r.URL.Path,
+				r.RemoteAddr,
+			)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+/* adminJSON sends v back as JSON. */
+func adminJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); nil != err {
+		log.Printf("Admin API: error sending response: %v", err)
+	}
+}
+
+/* adminListFeatures lists the toggleable features and whether they're on. */
+func adminListFeatures(w http.ResponseWriter, r *http.Request) {
+	if http.MethodGet != r.Method {
+		http.Error(w, "Invalid method", http.StatusMethodNotAllowed)
+		return
+	}
+	type fs struct {
+		Enabled     bool   `json:"enabled"`
+		Description string `json:"description"`
+	}
+	m := make(map[string]fs)
+	for _, n := range featureNames() {
+		f := features[n]
+		m[n] = fs{Enabled: f.Enabled(), Description: f.desc}
+	}
+	adminJSON(w, m)
+}
+
+// adminSetFeature turns the feature named in the URL path on or off, based
+// on the enabled parameter.  Every change is logged, to the audit log as
+// well if we have one.
+func adminSetFeature(w http.ResponseWriter, r *http.Request) {
+	if http.MethodPost != r.Method {
+		http.Error(w, "Invalid method", http.StatusMethodNotAllowed)
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, "/features/")
+	f, ok := features[name]
+	if !ok {
+		http.Error(w, "Unknown feature", http.StatusNotFound)
+		return
+	}
+	on, err := strconv.ParseBool(r.FormValue("enabled"))
+	if nil != err {
+		http.Error(w, "Invalid enabled value", http.StatusBadRequest)
+		return
+	}
+	was, err := f.Set(on)
+	if nil != err {
+		log.Printf(
+			"Admin API: %v unable to set feature %v to %v: %v",
+			r.RemoteAddr,
+			name,
+			on,
+			err,
+		)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	/* Note who did what */
+	m := fmt.Sprintf(
+		"Admin API: %v set feature %v to %v (was %v)",
+		r.RemoteAddr,
+		name,
+		on,
+		was,
+	)
+	log.Printf("%v", m)
+	if nil != auditLog {
+		auditLog.Printf("%v", m)
+	}
+	adminJSON(w, map[string]bool{"enabled": on, "was": was})
+}
@@ -0,0 +1,59 @@
+package main
+
+/*
+ * admin_test.go
+ * Tests for admin.go
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"os"
+	"runtime"
+	"testing"
+)
+
+func TestAdminListenerUnix(t *testing.T) {
+	if "windows" == runtime.GOOS || "plan9" == runtime.GOOS {
+		t.Skipf("No umask on %s", runtime.GOOS)
+	}
+	t.Chdir(t.TempDir())
+	const sock = "./admin.sock"
+
+	/* A fresh socket should only be usable by us */
+	l, err := adminListener(sock)
+	if nil != err {
+		t.Fatalf("Listen: %s", err)
+	}
+	fi, err := os.Lstat(sock)
+	if nil != err {
+		t.Fatalf("Lstat: %s", err)
+	}
+	if got := fi.Mode().Perm(); 0600 != got {
+		t.Errorf("Socket permissions %v, want -rw-------", got)
+	}
+
+	/* A stale socket should be replaced */
+	l.(interface{ SetUnlinkOnClose(bool) }).SetUnlinkOnClose(false)
+	l.Close()
+	if l, err = adminListener(sock); nil != err {
+		t.Fatalf("Listen with stale socket: %s", err)
+	}
+	l.Close()
+
+	/* Anything else should be left alone */
+	const file = "./admin.file"
+	if err := os.WriteFile(file, []byte("kittens"), 0644); nil != err {
+		t.Fatalf("Making file: %s", err)
+	}
+	if l, err = adminListener(file); nil == err {
+		l.Close()
+		t.Fatalf("Listened on top of a regular file")
+	}
+	if b, err := os.ReadFile(file); nil != err {
+		t.Errorf("Reading file: %s", err)
+	} else if "kittens" != string(b) {
+		t.Errorf("File changed to %q", b)
+	}
+}
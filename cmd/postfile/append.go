@@ -0,0 +1,27 @@
+package main
+
+/*
+ * append.go
+ * Append uploads to one file per client and path
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import "net"
+
+// appendStorage takes the port off of uploads' sources, so uploads from the
+// same address to the same path get the same name and, with -append, end up
+// in the same file.
+type appendStorage struct{ Storage }
+
+/* Open opens the upload as if it came from the client's address, sans port. */
+func (s appendStorage) Open(m *Meta) (Upload, error) {
+	h, _, err := net.SplitHostPort(m.Source)
+	if nil != err {
+		return s.Storage.Open(m)
+	}
+	mm := *m
+	mm.Source = h
+	return s.Storage.Open(&mm)
+}
@@ -0,0 +1,110 @@
+package main
+
+/*
+ * audit.go
+ * Audit log of every request
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+/* auditLog is where audit lines go, if we're auditing */
+var auditLog *log.Logger
+
+/* openAudit opens the named file for appending audit lines. */
+func openAudit(fn string) error {
+	f, err := os.OpenFile(fn, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if nil != err {
+		return err
+	}
+	var w io.Writer = f
+	if rd := redactorFor(redactAudit); nil != rd {
+		w = redactWriter{w: f, rd: rd}
+	}
+	auditLog = log.New(w, "", log.LstdFlags|log.LUTC)
+	return nil
+}
+
+// withAudit wraps h so that every request, successful or not, is recorded in
+// the audit log along with who made it and what happened.
+func withAudit(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w}
+		cr := &countReader{ReadCloser: r.Body}
+		r.Body = cr
+		h.ServeHTTP(sw, r)
+		if 0 == sw.status {
+			sw.status = http.StatusOK
+		}
+		who := tokenName(r)
+		if "" == who {
+			who = "-"
+		}
+		auditLog.Printf(
+			"%v %v %q %v Host:%q UA:%q token:%v status:%v "+
+				"received:%v duration:%v",
+			r.RemoteAddr,
+			r.Method,
+			redactorFor(redactAudit).Path(r.URL.String()),
+			r.Proto,
+			r.Host,
+			r.Header.Get("User-Agent"),
+			who,
+			sw.status,
+			cr.n,
+			time.Since(start),
+		)
+	})
+}
+
+// statusWriter notes the status code and number of body bytes sent back to
+// the client.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	n      int64
+}
+
+/* WriteHeader notes the status and passes it on. */
+func (w *statusWriter) WriteHeader(status int) {
+	if 0 == w.status {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+/* Write sets an implicit 200 if we've not got a status yet. */
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if 0 == w.status {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.n += int64(n)
+	return n, err
+}
+
+// Unwrap returns the underlying http.ResponseWriter, for
+// http.ResponseController.
+func (w *statusWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
+
+/* countReader counts the bytes read through it. */
+type countReader struct {
+	io.ReadCloser
+	n int64
+}
+
+/* Read reads and counts. */
+func (c *countReader) Read(b []byte) (int, error) {
+	n, err := c.ReadCloser.Read(b)
+	c.n += int64(n)
+	return n, err
+}
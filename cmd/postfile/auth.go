@@ -0,0 +1,134 @@
+package main
+
+/*
+ * auth.go
+ * Token-based authentication
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// tokens maps allowed tokens to names for logging.  If it's empty, no
+// authentication is required.
+var tokens = make(map[string]string)
+
+// loadTokens loads tokens from the named file, one per line, optionally
+// followed by whitespace and a name to use in logs, and then dir=subdir and
+// quota=bytes options, for -token-dirs.  Blank lines and lines starting
+// with a # are ignored.
+func loadTokens(fn string) error {
+	ts, opts, err := readTokens(fn)
+	if nil != err {
+		return err
+	}
+	tokens = ts
+	tokenOpts = opts
+	return nil
+}
+
+// readTokens reads tokens from the named file, in the format described for
+// loadTokens, and returns them mapped to their names as well as any options
+// mapped to the tokens' names.
+func readTokens(fn string) (
+	map[string]string,
+	map[string]tokenOptions,
+	error,
+) {
+	f, err := os.Open(fn)
+	if nil != err {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	var (
+		tokens = make(map[string]string)
+		opts   = make(map[string]tokenOptions)
+		s      = bufio.NewScanner(f)
+		ln     int
+	)
+	for s.Scan() {
+		ln++
+		fs := strings.Fields(s.Text())
+		if 0 == len(fs) || strings.HasPrefix(fs[0], "#") {
+			continue
+		}
+		/* Unnamed tokens get a name derived from the token */
+		tok, fs := fs[0], fs[1:]
+		name := fmt.Sprintf("%x", sha256.Sum256([]byte(tok)))[:8]
+		if 0 != len(fs) && !strings.Contains(fs[0], "=") {
+			name, fs = fs[0], fs[1:]
+		}
+		tokens[tok] = name
+		if 0 == len(fs) {
+			continue
+		}
+		o, err := parseTokenOptions(fs)
+		if nil != err {
+			return nil, nil, fmt.Errorf("line %d: %w", ln, err)
+		}
+		opts[name] = o
+	}
+	if nil != s.Err() {
+		return nil, nil, s.Err()
+	}
+	if 0 == len(tokens) {
+		return nil, nil, fmt.Errorf("no tokens found in %s", fn)
+	}
+	return tokens, opts, nil
+}
+
+// tokenName returns the name of the token presented with r, either as a
+// bearer token or a basic auth password.  If no valid token was presented,
+// tokenName returns the empty string.  Paths with a route with its own
+// tokens are checked against those instead of -tokens.
+func tokenName(r *http.Request) string {
+	tok, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		_, tok, _ = r.BasicAuth()
+	}
+	return lookupTokenIn(tokensFor(r.URL.Path), tok)
+}
+
+// tokensFor returns the tokens which allow uploads to the path p: its
+// route's, if it has one with tokens, or -tokens'.
+func tokensFor(p string) map[string]string {
+	if pr := routeFor(p); nil != pr && nil != pr.tokens {
+		return pr.tokens
+	}
+	return tokens
+}
+
+// lookupToken returns the name of the token tok, or the empty string if it
+// isn't a valid token.
+func lookupToken(tok string) string { return lookupTokenIn(tokens, tok) }
+
+// lookupTokenIn returns the name of the token tok in ts, or the empty string
+// if it isn't there.
+func lookupTokenIn(ts map[string]string, tok string) string {
+	if "" == tok {
+		return ""
+	}
+	/* Look at all of them, to not leak timing */
+	var name string
+	for t, n := range ts {
+		if 1 == subtle.ConstantTimeCompare([]byte(t), []byte(tok)) {
+			name = n
+		}
+	}
+	return name
+}
+
+/* authorized returns true if r may be handled. */
+func authorized(r *http.Request) bool {
+	return 0 == len(tokensFor(r.URL.Path)) || "" != tokenName(r)
+}
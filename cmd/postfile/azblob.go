@@ -0,0 +1,279 @@
+package main
+
+/*
+ * azblob.go
+ * Send uploads to an Azure Blob Storage container
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/magisterquis/postfile"
+)
+
+// AZBLOCKSIZE is the size of the blocks in which uploads are sent to Azure.
+// Bodies smaller than this are sent in a single request.
+const AZBLOCKSIZE = 8 * 1024 * 1024
+
+/* azAPIVersion is the version of the Blob service REST API we speak */
+const azAPIVersion = "2021-08-06"
+
+// azureStore sends uploads to an Azure Blob Storage container.  The account
+// name comes from AZURE_STORAGE_ACCOUNT and credentials from either
+// AZURE_STORAGE_KEY or AZURE_STORAGE_SAS_TOKEN.
+type azureStore struct {
+	account   string
+	container string
+	prefix    string
+	key       []byte
+	sas       url.Values
+}
+
+// newAzureStore makes a new azureStore from a URL of the form
+// azblob://container/prefix.
+func newAzureStore(u *url.URL) (*azureStore, error) {
+	s := &azureStore{
+		account:   os.Getenv("AZURE_STORAGE_ACCOUNT"),
+		container: u.Host,
+		prefix:    strings.TrimPrefix(u.Path, "/"),
+	}
+	if "" == s.container {
+		return nil, errors.New("missing container")
+	}
+	if "" == s.account {
+		return nil, errors.New("AZURE_STORAGE_ACCOUNT must be set")
+	}
+	if k := os.Getenv("AZURE_STORAGE_KEY"); "" != k {
+		var err error
+		if s.key, err = base64.StdEncoding.DecodeString(k); nil != err {
+			return nil, fmt.Errorf("decoding AZURE_STORAGE_KEY: %w", err)
+		}
+	} else if t := os.Getenv("AZURE_STORAGE_SAS_TOKEN"); "" != t {
+		var err error
+		s.sas, err = url.ParseQuery(strings.TrimPrefix(t, "?"))
+		if nil != err {
+			return nil, fmt.Errorf(
+				"parsing AZURE_STORAGE_SAS_TOKEN: %w",
+				err,
+			)
+		}
+	} else {
+		return nil, errors.New(
+			"AZURE_STORAGE_KEY or AZURE_STORAGE_SAS_TOKEN must be set",
+		)
+	}
+	return s, nil
+}
+
+// Open starts an upload to a blob named after the upload.
+func (s *azureStore) Open(m *Meta) (Upload, error) {
+	blob := s.prefix + remoteName(postfile.BaseName(m))
+	name := "azblob://" + s.container + "/" + blob
+	return newPipeUpload(name, func(r io.Reader) error {
+		_, err := s.upload(blob, r)
+		return err
+	}), nil
+}
+
+/* Probe checks whether the container is accessible. */
+func (s *azureStore) Probe() error {
+	return s.do(
+		http.MethodGet,
+		"",
+		url.Values{"restype": {"container"}},
+		nil,
+		nil,
+	)
+}
+
+// upload streams body to the container as a block blob.  It returns the
+// number of bytes sent.
+func (s *azureStore) upload(blob string, body io.Reader) (int64, error) {
+	/* Small bodies get a single request */
+	buf := make([]byte, AZBLOCKSIZE)
+	n, last, err := readPart(body, buf)
+	if nil != err {
+		return 0, err
+	}
+	if last {
+		if err := s.do(
+			http.MethodPut,
+			blob,
+			nil,
+			http.Header{"X-Ms-Blob-Type": {"BlockBlob"}},
+			buf[:n],
+		); nil != err {
+			return 0, err
+		}
+		return int64(n), nil
+	}
+
+	/* Big ones go in blocks */
+	var (
+		ids []string
+		tn  int64
+	)
+	for 0 != n {
+		id := base64.StdEncoding.EncodeToString(
+			[]byte(fmt.Sprintf("%08d", len(ids))),
+		)
+		if err := s.do(http.MethodPut, blob, url.Values{
+			"comp":    {"block"},
+			"blockid": {id},
+		}, nil, buf[:n]); nil != err {
+			return tn, fmt.Errorf(
+				"sending block %v: %w",
+				len(ids),
+				err,
+			)
+		}
+		ids = append(ids, id)
+		tn += int64(n)
+		if n, _, err = readPart(body, buf); nil != err {
+			return tn, err
+		}
+	}
+
+	/* Commit the blocks */
+	bl, err := xml.Marshal(struct {
+		XMLName xml.Name `xml:"BlockList"`
+		Latest  []string `xml:"Latest"`
+	}{Latest: ids})
+	if nil != err {
+		return tn, err
+	}
+	if err := s.do(
+		http.MethodPut,
+		blob,
+		url.Values{"comp": {"blocklist"}},
+		nil,
+		append([]byte(xml.Header), bl...),
+	); nil != err {
+		return tn, fmt.Errorf("committing blocks: %w", err)
+	}
+	return tn, nil
+}
+
+// do makes an authenticated request for the given blob and makes sure it got
+// a 2xx response.
+func (s *azureStore) do(
+	method string,
+	blob string,
+	query url.Values,
+	hdr http.Header,
+	body []byte,
+) error {
+	/* Work out the URL */
+	q := url.Values{}
+	for k, v := range query {
+		q[k] = v
+	}
+	for k, v := range s.sas {
+		q[k] = v
+	}
+	u := &url.URL{
+		Scheme:   "https",
+		Host:     s.account + ".blob.core.windows.net",
+		Path:     strings.TrimSuffix("/"+s.container+"/"+blob, "/"),
+		RawQuery: q.Encode(),
+	}
+
+	/* Roll the request */
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if nil != err {
+		return err
+	}
+	for k, v := range hdr {
+		req.Header[k] = v
+	}
+	req.Header.Set("X-Ms-Date", time.Now().UTC().Format(http.TimeFormat))
+	req.Header.Set("X-Ms-Version", azAPIVersion)
+	if nil != s.key {
+		s.sign(req, query)
+	}
+
+	/* Send it off */
+	res, err := remoteClient.Do(req)
+	if nil != err {
+		return err
+	}
+	defer res.Body.Close()
+	if 2 != res.StatusCode/100 {
+		b, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return fmt.Errorf("%v (%s)", res.Status, bytes.TrimSpace(b))
+	}
+	io.Copy(io.Discard, res.Body)
+	return nil
+}
+
+// sign adds a Shared Key Authorization header to req.  The query is passed in
+// separately to avoid having to pick SAS parameters back out.
+func (s *azureStore) sign(req *http.Request, query url.Values) {
+	/* Canonicalized x-ms- headers */
+	var hs []string
+	for k := range req.Header {
+		if lk := strings.ToLower(k); strings.HasPrefix(lk, "x-ms-") {
+			hs = append(hs, lk+":"+strings.TrimSpace(req.Header.Get(k)))
+		}
+	}
+	sort.Strings(hs)
+
+	/* Canonicalized resource */
+	res := "/" + s.account + req.URL.EscapedPath()
+	var qs []string
+	for k, v := range query {
+		vs := append([]string(nil), v...)
+		sort.Strings(vs)
+		qs = append(qs, strings.ToLower(k)+":"+strings.Join(vs, ","))
+	}
+	sort.Strings(qs)
+	for _, q := range qs {
+		res += "\n" + q
+	}
+
+	/* Content-Length is blank when there's no body */
+	cl := ""
+	if 0 != req.ContentLength {
+		cl = fmt.Sprintf("%v", req.ContentLength)
+	}
+
+	sts := strings.Join([]string{
+		req.Method,
+		req.Header.Get("Content-Encoding"),
+		req.Header.Get("Content-Language"),
+		cl,
+		req.Header.Get("Content-MD5"),
+		req.Header.Get("Content-Type"),
+		"", /* Date, we use x-ms-date */
+		"", /* If-Modified-Since */
+		"", /* If-Match */
+		"", /* If-None-Match */
+		"", /* If-Unmodified-Since */
+		"", /* Range */
+		strings.Join(hs, "\n"),
+		res,
+	}, "\n")
+	m := hmac.New(sha256.New, s.key)
+	m.Write([]byte(sts))
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"SharedKey %s:%s",
+		s.account,
+		base64.StdEncoding.EncodeToString(m.Sum(nil)),
+	))
+}
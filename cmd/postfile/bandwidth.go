@@ -0,0 +1,117 @@
+package main
+
+/*
+ * bandwidth.go
+ * Limit how fast we take data in
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// bandwidthSlices is how many reads per second we try to let each
+	// connection have when the limit's in effect, so connections take
+	// turns in small chunks rather than big ones.
+	bandwidthSlices = 20
+	/* bandwidthMinChunk is the smallest read we'll let a connection do */
+	bandwidthMinChunk = 512
+	/* bandwidthMaxChunk is the largest read we'll let a connection do */
+	bandwidthMaxChunk = 64 * 1024
+)
+
+// inboundLimit limits the total rate at which we read from clients, if it's
+// not nil.
+var inboundLimit *bandwidthLimiter
+
+// bandwidthLimiter spreads a fixed number of bytes per second across
+// readers.  Each read reserves the next slot of time on a shared clock, so
+// readers are served in the order they asked, and as reads are kept small,
+// busy connections take turns.
+type bandwidthLimiter struct {
+	rate  float64 /* Bytes per second */
+	chunk int     /* Largest read */
+	next  time.Time
+	l     sync.Mutex
+}
+
+/* newBandwidthLimiter returns a limiter which allows rate bytes/second. */
+func newBandwidthLimiter(rate int64) *bandwidthLimiter {
+	return &bandwidthLimiter{
+		rate: float64(rate),
+		chunk: int(min(
+			max(rate/bandwidthSlices, bandwidthMinChunk),
+			bandwidthMaxChunk,
+		)),
+	}
+}
+
+// wait waits until n more bytes can be read without going over the limit.
+// It's called after the bytes have been read, so the limit's enforced on
+// average, with TCP backpressure doing the rest.
+func (bl *bandwidthLimiter) wait(n int) {
+	if 0 >= n {
+		return
+	}
+	d := time.Duration(float64(n) / bl.rate * float64(time.Second))
+	bl.l.Lock()
+	now := time.Now()
+	start := bl.next
+	if start.Before(now) {
+		start = now
+	}
+	bl.next = start.Add(d)
+	bl.l.Unlock()
+	time.Sleep(time.Until(start))
+}
+
+// limitConn returns c, limited by inboundLimit, if there is one.  If not, c
+// is returned as-is.
+func limitConn(c net.Conn) net.Conn {
+	if nil == inboundLimit {
+		return c
+	}
+	return &limitedConn{Conn: c, bl: inboundLimit}
+}
+
+/* limitedConn is a net.Conn which reads no faster than bl allows. */
+type limitedConn struct {
+	net.Conn
+	bl *bandwidthLimiter
+}
+
+/* Read reads a limited amount from the underlying conn, then waits. */
+func (c *limitedConn) Read(b []byte) (int, error) {
+	if len(b) > c.bl.chunk {
+		b = b[:c.bl.chunk]
+	}
+	n, err := c.Conn.Read(b)
+	c.bl.wait(n)
+	return n, err
+}
+
+// limitListener returns l, with accepted connections limited by
+// inboundLimit, if there is one.  If not, l is returned as-is.
+func limitListener(l net.Listener) net.Listener {
+	if nil == inboundLimit {
+		return l
+	}
+	return limitedListener{l}
+}
+
+/* limitedListener limits the connections it accepts with limitConn. */
+type limitedListener struct{ net.Listener }
+
+/* Accept accepts a connection and limits it. */
+func (l limitedListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if nil != err {
+		return nil, err
+	}
+	return limitConn(c), nil
+}
@@ -0,0 +1,143 @@
+package main
+
+/*
+ * beacon.go
+ * Save GET requests' query strings
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/magisterquis/postfile"
+)
+
+const (
+	/* beaconDir holds the beacon files, one per client */
+	beaconDir = "beacons"
+	/* beaconExt is the extension for beacon files */
+	beaconExt = ".jsonl"
+)
+
+var (
+	// beaconPaths are the paths at which we save GET requests.  Paths
+	// ending in a slash match everything under them.
+	beaconPaths []string
+
+	/* beaconNames is how we name beacon files */
+	beaconNames postfile.NamePolicy
+)
+
+/* beaconRecord is what we save about a beacon. */
+type beaconRecord struct {
+	Time      time.Time   `json:"time"`
+	Source    string      `json:"source"`
+	Host      string      `json:"host,omitempty"`
+	Path      string      `json:"path"`
+	Query     string      `json:"query"`
+	Params    url.Values  `json:"params,omitempty"`
+	Header    http.Header `json:"header"`
+	Token     string      `json:"token,omitempty"`
+	SinceLast float64     `json:"since_last_seconds,omitempty"`
+}
+
+/* isBeacon returns true if r is a GET to one of beaconPaths. */
+func isBeacon(r *http.Request) bool {
+	if http.MethodGet != r.Method {
+		return false
+	}
+	for _, p := range beaconPaths {
+		if p == r.URL.Path || (strings.HasSuffix(p, "/") &&
+			strings.HasPrefix(r.URL.Path, p)) {
+			return true
+		}
+	}
+	return false
+}
+
+// handleBeacon appends r's query string, headers, and the time since the
+// client's last beacon as a line of JSON to the client's beacon file.
+func handleBeacon(w http.ResponseWriter, r *http.Request, rl reqLog) {
+	/* Beacons are routed before withExpiry and withMaintenance */
+	if expired() {
+		rl.Printf("Expired")
+		http.Error(w, "Gone", http.StatusGone)
+		return
+	}
+	if maintenanceFeature.Enabled() {
+		handleMaintenance(w, r, rl)
+		return
+	}
+	if !authorized(r) {
+		rl.Printf("Unauthorized beacon")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	now := time.Now()
+	src := r.RemoteAddr
+	if h, _, err := net.SplitHostPort(src); nil == err {
+		src = h
+	}
+	br := beaconRecord{
+		Time:   now,
+		Source: r.RemoteAddr,
+		Host:   r.Host,
+		Path:   r.URL.Path,
+		Query:  r.URL.RawQuery,
+		Params: r.URL.Query(),
+		Header: r.Header.Clone(),
+		Token:  tokenName(r),
+	}
+	if "" != br.Header.Get("Authorization") {
+		br.Header.Set("Authorization", "REDACTED")
+	}
+
+	/* The client's file was last changed by its last beacon */
+	base := beaconNames.Sanitize(src)
+	fi, err := os.Stat(filepath.Join(
+		beaconDir,
+		postfile.MakeName(base, 0)+beaconExt,
+	))
+	if nil == err {
+		br.SinceLast = now.Sub(fi.ModTime()).Seconds()
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		rl.Printf("Unable to check beacon file: %v", err)
+	}
+	b, err := json.Marshal(br)
+	if nil != err {
+		rl.Printf("Unable to encode beacon: %v", err)
+		http.Error(w, "encode", http.StatusInternalServerError)
+		return
+	}
+
+	/* Save the beacon */
+	if err := os.MkdirAll(beaconDir, 0700); nil != err {
+		rl.Printf("Unable to make beacon directory: %v", err)
+		http.Error(w, "open", http.StatusInternalServerError)
+		return
+	}
+	f, err := postfile.AppendFile(beaconDir, base, beaconExt)
+	if nil != err {
+		rl.Printf("Unable to open beacon file: %v", err)
+		http.Error(w, "open", http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(append(b, '\n')); nil != err {
+		rl.Printf("Error saving beacon to %q: %v", f.Name(), err)
+		http.Error(w, "write", http.StatusInternalServerError)
+		return
+	}
+	rl.Printf("Saved %d-byte beacon query to %q", len(br.Query), f.Name())
+}
@@ -0,0 +1,62 @@
+package main
+
+/*
+ * beacon_test.go
+ * Tests for beacon.go
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHandleBeacon(t *testing.T) {
+	t.Chdir(t.TempDir())
+	if err := os.Mkdir(beaconDir, 0700); nil != err {
+		t.Fatalf("Error making beacon directory: %v", err)
+	}
+	for _, c := range []struct {
+		name  string
+		exp   bool
+		maint bool
+		want  int
+		saved bool
+	}{
+		{"expired", true, false, http.StatusGone, false},
+		{"maint", false, true, http.StatusServiceUnavailable, false},
+		{"ok", false, false, http.StatusOK, true},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			if c.exp {
+				expiry = time.Now().Add(-time.Hour)
+				defer func() { expiry = time.Time{} }()
+			}
+			if c.maint {
+				maintenanceFeature.Set(true)
+				defer maintenanceFeature.Set(false)
+			}
+			r := httptest.NewRequest(http.MethodGet, "/b?id=1", nil)
+			w := httptest.NewRecorder()
+			handleBeacon(w, r, newReqLog(r))
+			if c.want != w.Code {
+				t.Errorf("Got %d, want %d", w.Code, c.want)
+			}
+			fs, err := filepath.Glob(
+				filepath.Join(beaconDir, "*"+beaconExt),
+			)
+			if nil != err {
+				t.Fatalf("Error looking for beacons: %v", err)
+			}
+			if saved := 0 != len(fs); saved != c.saved {
+				t.Errorf("Saved %v, want %v", saved, c.saved)
+			}
+		})
+	}
+}
@@ -0,0 +1,281 @@
+package main
+
+/*
+ * bench.go
+ * Benchmark a postfile server
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/magisterquis/postfile"
+)
+
+// benchResult is what one benchmark worker saw.
+type benchResult struct {
+	latencies []time.Duration
+	bytes     int64
+	errors    int
+	firstErr  error
+}
+
+// benchMain is the main function for the bench subcommand, which sends
+// uploads to a server, or a temporary one of our own, as fast as it can and
+// reports how quickly they were handled.
+func benchMain(args []string) {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	var (
+		target = fs.String(
+			"url",
+			"",
+			"Upload `URL` of the server to benchmark (default a "+
+				"temporary local instance)",
+		)
+		dir = fs.String(
+			"dir",
+			"",
+			"Directory in which the temporary instance stores "+
+				"files, which are kept (default a temporary "+
+				"`directory`, which is removed)",
+		)
+		token = fs.String(
+			"token",
+			"",
+			"Optional bearer `token` to send",
+		)
+		insecure = fs.Bool(
+			"insecure",
+			false,
+			"Don't verify the server's TLS certificate",
+		)
+		concurrency = fs.Int(
+			"c",
+			8,
+			"Send this many `uploads` at once",
+		)
+		sizes = fs.String(
+			"size",
+			"65536",
+			"Comma-separated upload body sizes, in `bytes`, used "+
+				"in turn",
+		)
+		duration = fs.Duration(
+			"duration",
+			10*time.Second,
+			"Send uploads for this `period`",
+		)
+	)
+	fs.Usage = func() {
+		fmt.Fprintf(
+			os.Stderr,
+			`Usage: %v bench [options]
+
+Sends uploads to a postfile server as fast as it can for a while and reports
+throughput and latency percentiles.  Without -url, a temporary instance is
+started which listens on the loopback interface and stores files in -dir.
+
+Options:
+`,
+			os.Args[0],
+		)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	/* Work out how big to make bodies */
+	var ns []int
+	for _, s := range splitList(*sizes) {
+		n, err := strconv.Atoi(s)
+		if nil != err || 0 > n {
+			log.Fatalf("Invalid body size %q", s)
+		}
+		ns = append(ns, n)
+	}
+	if 0 == len(ns) {
+		log.Fatalf("Need at least one body size")
+	}
+	if 0 >= *concurrency {
+		log.Fatalf("Concurrency must be positive")
+	}
+	body := make([]byte, slices.Max(ns))
+	rand.Read(body)
+
+	/* Start our own server, if we're not benchmarking someone else's */
+	u := *target
+	if "" == u {
+		var (
+			cleanup func()
+			err     error
+		)
+		if u, cleanup, err = startBenchServer(*dir); nil != err {
+			log.Fatalf("Unable to start temporary server: %v", err)
+		}
+		defer cleanup()
+	}
+
+	/* Hammer it */
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.MaxIdleConnsPerHost = *concurrency
+	if *insecure {
+		t.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	c := &http.Client{Transport: t}
+	var (
+		wg      sync.WaitGroup
+		next    atomic.Int64
+		results = make([]benchResult, *concurrency)
+		start   = time.Now()
+		end     = start.Add(*duration)
+	)
+	for i := range results {
+		wg.Add(1)
+		go func(br *benchResult) {
+			defer wg.Done()
+			for time.Now().Before(end) {
+				n := ns[int(next.Add(1)-1)%len(ns)]
+				d, err := benchUpload(c, u, *token, body[:n])
+				if nil != err {
+					br.errors++
+					if nil == br.firstErr {
+						br.firstErr = err
+					}
+					continue
+				}
+				br.latencies = append(br.latencies, d)
+				br.bytes += int64(n)
+			}
+		}(&results[i])
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	/* Tell the user how it went */
+	var (
+		all    []time.Duration
+		nBytes int64
+		nErrs  int
+		err    error
+	)
+	for _, br := range results {
+		all = append(all, br.latencies...)
+		nBytes += br.bytes
+		nErrs += br.errors
+		if nil == err {
+			err = br.firstErr
+		}
+	}
+	slices.Sort(all)
+	fmt.Printf("Target:      %s\n", u)
+	fmt.Printf("Duration:    %s\n", elapsed.Round(time.Millisecond))
+	fmt.Printf("Concurrency: %d\n", *concurrency)
+	fmt.Printf("Body sizes:  %v bytes\n", ns)
+	fmt.Printf("Uploads:     %d (%d errors)\n", len(all), nErrs)
+	if nil != err {
+		fmt.Printf("First error: %v\n", err)
+	}
+	fmt.Printf(
+		"Throughput:  %.1f uploads/s, %.2f MiB/s\n",
+		float64(len(all))/elapsed.Seconds(),
+		float64(nBytes)/elapsed.Seconds()/(1024*1024),
+	)
+	if 0 == len(all) {
+		return
+	}
+	fmt.Printf("Latency:    ")
+	for _, p := range []int{50, 90, 99, 100} {
+		d := all[(len(all)-1)*p/100]
+		fmt.Printf(" p%d %s", p, d.Round(time.Microsecond))
+	}
+	fmt.Printf("\n")
+}
+
+// startBenchServer starts a temporary plaintext instance listening on the
+// loopback interface which stores files in dir, or a temporary directory if
+// dir is empty.  It returns the URL to which to send uploads and a function
+// to stop the instance and remove the temporary directory.  Logging is
+// turned off until the cleanup function is called.
+func startBenchServer(dir string) (string, func(), error) {
+	rmDir := "" == dir
+	if rmDir {
+		var err error
+		dir, err = os.MkdirTemp("", "postfile-bench-")
+		if nil != err {
+			return "", nil, err
+		}
+	} else if err := os.MkdirAll(dir, 0700); nil != err {
+		return "", nil, err
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		if rmDir {
+			os.RemoveAll(dir)
+		}
+		return "", nil, err
+	}
+	store = postfile.LocalStorage{Dir: dir, Names: defaultNamePolicy()}
+	localFiles = true
+	srv := &http.Server{
+		Handler:  uploadChain(),
+		ErrorLog: log.New(io.Discard, "", 0),
+	}
+	go srv.Serve(l)
+	lw := log.Writer()
+	log.SetOutput(io.Discard)
+	return "http://" + l.Addr().String() + "/bench", func() {
+		srv.Close()
+		log.SetOutput(lw)
+		if rmDir {
+			if err := os.RemoveAll(dir); nil != err {
+				log.Printf("Unable to remove %s: %v", dir, err)
+			}
+		}
+	}, nil
+}
+
+// benchUpload sends body to u and returns how long it took to get a
+// successful response.
+func benchUpload(
+	c *http.Client,
+	u string,
+	token string,
+	body []byte,
+) (time.Duration, error) {
+	req, err := http.NewRequest(http.MethodPost, u, bytes.NewReader(body))
+	if nil != err {
+		return 0, err
+	}
+	if "" != token {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	start := time.Now()
+	res, err := c.Do(req)
+	if nil != err {
+		return 0, err
+	}
+	defer res.Body.Close()
+	if _, err := io.Copy(io.Discard, res.Body); nil != err {
+		return 0, err
+	}
+	d := time.Since(start)
+	if 2 != res.StatusCode/100 {
+		return 0, fmt.Errorf("unexpected status %s", res.Status)
+	}
+	return d, nil
+}
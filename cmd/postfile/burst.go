@@ -0,0 +1,195 @@
+package main
+
+/*
+ * burst.go
+ * Absorb bursts of uploads faster than storage can take them
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"io"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+/* burstReadSize is how much spilled data we send to storage at once */
+const burstReadSize = 32 * 1024
+
+/* burstWG waits for buffered uploads to reach storage */
+var burstWG sync.WaitGroup
+
+// burstStorage buffers uploads in memory, up to a limit shared by all
+// uploads, and then in files in a scratch directory, and sends them to
+// another Storage in the background.  Clients finish as soon as their
+// uploads are buffered.  Errors from the other Storage are logged.
+type burstStorage struct {
+	Storage
+	dir    string
+	max    int64
+	memUse atomic.Int64
+}
+
+/* Open opens an upload in the backing storage and starts feeding it. */
+func (s *burstStorage) Open(m *Meta) (Upload, error) {
+	bu, err := s.Storage.Open(m)
+	if nil != err {
+		return nil, err
+	}
+	u := &burstUpload{Upload: bu, s: s}
+	u.cond = sync.NewCond(&u.l)
+	burstWG.Add(1)
+	go u.drain()
+	return u, nil
+}
+
+/* burstUpload is an upload being buffered. */
+type burstUpload struct {
+	Upload
+	s    *burstStorage
+	l    sync.Mutex
+	cond *sync.Cond
+
+	mem    [][]byte /* Buffered in memory */
+	f      *os.File /* Spilled to disk, after mem */
+	fw, fr int64    /* Spill file write and read offsets */
+	done   bool     /* Commit called */
+	abort  bool     /* Abort called */
+	err    error    /* Error from storage */
+}
+
+// Write buffers b in memory if there's room and we've not already spilled
+// to disk, or on disk if not.
+func (u *burstUpload) Write(b []byte) (int, error) {
+	u.l.Lock()
+	defer u.l.Unlock()
+	if nil != u.err {
+		return 0, u.err
+	}
+	defer u.cond.Signal()
+
+	/* Memory's faster, if there's room. */
+	if nil == u.f {
+		if u.s.memUse.Add(int64(len(b))) <= u.s.max {
+			u.mem = append(u.mem, append([]byte(nil), b...))
+			return len(b), nil
+		}
+		u.s.memUse.Add(-int64(len(b)))
+		f, err := os.CreateTemp(u.s.dir, "postfile-burst-*")
+		if nil != err {
+			return 0, err
+		}
+		u.f = f
+	}
+
+	/* Not enough memory, spill to disk. */
+	n, err := u.f.WriteAt(b, u.fw)
+	u.fw += int64(n)
+	return n, err
+}
+
+// Commit marks the upload as finished.  It'll be committed to storage once
+// the buffered data's been sent.
+func (u *burstUpload) Commit() error {
+	u.l.Lock()
+	defer u.l.Unlock()
+	u.done = true
+	u.cond.Signal()
+	return u.err
+}
+
+/* Abort sends what we have to storage and then aborts the upload there. */
+func (u *burstUpload) Abort() error {
+	u.l.Lock()
+	defer u.l.Unlock()
+	u.abort = true
+	u.cond.Signal()
+	return nil
+}
+
+/* drain sends buffered data to storage. */
+func (u *burstUpload) drain() {
+	defer burstWG.Done()
+	defer u.cleanup()
+	buf := make([]byte, burstReadSize)
+	for {
+		u.l.Lock()
+		for 0 == len(u.mem) && u.fr == u.fw && !u.done && !u.abort {
+			u.cond.Wait()
+		}
+		var (
+			b       []byte
+			fromMem bool
+		)
+		switch {
+		case 0 != len(u.mem): /* Memory first */
+			b, fromMem = u.mem[0], true
+			u.mem = u.mem[1:]
+		case u.fr < u.fw: /* Then disk */
+			n, err := u.f.ReadAt(
+				buf[:min(int64(len(buf)), u.fw-u.fr)],
+				u.fr,
+			)
+			if nil != err && io.EOF != err {
+				u.fail(err)
+				u.l.Unlock()
+				return
+			}
+			u.fr += int64(n)
+			b = buf[:n]
+		default: /* Nothing left */
+			abort := u.abort
+			u.l.Unlock()
+			u.finish(abort)
+			return
+		}
+		u.l.Unlock()
+
+		/* Send it on */
+		_, err := u.Upload.Write(b)
+		if fromMem {
+			u.s.memUse.Add(-int64(len(b)))
+		}
+		if nil != err {
+			u.l.Lock()
+			u.fail(err)
+			u.l.Unlock()
+			return
+		}
+	}
+}
+
+/* fail notes a storage error and aborts the upload.  u.l must be held. */
+func (u *burstUpload) fail(err error) {
+	u.err = err
+	log.Printf("Error sending buffered data to %q: %v", u.Name(), err)
+	u.Upload.Abort()
+}
+
+/* finish commits or aborts the upload in storage. */
+func (u *burstUpload) finish(abort bool) {
+	if abort {
+		u.Upload.Abort()
+		return
+	}
+	if err := u.Upload.Commit(); nil != err {
+		log.Printf("Error finishing buffered upload %q: %v", u.Name(), err)
+	}
+}
+
+/* cleanup releases memory and removes the spill file. */
+func (u *burstUpload) cleanup() {
+	u.l.Lock()
+	defer u.l.Unlock()
+	for _, b := range u.mem {
+		u.s.memUse.Add(-int64(len(b)))
+	}
+	u.mem = nil
+	if nil != u.f {
+		u.f.Close()
+		os.Remove(u.f.Name())
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+/*
+ * chain.go
+ * Steps requests go through before being stored
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"context"
+	"net/http"
+)
+
+// Each request goes through a chain of middlewares, each of which either
+// handles the request itself or passes it to the next.  Only the steps for
+// features which are turned on are in the chain.  Steps which can be
+// toggled at runtime, like maintenance mode, are always there and check
+// whether they're on for each request.  At the end of the chain, the
+// upload is stored by the handler from newUploadHandler.
+
+/* middleware wraps a handler to add a step to handling requests. */
+type middleware func(next http.Handler) http.Handler
+
+/* chain wraps h in ms, so ms[0] sees requests first. */
+func chain(h http.Handler, ms ...middleware) http.Handler {
+	for i := len(ms) - 1; 0 <= i; i-- {
+		h = ms[i](h)
+	}
+	return h
+}
+
+// uploadChain returns the chain of steps for the features configured by
+// main, ending in the handler from newUploadHandler.
+func uploadChain() http.Handler {
+	ms := []middleware{withReqLog, withDebugHeaders}
+	if nil != pcapWriters["http"] {
+		ms = append(ms, withPcap)
+	}
+
+	/* Things which aren't uploads */
+	if "" != healthPath {
+		ms = append(ms, route(
+			isHealthCheck,
+			func(w http.ResponseWriter, r *http.Request, _ reqLog) {
+				handleHealth(w, r)
+			},
+		))
+	}
+	if "" != uiPrefix {
+		ms = append(ms, route(isUIRequest, handleUI))
+	}
+	if serveForm {
+		ms = append(ms, route(isFormRequest, handleForm))
+	}
+	if "" != listPath {
+		ms = append(ms, route(isListRequest, handleList))
+	}
+	if "" != progressPath {
+		ms = append(ms, route(isProgressRequest, handleProgress))
+	}
+	if 0 != len(beaconPaths) {
+		ms = append(ms, route(isBeacon, handleBeacon))
+	}
+	if allowDownloads {
+		ms = append(ms, route(isDownload, handleDownload))
+	}
+	if allowDeletes {
+		ms = append(ms, route(isDelete, handleDelete))
+	}
+	if webDAV {
+		ms = append(ms, route(isWebDAV, handleWebDAV))
+	}
+
+	// Things which are, but might not be allowed.  Expiry and maintenance
+	// come first so the honeypot doesn't keep recording.
+	ms = append(
+		ms,
+		withExpiry,
+		withMaintenance,
+		withUploadMethods,
+		withAuth,
+	)
+	if 0 != len(pathRoutes) {
+		ms = append(ms, withRouteLimits)
+	}
+	if 0 != idempotencyKeep {
+		ms = append(ms, withIdempotency)
+	}
+	if "" != wsPath {
+		ms = append(ms, route(isWebSocket, handleWebSocket))
+	}
+	if 0 != firstByteTimeout || 0 != idleTimeout || 0 != minRate {
+		ms = append(ms, withBodyDeadlines)
+	}
+	if "" != progressPath {
+		ms = append(ms, withProgress)
+	}
+	if serveForm {
+		ms = append(ms, route(isFormUpload, handleFormUpload))
+	}
+	if chunkedUploads {
+		ms = append(ms, route(isChunk, handleChunk))
+	}
+	if 0 != len(contentTypes) { /* Routes above check their own */
+		ms = append(ms, withContentTypes)
+	}
+
+	return chain(newUploadHandler(), ms...)
+}
+
+/* rlKey is the context key for a request's reqLog. */
+type rlKey struct{}
+
+// withReqLog makes the request's reqLog, which the rest of the chain gets
+// with requestLog.
+func withReqLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		next.ServeHTTP(w, r.WithContext(context.WithValue(
+			r.Context(),
+			rlKey{},
+			newReqLog(r),
+		)))
+	})
+}
+
+/* requestLog returns r's reqLog, from withReqLog. */
+func requestLog(r *http.Request) reqLog {
+	rl, _ := r.Context().Value(rlKey{}).(reqLog)
+	return rl
+}
+
+// route returns a middleware which sends requests for which is returns true
+// to h instead of the next step.
+func route(
+	is func(r *http.Request) bool,
+	h func(w http.ResponseWriter, r *http.Request, rl reqLog),
+) middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(
+			w http.ResponseWriter,
+			r *http.Request,
+		) {
+			if is(r) {
+				h(w, r, requestLog(r))
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+/* withDebugHeaders logs requests' headers, if we're debugging. */
+func withDebugHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if debugFeature.Enabled() {
+			h := r.Header.Clone()
+			if "" != h.Get("Authorization") {
+				h.Set("Authorization", "REDACTED")
+			}
+			requestLog(r).Printf("Headers: %v", h)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// withUploadMethods rejects requests which can't be uploads, or records them
+// if we're a honeypot.
+func withUploadMethods(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if http.MethodPost != r.Method && !isWebSocket(r) &&
+			!isWebDAVPut(r) {
+			if honeypotFeature.Enabled() {
+				handleHoneypot(w, r, requestLog(r))
+				return
+			}
+			requestLog(r).Printf("Invalid method")
+			http.Error(
+				w,
+				"Invalid method",
+				http.StatusMethodNotAllowed,
+			)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+/* withExpiry rejects uploads after we've expired. */
+func withExpiry(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if expired() {
+			requestLog(r).Printf("Expired")
+			http.Error(w, "Gone", http.StatusGone)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+/* withMaintenance turns away uploads while we're in maintenance. */
+func withMaintenance(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if maintenanceFeature.Enabled() {
+			handleMaintenance(w, r, requestLog(r))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+/* withAuth makes sure the client's allowed to upload. */
+func withAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(r) {
+			requestLog(r).Printf("Unauthorized")
+			if isWebDAVPut(r) {
+				davChallenge(w)
+			}
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+/* withBodyDeadlines doesn't let bodies take too long. */
+func withBodyDeadlines(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		withDeadlines(w, r)
+		next.ServeHTTP(w, r)
+	})
+}
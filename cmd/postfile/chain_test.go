@@ -0,0 +1,105 @@
+package main
+
+/*
+ * chain_test.go
+ * Tests for chain.go
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/magisterquis/postfile"
+)
+
+func TestUploadChainHoneypotUnavailable(t *testing.T) {
+	t.Chdir(t.TempDir())
+	if _, err := honeypotFeature.Set(true); nil != err {
+		t.Fatalf("Error enabling honeypot: %v", err)
+	}
+	defer honeypotFeature.Set(false)
+	for _, c := range []struct {
+		name    string
+		expired bool
+		want    int
+	}{
+		{"expired", true, http.StatusGone},
+		{"maintenance", false, http.StatusServiceUnavailable},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			if c.expired {
+				expiry = time.Now().Add(-time.Hour)
+				defer func() { expiry = time.Time{} }()
+			} else {
+				maintenanceFeature.Set(true)
+				defer maintenanceFeature.Set(false)
+			}
+			r := httptest.NewRequest(http.MethodGet, "/foo", nil)
+			w := httptest.NewRecorder()
+			uploadChain().ServeHTTP(w, r)
+			if c.want != w.Code {
+				t.Errorf("Got %d, want %d", w.Code, c.want)
+			}
+			if fs, err := filepath.Glob(
+				"*" + honeypotExt,
+			); nil != err {
+				t.Errorf("Error looking for requests: %v", err)
+			} else if 0 != len(fs) {
+				t.Errorf("Recorded %s", fs[0])
+			}
+		})
+	}
+}
+
+func TestUploadChainChunked(t *testing.T) {
+	t.Chdir(t.TempDir())
+	defer func(s Storage) { store = s }(store)
+	store = postfile.LocalStorage{}
+	if err := setupChunkDir("."); nil != err {
+		t.Fatalf("Error setting up chunk directory: %v", err)
+	}
+	for _, c := range []struct {
+		name    string
+		chunked bool
+		expired bool
+		want    int
+		body    string
+	}{
+		{"off", false, false, http.StatusOK, "7\n"},
+		{"on", true, false, http.StatusOK, ""},
+		{"expired", true, true, http.StatusGone, "Gone\n"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			old := chunkedUploads
+			defer func() { chunkedUploads = old }()
+			chunkedUploads = c.chunked
+			if c.expired {
+				expiry = time.Now().Add(-time.Hour)
+				defer func() { expiry = time.Time{} }()
+			}
+			r := httptest.NewRequest(
+				http.MethodPost,
+				"/foo?"+chunkParam+"=new",
+				strings.NewReader("kittens"),
+			)
+			w := httptest.NewRecorder()
+			uploadChain().ServeHTTP(w, r)
+			if c.want != w.Code {
+				t.Errorf("Got %d, want %d", w.Code, c.want)
+			}
+			got := w.Body.String()
+			if "" == c.body && ("" == got || "7\n" == got) {
+				t.Errorf("Got %q, want a session ID", got)
+			} else if "" != c.body && c.body != got {
+				t.Errorf("Got %q, want %q", got, c.body)
+			}
+		})
+	}
+}
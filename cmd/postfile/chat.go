@@ -0,0 +1,51 @@
+package main
+
+/*
+ * chat.go
+ * Slack and Discord notifications
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// chatNotifier posts a message about each upload to a Slack or Discord
+// webhook, optionally only for some paths or large-enough files.
+type chatNotifier struct {
+	kind    string /* slack or discord */
+	url     string
+	paths   *regexp.Regexp /* May be nil */
+	minSize int64
+}
+
+/* String returns the kind of chat and the URL. */
+func (c chatNotifier) String() string { return c.kind + " webhook" }
+
+/* Notify posts a message about e, if it passes the filters. */
+func (c chatNotifier) Notify(e uploadEvent) error {
+	if e.Size < c.minSize ||
+		(nil != c.paths && !c.paths.MatchString(e.Path)) {
+		return nil
+	}
+	msg := fmt.Sprintf(
+		"File arrived from %s: %s (%d bytes, SHA256 %s) stored as %s",
+		e.Source,
+		e.Path,
+		e.Size,
+		e.SHA256,
+		e.Name,
+	)
+	if "" != e.Preview {
+		msg += fmt.Sprintf(", starting %q", e.Preview)
+	}
+	switch c.kind {
+	case "discord":
+		return postJSON(c.url, map[string]string{"content": msg})
+	default:
+		return postJSON(c.url, map[string]string{"text": msg})
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+/*
+ * checksum.go
+ * Check uploads against client-supplied digests
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+
+	"github.com/magisterquis/postfile"
+)
+
+/* checksumSHA256Header is the header with a body's SHA256 hash. */
+const checksumSHA256Header = "X-Checksum-SHA256"
+
+// errChecksumMismatch is returned by bodyDigests.verify if a body doesn't
+// match its digest.
+var errChecksumMismatch = errors.New("checksum mismatch")
+
+// quarantineMismatches, if set, moves uploads which don't match their
+// digests to quarantineDir.  It's only set if uploads are in their own
+// local files.
+var quarantineMismatches bool
+
+// bodyDigests hashes a request body and checks it against the Content-MD5 and
+// X-Checksum-SHA256 headers.
+type bodyDigests struct {
+	want map[string][]byte    /* By header */
+	have map[string]hash.Hash /* By header */
+}
+
+// newBodyDigests returns a bodyDigests for r's digest headers, or nil if r
+// has none.  Content-MD5 should be base64-encoded and X-Checksum-SHA256 may
+// be hex or base64.
+func newBodyDigests(r *http.Request) (*bodyDigests, error) {
+	bd := &bodyDigests{
+		want: make(map[string][]byte),
+		have: make(map[string]hash.Hash),
+	}
+	for _, d := range []struct {
+		header string
+		new    func() hash.Hash
+	}{
+		{"Content-MD5", md5.New},
+		{checksumSHA256Header, sha256.New},
+	} {
+		v := r.Header.Get(d.header)
+		if "" == v {
+			continue
+		}
+		h := d.new()
+		want, err := decodeDigest(v, h.Size())
+		if nil != err {
+			return nil, fmt.Errorf("invalid %s: %w", d.header, err)
+		}
+		bd.want[d.header] = want
+		bd.have[d.header] = h
+	}
+	if 0 == len(bd.want) {
+		return nil, nil
+	}
+	return bd, nil
+}
+
+// decodeDigest decodes a hex or base64 digest of the given size.
+func decodeDigest(s string, size int) ([]byte, error) {
+	if hex.EncodedLen(size) == len(s) {
+		return hex.DecodeString(s)
+	}
+	b, err := base64.StdEncoding.DecodeString(s)
+	if nil != err {
+		return nil, err
+	}
+	if size != len(b) {
+		return nil, fmt.Errorf("need %d bytes, got %d", size, len(b))
+	}
+	return b, nil
+}
+
+// wrap returns body, hashed as it's read.  At the end of body, the returned
+// reader checks the hashes and, if they don't match, returns a 422
+// StatusError wrapping errChecksumMismatch instead of io.EOF.
+func (bd *bodyDigests) wrap(body io.Reader) io.Reader {
+	ws := make([]io.Writer, 0, len(bd.have))
+	for _, h := range bd.have {
+		ws = append(ws, h)
+	}
+	return digestReader{io.TeeReader(body, io.MultiWriter(ws...)), bd}
+}
+
+/* digestReader checks a body against its digests when it's been read. */
+type digestReader struct {
+	r  io.Reader
+	bd *bodyDigests
+}
+
+/* Read reads from d.r and, at EOF, checks the body's digests. */
+func (d digestReader) Read(b []byte) (int, error) {
+	n, err := d.r.Read(b)
+	if io.EOF != err {
+		return n, err
+	}
+	if verr := d.bd.verify(); nil != verr {
+		return n, &postfile.StatusError{
+			Status:  http.StatusUnprocessableEntity,
+			Message: "Checksum mismatch",
+			Err:     verr,
+		}
+	}
+	return n, err
+}
+
+// verify returns an error wrapping errChecksumMismatch if what's been read
+// doesn't match a digest.
+func (bd *bodyDigests) verify() error {
+	for hdr, want := range bd.want {
+		if have := bd.have[hdr].Sum(nil); !bytes.Equal(want, have) {
+			return fmt.Errorf(
+				"%w: %s is %x, body's is %x",
+				errChecksumMismatch,
+				hdr,
+				want,
+				have,
+			)
+		}
+	}
+	return nil
+}
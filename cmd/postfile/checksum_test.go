@@ -0,0 +1,120 @@
+package main
+
+/*
+ * checksum_test.go
+ * Tests for checksum.go
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/magisterquis/postfile"
+)
+
+func TestBodyDigests(t *testing.T) {
+	const (
+		body      = "kittens"
+		md5B64    = "hBaajVsyiejs4A13NQgbUw=="
+		sha256B64 = "yBp7HnVb34cWD/AI+UyOzCG8KnEKI79eE1EwDtwCMaE="
+		sha256Hex = "c81a7b1e755bdf87160ff008f94c8ecc" +
+			"21bc2a710a23bf5e1351300edc0231a1"
+	)
+	for _, c := range []struct {
+		name    string
+		headers map[string]string
+		badHdr  bool /* newBodyDigests should fail */
+		nilBD   bool /* No digests */
+		match   bool
+	}{{
+		name:  "none",
+		nilBD: true,
+	}, {
+		name:    "md5",
+		headers: map[string]string{"Content-MD5": md5B64},
+		match:   true,
+	}, {
+		name:    "sha256_hex",
+		headers: map[string]string{checksumSHA256Header: sha256Hex},
+		match:   true,
+	}, {
+		name:    "sha256_base64",
+		headers: map[string]string{checksumSHA256Header: sha256B64},
+		match:   true,
+	}, {
+		name: "both",
+		headers: map[string]string{
+			"Content-MD5":        md5B64,
+			checksumSHA256Header: sha256Hex,
+		},
+		match: true,
+	}, {
+		name: "md5_wrong",
+		headers: map[string]string{
+			"Content-MD5": "AAAAAAAAAAAAAAAAAAAAAA==",
+		},
+	}, {
+		name: "sha256_wrong",
+		headers: map[string]string{
+			"Content-MD5":        md5B64,
+			checksumSHA256Header: strings.Repeat("0", 64),
+		},
+	}, {
+		name:    "md5_short",
+		headers: map[string]string{"Content-MD5": "AAAA"},
+		badHdr:  true,
+	}, {
+		name:    "sha256_garbage",
+		headers: map[string]string{checksumSHA256Header: "kittens"},
+		badHdr:  true,
+	}} {
+		t.Run(c.name, func(t *testing.T) {
+			r := httptest.NewRequest(
+				http.MethodPost,
+				"/",
+				strings.NewReader(body),
+			)
+			for k, v := range c.headers {
+				r.Header.Set(k, v)
+			}
+			bd, err := newBodyDigests(r)
+			if c.badHdr {
+				if nil == err {
+					t.Fatalf("Accepted bad digest")
+				}
+				return
+			} else if nil != err {
+				t.Fatalf("Error: %v", err)
+			}
+			if c.nilBD {
+				if nil != bd {
+					t.Fatalf("Got digests, want nil")
+				}
+				return
+			} else if nil == bd {
+				t.Fatalf("Got nil digests")
+			}
+			_, err = io.Copy(io.Discard, bd.wrap(r.Body))
+			if c.match {
+				if nil != err {
+					t.Errorf("Mismatch: %v", err)
+				}
+				return
+			}
+			var se *postfile.StatusError
+			if !errors.Is(err, errChecksumMismatch) {
+				t.Errorf("Got %v, want a mismatch", err)
+			} else if !errors.As(err, &se) ||
+				http.StatusUnprocessableEntity != se.Status {
+				t.Errorf("Got %v, want a 422", err)
+			}
+		})
+	}
+}
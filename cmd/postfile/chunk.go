@@ -0,0 +1,543 @@
+package main
+
+/*
+ * chunk.go
+ * Chunked upload sessions with per-part checksums
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/magisterquis/postfile"
+)
+
+const (
+	/* chunkPartHeader holds the hex-encoded SHA256 hash of a part */
+	chunkPartHeader = "X-Part-Sha256"
+	/* chunkMaxParts is the most parts a session may have */
+	chunkMaxParts = 100000
+	/* chunkSessionTTL is how long an idle session is kept */
+	chunkSessionTTL = 24 * time.Hour
+	/* chunkMaxSessions is the most sessions we'll have at once */
+	chunkMaxSessions = 1024
+	/* chunkMaxBytes is the most bytes of parts we'll hold at once */
+	chunkMaxBytes = 16 * 1024 * 1024 * 1024
+	/* chunkDirName is the hidden directory in -dir which holds parts */
+	chunkDirName = ".chunks"
+	/* chunkParam is the query parameter which holds a session's ID */
+	chunkParam = "chunk-session"
+)
+
+var (
+	/* errChunkFull indicates we're holding chunkMaxBytes of parts */
+	errChunkFull = errors.New("too many bytes in chunked sessions")
+	/* errChunkSessions indicates we have chunkMaxSessions sessions */
+	errChunkSessions = errors.New("too many chunked sessions")
+)
+
+// Chunked uploads, with -chunked, work like so:
+//
+//	POST /path?chunk-session=new         -> Session ID
+//	POST /path?chunk-session=ID&part=N   -> Part status, 422 on mismatch
+//	POST /path?chunk-session=ID&status   -> Status of all received parts
+//	POST /path?chunk-session=ID&complete -> Parts stored as one upload
+//
+// Parts are numbered from 0, may be sent in any order, and may be resent.
+// If the X-Part-Sha256 header is set, the part's hash is checked against it
+// and a mismatched part is discarded, to be sent again.  Parts are kept in
+// a directory per session in chunkDir.
+var (
+	chunkSessions  = make(map[string]*chunkSession)
+	chunkSessionsL sync.Mutex
+
+	/* chunkDir holds sessions' parts */
+	chunkDir string
+
+	/* chunkedUploads is set if we accept chunked uploads at all */
+	chunkedUploads bool
+
+	/* chunkBytes is the number of bytes of parts we're holding */
+	chunkBytes atomic.Int64
+)
+
+// chunkSession is an in-progress chunked upload.  The lock is only held to
+// update the session's bookkeeping, not while parts are being sent.
+type chunkSession struct {
+	sync.Mutex
+	id         string
+	dir        string
+	meta       Meta
+	parts      map[int]chunkPart /* nil once the session's over */
+	size       int64             /* Total size of parts */
+	last       time.Time
+	receiving  int  /* Parts on their way in */
+	completing bool /* Parts are being sent to storage */
+}
+
+/* chunkPart describes a received part. */
+type chunkPart struct {
+	Part   int    `json:"part"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+	Status string `json:"status"`
+}
+
+// setupChunkDir puts sessions' parts in a hidden directory in dir, removing
+// any parts left over from before we started.
+func setupChunkDir(dir string) error {
+	chunkDir = filepath.Join(dir, chunkDirName)
+	if err := os.RemoveAll(chunkDir); nil != err {
+		return fmt.Errorf("removing old parts: %w", err)
+	}
+	return nil
+}
+
+/* isChunk returns true if r is part of a chunked upload session. */
+func isChunk(r *http.Request) bool {
+	return r.URL.Query().Has(chunkParam)
+}
+
+/* handleChunk handles a request for a chunked upload session. */
+func handleChunk(w http.ResponseWriter, r *http.Request, rl reqLog) {
+	q := r.URL.Query()
+	id := q.Get(chunkParam)
+
+	/* Starting a new session is easy. */
+	if "new" == id {
+		s, err := newChunkSession(r)
+		if errors.Is(err, errChunkSessions) {
+			rl.Printf("Too many chunked sessions")
+			http.Error(
+				w,
+				"Too many sessions",
+				http.StatusServiceUnavailable,
+			)
+			return
+		} else if nil != err {
+			rl.With(0, "", err).Printf(
+				"Unable to start chunked session: %v",
+				err,
+			)
+			http.Error(w, "session", http.StatusInternalServerError)
+			return
+		}
+		rl.Printf("Started chunked session %s", s.id)
+		fmt.Fprintf(w, "%s\n", s.id)
+		return
+	}
+
+	/* Everything else needs a session. */
+	chunkSessionsL.Lock()
+	s, ok := chunkSessions[id]
+	chunkSessionsL.Unlock()
+	if !ok {
+		rl.Printf("Unknown chunked session %q", id)
+		http.Error(w, "Unknown session", http.StatusNotFound)
+		return
+	}
+	s.Lock()
+	if nil == s.parts { /* Finished while we waited. */
+		s.Unlock()
+		http.Error(w, "Unknown session", http.StatusNotFound)
+		return
+	}
+	s.last = time.Now()
+	s.Unlock()
+
+	switch {
+	case q.Has("part"):
+		s.receivePart(w, r, rl, q.Get("part"))
+	case q.Has("status"):
+		s.Lock()
+		ps := s.status()
+		s.Unlock()
+		adminJSON(w, ps)
+	case q.Has("complete"):
+		s.complete(w, rl)
+	default:
+		http.Error(
+			w,
+			"Missing part, status, or complete",
+			http.StatusBadRequest,
+		)
+	}
+}
+
+/* newChunkSession starts a new session for r. */
+func newChunkSession(r *http.Request) (*chunkSession, error) {
+	reapChunkSessions()
+	chunkSessionsL.Lock()
+	n := len(chunkSessions)
+	chunkSessionsL.Unlock()
+	if chunkMaxSessions <= n {
+		return nil, errChunkSessions
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); nil != err {
+		return nil, err
+	}
+	id := hex.EncodeToString(b)
+	dir := filepath.Join(chunkDir, id)
+	if err := os.MkdirAll(dir, 0700); nil != err {
+		return nil, err
+	}
+	s := &chunkSession{
+		id:  id,
+		dir: dir,
+		meta: Meta{
+			Source: r.RemoteAddr,
+			Path:   r.URL.Path,
+			Host:   r.Host,
+			Time:   time.Now(),
+			Token:  tokenName(r),
+		},
+		parts: make(map[int]chunkPart),
+		last:  time.Now(),
+	}
+	s.meta.JA3, s.meta.JA4 = requestFingerprint(r)
+	s.meta.TLS = postfile.NewTLSInfo(r.TLS)
+	chunkSessionsL.Lock()
+	defer chunkSessionsL.Unlock()
+	chunkSessions[s.id] = s
+	return s, nil
+}
+
+// reapChunkSessions removes sessions which have been idle too long and
+// aren't receiving parts or being completed.
+func reapChunkSessions() {
+	chunkSessionsL.Lock()
+	defer chunkSessionsL.Unlock()
+	for id, s := range chunkSessions {
+		s.Lock()
+		if time.Since(s.last) > chunkSessionTTL &&
+			0 == s.receiving && !s.completing {
+			delete(chunkSessions, id)
+			s.end()
+		}
+		s.Unlock()
+	}
+}
+
+// end removes the session's parts and gives back the space they took.  The
+// session should already be out of chunkSessions and s must be locked.
+func (s *chunkSession) end() {
+	os.RemoveAll(s.dir)
+	chunkBytes.Add(-s.size)
+	s.size = 0
+	s.parts = nil
+}
+
+// chunkSpace counts bytes written to it against chunkMaxBytes, and returns
+// errChunkFull if there's no more room.
+type chunkSpace struct{ n int64 }
+
+/* Write counts b's length, if there's room. */
+func (c *chunkSpace) Write(b []byte) (int, error) {
+	if chunkMaxBytes < chunkBytes.Add(int64(len(b))) {
+		chunkBytes.Add(-int64(len(b)))
+		return 0, errChunkFull
+	}
+	c.n += int64(len(b))
+	return len(b), nil
+}
+
+/* release gives back the bytes counted by c. */
+func (c *chunkSpace) release() {
+	chunkBytes.Add(-c.n)
+	c.n = 0
+}
+
+// receivePart saves a part and checks its hash.  s is only locked to note
+// the part once it's been saved.
+func (s *chunkSession) receivePart(
+	w http.ResponseWriter,
+	r *http.Request,
+	rl reqLog,
+	ps string,
+) {
+	pn, err := strconv.Atoi(ps)
+	if nil != err || 0 > pn || chunkMaxParts <= pn {
+		rl.Printf("Invalid part number %q in session %s", ps, s.id)
+		http.Error(w, "Invalid part", http.StatusBadRequest)
+		return
+	}
+	want := strings.ToLower(r.Header.Get(chunkPartHeader))
+
+	// Make sure it's something we want.  Every part should have the
+	// upload's Content-Type, but only the first starts with something
+	// to sniff.
+	var body io.Reader = r.Body
+	if 0 == pn || !sniffContentTypes {
+		if body, err = checkContentType(
+			r.Header.Get("Content-Type"),
+			body,
+		); nil != err {
+			rl.Printf(
+				"Refused part %d of session %s: %v",
+				pn,
+				s.id,
+				err,
+			)
+			sendStatusError(w, err)
+			return
+		}
+	}
+
+	/* Note we're getting a part, so we don't get reaped. */
+	s.Lock()
+	if s.completing {
+		s.Unlock()
+		http.Error(w, "Session completing", http.StatusConflict)
+		return
+	}
+	s.receiving++
+	s.Unlock()
+	defer func() {
+		s.Lock()
+		s.receiving--
+		s.Unlock()
+	}()
+
+	/* Save the part to a temporary file, hashing as we go. */
+	fn := filepath.Join(s.dir, strconv.Itoa(pn))
+	f, err := os.CreateTemp(s.dir, "*.tmp")
+	if nil != err {
+		rl.With(0, "", err).Printf("Unable to save part %d: %v", pn, err)
+		http.Error(w, "open", http.StatusInternalServerError)
+		return
+	}
+	var cs chunkSpace
+	h := sha256.New()
+	n, err := copyBody(io.MultiWriter(&cs, f, h), body)
+	if cerr := f.Close(); nil == err {
+		err = cerr
+	}
+	if errors.Is(err, errChunkFull) {
+		cs.release()
+		os.Remove(f.Name())
+		rl.With(n, "", err).Printf(
+			"No room for part %d of session %s",
+			pn,
+			s.id,
+		)
+		http.Error(w, "Too much data", http.StatusInsufficientStorage)
+		return
+	} else if nil != err {
+		cs.release()
+		os.Remove(f.Name())
+		rl.With(n, "", err).Printf(
+			"Error after receiving %d bytes of part %d of session %s: %v",
+			n,
+			pn,
+			s.id,
+			err,
+		)
+		http.Error(w, "write", http.StatusInternalServerError)
+		return
+	}
+	p := chunkPart{
+		Part:   pn,
+		Size:   n,
+		SHA256: hex.EncodeToString(h.Sum(nil)),
+		Status: "ok",
+	}
+
+	/* Make sure it's what the client sent. */
+	if "" != want && want != p.SHA256 {
+		cs.release()
+		os.Remove(f.Name())
+		p.Status = "mismatch"
+		rl.With(n, "", nil).Printf(
+			"Checksum mismatch for part %d of session %s: "+
+				"got %s, expected %s",
+			pn,
+			s.id,
+			p.SHA256,
+			want,
+		)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		adminJSON(w, p)
+		return
+	}
+	if "" == want {
+		p.Status = "unverified"
+	}
+
+	/* Put it with the rest of the parts. */
+	s.Lock()
+	defer s.Unlock()
+	if nil == s.parts || s.completing {
+		cs.release()
+		os.Remove(f.Name())
+		rl.Printf("Session %s ended before part %d arrived", s.id, pn)
+		http.Error(w, "Session over", http.StatusConflict)
+		return
+	}
+	if err := os.Rename(f.Name(), fn); nil != err {
+		cs.release()
+		os.Remove(f.Name())
+		rl.With(n, "", err).Printf("Unable to save part %d: %v", pn, err)
+		http.Error(w, "rename", http.StatusInternalServerError)
+		return
+	}
+	if old, ok := s.parts[pn]; ok {
+		chunkBytes.Add(-old.Size)
+		s.size -= old.Size
+	}
+	s.parts[pn] = p
+	s.size += n
+	rl.With(n, "", nil).Printf(
+		"Received %d-byte part %d of session %s",
+		n,
+		pn,
+		s.id,
+	)
+	adminJSON(w, p)
+}
+
+/* status returns the status of all received parts.  s must be locked. */
+func (s *chunkSession) status() []chunkPart {
+	ps := make([]chunkPart, 0, len(s.parts))
+	for _, p := range s.parts {
+		ps = append(ps, p)
+	}
+	sort.Slice(ps, func(i, j int) bool { return ps[i].Part < ps[j].Part })
+	return ps
+}
+
+// complete stores the session's parts, in order, as a single upload and ends
+// the session.  If parts are missing, the client is told which.  s is only
+// locked to check the parts and end the session; while the parts are being
+// stored, new parts are refused.
+func (s *chunkSession) complete(w http.ResponseWriter, rl reqLog) {
+	s.Lock()
+	if s.completing {
+		s.Unlock()
+		http.Error(w, "Session completing", http.StatusConflict)
+		return
+	}
+
+	/* Make sure we have every part. */
+	var missing []int
+	last := -1
+	for pn := range s.parts {
+		last = max(last, pn)
+	}
+	for pn := 0; pn <= last; pn++ {
+		if _, ok := s.parts[pn]; !ok {
+			missing = append(missing, pn)
+		}
+	}
+	if 0 == len(s.parts) || 0 != len(missing) {
+		s.Unlock()
+		rl.Printf("Session %s missing parts %v", s.id, missing)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		adminJSON(w, map[string]any{"missing": missing})
+		return
+	}
+
+	s.completing = true
+	ps := s.status()
+	s.Unlock()
+	defer func() {
+		s.Lock()
+		s.completing = false
+		s.Unlock()
+	}()
+
+	/* Send the parts to storage. */
+	u, err := store.Open(&s.meta)
+	if nil != err {
+		noteFailure()
+		rl.With(0, "", err).Printf("Unable to open storage: %v", err)
+		http.Error(w, "open", http.StatusInternalServerError)
+		return
+	}
+	var n int64
+	for pn := 0; pn <= last; pn++ {
+		var pw int64
+		pw, err = s.copyPart(u, ps[pn])
+		n += pw
+		if nil != err {
+			break
+		}
+	}
+	if nil != err {
+		noteFailure()
+		rl.With(n, u.Name(), err).Printf(
+			"Error after writing %v bytes of session %s to %q: %v",
+			n,
+			s.id,
+			u.Name(),
+			err,
+		)
+		u.Abort()
+		http.Error(w, "write", http.StatusInternalServerError)
+		return
+	}
+	if err := u.Commit(); nil != err {
+		noteFailure()
+		rl.With(n, u.Name(), err).Printf(
+			"Error finishing %v-byte upload to %q: %v",
+			n,
+			u.Name(),
+			err,
+		)
+		http.Error(w, "commit", http.StatusInternalServerError)
+		return
+	}
+	rl.With(n, u.Name(), nil).Printf(
+		"Wrote %v bytes from %d parts of session %s to %q",
+		n,
+		last+1,
+		s.id,
+		u.Name(),
+	)
+	noteUpload(&s.meta, u.Name(), n)
+
+	/* Session's done. */
+	chunkSessionsL.Lock()
+	delete(chunkSessions, s.id)
+	chunkSessionsL.Unlock()
+	s.Lock()
+	s.end()
+	s.Unlock()
+	adminJSON(w, map[string]any{"bytes": n, "name": u.Name(), "parts": ps})
+}
+
+/* copyPart copies part p to u. */
+func (s *chunkSession) copyPart(u Upload, p chunkPart) (int64, error) {
+	f, err := os.Open(filepath.Join(s.dir, strconv.Itoa(p.Part)))
+	if nil != err {
+		return 0, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	n, err := copyBody(io.MultiWriter(u, h), f)
+	if nil != err {
+		return n, err
+	}
+	if hex.EncodeToString(h.Sum(nil)) != p.SHA256 {
+		return n, fmt.Errorf("part %d changed on disk", p.Part)
+	}
+	return n, nil
+}
@@ -0,0 +1,174 @@
+package main
+
+/*
+ * chunk_test.go
+ * Tests for chunk.go
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/magisterquis/postfile"
+)
+
+// chunkRequest sends a chunked session request with the given query and body
+// and, if sum is set, the body's hash.  It returns the response.
+func chunkRequest(
+	t *testing.T,
+	query string,
+	body string,
+	sum bool,
+) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest(
+		http.MethodPost,
+		"/foo?"+query,
+		strings.NewReader(body),
+	)
+	if sum {
+		h := sha256.Sum256([]byte(body))
+		r.Header.Set(chunkPartHeader, hex.EncodeToString(h[:]))
+	}
+	w := httptest.NewRecorder()
+	handleChunk(w, r, newReqLog(r))
+	return w
+}
+
+func TestChunkSession(t *testing.T) {
+	dir := t.TempDir()
+	if err := setupChunkDir(t.TempDir()); nil != err {
+		t.Fatalf("Error setting up chunk directory: %v", err)
+	}
+	defer func(s Storage) { store = s }(store)
+	store = postfile.LocalStorage{Dir: dir}
+
+	/* Start a session. */
+	w := chunkRequest(t, chunkParam+"=new", "", false)
+	if http.StatusOK != w.Code {
+		t.Fatalf("New session: got %d: %s", w.Code, w.Body)
+	}
+	id := strings.TrimSpace(w.Body.String())
+	q := chunkParam + "=" + id
+
+	/* Send parts out of order, one of them broken. */
+	for _, c := range []struct {
+		part string
+		body string
+		sum  bool
+		want int
+	}{
+		{"1", "bar", true, http.StatusOK},
+		{"2", "baz", false, http.StatusOK},
+		{"-1", "", false, http.StatusBadRequest},
+		{"kittens", "", false, http.StatusBadRequest},
+	} {
+		w := chunkRequest(t, q+"&part="+c.part, c.body, c.sum)
+		if c.want != w.Code {
+			t.Fatalf(
+				"Part %s: got %d, want %d: %s",
+				c.part,
+				w.Code,
+				c.want,
+				w.Body,
+			)
+		}
+	}
+	r := httptest.NewRequest(
+		http.MethodPost,
+		"/foo?"+q+"&part=0",
+		strings.NewReader("foo"),
+	)
+	r.Header.Set(chunkPartHeader, strings.Repeat("00", sha256.Size))
+	w = httptest.NewRecorder()
+	handleChunk(w, r, newReqLog(r))
+	if http.StatusUnprocessableEntity != w.Code {
+		t.Fatalf("Mismatched part: got %d: %s", w.Code, w.Body)
+	}
+
+	/* Status should only have the good parts. */
+	w = chunkRequest(t, q+"&status", "", false)
+	var ps []chunkPart
+	if err := json.Unmarshal(w.Body.Bytes(), &ps); nil != err {
+		t.Fatalf("Error decoding status %q: %v", w.Body, err)
+	}
+	if 2 != len(ps) ||
+		1 != ps[0].Part || "ok" != ps[0].Status ||
+		2 != ps[1].Part || "unverified" != ps[1].Status {
+		t.Fatalf("Status: got %+v", ps)
+	}
+
+	/* Can't complete with a missing part. */
+	w = chunkRequest(t, q+"&complete", "", false)
+	if http.StatusConflict != w.Code {
+		t.Fatalf("Incomplete session: got %d: %s", w.Code, w.Body)
+	}
+	var missing struct{ Missing []int }
+	if err := json.Unmarshal(w.Body.Bytes(), &missing); nil != err {
+		t.Fatalf("Error decoding missing parts %q: %v", w.Body, err)
+	}
+	if 1 != len(missing.Missing) || 0 != missing.Missing[0] {
+		t.Fatalf("Missing parts: got %v, want [0]", missing.Missing)
+	}
+
+	/* Resend the broken part and finish. */
+	w = chunkRequest(t, q+"&part=0", "foo", true)
+	if http.StatusOK != w.Code {
+		t.Fatalf("Resent part: got %d: %s", w.Code, w.Body)
+	}
+	w = chunkRequest(t, q+"&complete", "", false)
+	if http.StatusOK != w.Code {
+		t.Fatalf("Complete: got %d: %s", w.Code, w.Body)
+	}
+	var res struct {
+		Bytes int64
+		Name  string
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &res); nil != err {
+		t.Fatalf("Error decoding completion %q: %v", w.Body, err)
+	}
+	if b, err := os.ReadFile(res.Name); nil != err {
+		t.Fatalf("Error reading upload: %v", err)
+	} else if "foobarbaz" != string(b) || 9 != res.Bytes {
+		t.Errorf(
+			"Upload has %d bytes %q, want 9 bytes %q",
+			res.Bytes,
+			b,
+			"foobarbaz",
+		)
+	}
+
+	/* Session and its parts should be gone. */
+	w = chunkRequest(t, q+"&status", "", false)
+	if http.StatusNotFound != w.Code {
+		t.Errorf("Finished session: got %d: %s", w.Code, w.Body)
+	}
+	if _, err := os.Stat(
+		filepath.Join(chunkDir, id),
+	); !os.IsNotExist(err) {
+		t.Errorf("Session directory still there: %v", err)
+	}
+	if n := chunkBytes.Load(); 0 != n {
+		t.Errorf("Still holding %d bytes of parts", n)
+	}
+}
+
+func TestChunkSessionUnknown(t *testing.T) {
+	if err := setupChunkDir(t.TempDir()); nil != err {
+		t.Fatalf("Error setting up chunk directory: %v", err)
+	}
+	w := chunkRequest(t, chunkParam+"=kittens&status", "", false)
+	if http.StatusNotFound != w.Code {
+		t.Errorf("Got %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
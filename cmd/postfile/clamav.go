@@ -0,0 +1,240 @@
+package main
+
+/*
+ * clamav.go
+ * Scan uploads with clamd
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/magisterquis/postfile"
+)
+
+const (
+	/* quarantineDir holds uploads clamd didn't like */
+	quarantineDir = ".quarantine"
+	/* clamdChunkSize is the size of the chunks we send to clamd */
+	clamdChunkSize = 64 * 1024
+	/* clamdMaxReply is the longest reply we'll read from clamd */
+	clamdMaxReply = 4096
+)
+
+// errInfected is returned from an upload's Commit if clamd found something
+// and the upload was quarantined or deleted.  HTTP clients get a 422.
+var errInfected = &postfile.StatusError{
+	Status:  http.StatusUnprocessableEntity,
+	Message: "Rejected",
+	Err:     errors.New("upload failed malware scan"),
+}
+
+// clamavAction is what to do with an upload in which clamd finds something.
+type clamavAction string
+
+const (
+	clamavTag        clamavAction = "tag"        /* Just note it */
+	clamavQuarantine clamavAction = "quarantine" /* Move to quarantineDir */
+	clamavDelete     clamavAction = "delete"     /* Remove it */
+)
+
+// clamavStorage streams each upload to clamd when it's committed, and
+// records the verdict in the logs and the upload's metadata sidecar file.
+// Uploads in which clamd finds something are dealt with according to
+// action; uploads which can't be scanned are kept.  Uploads must be stored
+// in local files.
+type clamavStorage struct {
+	Storage
+	network string
+	addr    string
+	timeout time.Duration
+	action  clamavAction
+}
+
+// newClamavStorage returns a clamavStorage wrapping s which talks to clamd
+// at addr, which is either host:port or a Unix socket path.
+func newClamavStorage(
+	s Storage,
+	addr string,
+	timeout time.Duration,
+	action string,
+) (clamavStorage, error) {
+	cs := clamavStorage{
+		Storage: s,
+		network: "tcp",
+		addr:    addr,
+		timeout: timeout,
+		action:  clamavAction(action),
+	}
+	switch cs.action {
+	case clamavTag, clamavQuarantine, clamavDelete:
+	default:
+		return clamavStorage{}, fmt.Errorf("unknown action %q", action)
+	}
+	if strings.HasPrefix(addr, "unix:") {
+		cs.network, cs.addr = "unix", strings.TrimPrefix(addr, "unix:")
+	} else if strings.ContainsRune(addr, filepath.Separator) {
+		cs.network = "unix"
+	}
+	return cs, nil
+}
+
+/* Open opens the upload, which will be scanned when it's committed. */
+func (s clamavStorage) Open(m *Meta) (Upload, error) {
+	u, err := s.Storage.Open(m)
+	if nil != err {
+		return nil, err
+	}
+	return clamavUpload{Upload: u, s: s, m: m}, nil
+}
+
+/* clamavUpload is an upload which is scanned when committed. */
+type clamavUpload struct {
+	Upload
+	s clamavStorage
+	m *Meta
+}
+
+// Commit commits the upload and scans it.  If clamd finds something and
+// the upload isn't kept, Commit returns errInfected.
+func (u clamavUpload) Commit() error {
+	if err := u.Upload.Commit(); nil != err {
+		return err
+	}
+	fn := u.Name()
+	verdict, found, err := u.s.scan(fn)
+	if nil != err {
+		log.Printf("Unable to scan %s with clamd: %v", fn, err)
+		verdict = "ERROR: " + err.Error()
+	} else if found {
+		log.Printf("Clamd found %s in %s", verdict, fn)
+	}
+	if err := updateSidecar(uploadEvent{
+		Source: u.m.Source,
+		Path:   u.m.Path,
+		Host:   u.m.Host,
+		Time:   u.m.Time,
+		Token:  u.m.Token,
+		Name:   fn,
+	}, func(s *sidecar) {
+		s.ClamAV = verdict
+	}); nil != err {
+		log.Printf("Unable to save scan result for %s: %v", fn, err)
+	}
+	if !found {
+		return nil
+	}
+
+	/* Deal with whatever clamd found */
+	switch u.s.action {
+	case clamavQuarantine:
+		qn, err := quarantine(fn)
+		if nil != err {
+			return err
+		}
+		log.Printf("Quarantined %s as %s", fn, qn)
+	case clamavDelete:
+		if err := os.Remove(fn); nil != err {
+			return fmt.Errorf("removing %s: %w", fn, err)
+		}
+		log.Printf("Removed %s", fn)
+	default:
+		return nil
+	}
+	return errInfected
+}
+
+// quarantine moves the file named fn to quarantineDir and returns its new
+// name.
+func quarantine(fn string) (string, error) {
+	qn := filepath.Join(
+		quarantineDir,
+		strings.NewReplacer("/", "_", `\`, "_").Replace(fn),
+	)
+	if err := os.MkdirAll(quarantineDir, 0700); nil != err {
+		return "", fmt.Errorf("making quarantine directory: %w", err)
+	}
+	if err := os.Rename(fn, qn); nil != err {
+		return "", fmt.Errorf("quarantining %s: %w", fn, err)
+	}
+	return qn, nil
+}
+
+// scan sends the file named fn to clamd with INSTREAM.  It returns clamd's
+// verdict, e.g. OK or the name of a signature, and whether clamd found
+// something.
+func (s clamavStorage) scan(fn string) (string, bool, error) {
+	f, err := os.Open(fn)
+	if nil != err {
+		return "", false, err
+	}
+	defer f.Close()
+	c, err := net.DialTimeout(s.network, s.addr, s.timeout)
+	if nil != err {
+		return "", false, err
+	}
+	defer c.Close()
+	if 0 != s.timeout {
+		c.SetDeadline(time.Now().Add(s.timeout))
+	}
+
+	/* Send the file in length-prefixed chunks, then a 0-length one */
+	bw := bufio.NewWriter(c)
+	if _, err := bw.WriteString("zINSTREAM\x00"); nil != err {
+		return "", false, err
+	}
+	b := make([]byte, 4+clamdChunkSize)
+	for {
+		n, err := f.Read(b[4:])
+		binary.BigEndian.PutUint32(b, uint32(n))
+		if 0 != n {
+			if _, err := bw.Write(b[:4+n]); nil != err {
+				return "", false, err
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		} else if nil != err {
+			return "", false, err
+		}
+	}
+	if _, err := bw.Write(make([]byte, 4)); nil != err {
+		return "", false, err
+	}
+	if err := bw.Flush(); nil != err {
+		return "", false, err
+	}
+
+	/* Work out what clamd thought; the reply ends in a NUL */
+	reply, err := bufio.NewReader(
+		io.LimitReader(c, clamdMaxReply),
+	).ReadString(0)
+	if nil != err && (!errors.Is(err, io.EOF) || "" == reply) {
+		return "", false, err
+	}
+	reply = strings.TrimPrefix(
+		strings.TrimRight(reply, "\x00\n"),
+		"stream: ",
+	)
+	switch {
+	case "OK" == reply:
+		return reply, false, nil
+	case strings.HasSuffix(reply, " FOUND"):
+		return strings.TrimSuffix(reply, " FOUND"), true, nil
+	default:
+		return "", false, fmt.Errorf("clamd said %q", reply)
+	}
+}
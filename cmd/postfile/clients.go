@@ -0,0 +1,231 @@
+package main
+
+/*
+ * clients.go
+ * Per-client upload statistics
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"log"
+	"maps"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	/* clientStatsMax is the most clients we'll keep track of */
+	clientStatsMax = 100000
+	/* clientPathsMax is the most paths we'll remember per client */
+	clientPathsMax = 100
+	/* clientSummaryMax is how many clients we log at shutdown */
+	clientSummaryMax = 10
+)
+
+var (
+	/* clientStats holds each client's statistics, by address */
+	clientStats  = make(map[string]*clientStat)
+	clientStatsL sync.Mutex
+
+	// clientStatsFile, if set, is where we save clientStats every so
+	// often and at shutdown.
+	clientStatsFile  string
+	clientStatsFileL sync.Mutex
+)
+
+func init() {
+	adminMux.HandleFunc("/clients", adminClients)
+}
+
+// clientStat describes what one client has uploaded.  Paths holds the number
+// of uploads to each path, for up to clientPathsMax paths.
+type clientStat struct {
+	Address   string           `json:"address"`
+	Uploads   int64            `json:"uploads"`
+	Bytes     int64            `json:"bytes"`
+	FirstSeen time.Time        `json:"first_seen"`
+	LastSeen  time.Time        `json:"last_seen"`
+	Paths     map[string]int64 `json:"paths"`
+}
+
+// clientAddr returns the address, without a port, of the client which sent
+// the upload described by m.
+func clientAddr(m *Meta) string {
+	if h, _, err := net.SplitHostPort(m.Source); nil == err {
+		return h
+	}
+	return m.Source
+}
+
+/* noteClientUpload adds an upload of n bytes to its client's statistics. */
+func noteClientUpload(m *Meta, n int64) {
+	a := clientAddr(m)
+	now := time.Now()
+	clientStatsL.Lock()
+	defer clientStatsL.Unlock()
+	cs, ok := clientStats[a]
+	if !ok {
+		if clientStatsMax <= len(clientStats) {
+			return
+		}
+		cs = &clientStat{
+			Address:   a,
+			FirstSeen: now,
+			Paths:     make(map[string]int64),
+		}
+		clientStats[a] = cs
+	}
+	cs.Uploads++
+	cs.Bytes += n
+	cs.LastSeen = now
+	if _, ok := cs.Paths[m.Path]; ok || clientPathsMax > len(cs.Paths) {
+		cs.Paths[m.Path]++
+	}
+}
+
+// snapshot returns a copy of cs which won't change as more uploads arrive.
+// clientStatsL must be held.
+func (cs *clientStat) snapshot() clientStat {
+	c := *cs
+	c.Paths = maps.Clone(cs.Paths)
+	return c
+}
+
+// sortedClientStats returns a copy of every client's statistics, most bytes
+// first.
+func sortedClientStats() []clientStat {
+	clientStatsL.Lock()
+	css := make([]clientStat, 0, len(clientStats))
+	for _, cs := range clientStats {
+		css = append(css, cs.snapshot())
+	}
+	clientStatsL.Unlock()
+	slices.SortFunc(css, func(a, b clientStat) int {
+		if c := cmp.Compare(b.Bytes, a.Bytes); 0 != c {
+			return c
+		}
+		return cmp.Compare(a.Address, b.Address)
+	})
+	return css
+}
+
+// adminClients returns every client's statistics, or just one client's if
+// the address parameter is set.
+func adminClients(w http.ResponseWriter, r *http.Request) {
+	if http.MethodGet != r.Method {
+		http.Error(w, "Invalid method", http.StatusMethodNotAllowed)
+		return
+	}
+	a := r.FormValue("address")
+	if "" == a {
+		adminJSON(w, sortedClientStats())
+		return
+	}
+	clientStatsL.Lock()
+	cs, ok := clientStats[a]
+	var c clientStat
+	if ok {
+		c = cs.snapshot()
+	}
+	clientStatsL.Unlock()
+	if !ok {
+		http.Error(w, "Unknown client", http.StatusNotFound)
+		return
+	}
+	adminJSON(w, c)
+}
+
+// loadClientStats loads saved statistics from fn, if it exists, and saves
+// them back to it every interval.
+func loadClientStats(fn string, interval time.Duration) error {
+	clientStatsFile = fn
+	b, err := os.ReadFile(fn)
+	if nil == err {
+		var css []*clientStat
+		if err := json.Unmarshal(b, &css); nil != err {
+			return fmt.Errorf("parsing %v: %w", fn, err)
+		}
+		clientStatsL.Lock()
+		for _, cs := range css {
+			if nil == cs.Paths {
+				cs.Paths = make(map[string]int64)
+			}
+			clientStats[cs.Address] = cs
+		}
+		clientStatsL.Unlock()
+		log.Printf("Loaded statistics for %d clients", len(css))
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	go func() {
+		for range time.Tick(interval) {
+			if err := saveClientStats(); nil != err {
+				log.Printf(
+					"Unable to save client statistics: %v",
+					err,
+				)
+			}
+		}
+	}()
+	return nil
+}
+
+// saveClientStats saves every client's statistics to clientStatsFile, if
+// it's set.
+func saveClientStats() error {
+	if "" == clientStatsFile {
+		return nil
+	}
+	b, err := json.MarshalIndent(sortedClientStats(), "", "  ")
+	if nil != err {
+		return err
+	}
+	clientStatsFileL.Lock()
+	defer clientStatsFileL.Unlock()
+	tmp := clientStatsFile + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); nil != err {
+		return err
+	}
+	return os.Rename(tmp, clientStatsFile)
+}
+
+// logClientStats logs a summary of the clients which uploaded the most and
+// saves everyone's statistics.  It's meant to be called at shutdown.
+func logClientStats() {
+	css := sortedClientStats()
+	var nu, nb int64
+	for _, cs := range css {
+		nu += cs.Uploads
+		nb += cs.Bytes
+	}
+	log.Printf(
+		"Client statistics: %d clients, %d uploads, %d bytes",
+		len(css),
+		nu,
+		nb,
+	)
+	for _, cs := range css[:min(len(css), clientSummaryMax)] {
+		log.Printf(
+			"Client %s: %d uploads, %d bytes, %d paths, "+
+				"first seen %s, last seen %s",
+			cs.Address,
+			cs.Uploads,
+			cs.Bytes,
+			len(cs.Paths),
+			cs.FirstSeen.Format(time.RFC3339),
+			cs.LastSeen.Format(time.RFC3339),
+		)
+	}
+	if err := saveClientStats(); nil != err {
+		log.Printf("Unable to save client statistics: %v", err)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+/*
+ * compliance.go
+ * Locked-down settings for sanctioned deployments
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"crypto/tls"
+	"time"
+)
+
+/* complianceMode is true if we're running in compliance mode */
+var complianceMode bool
+
+// complianceSettings are the settings which matter for compliance mode.
+type complianceSettings struct {
+	plaintext bool
+	gateway   bool /* FastCGI or SCGI */
+	tokens    string
+	audit     string
+	retention time.Duration
+	storage   string
+	badTLS    string
+	decoy     bool
+	honeypot  bool
+	previews  bool
+	beacons   bool
+	unauthed  []string /* Flags for listeners without authentication */
+	tlsMin    uint16   /* From -tls-min, or 0 */
+}
+
+// problems returns a list of the reasons the settings aren't acceptable for
+// compliance mode, or nil if they're fine.
+func (c complianceSettings) problems() []string {
+	var ps []string
+	if c.plaintext || c.gateway {
+		ps = append(ps, "TLS is required (no -http, -fcgi, or -scgi)")
+	}
+	if 0 != c.tlsMin && tls.VersionTLS12 > c.tlsMin {
+		ps = append(ps, "TLS 1.2 or later is required (-tls-min)")
+	}
+	if "" == c.tokens {
+		ps = append(ps, "authentication is required (-tokens)")
+	}
+	if "" == c.audit {
+		ps = append(ps, "audit logging is required (-audit)")
+	}
+	if 0 >= c.retention {
+		ps = append(ps, "a retention period is required (-retention)")
+	}
+	if "" != c.storage {
+		ps = append(
+			ps,
+			"retention can only be enforced on local storage "+
+				"(no -storage)",
+		)
+	}
+	if "http" != c.badTLS {
+		ps = append(ps, "decoy behavior isn't allowed (-tls-garbage)")
+	}
+	if c.decoy {
+		ps = append(ps, "decoy responses aren't allowed (-decoy-status)")
+	}
+	if c.honeypot {
+		ps = append(ps, honeypotFeature.problem)
+	}
+	if c.previews {
+		ps = append(ps, previewsFeature.problem)
+	}
+	if c.beacons {
+		ps = append(
+			ps,
+			"recording GET requests isn't allowed (-beacon-paths)",
+		)
+	}
+	for _, f := range c.unauthed {
+		ps = append(
+			ps,
+			"unauthenticated listeners aren't allowed (-"+f+")",
+		)
+	}
+	return ps
+}
@@ -0,0 +1,403 @@
+package main
+
+/*
+ * config.go
+ * Settings from a config file
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// The config file is a subset of TOML.  Keys are flag names, and values are
+// strings, numbers, booleans, or, for flags which may be repeated, arrays.
+// Keys in a [table] are prefixed with the table's name and a hyphen, so
+//
+//	dir = "/var/lib/postfile"
+//	tokens = "/etc/postfile/tokens"
+//
+//	[federate]
+//	listen = "0.0.0.0:4434"
+//	peer = [
+//	    "https://a.example.com:4434",
+//	    "https://b.example.com:4434",
+//	]
+//
+// is the same as -dir /var/lib/postfile -tokens /etc/postfile/tokens
+// -federate-listen 0.0.0.0:4434 -federate-peer https://a.example.com:4434
+// -federate-peer https://b.example.com:4434.  Durations are strings, e.g.
+// "5m".  Flags given on the command line override the config file.
+//
+// Listeners other than -l may be added with [[listener]] sections, each of
+// which has a listen address, as for -l, and may have http = true to serve
+// plaintext HTTP instead of HTTPS:
+//
+//	[[listener]]
+//	listen = "0.0.0.0:443"
+//
+//	[[listener]]
+//	listen = "/run/postfile/http.sock"
+//	http = true
+//
+// All listeners share every other setting, including routing and
+// authentication.  Listeners can't be changed by reloading the config file.
+
+// configOverridden holds the names of the flags set on the command line or
+// in the environment, which the config file doesn't change.
+var configOverridden = make(map[string]bool)
+
+// configValues holds the values last read from the config file, as they
+// appeared in the file.
+var configValues = make(map[string]string)
+
+/* configSetting is a flag's values from the config file. */
+type configSetting struct {
+	name   string
+	values []string
+	line   int
+}
+
+/* configListener is a [[listener]] section from the config file. */
+type configListener struct {
+	addr      string
+	plaintext bool
+}
+
+/* configListeners are the listeners from the config file. */
+var configListeners []configListener
+
+// loadConfig sets the flags not set on the command line, as well as
+// configListeners, from the config file named fn.
+func loadConfig(fn string) error {
+	ss, ls, err := parseConfig(fn)
+	if nil != err {
+		return err
+	}
+	configListeners = ls
+
+	/* Don't override the command line */
+	flag.Visit(func(f *flag.Flag) { configOverridden[f.Name] = true })
+
+	for _, cs := range ss {
+		configValues[cs.name] = strings.Join(cs.values, "\n")
+		if configOverridden[cs.name] {
+			continue
+		}
+		for _, v := range cs.values {
+			if err := flag.Set(cs.name, v); nil != err {
+				return fmt.Errorf(
+					"line %d: invalid value for %q: %w",
+					cs.line,
+					cs.name,
+					err,
+				)
+			}
+		}
+	}
+	return nil
+}
+
+// parseConfig parses the config file named fn.  Settings are checked to
+// make sure they're for flags which exist.
+func parseConfig(fn string) ([]configSetting, []configListener, error) {
+	f, err := os.Open(fn)
+	if nil != err {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	var (
+		s      = bufio.NewScanner(f)
+		lnum   int
+		table  string
+		seen   = make(map[string]bool)
+		ss     []configSetting
+		ls     []configListener
+		lstart int /* Line of the current [[listener]], or 0 */
+	)
+	/* endListener makes sure the last [[listener]] had an address. */
+	endListener := func() error {
+		if 0 != lstart && "" == ls[len(ls)-1].addr {
+			return fmt.Errorf(
+				"line %d: listener without a listen address",
+				lstart,
+			)
+		}
+		lstart = 0
+		return nil
+	}
+	for s.Scan() {
+		lnum++
+		line := strings.TrimSpace(stripComment(s.Text()))
+		if "" == line {
+			continue
+		}
+
+		/* Tables prefix keys, except for listeners */
+		if strings.HasPrefix(line, "[") {
+			if err := endListener(); nil != err {
+				return nil, nil, err
+			}
+		}
+		if strings.HasPrefix(line, "[[") {
+			if "[[listener]]" != strings.Join(
+				strings.Fields(line),
+				"",
+			) {
+				return nil, nil, fmt.Errorf(
+					"line %d: only [[listener]] may be "+
+						"repeated",
+					lnum,
+				)
+			}
+			ls = append(ls, configListener{})
+			lstart, table = lnum, ""
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			if !strings.HasSuffix(line, "]") {
+				return nil, nil, fmt.Errorf(
+					"line %d: invalid table",
+					lnum,
+				)
+			}
+			table = strings.TrimSpace(line[1 : len(line)-1])
+			if "" == table {
+				return nil, nil, fmt.Errorf(
+					"line %d: empty table name",
+					lnum,
+				)
+			}
+			continue
+		}
+
+		/* Everything else is key = value */
+		k, v, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, nil, fmt.Errorf(
+				"line %d: expected key = value",
+				lnum,
+			)
+		}
+		k = strings.Trim(strings.TrimSpace(k), `"`)
+		if "" != table {
+			k = table + "-" + k
+		}
+		v = strings.TrimSpace(v)
+
+		/* Arrays may span lines */
+		start := lnum
+		for strings.HasPrefix(v, "[") && !arrayClosed(v) {
+			if !s.Scan() {
+				return nil, nil, fmt.Errorf(
+					"line %d: unterminated array",
+					start,
+				)
+			}
+			lnum++
+			v += " " + strings.TrimSpace(stripComment(s.Text()))
+		}
+		vs, err := parseConfigValue(v)
+		if nil != err {
+			return nil, nil, fmt.Errorf("line %d: %w", start, err)
+		}
+		if 0 != lstart {
+			if err := setListener(
+				&ls[len(ls)-1],
+				k,
+				vs,
+			); nil != err {
+				return nil, nil, fmt.Errorf(
+					"line %d: %w",
+					start,
+					err,
+				)
+			}
+			continue
+		}
+
+		/* Make sure it's a real flag */
+		fl := flag.Lookup(k)
+		if nil == fl || "config" == k {
+			return nil, nil, fmt.Errorf(
+				"line %d: unknown setting %q",
+				start,
+				k,
+			)
+		}
+		if seen[k] {
+			return nil, nil, fmt.Errorf(
+				"line %d: %q set twice",
+				start,
+				k,
+			)
+		}
+		seen[k] = true
+		if _, ok := fl.Value.(*multiFlag); !ok && 1 != len(vs) {
+			return nil, nil, fmt.Errorf(
+				"line %d: %q takes one value",
+				start,
+				k,
+			)
+		}
+		ss = append(ss, configSetting{name: k, values: vs, line: start})
+	}
+	if err := endListener(); nil != err {
+		return nil, nil, err
+	}
+	return ss, ls, s.Err()
+}
+
+/* setListener sets the setting k in a [[listener]] section to vs. */
+func setListener(cl *configListener, k string, vs []string) error {
+	if 1 != len(vs) {
+		return fmt.Errorf("listener %q takes one value", k)
+	}
+	switch k {
+	case "listen":
+		cl.addr = vs[0]
+	case "http":
+		b, err := strconv.ParseBool(vs[0])
+		if nil != err {
+			return fmt.Errorf("invalid listener http: %w", err)
+		}
+		cl.plaintext = b
+	default:
+		return fmt.Errorf("unknown listener setting %q", k)
+	}
+	return nil
+}
+
+/* stripComment removes a # comment from line, minding quotes. */
+func stripComment(line string) string {
+	var q byte
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case '"' == q && '\\' == c:
+			i++ /* Skip the escaped character */
+		case 0 != q && c == q:
+			q = 0
+		case 0 != q:
+		case '"' == c || '\'' == c:
+			q = c
+		case '#' == c:
+			return line[:i]
+		}
+	}
+	return line
+}
+
+/* arrayClosed returns true if the array in v has its closing bracket. */
+func arrayClosed(v string) bool {
+	_, err := parseConfigValue(v)
+	return !errors.Is(err, errUnterminatedArray)
+}
+
+/* errUnterminatedArray is returned for an array without a ] */
+var errUnterminatedArray = errors.New("unterminated array")
+
+// parseConfigValue parses a value, which is either a single value or an
+// array.  Strings are unquoted.
+func parseConfigValue(v string) ([]string, error) {
+	if !strings.HasPrefix(v, "[") {
+		s, rest, err := parseConfigScalar(v)
+		if nil != err {
+			return nil, err
+		}
+		if "" != strings.TrimSpace(rest) {
+			return nil, fmt.Errorf("unexpected %q", rest)
+		}
+		return []string{s}, nil
+	}
+	var vs []string
+	rest := strings.TrimSpace(v[1:])
+	for {
+		if "" == rest {
+			return nil, errUnterminatedArray
+		}
+		if strings.HasPrefix(rest, "]") {
+			if "" != strings.TrimSpace(rest[1:]) {
+				return nil, fmt.Errorf("unexpected %q", rest[1:])
+			}
+			return vs, nil
+		}
+		s, r, err := parseConfigScalar(rest)
+		if nil != err {
+			return nil, err
+		}
+		vs = append(vs, s)
+		rest = strings.TrimSpace(r)
+		if strings.HasPrefix(rest, ",") {
+			rest = strings.TrimSpace(rest[1:])
+		} else if !strings.HasPrefix(rest, "]") && "" != rest {
+			return nil, fmt.Errorf(
+				"expected , or ] before %q",
+				rest,
+			)
+		}
+	}
+}
+
+// parseConfigScalar parses a string, number, or boolean at the start of v
+// and returns it and the rest of v.
+func parseConfigScalar(v string) (string, string, error) {
+	switch {
+	case strings.HasPrefix(v, `"`):
+		var sb strings.Builder
+		for i := 1; i < len(v); i++ {
+			switch c := v[i]; c {
+			case '"':
+				return sb.String(), v[i+1:], nil
+			case '\\':
+				i++
+				if i == len(v) {
+					return "", "", errors.New(
+						"unterminated string",
+					)
+				}
+				switch v[i] {
+				case 'n':
+					sb.WriteByte('\n')
+				case 't':
+					sb.WriteByte('\t')
+				case 'r':
+					sb.WriteByte('\r')
+				case '"', '\\':
+					sb.WriteByte(v[i])
+				default:
+					return "", "", fmt.Errorf(
+						"invalid escape \\%c",
+						v[i],
+					)
+				}
+			default:
+				sb.WriteByte(c)
+			}
+		}
+		return "", "", fmt.Errorf("unterminated string")
+	case strings.HasPrefix(v, "'"):
+		s, rest, ok := strings.Cut(v[1:], "'")
+		if !ok {
+			return "", "", fmt.Errorf("unterminated string")
+		}
+		return s, rest, nil
+	default:
+		end := strings.IndexAny(v, ", ]\t")
+		if -1 == end {
+			end = len(v)
+		}
+		if 0 == end {
+			return "", "", fmt.Errorf("missing value")
+		}
+		return v[:end], v[end:], nil
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+/*
+ * config_test.go
+ * Tests for config.go
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"os"
+	"slices"
+	"testing"
+)
+
+func TestParseConfigListeners(t *testing.T) {
+	t.Chdir(t.TempDir())
+	for _, c := range []struct {
+		name   string
+		config string
+		want   []configListener
+		err    bool
+	}{{
+		name: "two",
+		config: `[[listener]]
+listen = "0.0.0.0:443" # HTTPS
+
+[[ listener ]]
+listen = "/run/postfile.sock"
+http = true
+`,
+		want: []configListener{
+			{addr: "0.0.0.0:443"},
+			{addr: "/run/postfile.sock", plaintext: true},
+		},
+	}, {
+		name:   "no_address",
+		config: "[[listener]]\nhttp = true\n[[listener]]\nlisten = \"x\"\n",
+		err:    true,
+	}, {
+		name:   "unknown_setting",
+		config: "[[listener]]\nlisten = \"x\"\ndir = \"/tmp\"\n",
+		err:    true,
+	}, {
+		name:   "bad_http",
+		config: "[[listener]]\nlisten = \"x\"\nhttp = kittens\n",
+		err:    true,
+	}, {
+		name:   "other_array",
+		config: "[[route]]\n",
+		err:    true,
+	}} {
+		t.Run(c.name, func(t *testing.T) {
+			err := os.WriteFile("config", []byte(c.config), 0600)
+			if nil != err {
+				t.Fatalf("Error writing config: %v", err)
+			}
+			_, got, err := parseConfig("config")
+			if c.err {
+				if nil == err {
+					t.Errorf("No error, got %v", got)
+				}
+				return
+			}
+			if nil != err {
+				t.Fatalf("Error: %v", err)
+			}
+			if !slices.Equal(got, c.want) {
+				t.Errorf("Got %+v, want %+v", got, c.want)
+			}
+		})
+	}
+}
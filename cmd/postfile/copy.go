@@ -0,0 +1,72 @@
+package main
+
+/*
+ * copy.go
+ * Copy bodies to storage
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"bufio"
+	"io"
+	"sync"
+)
+
+// defaultBufferSize is the default size of the buffers used to copy bodies to
+// storage.  It's a good bit bigger than io.Copy's, which makes for fewer,
+// larger writes on fast links.
+const defaultBufferSize = 256 * 1024
+
+var (
+	// copyBufferSize is the size of the buffers in copyBuffers and
+	// writeBuffers.  It's set once by main, before anything's copied.
+	copyBufferSize = defaultBufferSize
+
+	// bufferWrites, if set, makes copyBody buffer writes to storage, so
+	// small reads from the network don't turn into small writes.
+	bufferWrites bool
+
+	/* Buffers, reused between uploads. */
+	copyBuffers = sync.Pool{New: func() any {
+		b := make([]byte, copyBufferSize)
+		return &b
+	}}
+	writeBuffers = sync.Pool{New: func() any {
+		return bufio.NewWriterSize(nil, copyBufferSize)
+	}}
+)
+
+// copyBody copies src to dst, like io.Copy, but with a pooled buffer of
+// copyBufferSize bytes and, if bufferWrites is set, buffered writes.  The
+// returned count is the number of bytes read from src.
+func copyBody(dst io.Writer, src io.Reader) (int64, error) {
+	bp := copyBuffers.Get().(*[]byte)
+	defer copyBuffers.Put(bp)
+
+	/* Buffer writes, if we're meant to. */
+	var bw *bufio.Writer
+	if bufferWrites {
+		bw = writeBuffers.Get().(*bufio.Writer)
+		bw.Reset(dst)
+		defer func() {
+			bw.Reset(nil)
+			writeBuffers.Put(bw)
+		}()
+		dst = bw
+	}
+
+	// The anonymous structs hide ReadFrom and WriteTo, which would
+	// otherwise have io.CopyBuffer ignore our buffer.  *os.File's
+	// ReadFrom, in particular, falls back to io.Copy's own small buffer.
+	n, err := io.CopyBuffer(
+		struct{ io.Writer }{dst},
+		struct{ io.Reader }{src},
+		*bp,
+	)
+	if nil == err && nil != bw {
+		err = bw.Flush()
+	}
+	return n, err
+}
@@ -0,0 +1,176 @@
+package main
+
+/*
+ * ctype.go
+ * Only accept some types of uploads
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/magisterquis/postfile"
+)
+
+var (
+	// contentTypes are the content types of uploads we'll accept, from
+	// -content-types.  A type may end in /* to allow any subtype.  If
+	// there's none, uploads of any type are accepted.
+	contentTypes []string
+
+	// sniffContentTypes, if set, checks uploads' sniffed content types
+	// against contentTypes instead of their Content-Type headers.
+	sniffContentTypes bool
+)
+
+/* parseContentTypes sets contentTypes from a comma-separated list. */
+func parseContentTypes(s string) error {
+	for _, ct := range splitList(s) {
+		mt, _, err := mime.ParseMediaType(ct)
+		if nil != err {
+			return fmt.Errorf("invalid type %q: %w", ct, err)
+		}
+		contentTypes = append(contentTypes, mt)
+	}
+	return nil
+}
+
+// allowedContentType returns true if ct, which may have parameters, is in
+// contentTypes.
+func allowedContentType(ct string) bool {
+	mt, _, err := mime.ParseMediaType(ct)
+	if nil != err {
+		return false
+	}
+	major, _, _ := strings.Cut(mt, "/")
+	return slices.Contains(contentTypes, mt) ||
+		slices.Contains(contentTypes, major+"/*")
+}
+
+// contentTypeError returns a 415 StatusError for an upload of type ct,
+// which isn't in contentTypes.
+func contentTypeError(ct string) error {
+	return &postfile.StatusError{
+		Status:  http.StatusUnsupportedMediaType,
+		Message: "Unsupported content type",
+		Err:     fmt.Errorf("unacceptable content type %q", ct),
+	}
+}
+
+// checkContentType checks an upload's content type against contentTypes.
+// The type is ct, normally from a Content-Type header, or, if we're
+// sniffing, the type of body's first sniffLen bytes.  The returned reader
+// has the sniffed bytes put back in front of the rest of body.  If the type
+// isn't allowed, a StatusError is returned.
+func checkContentType(ct string, body io.Reader) (io.Reader, error) {
+	if 0 == len(contentTypes) {
+		return body, nil
+	}
+	if sniffContentTypes {
+		b := make([]byte, sniffLen)
+		n, err := io.ReadFull(body, b)
+		if nil != err && !errors.Is(err, io.EOF) &&
+			!errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, &postfile.StatusError{
+				Status:  http.StatusBadRequest,
+				Message: "read",
+				Err:     fmt.Errorf("sniffing body: %w", err),
+			}
+		}
+		ct = sniffType(b[:n])
+		body = io.MultiReader(bytes.NewReader(b[:n]), body)
+	}
+	if !allowedContentType(ct) {
+		return nil, contentTypeError(ct)
+	}
+	return body, nil
+}
+
+// ctypeWriter checks the sniffed type of what's written to it against
+// contentTypes before passing it to w.  Writes fail with a StatusError if
+// the type isn't allowed.  Less than sniffLen bytes is checked by check.
+type ctypeWriter struct {
+	w   io.Writer
+	buf []byte
+	ok  bool /* Type's allowed */
+}
+
+/* Write writes b to cw.w, once we've seen enough to sniff it. */
+func (cw *ctypeWriter) Write(b []byte) (int, error) {
+	if cw.ok {
+		return cw.w.Write(b)
+	}
+	n := min(len(b), sniffLen-len(cw.buf))
+	cw.buf = append(cw.buf, b[:n]...)
+	if len(cw.buf) < sniffLen {
+		return n, nil
+	}
+	if err := cw.check(); nil != err {
+		return 0, err
+	}
+	if n == len(b) {
+		return n, nil
+	}
+	wn, err := cw.w.Write(b[n:])
+	return n + wn, err
+}
+
+// check checks the type of what's been buffered, if it's not been checked
+// already, and if it's allowed, writes it to cw.w.  Empty data has no type
+// to check.
+func (cw *ctypeWriter) check() error {
+	if cw.ok || 0 == len(cw.buf) {
+		return nil
+	}
+	if ct := sniffType(cw.buf); !allowedContentType(ct) {
+		return contentTypeError(ct)
+	}
+	cw.ok = true
+	_, err := cw.w.Write(cw.buf)
+	cw.buf = nil
+	return err
+}
+
+// withContentTypes rejects uploads which aren't of one of the allowed
+// content types with a 415.  Sniffing puts the sniffed bytes back in front
+// of the rest of the body for the rest of the chain.  Form uploads, chunked
+// sessions, and WebSockets are routed before this and check each file,
+// part, and message themselves.
+func withContentTypes(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := checkContentType(
+			r.Header.Get("Content-Type"),
+			r.Body,
+		)
+		if nil != err {
+			requestLog(r).Printf("Refused upload: %v", err)
+			sendStatusError(w, err)
+			return
+		}
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{body, r.Body}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// sendStatusError sends the client err's status and message, if it's a
+// StatusError, or a 500.
+func sendStatusError(w http.ResponseWriter, err error) {
+	var se *postfile.StatusError
+	if !errors.As(err, &se) {
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+	http.Error(w, se.Message, se.Status)
+}
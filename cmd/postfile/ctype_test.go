@@ -0,0 +1,199 @@
+package main
+
+/*
+ * ctype_test.go
+ * Tests for ctype.go
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"strings"
+	"testing"
+
+	"github.com/magisterquis/postfile"
+)
+
+/* pngStart is the start of a PNG file. */
+const pngStart = "\x89PNG\r\n\x1a\n"
+
+// setContentTypes sets contentTypes and sniffContentTypes until the test's
+// done.
+func setContentTypes(t *testing.T, sniff bool, cts ...string) {
+	t.Helper()
+	oc, os := contentTypes, sniffContentTypes
+	t.Cleanup(func() { contentTypes, sniffContentTypes = oc, os })
+	contentTypes, sniffContentTypes = nil, sniff
+	if err := parseContentTypes(strings.Join(cts, ",")); nil != err {
+		t.Fatalf("Error parsing content types: %v", err)
+	}
+}
+
+/* isUnsupported returns true if err is a 415 StatusError. */
+func isUnsupported(err error) bool {
+	var se *postfile.StatusError
+	return errors.As(err, &se) &&
+		http.StatusUnsupportedMediaType == se.Status
+}
+
+func TestCheckContentType(t *testing.T) {
+	for _, c := range []struct {
+		name  string
+		sniff bool
+		ct    string
+		body  string
+		ok    bool
+	}{
+		{"header_ok", false, "image/png", "kittens", true},
+		{"header_params", false, "text/plain; charset=utf-8", "", true},
+		{"header_bad", false, "application/zip", pngStart, false},
+		{"header_none", false, "", pngStart, false},
+		{"sniff_ok", true, "application/zip", pngStart + "x", true},
+		{"sniff_bad", true, "image/png", "PK\x03\x04", false},
+		{"sniff_empty", true, "image/png", "", false},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			setContentTypes(t, c.sniff, "image/*", "text/plain")
+			body, err := checkContentType(
+				c.ct,
+				strings.NewReader(c.body),
+			)
+			if !c.ok {
+				if !isUnsupported(err) {
+					t.Errorf("Got %v, want a 415", err)
+				}
+				return
+			}
+			if nil != err {
+				t.Fatalf("Error: %v", err)
+			}
+			if b, err := io.ReadAll(body); nil != err {
+				t.Fatalf("Error reading body: %v", err)
+			} else if c.body != string(b) {
+				t.Errorf("Body is %q, want %q", b, c.body)
+			}
+		})
+	}
+}
+
+func TestCtypeWriter(t *testing.T) {
+	setContentTypes(t, true, "image/png")
+	for _, c := range []struct {
+		name   string
+		writes []string
+		ok     bool
+	}{
+		{"short", []string{pngStart}, true},
+		{"split", []string{pngStart[:2], pngStart[2:]}, true},
+		{"long", []string{pngStart + strings.Repeat("x", 999)}, true},
+		{"empty", nil, true},
+		{"bad_short", []string{"kittens"}, false},
+		{"bad_long", []string{strings.Repeat("x", 2*sniffLen)}, false},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			var (
+				buf bytes.Buffer
+				err error
+			)
+			cw := &ctypeWriter{w: &buf}
+			for _, w := range c.writes {
+				if _, err = cw.Write([]byte(w)); nil != err {
+					break
+				}
+			}
+			if nil == err {
+				err = cw.check()
+			}
+			if !c.ok {
+				if !isUnsupported(err) {
+					t.Errorf("Got %v, want a 415", err)
+				}
+				if 0 != buf.Len() {
+					t.Errorf("Wrote %q", buf.Bytes())
+				}
+				return
+			}
+			if nil != err {
+				t.Fatalf("Error: %v", err)
+			}
+			want := strings.Join(c.writes, "")
+			if got := buf.String(); want != got {
+				t.Errorf("Wrote %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestFormUploadContentType(t *testing.T) {
+	t.Chdir(t.TempDir())
+	setContentTypes(t, false, "image/png")
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for _, f := range []struct{ name, ct string }{
+		{"ok.png", "image/png"},
+		{"bad.zip", "application/zip"},
+	} {
+		h := make(textproto.MIMEHeader)
+		h.Set(
+			"Content-Disposition",
+			`form-data; name="file"; filename="`+f.name+`"`,
+		)
+		h.Set("Content-Type", f.ct)
+		pw, err := mw.CreatePart(h)
+		if nil != err {
+			t.Fatalf("Error making form part: %v", err)
+		}
+		io.WriteString(pw, pngStart)
+	}
+	mw.Close()
+	r := httptest.NewRequest(http.MethodPost, "/", &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	w := httptest.NewRecorder()
+	handleFormUpload(w, r, newReqLog(r))
+	if http.StatusUnsupportedMediaType != w.Code {
+		t.Errorf(
+			"Got %d, want %d",
+			w.Code,
+			http.StatusUnsupportedMediaType,
+		)
+	}
+}
+
+func TestChunkPartContentType(t *testing.T) {
+	if err := setupChunkDir(t.TempDir()); nil != err {
+		t.Fatalf("Error setting up chunk directory: %v", err)
+	}
+	setContentTypes(t, true, "image/png")
+	w := chunkRequest(t, chunkParam+"=new", "", false)
+	q := chunkParam + "=" + strings.TrimSpace(w.Body.String())
+
+	/* Only the first part's sniffed. */
+	for _, c := range []struct {
+		part string
+		body string
+		want int
+	}{
+		{"1", "kittens", http.StatusOK},
+		{"0", "kittens", http.StatusUnsupportedMediaType},
+		{"0", pngStart, http.StatusOK},
+	} {
+		w := chunkRequest(t, q+"&part="+c.part, c.body, false)
+		if c.want != w.Code {
+			t.Errorf(
+				"Part %s (%q): got %d, want %d",
+				c.part,
+				c.body,
+				w.Code,
+				c.want,
+			)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+/*
+ * decoy.go
+ * Send clients something other than the real response
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"text/template"
+)
+
+// decoyDefaultBody is sent if we've no decoy body template, and looks like
+// nginx's error pages.
+const decoyDefaultBody = "<html>\r\n" +
+	"<head><title>{{.Status}}</title></head>\r\n" +
+	"<body>\r\n" +
+	"<center><h1>{{.Status}}</h1></center>\r\n" +
+	"<hr><center>nginx</center>\r\n" +
+	"</body>\r\n" +
+	"</html>\r\n"
+
+// decoy is the response sent instead of the real one.
+type decoy struct {
+	code   int
+	header http.Header
+	body   *template.Template
+}
+
+// newDecoy returns a decoy which sends the given status code and headers,
+// which are "Name: value" strings.  If bodyFile isn't empty, it's a
+// text/template for the body, which is given the request's Method, Path,
+// Host, and Status.
+func newDecoy(code int, headers []string, bodyFile string) (*decoy, error) {
+	if 100 > code || 599 < code {
+		return nil, fmt.Errorf("invalid status code %d", code)
+	}
+	hs, err := parseHeaders(headers)
+	if nil != err {
+		return nil, err
+	}
+	d := &decoy{code: code, header: hs}
+	src := decoyDefaultBody
+	if "" != bodyFile {
+		b, err := os.ReadFile(bodyFile)
+		if nil != err {
+			return nil, err
+		}
+		src = string(b)
+	} else if "" == d.header.Get("Content-Type") {
+		d.header.Set("Content-Type", "text/html")
+	}
+	if d.body, err = template.New("decoy").Parse(src); nil != err {
+		return nil, fmt.Errorf("parsing body template: %w", err)
+	}
+	return d, nil
+}
+
+// Wrap returns a handler which calls next but sends the client the decoy
+// response.  Requests for the health check, UI, and other features which
+// need real responses are passed through.
+func (d *decoy) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isHealthCheck(r) || isUIRequest(r) || isFormRequest(r) ||
+			isFormUpload(r) || isListRequest(r) || isDownload(r) ||
+			isDelete(r) || isWebSocket(r) || isWebDAV(r) ||
+			isWebDAVPut(r) || isChunk(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		/* Handle the request, but throw away the response */
+		next.ServeHTTP(&discardWriter{
+			ResponseWriter: w,
+			header:         make(http.Header),
+		}, r)
+
+		/* Send the decoy instead */
+		var b bytes.Buffer
+		if err := d.body.Execute(&b, map[string]string{
+			"Method": r.Method,
+			"Path":   r.URL.Path,
+			"Host":   r.Host,
+			"Status": fmt.Sprintf(
+				"%d %s",
+				d.code,
+				http.StatusText(d.code),
+			),
+		}); nil != err {
+			log.Printf("[%s] Error rendering decoy: %v", r.RemoteAddr, err)
+		}
+		for k, vs := range d.header {
+			w.Header()[k] = vs
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(b.Len()))
+		w.WriteHeader(d.code)
+		w.Write(b.Bytes())
+	})
+}
+
+// discardWriter is an http.ResponseWriter which throws away everything but
+// still allows access to the underlying connection.
+type discardWriter struct {
+	http.ResponseWriter
+	header http.Header
+}
+
+/* Header returns a throwaway header. */
+func (w *discardWriter) Header() http.Header { return w.header }
+
+/* WriteHeader does nothing. */
+func (w *discardWriter) WriteHeader(int) {}
+
+/* Write pretends to write b. */
+func (w *discardWriter) Write(b []byte) (int, error) { return len(b), nil }
+
+// Unwrap returns the underlying http.ResponseWriter, for
+// http.ResponseController.
+func (w *discardWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,113 @@
+package main
+
+/*
+ * delete.go
+ * Let clients DELETE stored files
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+/* allowDeletes allows authorized clients to DELETE stored files */
+var allowDeletes bool
+
+/* isDelete returns true if r is a request to remove stored files. */
+func isDelete(r *http.Request) bool {
+	return allowDeletes && http.MethodDelete == r.Method
+}
+
+// handleDelete removes the uploaded file named by the request's path or, if
+// the path is / and the source parameter is set, every uploaded file from
+// that source.  Source is either an address or just a host.  Files which
+// aren't uploads, like our keypair, are never removed.  The client is sent
+// a JSON list of the removed files.
+func handleDelete(w http.ResponseWriter, r *http.Request, rl reqLog) {
+	if !authorized(r) {
+		rl.Printf("Unauthorized delete")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	/* Work out what to delete */
+	var names []string
+	name := strings.TrimPrefix(r.URL.Path, "/")
+	src := r.URL.Query().Get("source")
+	switch {
+	case "" != name:
+		if !storedFileName(name) {
+			rl.Printf("Invalid delete name %q", name)
+			http.Error(w, "Invalid name", http.StatusBadRequest)
+			return
+		}
+		names = []string{name}
+	case "" != src:
+		fs, err := listFiles()
+		if nil != err {
+			rl.Printf("Error listing files to delete: %v", err)
+			http.Error(
+				w,
+				"Unable to list files",
+				http.StatusInternalServerError,
+			)
+			return
+		}
+		for _, f := range fs {
+			if fromSource(f.Source, src) {
+				names = append(names, f.Name)
+			}
+		}
+	default:
+		http.Error(w, "Need a file name or source", http.StatusBadRequest)
+		return
+	}
+
+	/* Delete ALL the files */
+	deleted := make([]string, 0, len(names))
+	for _, n := range names {
+		if err := removeUpload(n); os.IsNotExist(err) {
+			continue
+		} else if nil != err {
+			rl.Printf("Error deleting %q: %v", n, err)
+			continue
+		}
+		deleted = append(deleted, n)
+		rl.Printf("Deleted %q", n)
+		s, err := readSidecar(n)
+		if nil != err {
+			continue
+		}
+		metaL.Lock()
+		os.Remove(sidecarName(n))
+		metaL.Unlock()
+		uploadGone(*s, "deleted")
+	}
+	if "" != name && 0 == len(deleted) {
+		rl.Printf("Delete of nonexistent %q", name)
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string][]string{
+		"deleted": deleted,
+	}); nil != err {
+		rl.Printf("Error sending deleted files: %v", err)
+	}
+}
+
+/* fromSource returns true if the address addr is, or is on, src. */
+func fromSource(addr, src string) bool {
+	if addr == src {
+		return true
+	}
+	h, _, err := net.SplitHostPort(addr)
+	return nil == err && h == src
+}
@@ -0,0 +1,57 @@
+package main
+
+/*
+ * delete_test.go
+ * Tests for delete.go
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"testing"
+)
+
+func TestHandleDeleteKeypair(t *testing.T) {
+	t.Chdir(t.TempDir())
+	up := "key.pem_000000"
+	for _, n := range []string{"key.pem", "cert.pem", up} {
+		if err := os.WriteFile(n, []byte("x"), 0600); nil != err {
+			t.Fatalf("Writing %s: %v", n, err)
+		}
+	}
+
+	/* Asking by name shouldn't work. */
+	r := httptest.NewRequest(http.MethodDelete, "/key.pem", nil)
+	w := httptest.NewRecorder()
+	handleDelete(w, r, newReqLog(r))
+	if http.StatusBadRequest != w.Code {
+		t.Errorf(
+			"Delete of key.pem: got status %d, want %d",
+			w.Code,
+			http.StatusBadRequest,
+		)
+	}
+
+	/* Nor should asking by source. */
+	r = httptest.NewRequest(http.MethodDelete, "/?source=key.pem", nil)
+	w = httptest.NewRecorder()
+	handleDelete(w, r, newReqLog(r))
+	var got struct{ Deleted []string }
+	if err := json.Unmarshal(w.Body.Bytes(), &got); nil != err {
+		t.Fatalf("Parsing response %q: %v", w.Body, err)
+	}
+	if want := []string{up}; !slices.Equal(got.Deleted, want) {
+		t.Errorf("Deleted %q, want %q", got.Deleted, want)
+	}
+	for _, n := range []string{"key.pem", "cert.pem"} {
+		if _, err := os.Stat(n); nil != err {
+			t.Errorf("Stat of %s after deletes: %v", n, err)
+		}
+	}
+}
@@ -0,0 +1,291 @@
+package main
+
+/*
+ * diff.go
+ * Diffs between repeated uploads to the same path
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/magisterquis/postfile"
+)
+
+const (
+	/* diffContext is the number of unchanged lines around changes */
+	diffContext = 3
+	/* diffMaxCells limits the size of the table used for diffing */
+	diffMaxCells = 25 * 1000 * 1000
+)
+
+/* localFiles is true if uploads are stored in the working directory */
+var localFiles bool
+
+func init() {
+	adminMux.HandleFunc("/diff", adminDiff)
+}
+
+// adminDiff returns diffs between consecutive uploads from one IP address to
+// one path, oldest first.  The source and path are given in the query
+// parameters of the same names.
+func adminDiff(w http.ResponseWriter, r *http.Request) {
+	if http.MethodGet != r.Method {
+		http.Error(w, "Invalid method", http.StatusMethodNotAllowed)
+		return
+	}
+	if !localFiles {
+		http.Error(
+			w,
+			"Diffs need files stored locally",
+			http.StatusNotImplemented,
+		)
+		return
+	}
+	src, path := r.FormValue("source"), r.FormValue("path")
+	if nil == net.ParseIP(src) || "" == path {
+		http.Error(w, "Need source IP and path", http.StatusBadRequest)
+		return
+	}
+	fns, err := versions(src, path)
+	if nil != err {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if 0 == len(fns) {
+		http.Error(w, "No uploads found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	for i := 1; i < len(fns); i++ {
+		d, err := diffFiles(fns[i-1], fns[i])
+		if nil != err {
+			fmt.Fprintf(
+				w,
+				"Error diffing %s and %s: %v\n",
+				fns[i-1],
+				fns[i],
+				err,
+			)
+			continue
+		}
+		w.Write(d)
+	}
+}
+
+// versions returns the names of the files uploaded from src to path, sorted
+// by modification time.  Names are expected to have been made safe with
+// namePolicy, and may have extensions.
+func versions(src, path string) ([]string, error) {
+	if strings.Contains(src, ":") {
+		src = "[" + src + "]"
+	}
+	re, err := regexp.Compile(
+		"^" + regexp.QuoteMeta(namePolicy.Sanitize(src+":")) + `\d+` +
+			regexp.QuoteMeta(namePolicy.Sanitize(
+				postfile.BaseName(&Meta{Path: path}),
+			)) +
+			`_\d{6,}(\.[^/\\]*)?$`,
+	)
+	if nil != err {
+		return nil, err
+	}
+	des, err := os.ReadDir(".")
+	if nil != err {
+		return nil, err
+	}
+	type version struct {
+		name string
+		mod  int64
+	}
+	var vs []version
+	for _, de := range des {
+		if !de.Type().IsRegular() || !re.MatchString(de.Name()) {
+			continue
+		}
+		fi, err := de.Info()
+		if nil != err {
+			continue
+		}
+		vs = append(vs, version{de.Name(), fi.ModTime().UnixNano()})
+	}
+	sort.Slice(vs, func(i, j int) bool {
+		if vs[i].mod != vs[j].mod {
+			return vs[i].mod < vs[j].mod
+		}
+		return vs[i].name < vs[j].name
+	})
+	fns := make([]string, len(vs))
+	for i, v := range vs {
+		fns[i] = v.name
+	}
+	return fns, nil
+}
+
+/* diffFiles returns a unified diff of files a and b. */
+func diffFiles(a, b string) ([]byte, error) {
+	ab, err := os.ReadFile(a)
+	if nil != err {
+		return nil, err
+	}
+	bb, err := os.ReadFile(b)
+	if nil != err {
+		return nil, err
+	}
+	var out bytes.Buffer
+	switch {
+	case bytes.Equal(ab, bb):
+		fmt.Fprintf(&out, "Files %s and %s are identical\n", a, b)
+		return out.Bytes(), nil
+	case -1 != bytes.IndexByte(ab, 0), -1 != bytes.IndexByte(bb, 0):
+		fmt.Fprintf(&out, "Binary files %s and %s differ\n", a, b)
+		return out.Bytes(), nil
+	}
+	al, bl := splitLines(ab), splitLines(bb)
+	if diffMaxCells < (len(al)+1)*(len(bl)+1) {
+		fmt.Fprintf(
+			&out,
+			"Files %s and %s differ (too big to diff)\n",
+			a,
+			b,
+		)
+		return out.Bytes(), nil
+	}
+	fmt.Fprintf(&out, "--- %s\n+++ %s\n", a, b)
+	writeHunks(&out, al, bl, lineDiff(al, bl))
+	return out.Bytes(), nil
+}
+
+/* splitLines splits b into lines, keeping line endings. */
+func splitLines(b []byte) []string {
+	var ls []string
+	for 0 != len(b) {
+		i := bytes.IndexByte(b, '\n')
+		if -1 == i {
+			i = len(b) - 1
+		}
+		ls = append(ls, string(b[:i+1]))
+		b = b[i+1:]
+	}
+	return ls
+}
+
+/* diffOp is one line of a diff: ' ', '-', or '+'. */
+type diffOp struct {
+	op   byte
+	a, b int /* Line indices in each file */
+}
+
+/* lineDiff finds the longest common subsequence of a and b's lines. */
+func lineDiff(a, b []string) []diffOp {
+	/* lcs[i][j] is the LCS length of a[i:] and b[j:] */
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; 0 <= i; i-- {
+		for j := len(b) - 1; 0 <= j; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+	var (
+		ops  []diffOp
+		i, j int
+	)
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			ops = append(ops, diffOp{' ', i, j})
+			i++
+			j++
+		case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			ops = append(ops, diffOp{'-', i, j})
+			i++
+		default:
+			ops = append(ops, diffOp{'+', i, j})
+			j++
+		}
+	}
+	return ops
+}
+
+/* writeHunks writes the changes in ops as unified diff hunks. */
+func writeHunks(out *bytes.Buffer, a, b []string, ops []diffOp) {
+	for start := 0; start < len(ops); {
+		/* Find the next change */
+		for start < len(ops) && ' ' == ops[start].op {
+			start++
+		}
+		if len(ops) == start {
+			return
+		}
+
+		/* Extend the hunk until there's enough unchanged lines */
+		end, same := start, 0
+		for i := start; i < len(ops) && same <= 2*diffContext; i++ {
+			if ' ' == ops[i].op {
+				same++
+				continue
+			}
+			same = 0
+			end = i + 1
+		}
+		lo := max(start-diffContext, 0)
+		hi := min(end+diffContext, len(ops))
+
+		/* Header */
+		var an, bn int
+		for _, o := range ops[lo:hi] {
+			if '+' != o.op {
+				an++
+			}
+			if '-' != o.op {
+				bn++
+			}
+		}
+		fmt.Fprintf(
+			out,
+			"@@ -%s +%s @@\n",
+			hunkRange(ops[lo].a, an),
+			hunkRange(ops[lo].b, bn),
+		)
+
+		/* Lines */
+		for _, o := range ops[lo:hi] {
+			l := b[o.b:]
+			if '+' != o.op {
+				l = a[o.a:]
+			}
+			out.WriteByte(o.op)
+			out.WriteString(l[0])
+			if !strings.HasSuffix(l[0], "\n") {
+				out.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+		start = hi
+	}
+}
+
+/* hunkRange formats a unified diff hunk range. */
+func hunkRange(start, n int) string {
+	if 0 == n {
+		return fmt.Sprintf("%d,0", start)
+	}
+	if 1 == n {
+		return fmt.Sprintf("%d", start+1)
+	}
+	return fmt.Sprintf("%d,%d", start+1, n)
+}
@@ -0,0 +1,59 @@
+package main
+
+/*
+ * diff_test.go
+ * Tests for diff.go
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"os"
+	"slices"
+	"testing"
+
+	"github.com/magisterquis/postfile"
+)
+
+func TestVersions(t *testing.T) {
+	defer func(np postfile.NamePolicy) { namePolicy = np }(namePolicy)
+	for _, np := range []postfile.NamePolicy{
+		postfile.NameAsIs,
+		postfile.NamePercent,
+		postfile.NameTruncate,
+		postfile.NameHash,
+	} {
+		t.Run(np.String(), func(t *testing.T) {
+			t.Chdir(t.TempDir())
+			namePolicy = np
+			var want []string
+			for i, m := range []Meta{
+				{Source: "[::1]:1234", Path: "/foo/bar", Ext: ".txt"},
+				{Source: "[::1]:5678", Path: "/foo/bar"},
+				{Source: "[::1]:1234", Path: "/foo/baz"},
+				{Source: "127.0.0.1:1234", Path: "/foo/bar"},
+			} {
+				n := postfile.MakeName(
+					np.Sanitize(postfile.BaseName(&m)),
+					i,
+				) + m.Ext
+				err := os.WriteFile(n, []byte("x"), 0600)
+				if nil != err {
+					t.Fatalf("Writing %s: %v", n, err)
+				}
+				if "/foo/bar" == m.Path && "[" == m.Source[:1] {
+					want = append(want, n)
+				}
+			}
+			got, err := versions("::1", "/foo/bar")
+			if nil != err {
+				t.Fatalf("Error: %v", err)
+			}
+			slices.Sort(got)
+			if !slices.Equal(got, want) {
+				t.Errorf("Got %q, want %q", got, want)
+			}
+		})
+	}
+}
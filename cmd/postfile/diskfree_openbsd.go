@@ -0,0 +1,20 @@
+package main
+
+/*
+ * diskfree_openbsd.go
+ * Free disk space, via OpenBSD's statfs
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import "syscall"
+
+/* diskFree returns the bytes available to us on path's filesystem. */
+func diskFree(path string) (uint64, bool) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); nil != err {
+		return 0, false
+	}
+	return uint64(st.F_bavail) * uint64(st.F_bsize), true
+}
@@ -0,0 +1,14 @@
+//go:build !linux && !darwin && !freebsd && !openbsd
+
+package main
+
+/*
+ * diskfree_other.go
+ * Free disk space, where we don't know how to get it
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+/* diskFree always fails. */
+func diskFree(path string) (uint64, bool) { return 0, false }
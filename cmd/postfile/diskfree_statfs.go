@@ -0,0 +1,22 @@
+//go:build linux || darwin || freebsd
+
+package main
+
+/*
+ * diskfree_statfs.go
+ * Free disk space, via statfs
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import "syscall"
+
+/* diskFree returns the bytes available to us on path's filesystem. */
+func diskFree(path string) (uint64, bool) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); nil != err {
+		return 0, false
+	}
+	return uint64(st.Bavail) * uint64(st.Bsize), true
+}
@@ -0,0 +1,226 @@
+package main
+
+/*
+ * dns.go
+ * Receive files in DNS queries
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Files sent over DNS are split into queries for names of the form
+//
+//	<chunk>.<seq>.<id>.<zone>
+//
+// where chunk is a piece of the file, base32-encoded without padding and
+// split into as many labels as needed, seq is a decimal sequence number
+// which orders the chunks, and id, made of letters, numbers, hyphens, and
+// underscores, identifies the file.  As queries usually come via a
+// resolver, files are identified by id alone; clients should pick a random
+// one.  A query with no chunk, <seq>.<id>.<zone>, ends the file, as does
+// dnsIdle without a chunk.  Files are stored with a path of /dns/<id>.
+//
+// A queries in the zone are answered with the -dns-answer address and
+// everything else in the zone gets an empty answer, all with a TTL of 0 so
+// resolvers don't cache anything.
+const (
+	dnsIdle       = time.Minute
+	dnsMaxSize    = 64 << 20 /* Per file */
+	dnsMaxPending = 1024     /* Files at once */
+	dnsMaxID      = 63       /* Longest file ID */
+)
+
+/* DNS message bits */
+const (
+	dnsTypeA       = 1
+	dnsClassIN     = 1
+	dnsFlagQR      = 0x8000
+	dnsFlagAA      = 0x0400
+	dnsFlagRD      = 0x0100
+	dnsOpcodeMask  = 0x7800
+	dnsRcodeFormat = 1
+	dnsRcodeNotImp = 4
+	dnsRcodeRefuse = 5
+)
+
+/* dnsB32 decodes chunks */
+var dnsB32 = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+/* dnsServer answers queries and reassembles files. */
+type dnsServer struct {
+	zone   []string /* Lowercase labels */
+	answer [4]byte
+	ra     *reassembler
+}
+
+// listenDNS answers DNS queries on UDP address addr for names in zone, and
+// saves the files in them.  A queries get the IPv4 address answer.
+func listenDNS(addr, zone, answer string) (net.PacketConn, error) {
+	ds := &dnsServer{
+		ra: newReassembler("DNS", dnsIdle, dnsMaxSize, dnsMaxPending),
+	}
+	zone = strings.ToLower(strings.Trim(zone, "."))
+	if "" == zone {
+		return nil, fmt.Errorf("need a zone")
+	}
+	ds.zone = strings.Split(zone, ".")
+	ip := net.ParseIP(answer).To4()
+	if nil == ip {
+		return nil, fmt.Errorf(
+			"answer %q is not an IPv4 address",
+			answer,
+		)
+	}
+	copy(ds.answer[:], ip)
+	pc, err := net.ListenPacket("udp", addr)
+	if nil != err {
+		return nil, err
+	}
+	go ds.serve(pc)
+	return pc, nil
+}
+
+/* serve answers queries sent to pc. */
+func (ds *dnsServer) serve(pc net.PacketConn) {
+	buf := make([]byte, 65536)
+	for {
+		n, a, err := pc.ReadFrom(buf)
+		if nil != err {
+			if !handleReadError("DNS", err) {
+				return
+			}
+			continue
+		}
+		res := ds.handle(a.String(), buf[:n])
+		if nil == res {
+			continue
+		}
+		if _, err := pc.WriteTo(res, a); nil != err {
+			log.Printf(
+				"[%s] Error sending DNS response: %v",
+				a,
+				err,
+			)
+		}
+	}
+}
+
+// handle handles a query from src and returns the response, or nil if
+// there's nothing sensible to send back.
+func (ds *dnsServer) handle(src string, q []byte) []byte {
+	/* Header, and we only want queries */
+	if 12 > len(q) {
+		return nil
+	}
+	flags := binary.BigEndian.Uint16(q[2:])
+	if 0 != flags&dnsFlagQR {
+		return nil
+	}
+	res := func(rcode uint16, question []byte, answer bool) []byte {
+		b := make([]byte, 12, 12+len(question)+16)
+		copy(b, q[:2])
+		fl := dnsFlagQR | dnsFlagAA | rcode
+		fl |= flags & (dnsOpcodeMask | dnsFlagRD)
+		binary.BigEndian.PutUint16(b[2:], fl)
+		if nil != question {
+			binary.BigEndian.PutUint16(b[4:], 1)
+			b = append(b, question...)
+		}
+		if answer {
+			binary.BigEndian.PutUint16(b[6:], 1)
+			b = append(b, 0xC0, 12) /* Pointer to the question */
+			b = binary.BigEndian.AppendUint16(b, dnsTypeA)
+			b = binary.BigEndian.AppendUint16(b, dnsClassIN)
+			b = binary.BigEndian.AppendUint32(b, 0) /* TTL */
+			b = binary.BigEndian.AppendUint16(b, 4)
+			b = append(b, ds.answer[:]...)
+		}
+		return b
+	}
+	if 0 != flags&dnsOpcodeMask {
+		return res(dnsRcodeNotImp, nil, false)
+	}
+	if 1 != binary.BigEndian.Uint16(q[4:]) {
+		return res(dnsRcodeFormat, nil, false)
+	}
+
+	/* Get the name and type */
+	var (
+		labels []string
+		off    = 12
+	)
+	for {
+		if len(q) <= off {
+			return res(dnsRcodeFormat, nil, false)
+		}
+		l := int(q[off])
+		off++
+		if 0 == l {
+			break
+		}
+		/* No compression in questions */
+		if 63 < l || len(q) < off+l {
+			return res(dnsRcodeFormat, nil, false)
+		}
+		labels = append(
+			labels,
+			strings.ToLower(string(q[off:off+l])),
+		)
+		off += l
+	}
+	if len(q) < off+4 {
+		return res(dnsRcodeFormat, nil, false)
+	}
+	question := q[12 : off+4]
+	qtype := binary.BigEndian.Uint16(q[off:])
+
+	/* Make sure it's for us */
+	nl := len(labels) - len(ds.zone)
+	if 0 > nl {
+		return res(dnsRcodeRefuse, question, false)
+	}
+	for i, l := range ds.zone {
+		if labels[nl+i] != l {
+			return res(dnsRcodeRefuse, question, false)
+		}
+	}
+
+	/* Save the chunk, if it looks like one */
+	if 2 <= nl {
+		ds.chunk(src, labels[:nl])
+	}
+	return res(0, question, dnsTypeA == qtype)
+}
+
+/* chunk passes the chunk in labels, from src, to the reassembler. */
+func (ds *dnsServer) chunk(src string, labels []string) {
+	id := labels[len(labels)-1]
+	if dnsMaxID < len(id) || "" == id || "" != strings.Trim(
+		id,
+		"abcdefghijklmnopqrstuvwxyz0123456789-_",
+	) {
+		return
+	}
+	seq, err := strconv.ParseUint(labels[len(labels)-2], 10, 32)
+	if nil != err {
+		return
+	}
+	b, err := dnsB32.DecodeString(
+		strings.ToUpper(strings.Join(labels[:len(labels)-2], "")),
+	)
+	if nil != err {
+		return
+	}
+	ds.ra.handle(id, src, "/dns/"+id, uint32(seq), b)
+}
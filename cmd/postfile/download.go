@@ -0,0 +1,95 @@
+package main
+
+/*
+ * download.go
+ * Let clients GET stored files
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"net/http"
+	"os"
+	"strings"
+)
+
+/* consumingPrefix is prepended to files being downloaded once */
+const consumingPrefix = ".consuming-"
+
+var (
+	/* allowDownloads allows authorized clients to GET stored files */
+	allowDownloads bool
+
+	/* downloadOnce removes files after they've been downloaded */
+	downloadOnce bool
+)
+
+/* isDownload returns true if r is a request for a stored file. */
+func isDownload(r *http.Request) bool {
+	return allowDownloads &&
+		(http.MethodGet == r.Method || http.MethodHead == r.Method)
+}
+
+// handleDownload sends the client the stored file named by the request's
+// path.  If downloadOnce is set, the file is removed after a GET, and the
+// uploader told, if they asked.
+func handleDownload(w http.ResponseWriter, r *http.Request, rl reqLog) {
+	if !authorized(r) {
+		rl.Printf("Unauthorized download")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, "/")
+	if !storedFileName(name) {
+		rl.Printf("Invalid download name %q", name)
+		http.Error(w, "Invalid name", http.StatusBadRequest)
+		return
+	}
+	if !downloadOnce || http.MethodHead == r.Method {
+		rl.Printf("Download of %q", name)
+		serveStoredFile(w, r, name)
+		return
+	}
+
+	/* Claim the file so nobody else gets it */
+	tmp := consumingPrefix + strings.ReplaceAll(name, "/", "_")
+	if err := os.Rename(name, tmp); os.IsNotExist(err) {
+		rl.Printf("Download of nonexistent %q", name)
+		http.NotFound(w, r)
+		return
+	} else if nil != err {
+		rl.Printf("Error claiming %q for download: %v", name, err)
+		http.Error(w, "Unable to download", http.StatusInternalServerError)
+		return
+	}
+	f, err := os.Open(tmp)
+	if nil != err {
+		rl.Printf("Error opening %q for download: %v", name, err)
+		http.Error(w, "Unable to download", http.StatusInternalServerError)
+		os.Rename(tmp, name)
+		return
+	}
+	defer f.Close()
+
+	/* All or nothing */
+	r.Header.Del("Range")
+	if !sendStoredFile(w, r, f, name) {
+		os.Rename(tmp, name)
+		return
+	}
+	if err := os.Remove(tmp); nil != err {
+		rl.Printf("Error removing downloaded %q: %v", name, err)
+	}
+	rl.Printf("Download of %q, removed", name)
+
+	/* Tell the uploader it's gone */
+	s, err := readSidecar(name)
+	if nil != err {
+		return
+	}
+	metaL.Lock()
+	os.Remove(sidecarName(name))
+	metaL.Unlock()
+	uploadGone(*s, "consumed")
+}
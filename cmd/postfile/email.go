@@ -0,0 +1,176 @@
+package main
+
+/*
+ * email.go
+ * Email notifications
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// smtpNotifier emails a summary of each upload or, if digest isn't zero, a
+// digest of the uploads every digest.
+type smtpNotifier struct {
+	addr string
+	auth smtp.Auth /* May be nil */
+	from string
+	to   []string
+
+	digest  time.Duration
+	pending []uploadEvent
+	l       sync.Mutex
+}
+
+// newSMTPNotifier returns a new smtpNotifier which sends mail via the server
+// in u, which is either smtp://[user:pass@]host[:port] or host:port.  The
+// port defaults to 25.  If digest is not zero, a goroutine is started to
+// send digests.
+func newSMTPNotifier(
+	u string,
+	from string,
+	to string,
+	digest time.Duration,
+) (*smtpNotifier, error) {
+	s := &smtpNotifier{digest: digest, from: from}
+
+	/* Work out where to send mail */
+	if !strings.Contains(u, "://") {
+		u = "smtp://" + u
+	}
+	pu, err := url.Parse(u)
+	if nil != err {
+		return nil, err
+	}
+	if "smtp" != pu.Scheme {
+		return nil, fmt.Errorf("unsupported scheme %q", pu.Scheme)
+	}
+	host := pu.Hostname()
+	if "" == host {
+		return nil, fmt.Errorf("missing server")
+	}
+	port := pu.Port()
+	if "" == port {
+		port = "25"
+	}
+	s.addr = net.JoinHostPort(host, port)
+	if nil != pu.User {
+		pass, _ := pu.User.Password()
+		s.auth = smtp.PlainAuth("", pu.User.Username(), pass, host)
+	}
+
+	/* Work out who to send mail to and from */
+	for _, t := range strings.Split(to, ",") {
+		if t = strings.TrimSpace(t); "" != t {
+			s.to = append(s.to, t)
+		}
+	}
+	if 0 == len(s.to) {
+		return nil, fmt.Errorf("no recipients")
+	}
+	if "" == s.from {
+		hn, err := os.Hostname()
+		if nil != err {
+			hn = "localhost"
+		}
+		s.from = "postfile@" + hn
+	}
+
+	if 0 != digest {
+		go s.sendDigests()
+	}
+	return s, nil
+}
+
+/* String returns the server's address. */
+func (s *smtpNotifier) String() string { return "smtp://" + s.addr }
+
+/* Notify emails a summary of e or saves it for the next digest. */
+func (s *smtpNotifier) Notify(e uploadEvent) error {
+	if 0 == s.digest {
+		return s.send(
+			"File arrived: "+e.Path,
+			formatEvents([]uploadEvent{e}),
+		)
+	}
+	s.l.Lock()
+	defer s.l.Unlock()
+	s.pending = append(s.pending, e)
+	return nil
+}
+
+/* sendDigests sends a digest of pending events every s.digest. */
+func (s *smtpNotifier) sendDigests() {
+	for range time.Tick(s.digest) {
+		s.l.Lock()
+		es := s.pending
+		s.pending = nil
+		s.l.Unlock()
+		if 0 == len(es) {
+			continue
+		}
+		if err := s.send(
+			fmt.Sprintf("%d files arrived", len(es)),
+			formatEvents(es),
+		); nil != err {
+			log.Printf("Error emailing digest, will retry: %v", err)
+			s.l.Lock()
+			s.pending = append(es, s.pending...)
+			s.l.Unlock()
+		}
+	}
+}
+
+/* send sends an email. */
+func (s *smtpNotifier) send(subject, body string) error {
+	var m bytes.Buffer
+	fmt.Fprintf(&m, "From: %s\r\n", s.from)
+	fmt.Fprintf(&m, "To: %s\r\n", strings.Join(s.to, ", "))
+	fmt.Fprintf(&m, "Subject: [postfile] %s\r\n", mailHeader(subject))
+	fmt.Fprintf(&m, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	m.WriteString("MIME-Version: 1.0\r\n")
+	m.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	m.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+	return smtp.SendMail(s.addr, s.auth, s.from, s.to, m.Bytes())
+}
+
+/* formatEvents describes es in plain text. */
+func formatEvents(es []uploadEvent) string {
+	var sb strings.Builder
+	for _, e := range es {
+		fmt.Fprintf(
+			&sb,
+			"Time:   %s\nSource: %s\nPath:   %s\nHost:   %s\n"+
+				"Size:   %d\nSHA256: %s\nStored: %s\n",
+			e.Time.Format(time.RFC3339),
+			e.Source,
+			e.Path,
+			e.Host,
+			e.Size,
+			e.SHA256,
+			e.Name,
+		)
+		if "" != e.Preview {
+			fmt.Fprintf(&sb, "Start:  %q\n", e.Preview)
+		}
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
+
+/* mailHeader removes line breaks from s, for use in a header. */
+func mailHeader(s string) string {
+	return strings.NewReplacer("\r", " ", "\n", " ").Replace(s)
+}
@@ -0,0 +1,179 @@
+package main
+
+/*
+ * enrich.go
+ * Add external information to upload metadata
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	/* metaDir holds upload metadata sidecar files */
+	metaDir = ".meta"
+	/* enrichMaxResponse is the most we'll read from an enrichment hook */
+	enrichMaxResponse = 1024 * 1024
+)
+
+/* metaL serializes access to sidecar files */
+var metaL sync.Mutex
+
+func init() {
+	adminMux.HandleFunc("/meta", adminMeta)
+}
+
+// sidecar is the contents of a metadata sidecar file.  Enrichment holds
+// the responses from enrichment hooks, keyed by hook URL.  Uploads with a
+// TTL have Expires set, and Callback if the uploader wants to know when the
+// upload's gone.  ClamAV is clamd's verdict, with -clamav.
+type sidecar struct {
+	Upload     uploadEvent                `json:"upload"`
+	Enrichment map[string]json.RawMessage `json:"enrichment,omitempty"`
+	Expires    *time.Time                 `json:"expires,omitempty"`
+	Callback   string                     `json:"callback,omitempty"`
+	ClamAV     string                     `json:"clamav,omitempty"`
+}
+
+// enricher POSTs upload details to an external service and adds the
+// response, which should be JSON, to the upload's metadata sidecar file.
+type enricher struct {
+	url string
+}
+
+/* String returns the hook's URL. */
+func (en enricher) String() string { return "enrichment hook " + en.url }
+
+/* Notify sends e to the hook and saves what it sends back. */
+func (en enricher) Notify(e uploadEvent) error {
+	b, err := json.Marshal(e)
+	if nil != err {
+		return err
+	}
+	res, err := webhookClient.Post(
+		en.url,
+		"application/json",
+		bytes.NewReader(b),
+	)
+	if nil != err {
+		return err
+	}
+	defer res.Body.Close()
+	rb, err := io.ReadAll(io.LimitReader(res.Body, enrichMaxResponse))
+	if nil != err {
+		return err
+	}
+	if 2 != res.StatusCode/100 {
+		return fmt.Errorf("unexpected status %s", res.Status)
+	}
+
+	/* Not JSON?  Save it as a string. */
+	if !json.Valid(rb) {
+		if rb, err = json.Marshal(string(rb)); nil != err {
+			return err
+		}
+	}
+	return updateSidecar(e, func(s *sidecar) {
+		s.Enrichment[en.url] = rb
+	})
+}
+
+// sidecarWriter saves each upload's details to its metadata sidecar file,
+// even if nothing else would.
+type sidecarWriter struct{}
+
+/* String returns "sidecar writer". */
+func (sidecarWriter) String() string { return "sidecar writer" }
+
+/* Notify saves e to its sidecar. */
+func (sidecarWriter) Notify(e uploadEvent) error {
+	return updateSidecar(e, func(*sidecar) {})
+}
+
+// updateSidecar calls f on e's sidecar, which is created if it doesn't
+// exist, and saves it.
+func updateSidecar(e uploadEvent, f func(s *sidecar)) error {
+	metaL.Lock()
+	defer metaL.Unlock()
+	fn := sidecarName(e.Name)
+	s := sidecar{Upload: e}
+	if b, err := os.ReadFile(fn); nil == err {
+		if err := json.Unmarshal(b, &s); nil != err {
+			return fmt.Errorf("parsing %v: %w", fn, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	if "" != e.SHA256 { /* Hashed details are better */
+		s.Upload = e
+	}
+	if nil == s.Enrichment {
+		s.Enrichment = make(map[string]json.RawMessage)
+	}
+	f(&s)
+	b, err := json.MarshalIndent(s, "", "  ")
+	if nil != err {
+		return err
+	}
+	if err := os.MkdirAll(metaDir, 0700); nil != err {
+		return err
+	}
+	tmp := fn + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); nil != err {
+		return err
+	}
+	return os.Rename(tmp, fn)
+}
+
+/* readSidecar returns the sidecar for the upload named name, if it has one. */
+func readSidecar(name string) (*sidecar, error) {
+	metaL.Lock()
+	defer metaL.Unlock()
+	b, err := os.ReadFile(sidecarName(name))
+	if nil != err {
+		return nil, err
+	}
+	var s sidecar
+	if err := json.Unmarshal(b, &s); nil != err {
+		return nil, err
+	}
+	return &s, nil
+}
+
+/* sidecarName returns the name of the sidecar file for an upload. */
+func sidecarName(name string) string {
+	return filepath.Join(
+		metaDir,
+		strings.NewReplacer("/", "_", `\`, "_").Replace(name)+".json",
+	)
+}
+
+/* adminMeta returns the metadata sidecar for the upload given by name. */
+func adminMeta(w http.ResponseWriter, r *http.Request) {
+	name := r.FormValue("name")
+	if "" == name {
+		http.Error(w, "Need name", http.StatusBadRequest)
+		return
+	}
+	s, err := readSidecar(name)
+	if os.IsNotExist(err) {
+		http.Error(w, "No metadata", http.StatusNotFound)
+		return
+	} else if nil != err {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	adminJSON(w, s)
+}
@@ -0,0 +1,55 @@
+package main
+
+/*
+ * env.go
+ * Settings from environment variables
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+/* envPrefix starts the names of environment variables which set flags */
+const envPrefix = "POSTFILE_"
+
+// envName returns the name of the environment variable for the flag named
+// name, e.g. POSTFILE_ACCESS_LOG for -access-log.
+func envName(name string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// loadEnv sets the flags not set on the command line from POSTFILE_*
+// environment variables.  Flags which may be repeated take one value per
+// line.
+func loadEnv() error {
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	var err error
+	flag.VisitAll(func(f *flag.Flag) {
+		v, ok := os.LookupEnv(envName(f.Name))
+		if !ok || set[f.Name] || nil != err {
+			return
+		}
+		vs := []string{v}
+		if _, ok := f.Value.(*multiFlag); ok {
+			vs = strings.Split(strings.TrimSpace(v), "\n")
+		}
+		for _, v := range vs {
+			if serr := flag.Set(f.Name, v); nil != serr {
+				err = fmt.Errorf(
+					"invalid value for %s: %w",
+					envName(f.Name),
+					serr,
+				)
+				return
+			}
+		}
+	})
+	return err
+}
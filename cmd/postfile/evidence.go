@@ -0,0 +1,538 @@
+package main
+
+/*
+ * evidence.go
+ * Assemble evidence packages for a source
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/magisterquis/postfile"
+)
+
+/* logTimeLayout is the format of the timestamps log.Printf puts on lines */
+const logTimeLayout = "2006/01/02 15:04:05"
+
+// evidenceFile describes a file in an evidence package.
+type evidenceFile struct {
+	Name     string    `json:"name"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+	SHA256   string    `json:"sha256"`
+}
+
+/* multiFlag is a flag which may be given more than once */
+type multiFlag []string
+
+/* String satisfies flag.Value. */
+func (m *multiFlag) String() string { return strings.Join(*m, ", ") }
+
+/* Set satisfies flag.Value. */
+func (m *multiFlag) Set(s string) error {
+	*m = append(*m, s)
+	return nil
+}
+
+// evidenceMain is the main function for the evidence subcommand, which
+// assembles a tarball with the files, metadata, hashes, and log lines for a
+// source IP address or token, and a signed summary.
+func evidenceMain(args []string) {
+	var logs multiFlag
+	fs := flag.NewFlagSet("evidence", flag.ExitOnError)
+	var (
+		dir = fs.String(
+			"dir",
+			"posts",
+			"POSTed files `directory`",
+		)
+		source = fs.String(
+			"source",
+			"",
+			"Source IP `address` for which to gather evidence",
+		)
+		token = fs.String(
+			"token",
+			"",
+			"Token `name` for which to gather evidence, which "+
+				"requires an -audit log to be given with -log",
+		)
+		from = fs.String(
+			"from",
+			"",
+			"Optional start `time` of the evidence",
+		)
+		to = fs.String(
+			"to",
+			"",
+			"Optional end `time` of the evidence",
+		)
+		keyFile = fs.String(
+			"key",
+			"",
+			"PEM-encoded PKCS8 Ed25519 signing key `file`, e.g. "+
+				"from openssl genpkey -algorithm ed25519",
+		)
+		names = fs.String(
+			"names",
+			defaultNamePolicy().String(),
+			"Filename sanitization `policy` with which files "+
+				"were stored (see the server's -names)",
+		)
+		out = fs.String(
+			"o",
+			"",
+			"Output `file` (default evidence-<source>-<time>.tar.gz)",
+		)
+	)
+	fs.Var(
+		&logs,
+		"log",
+		"Log `file` from which to excerpt lines (may be repeated)",
+	)
+	fs.Usage = func() {
+		fmt.Fprintf(
+			os.Stderr,
+			`Usage: %v evidence [options]
+
+Assembles an evidence package for a source IP address or token: the files
+it uploaded, their metadata and hashes, relevant log lines, and a summary
+signed with an Ed25519 key, which must be given with -key.
+
+Options:
+`,
+			os.Args[0],
+		)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	/* Work out what we're looking for */
+	if ("" == *source) == ("" == *token) {
+		log.Fatalf("Need exactly one of -source or -token")
+	}
+	if "" == *keyFile {
+		log.Fatalf("Need a signing key (-key)")
+	}
+	np, err := postfile.ParseNamePolicy(*names)
+	if nil != err {
+		log.Fatalf("Invalid -names: %v", err)
+	}
+	var start, end time.Time
+	if "" != *from {
+		if start, err = parseExpiry(*from); nil != err {
+			log.Fatalf("Unable to parse start time %q: %v", *from, err)
+		}
+	}
+	if "" != *to {
+		if end, err = parseExpiry(*to); nil != err {
+			log.Fatalf("Unable to parse end time %q: %v", *to, err)
+		}
+	}
+	inRange := func(t time.Time) bool {
+		return (start.IsZero() || !t.Before(start)) &&
+			(end.IsZero() || !t.After(end))
+	}
+
+	/* Prefixes of the files and log line fields we're after.  For
+	tokens, we get the addresses from the audit log.  File names were
+	made safe with the name policy; log lines weren't. */
+	var (
+		filePrefixes []string
+		linePrefixes []string
+		who          string
+	)
+	if "" != *source {
+		who = *source
+		linePrefixes = []string{*source + ":", "[" + *source + "]:"}
+		for _, p := range linePrefixes {
+			filePrefixes = append(filePrefixes, np.Sanitize(p))
+		}
+	} else {
+		who = "token " + *token
+		for _, l := range logs {
+			as, err := tokenAddrs(l, *token)
+			if nil != err {
+				log.Fatalf("Unable to read %v: %v", l, err)
+			}
+			for _, a := range as {
+				filePrefixes = append(
+					filePrefixes,
+					np.Sanitize(a+"_"),
+				)
+				linePrefixes = append(linePrefixes, a+" ")
+			}
+		}
+		if 0 == len(filePrefixes) {
+			log.Fatalf("No requests found for token %q", *token)
+		}
+	}
+	matchesName := func(path string) bool {
+		for _, e := range strings.Split(filepath.ToSlash(path), "/") {
+			for _, p := range filePrefixes {
+				if strings.HasPrefix(e, p) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	matchesLine := func(s string) bool {
+		for _, p := range linePrefixes {
+			if strings.Contains(s, " "+p) ||
+				strings.Contains(s, "["+p) ||
+				strings.Contains(s, `"`+p) {
+				return true
+			}
+		}
+		return false
+	}
+
+	/* Get hold of the key */
+	key, err := readSigningKey(*keyFile)
+	if nil != err {
+		log.Fatalf("Unable to get signing key: %v", err)
+	}
+	pub, err := x509.MarshalPKIXPublicKey(key.Public())
+	if nil != err {
+		log.Fatalf("Unable to marshal public key: %v", err)
+	}
+	kfp := sha256.Sum256(pub)
+	log.Printf("Signing with key SHA256:%x", kfp)
+
+	/* Open the output file */
+	now := time.Now().UTC()
+	if "" == *out {
+		*out = fmt.Sprintf(
+			"evidence-%s-%s.tar.gz",
+			strings.NewReplacer(":", "_", " ", "_").Replace(
+				strings.TrimPrefix(who, "token "),
+			),
+			now.Format("20060102T150405Z"),
+		)
+	}
+	f, err := os.OpenFile(*out, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if nil != err {
+		log.Fatalf("Unable to create %v: %v", *out, err)
+	}
+	gw := gzip.NewWriter(f)
+	tw := tar.NewWriter(gw)
+
+	/* Add the files and their sidecars, from within the upload
+	directory.  Logs are named relative to where we started. */
+	for i, l := range logs {
+		if logs[i], err = filepath.Abs(l); nil != err {
+			log.Fatalf("Unable to find %v: %v", l, err)
+		}
+	}
+	if err := os.Chdir(*dir); nil != err {
+		log.Fatalf("Unable to cd to %v: %v", *dir, err)
+	}
+	var manifest bytes.Buffer
+	efs, err := addEvidenceUploads(tw, &manifest, matchesName, inRange)
+	if nil != err {
+		log.Fatalf("Unable to add files from %v: %v", *dir, err)
+	}
+
+	/* Add the log excerpts */
+	for _, l := range logs {
+		ex, err := logExcerpt(l, matchesLine, inRange)
+		if nil != err {
+			log.Fatalf("Unable to excerpt %v: %v", l, err)
+		}
+		name := "logs/" + filepath.Base(l)
+		if err := addEvidenceBytes(tw, name, ex, now); nil != err {
+			log.Fatalf("Unable to add %v: %v", name, err)
+		}
+		h := sha256.Sum256(ex)
+		fmt.Fprintf(&manifest, "%x  %s\n", h, name)
+	}
+
+	/* Metadata and manifest */
+	md, err := json.MarshalIndent(efs, "", "\t")
+	if nil != err {
+		log.Fatalf("Unable to marshal metadata: %v", err)
+	}
+	if err := addEvidenceBytes(tw, "metadata.json", md, now); nil != err {
+		log.Fatalf("Unable to add metadata: %v", err)
+	}
+	mh := sha256.Sum256(md)
+	fmt.Fprintf(&manifest, "%x  %s\n", mh, "metadata.json")
+	if err := addEvidenceBytes(
+		tw,
+		"manifest.sha256",
+		manifest.Bytes(),
+		now,
+	); nil != err {
+		log.Fatalf("Unable to add manifest: %v", err)
+	}
+
+	/* Summary and its signature */
+	var (
+		summary bytes.Buffer
+		total   int64
+	)
+	for _, ef := range efs {
+		total += ef.Size
+	}
+	mfh := sha256.Sum256(manifest.Bytes())
+	fmt.Fprintf(&summary, "Evidence for:    %v\n", who)
+	fmt.Fprintf(&summary, "From:            %v\n", timeOrAny(start))
+	fmt.Fprintf(&summary, "To:              %v\n", timeOrAny(end))
+	fmt.Fprintf(&summary, "Generated:       %v\n", now.Format(time.RFC3339))
+	fmt.Fprintf(&summary, "Files:           %v\n", len(efs))
+	fmt.Fprintf(&summary, "Bytes:           %v\n", total)
+	fmt.Fprintf(&summary, "Logs:            %v\n", len(logs))
+	fmt.Fprintf(&summary, "Manifest SHA256: %x\n", mfh)
+	fmt.Fprintf(&summary, "Key SHA256:      %x\n", kfp)
+	for _, v := range []struct {
+		name string
+		b    []byte
+	}{
+		{"summary.txt", summary.Bytes()},
+		{"summary.txt.sig", []byte(base64.StdEncoding.EncodeToString(
+			ed25519.Sign(key, summary.Bytes()),
+		) + "\n")},
+		{"signing-key.pem", pem.EncodeToMemory(&pem.Block{
+			Type:  "PUBLIC KEY",
+			Bytes: pub,
+		})},
+	} {
+		if err := addEvidenceBytes(tw, v.name, v.b, now); nil != err {
+			log.Fatalf("Unable to add %v: %v", v.name, err)
+		}
+	}
+
+	/* All done */
+	if err := tw.Close(); nil != err {
+		log.Fatalf("Unable to finish tarball: %v", err)
+	}
+	if err := gw.Close(); nil != err {
+		log.Fatalf("Unable to finish compression: %v", err)
+	}
+	if err := f.Close(); nil != err {
+		log.Fatalf("Unable to close %v: %v", *out, err)
+	}
+	log.Printf(
+		"Wrote evidence package with %v files (%v bytes) to %v",
+		len(efs),
+		total,
+		*out,
+	)
+}
+
+/* timeOrAny returns t as an RFC3339 string, or "any" if it's not set. */
+func timeOrAny(t time.Time) string {
+	if t.IsZero() {
+		return "any"
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+/* readSigningKey reads a PEM-encoded PKCS8 Ed25519 key from a file. */
+func readSigningKey(fn string) (ed25519.PrivateKey, error) {
+	b, err := os.ReadFile(fn)
+	if nil != err {
+		return nil, err
+	}
+	blk, _ := pem.Decode(b)
+	if nil == blk {
+		return nil, fmt.Errorf("no PEM data in %v", fn)
+	}
+	k, err := x509.ParsePKCS8PrivateKey(blk.Bytes)
+	if nil != err {
+		return nil, err
+	}
+	ek, ok := k.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("key is a %T, not Ed25519", k)
+	}
+	return ek, nil
+}
+
+// tokenAddrs returns the client addresses which used the named token,
+// according to the audit log fn.
+func tokenAddrs(fn, name string) ([]string, error) {
+	f, err := os.Open(fn)
+	if nil != err {
+		return nil, err
+	}
+	defer f.Close()
+	as := make(map[string]bool)
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		if !strings.Contains(s.Text(), " token:"+name+" ") {
+			continue
+		}
+		/* Address is after the date and time */
+		if fs := strings.Fields(s.Text()); 3 <= len(fs) {
+			as[fs[2]] = true
+		}
+	}
+	ret := make([]string, 0, len(as))
+	for a := range as {
+		ret = append(ret, a)
+	}
+	sort.Strings(ret)
+	return ret, s.Err()
+}
+
+// logExcerpt returns the lines from the log file fn for which matches returns
+// true and which have a timestamp in range.
+func logExcerpt(
+	fn string,
+	matches func(string) bool,
+	inRange func(time.Time) bool,
+) ([]byte, error) {
+	f, err := os.Open(fn)
+	if nil != err {
+		return nil, err
+	}
+	defer f.Close()
+	var out bytes.Buffer
+	s := bufio.NewScanner(f)
+	s.Buffer(nil, 1024*1024)
+	for s.Scan() {
+		l := s.Text()
+		if !matches(l) {
+			continue
+		}
+		if len(logTimeLayout) <= len(l) {
+			t, err := time.ParseInLocation(
+				logTimeLayout,
+				l[:len(logTimeLayout)],
+				time.Local,
+			)
+			if nil == err && !inRange(t) {
+				continue
+			}
+		}
+		out.WriteString(l)
+		out.WriteByte('\n')
+	}
+	return out.Bytes(), s.Err()
+}
+
+// addEvidenceUploads adds to tw the uploads in the current directory for
+// which matches returns true and which were modified in range, as well as
+// their sidecars.  The hashes of everything added are written to manifest.
+// The uploads, but not the sidecars, are returned.
+func addEvidenceUploads(
+	tw *tar.Writer,
+	manifest io.Writer,
+	matches func(path string) bool,
+	inRange func(time.Time) bool,
+) ([]evidenceFile, error) {
+	var efs []evidenceFile
+	err := walkUploads(func(path string, d fs.DirEntry, err error) error {
+		if nil != err {
+			if "." == path {
+				return err
+			}
+			log.Printf("Unable to check %v: %v", path, err)
+			return nil
+		}
+		if !matches(path) {
+			return nil
+		}
+		fi, err := d.Info()
+		if nil != err || !inRange(fi.ModTime()) {
+			return nil
+		}
+		ef, err := addEvidenceFile(
+			tw,
+			path,
+			"files/"+filepath.ToSlash(path),
+		)
+		if nil != err {
+			return fmt.Errorf("adding %v: %w", path, err)
+		}
+		efs = append(efs, ef)
+		fmt.Fprintf(manifest, "%s  %s\n", ef.SHA256, ef.Name)
+
+		/* Metadata too, if we have it */
+		sn := sidecarName(path)
+		if _, err := os.Stat(sn); nil != err {
+			return nil
+		}
+		sf, err := addEvidenceFile(tw, sn, "meta/"+filepath.Base(sn))
+		if nil != err {
+			return fmt.Errorf("adding %v: %w", sn, err)
+		}
+		fmt.Fprintf(manifest, "%s  %s\n", sf.SHA256, sf.Name)
+		return nil
+	})
+	return efs, err
+}
+
+/* addEvidenceFile adds the file at path to tw, named name, and hashes it. */
+func addEvidenceFile(tw *tar.Writer, path, name string) (evidenceFile, error) {
+	f, err := os.Open(path)
+	if nil != err {
+		return evidenceFile{}, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if nil != err {
+		return evidenceFile{}, err
+	}
+	if err := tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0600,
+		Size:    fi.Size(),
+		ModTime: fi.ModTime(),
+	}); nil != err {
+		return evidenceFile{}, err
+	}
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tw, h), f); nil != err {
+		return evidenceFile{}, err
+	}
+	return evidenceFile{
+		Name:     name,
+		Size:     fi.Size(),
+		Modified: fi.ModTime().UTC(),
+		SHA256:   fmt.Sprintf("%x", h.Sum(nil)),
+	}, nil
+}
+
+/* addEvidenceBytes adds b to tw, named name, with modification time t. */
+func addEvidenceBytes(
+	tw *tar.Writer,
+	name string,
+	b []byte,
+	t time.Time,
+) error {
+	if err := tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0600,
+		Size:    int64(len(b)),
+		ModTime: t,
+	}); nil != err {
+		return err
+	}
+	_, err := tw.Write(b)
+	return err
+}
@@ -0,0 +1,87 @@
+package main
+
+/*
+ * evidence_test.go
+ * Tests for evidence.go
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAddEvidenceUploads(t *testing.T) {
+	t.Chdir(t.TempDir())
+	for _, n := range []string{
+		"1.2.3.4:5_foo_000000",
+		"tok/1.2.3.4:6_bar_000000",
+		"1.2.3.4:5_a_000000.d/inner",
+		"1.2.3.5:5_foo_000000",
+		sidecarName("1.2.3.4:5_foo_000000"),
+	} {
+		if err := os.MkdirAll(filepath.Dir(n), 0700); nil != err {
+			t.Fatalf("Making directory for %s: %v", n, err)
+		}
+		if err := os.WriteFile(n, []byte("x"), 0600); nil != err {
+			t.Fatalf("Writing %s: %v", n, err)
+		}
+	}
+	var (
+		tb       bytes.Buffer
+		manifest bytes.Buffer
+	)
+	tw := tar.NewWriter(&tb)
+	efs, err := addEvidenceUploads(
+		tw,
+		&manifest,
+		func(path string) bool {
+			return strings.Contains(path, "1.2.3.4:")
+		},
+		func(time.Time) bool { return true },
+	)
+	if nil != err {
+		t.Fatalf("Error: %v", err)
+	}
+	if err := tw.Close(); nil != err {
+		t.Fatalf("Error closing tarball: %v", err)
+	}
+
+	/* Make sure we got the right files. */
+	if 3 != len(efs) {
+		t.Errorf("Got %d files, want 3", len(efs))
+	}
+	var got []string
+	tr := tar.NewReader(&tb)
+	for {
+		hdr, err := tr.Next()
+		if io.EOF == err {
+			break
+		} else if nil != err {
+			t.Fatalf("Error reading tarball: %v", err)
+		}
+		got = append(got, hdr.Name)
+	}
+	slices.Sort(got)
+	want := []string{
+		"files/1.2.3.4:5_a_000000.d/inner",
+		"files/1.2.3.4:5_foo_000000",
+		"files/tok/1.2.3.4:6_bar_000000",
+		"meta/1.2.3.4:5_foo_000000.json",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("Got %q, want %q", got, want)
+	}
+	if n := strings.Count(manifest.String(), "\n"); len(want) != n {
+		t.Errorf("Manifest has %d lines, want %d", n, len(want))
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+/*
+ * expire.go
+ * Stop accepting uploads after a deadline
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+/* expiry is when we stop accepting uploads, if it's set */
+var expiry time.Time
+
+/* expiryLayouts are the time formats we accept for -expire */
+var expiryLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04Z07:00",
+	"2006-01-02T15:04",
+	"2006-01-02",
+}
+
+// parseExpiry parses s as a time in one of expiryLayouts.  Times without a
+// zone are taken to be UTC.
+func parseExpiry(s string) (time.Time, error) {
+	for _, l := range expiryLayouts {
+		if t, err := time.Parse(l, s); nil == err {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unknown time format")
+}
+
+/* expired returns true if we're past the expiry time. */
+func expired() bool {
+	return !expiry.IsZero() && !time.Now().Before(expiry)
+}
+
+// handleExpiry waits until the expiry time and then either wipes the uploads
+// in the current directory, archives them to the file named archive and then
+// wipes them, or does nothing, depending on action.
+func handleExpiry(action, archive string) {
+	time.Sleep(time.Until(expiry))
+	log.Printf("Expired at %v, no longer accepting uploads", expiry)
+
+	switch action {
+	case "none":
+		return
+	case "archive":
+		if err := archiveDir(archive); nil != err {
+			log.Printf(
+				"Unable to archive files to %v, not wiping: %v",
+				archive,
+				err,
+			)
+			return
+		}
+		log.Printf("Archived files to %v", archive)
+	}
+
+	/* Wipe ALL the uploads */
+	var n int
+	walkUploads(func(path string, d fs.DirEntry, err error) error {
+		if nil != err {
+			return nil
+		}
+		if err := removeUpload(path); nil != err {
+			log.Printf("Unable to remove %q: %v", path, err)
+			return nil
+		}
+		n++
+		return nil
+	})
+	log.Printf("Removed %v files after expiry", n)
+}
+
+// archiveDir writes the uploads in the current directory to a gzipped
+// tarball named fn.
+func archiveDir(fn string) error {
+	f, err := os.OpenFile(fn, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if nil != err {
+		return err
+	}
+	defer f.Close()
+	gw := gzip.NewWriter(f)
+	tw := tar.NewWriter(gw)
+
+	if err := walkUploads(func(
+		path string,
+		d fs.DirEntry,
+		err error,
+	) error {
+		if nil != err {
+			return err
+		}
+		fi, err := d.Info()
+		if nil != err {
+			return err
+		}
+		hdr, err := tar.FileInfoHeader(fi, "")
+		if nil != err {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(path)
+		if err := tw.WriteHeader(hdr); nil != err {
+			return err
+		}
+		sf, err := os.Open(path)
+		if nil != err {
+			return err
+		}
+		defer sf.Close()
+		_, err = io.Copy(tw, sf)
+		return err
+	}); nil != err {
+		return err
+	}
+
+	if err := tw.Close(); nil != err {
+		return err
+	}
+	if err := gw.Close(); nil != err {
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,58 @@
+package main
+
+/*
+ * expire_test.go
+ * Tests for expire.go
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestArchiveDir(t *testing.T) {
+	t.Chdir(t.TempDir())
+	up := "127.0.0.1:1234_foo_000000"
+	for _, n := range []string{up, "key.pem", "cert.pem"} {
+		if err := os.WriteFile(n, []byte("x"), 0600); nil != err {
+			t.Fatalf("Writing %s: %v", n, err)
+		}
+	}
+	fn := filepath.Join(t.TempDir(), "archive.tar.gz")
+	if err := archiveDir(fn); nil != err {
+		t.Fatalf("Error archiving: %v", err)
+	}
+
+	/* Make sure only the upload got archived. */
+	f, err := os.Open(fn)
+	if nil != err {
+		t.Fatalf("Opening archive: %v", err)
+	}
+	defer f.Close()
+	gr, err := gzip.NewReader(f)
+	if nil != err {
+		t.Fatalf("Reading archive: %v", err)
+	}
+	var got []string
+	tr := tar.NewReader(gr)
+	for {
+		hdr, err := tr.Next()
+		if io.EOF == err {
+			break
+		} else if nil != err {
+			t.Fatalf("Reading archive: %v", err)
+		}
+		got = append(got, hdr.Name)
+	}
+	if want := []string{up}; !slices.Equal(got, want) {
+		t.Errorf("Archived %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+/*
+ * extract.go
+ * Unpack tar and zip uploads
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+const (
+	// extractSuffix is added to an archive's name to make the name of
+	// the directory into which it's unpacked.
+	extractSuffix = ".d"
+	// extractMaxSize is the most we'll unpack from one archive, which
+	// keeps archive bombs from filling the disk.
+	extractMaxSize = 1 << 30
+	/* extractMaxFiles is the most files and directories we'll unpack */
+	extractMaxFiles = 10000
+)
+
+// errExtractTooBig is returned when an archive unpacks to more than
+// extractMaxSize bytes or extractMaxFiles files.
+var errExtractTooBig = errors.New("archive too big to unpack")
+
+// extractStorage unpacks uploads which are tar, gzipped tar, or zip
+// archives into directories next to them, named after the archives with
+// extractSuffix.  Only regular files and directories are unpacked; archives
+// with anything which would end up outside the directory aren't unpacked at
+// all.  Uploads must be stored in local files.
+type extractStorage struct {
+	Storage
+	discard bool /* Remove unpacked archives */
+}
+
+/* Open opens the upload, which will be unpacked if it's an archive. */
+func (s extractStorage) Open(m *Meta) (Upload, error) {
+	u, err := s.Storage.Open(m)
+	if nil != err {
+		return nil, err
+	}
+	return extractUpload{Upload: u, discard: s.discard}, nil
+}
+
+/* extractUpload is an upload which may be unpacked. */
+type extractUpload struct {
+	Upload
+	discard bool
+}
+
+// Commit commits the upload and unpacks it if it's an archive.  Errors
+// unpacking are logged, as the upload itself worked.
+func (u extractUpload) Commit() error {
+	if err := u.Upload.Commit(); nil != err {
+		return err
+	}
+	fn := u.Name()
+	kind, n, err := extractArchive(fn, fn+extractSuffix)
+	if nil != err {
+		log.Printf("Unable to unpack %s %s: %v", kind, fn, err)
+		return nil
+	} else if "" == kind {
+		return nil
+	}
+	log.Printf("Unpacked %d entries from %s %s", n, kind, fn)
+	if u.discard {
+		if err := os.Remove(fn); nil != err {
+			log.Printf("Unable to remove unpacked %s: %v", fn, err)
+		}
+	}
+	return nil
+}
+
+// extractArchive unpacks the archive in the file named fn into the new
+// directory dir.  It returns the kind of archive and how many files and
+// directories it unpacked.  If fn isn't an archive, extractArchive returns
+// an empty kind and doesn't make dir.  If unpacking fails, dir is removed.
+func extractArchive(fn, dir string) (kind string, n int, err error) {
+	f, err := os.Open(fn)
+	if nil != err {
+		return "", 0, err
+	}
+	defer f.Close()
+
+	/* Work out what we've got */
+	br := bufio.NewReader(f)
+	var next func() (string, bool, io.Reader, error)
+	switch hdr, _ := br.Peek(512); {
+	case bytes.HasPrefix(hdr, []byte("PK\x03\x04")):
+		fi, err := f.Stat()
+		if nil != err {
+			return "", 0, err
+		}
+		zr, err := zip.NewReader(f, fi.Size())
+		if nil != err {
+			return "zip", 0, err
+		}
+		kind, next = "zip", zipEntries(zr)
+	case isTar(hdr):
+		kind, next = "tar", tarEntries(tar.NewReader(br))
+	case bytes.HasPrefix(hdr, []byte{0x1f, 0x8b}):
+		gr, err := gzip.NewReader(br)
+		if nil != err {
+			return "", 0, nil
+		}
+		defer gr.Close()
+		gbr := bufio.NewReader(gr)
+		if hdr, _ := gbr.Peek(512); !isTar(hdr) {
+			return "", 0, nil
+		}
+		kind, next = "tar.gz", tarEntries(tar.NewReader(gbr))
+	default:
+		return "", 0, nil
+	}
+
+	/* Unpack into a fresh directory */
+	if err := os.Mkdir(dir, 0700); nil != err {
+		return kind, 0, err
+	}
+	defer func() {
+		if nil != err {
+			os.RemoveAll(dir)
+		}
+	}()
+	var left int64 = extractMaxSize
+	for {
+		name, isDir, r, err := next()
+		if errors.Is(err, io.EOF) {
+			return kind, n, nil
+		} else if nil != err {
+			return kind, n, err
+		}
+		if "" == name { /* Not a file or directory */
+			continue
+		}
+		if n++; extractMaxFiles < n {
+			return kind, n, errExtractTooBig
+		}
+		if !filepath.IsLocal(name) {
+			return kind, n, fmt.Errorf("unsafe path %q", name)
+		}
+		p := filepath.Join(dir, name)
+		if isDir {
+			if err := os.MkdirAll(p, 0700); nil != err {
+				return kind, n, err
+			}
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(p), 0700); nil != err {
+			return kind, n, err
+		}
+		if left, err = extractFile(p, r, left); nil != err {
+			return kind, n, fmt.Errorf("unpacking %q: %w", name, err)
+		}
+	}
+}
+
+// extractFile writes up to left bytes from r to a new file at p, and returns
+// how many bytes are left.  If there's more than left bytes to write,
+// extractFile returns errExtractTooBig.
+func extractFile(p string, r io.Reader, left int64) (int64, error) {
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if nil != err {
+		return left, err
+	}
+	defer f.Close()
+	n, err := copyBody(f, io.LimitReader(r, left+1))
+	if nil != err {
+		return left, err
+	}
+	if left < n {
+		return left, errExtractTooBig
+	}
+	return left - n, f.Close()
+}
+
+/* isTar returns true if hdr looks like the start of a POSIX tar file. */
+func isTar(hdr []byte) bool {
+	return 263 <= len(hdr) && bytes.Equal(hdr[257:262], []byte("ustar"))
+}
+
+// tarEntries returns a function which returns the name and contents of the
+// next entry in tr, and whether it's a directory.  Entries which aren't
+// regular files or directories have empty names.
+func tarEntries(tr *tar.Reader) func() (string, bool, io.Reader, error) {
+	return func() (string, bool, io.Reader, error) {
+		h, err := tr.Next()
+		if nil != err {
+			return "", false, nil, err
+		}
+		name := filepath.FromSlash(h.Name)
+		switch h.Typeflag {
+		case tar.TypeReg:
+			return name, false, tr, nil
+		case tar.TypeDir:
+			return name, true, nil, nil
+		default:
+			return "", false, nil, nil
+		}
+	}
+}
+
+// zipEntries is like tarEntries, but for zip files.
+func zipEntries(zr *zip.Reader) func() (string, bool, io.Reader, error) {
+	var (
+		i    int
+		prev io.Closer
+	)
+	return func() (string, bool, io.Reader, error) {
+		if nil != prev {
+			prev.Close()
+			prev = nil
+		}
+		if len(zr.File) <= i {
+			return "", false, nil, io.EOF
+		}
+		zf := zr.File[i]
+		i++
+		name := filepath.FromSlash(zf.Name)
+		switch m := zf.Mode(); {
+		case m.IsDir():
+			return name, true, nil, nil
+		case !m.IsRegular():
+			return "", false, nil, nil
+		}
+		rc, err := zf.Open()
+		if nil != err {
+			return "", false, nil, err
+		}
+		prev = rc
+		return name, false, rc, nil
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+/*
+ * features.go
+ * Features which can be toggled at runtime
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"fmt"
+	"sort"
+	"sync/atomic"
+)
+
+// feature is something which can be turned on and off while we're running.
+// If problem is set, it's why the feature can't be turned on in compliance
+// mode.
+type feature struct {
+	name    string
+	desc    string
+	problem string
+	on      atomic.Bool
+}
+
+/* features holds all of the toggleable features, by name */
+var features = make(map[string]*feature)
+
+/* Toggleable features */
+var (
+	debugFeature       = newFeature("debug", "Log extra request details")
+	maintenanceFeature = newFeature(
+		"maintenance",
+		"Refuse uploads with a 503 and note who tried",
+	)
+	rawFeature = newFeature(
+		"raw",
+		"Save uploads' request lines and headers with their bodies",
+	)
+	previewsFeature = newFeature(
+		"previews",
+		"Put the start of each upload in notifications",
+	).noncompliant(
+		"sending uploads' contents in notifications isn't allowed " +
+			"(-notify-previews)",
+	)
+	honeypotFeature = newFeature(
+		"honeypot",
+		"Record requests which can't be uploads instead of rejecting "+
+			"them",
+	).noncompliant(
+		"recording unauthenticated requests isn't allowed (-honeypot)",
+	)
+)
+
+/* newFeature registers a new, disabled feature. */
+func newFeature(name, desc string) *feature {
+	f := &feature{name: name, desc: desc}
+	features[name] = f
+	return f
+}
+
+/* Enabled returns true if the feature is on. */
+func (f *feature) Enabled() bool { return f.on.Load() }
+
+// noncompliant notes that f can't be turned on in compliance mode, because
+// of problem.  It returns f.
+func (f *feature) noncompliant(problem string) *feature {
+	f.problem = problem
+	return f
+}
+
+// Set turns the feature on or off, and returns what it was before.  Features
+// with a problem can't be turned on in compliance mode.
+func (f *feature) Set(on bool) (bool, error) {
+	if on && complianceMode && "" != f.problem {
+		return f.Enabled(), fmt.Errorf(
+			"compliance mode: %s",
+			f.problem,
+		)
+	}
+	return f.on.Swap(on), nil
+}
+
+/* featureNames returns the names of all of the features, sorted. */
+func featureNames() []string {
+	ns := make([]string, 0, len(features))
+	for n := range features {
+		ns = append(ns, n)
+	}
+	sort.Strings(ns)
+	return ns
+}
@@ -0,0 +1,351 @@
+package main
+
+/*
+ * federation.go
+ * Share the index of stored files with other instances
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"crypto/ed25519"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	/* federationPath is where we serve our index */
+	federationPath = "/index"
+
+	/* signatureHeader holds the index's signature */
+	signatureHeader = "X-Postfile-Signature"
+
+	/* maxIndexSize is the largest index we'll accept from a peer */
+	maxIndexSize = 64 << 20
+)
+
+var (
+	/* federationName is what we call ourselves to peers */
+	federationName string
+
+	/* peerIndexes holds the latest index from each peer, by URL */
+	peerIndexes  = make(map[string]*peerIndex)
+	peerIndexesL sync.Mutex
+)
+
+func init() {
+	adminMux.HandleFunc("/federation", adminFederation)
+}
+
+/* federatedIndex is the list of files one instance has stored. */
+type federatedIndex struct {
+	Instance  string       `json:"instance"`
+	Generated time.Time    `json:"generated"`
+	Files     []storedFile `json:"files"`
+}
+
+/* peerIndex is what we know about a peer's index. */
+type peerIndex struct {
+	URL       string
+	Index     *federatedIndex
+	LastSync  time.Time
+	LastError string
+}
+
+// federationTLS returns a TLS config which presents the certificate in
+// pair and requires that the other side's certificate is signed by a CA
+// in the file named caFile.
+func federationTLS(pair tls.Certificate, caFile string) (*tls.Config, error) {
+	pem, err := os.ReadFile(caFile)
+	if nil != err {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", caFile)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{pair},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		RootCAs:      pool,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// readPeerKeys reads the PEM-encoded Ed25519 public keys in the named file,
+// which peers use to sign their indexes.
+func readPeerKeys(fn string) ([]ed25519.PublicKey, error) {
+	b, err := os.ReadFile(fn)
+	if nil != err {
+		return nil, err
+	}
+	var keys []ed25519.PublicKey
+	for {
+		var blk *pem.Block
+		if blk, b = pem.Decode(b); nil == blk {
+			break
+		}
+		k, err := x509.ParsePKIXPublicKey(blk.Bytes)
+		if nil != err {
+			return nil, fmt.Errorf("key %d: %w", len(keys)+1, err)
+		}
+		pk, ok := k.(ed25519.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf(
+				"key %d is a %T, not Ed25519",
+				len(keys)+1,
+				k,
+			)
+		}
+		keys = append(keys, pk)
+	}
+	if 0 == len(keys) {
+		return nil, fmt.Errorf("no keys found in %s", fn)
+	}
+	return keys, nil
+}
+
+// serveFederation serves our index, signed with key, to peers on addr.
+// Peers must present a certificate signed by one of conf's CAs.
+func serveFederation(
+	addr string,
+	conf *tls.Config,
+	key ed25519.PrivateKey,
+) (net.Listener, error) {
+	l, err := tls.Listen("tcp", addr, conf)
+	if nil != err {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(federationPath, func(
+		w http.ResponseWriter,
+		r *http.Request,
+	) {
+		handleFederatedIndex(w, r, key)
+	})
+	go func() {
+		log.Fatalf(
+			"Federation server error: %v",
+			http.Serve(l, mux),
+		)
+	}()
+	return l, nil
+}
+
+/* handleFederatedIndex sends a peer our signed index. */
+func handleFederatedIndex(
+	w http.ResponseWriter,
+	r *http.Request,
+	key ed25519.PrivateKey,
+) {
+	if http.MethodGet != r.Method {
+		http.Error(w, "Invalid method", http.StatusMethodNotAllowed)
+		return
+	}
+	var peer string
+	if nil != r.TLS && 0 != len(r.TLS.PeerCertificates) {
+		peer = r.TLS.PeerCertificates[0].Subject.CommonName
+	}
+	fs, err := listFiles()
+	if nil != err {
+		log.Printf(
+			"[%s] Federation: unable to list files: %v",
+			r.RemoteAddr,
+			err,
+		)
+		http.Error(
+			w,
+			"Unable to list files",
+			http.StatusInternalServerError,
+		)
+		return
+	}
+	b, err := json.Marshal(federatedIndex{
+		Instance:  federationName,
+		Generated: time.Now(),
+		Files:     fs,
+	})
+	if nil != err {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sig := ed25519.Sign(key, b)
+	if debugFeature.Enabled() {
+		log.Printf(
+			"[%s] Federation: sent index of %d files to %q",
+			r.RemoteAddr,
+			len(fs),
+			peer,
+		)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set(
+		signatureHeader,
+		base64.StdEncoding.EncodeToString(sig),
+	)
+	w.Write(b)
+}
+
+/* verifyIndex checks that sig is one of keys' signature of b. */
+func verifyIndex(keys []ed25519.PublicKey, b, sig []byte) error {
+	for _, k := range keys {
+		if ed25519.Verify(k, b, sig) {
+			return nil
+		}
+	}
+	return errors.New("bad signature")
+}
+
+// syncPeers fetches each peer's index every interval, forever, and checks
+// it was signed by one of keys.  The first fetch happens right away.
+func syncPeers(
+	peers []string,
+	conf *tls.Config,
+	keys []ed25519.PublicKey,
+	interval time.Duration,
+) {
+	c := &http.Client{
+		Timeout:   time.Minute,
+		Transport: &http.Transport{TLSClientConfig: conf},
+	}
+	peerIndexesL.Lock()
+	for _, p := range peers {
+		peerIndexes[p] = &peerIndex{URL: p}
+	}
+	peerIndexesL.Unlock()
+	for {
+		for _, p := range peers {
+			fi, err := fetchIndex(c, p, keys)
+			peerIndexesL.Lock()
+			pi := peerIndexes[p]
+			if nil != err {
+				log.Printf(
+					"Federation: unable to sync with %s: %v",
+					p,
+					err,
+				)
+				pi.LastError = err.Error()
+			} else {
+				if debugFeature.Enabled() {
+					log.Printf(
+						"Federation: got index of "+
+							"%d files from %s (%s)",
+						len(fi.Files),
+						fi.Instance,
+						p,
+					)
+				}
+				pi.Index = fi
+				pi.LastSync = time.Now()
+				pi.LastError = ""
+			}
+			peerIndexesL.Unlock()
+		}
+		time.Sleep(interval)
+	}
+}
+
+/* fetchIndex gets a peer's index and checks it was signed by one of keys. */
+func fetchIndex(
+	c *http.Client,
+	peer string,
+	keys []ed25519.PublicKey,
+) (*federatedIndex, error) {
+	res, err := c.Get(peer + federationPath)
+	if nil != err {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if http.StatusOK != res.StatusCode {
+		return nil, fmt.Errorf("unexpected status %s", res.Status)
+	}
+	b, err := io.ReadAll(io.LimitReader(res.Body, maxIndexSize+1))
+	if nil != err {
+		return nil, err
+	}
+	if maxIndexSize < len(b) {
+		return nil, fmt.Errorf("index too large")
+	}
+
+	/* Make sure it came from who we think it did */
+	sig, err := base64.StdEncoding.DecodeString(
+		res.Header.Get(signatureHeader),
+	)
+	if nil != err || 0 == len(sig) {
+		return nil, fmt.Errorf("missing or invalid signature")
+	}
+	if err := verifyIndex(keys, b, sig); nil != err {
+		return nil, fmt.Errorf("verifying signature: %w", err)
+	}
+
+	var fi federatedIndex
+	if err := json.Unmarshal(b, &fi); nil != err {
+		return nil, fmt.Errorf("decoding index: %w", err)
+	}
+	for i := range fi.Files {
+		fi.Files[i].Instance = fi.Instance
+	}
+	return &fi, nil
+}
+
+/* federatedFiles returns the files our peers have, newest first. */
+func federatedFiles() []storedFile {
+	peerIndexesL.Lock()
+	var fs []storedFile
+	for _, pi := range peerIndexes {
+		if nil != pi.Index {
+			fs = append(fs, pi.Index.Files...)
+		}
+	}
+	peerIndexesL.Unlock()
+	sort.Slice(fs, func(i, j int) bool {
+		return fs[i].ModTime.After(fs[j].ModTime)
+	})
+	return fs
+}
+
+/* federating returns true if we have federated peers. */
+func federating() bool {
+	peerIndexesL.Lock()
+	defer peerIndexesL.Unlock()
+	return 0 != len(peerIndexes)
+}
+
+/* adminFederation returns the state of our peers' indexes. */
+func adminFederation(w http.ResponseWriter, r *http.Request) {
+	peerIndexesL.Lock()
+	ps := make([]map[string]any, 0, len(peerIndexes))
+	for _, pi := range peerIndexes {
+		p := map[string]any{"url": pi.URL}
+		if nil != pi.Index {
+			p["instance"] = pi.Index.Instance
+			p["generated"] = pi.Index.Generated
+			p["files"] = len(pi.Index.Files)
+			p["last_sync"] = pi.LastSync
+		}
+		if "" != pi.LastError {
+			p["last_error"] = pi.LastError
+		}
+		ps = append(ps, p)
+	}
+	peerIndexesL.Unlock()
+	sort.Slice(ps, func(i, j int) bool {
+		return ps[i]["url"].(string) < ps[j]["url"].(string)
+	})
+	adminJSON(w, ps)
+}
@@ -0,0 +1,99 @@
+package main
+
+/*
+ * federation_test.go
+ * Tests for federation.go
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"testing"
+)
+
+/* testPublicKeyPEM returns pub, PEM-encoded. */
+func testPublicKeyPEM(t *testing.T, pub any) []byte {
+	b, err := x509.MarshalPKIXPublicKey(pub)
+	if nil != err {
+		t.Fatalf("Marshalling public key: %s", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: b})
+}
+
+func TestVerifyIndex(t *testing.T) {
+	t.Chdir(t.TempDir())
+	var (
+		pubs  []byte
+		privs []ed25519.PrivateKey
+	)
+	for range 3 {
+		pub, priv, err := ed25519.GenerateKey(rand.Reader)
+		if nil != err {
+			t.Fatalf("Generating key: %s", err)
+		}
+		privs = append(privs, priv)
+		pubs = append(pubs, testPublicKeyPEM(t, pub)...)
+	}
+
+	/* Only trust the first two keys */
+	const fn = "peers.pem"
+	if err := os.WriteFile(fn, pubs[:2*len(pubs)/3], 0600); nil != err {
+		t.Fatalf("Writing keys: %s", err)
+	}
+	keys, err := readPeerKeys(fn)
+	if nil != err {
+		t.Fatalf("Reading keys: %s", err)
+	}
+	if 2 != len(keys) {
+		t.Fatalf("Read %d keys, want 2", len(keys))
+	}
+	index := []byte(`{"instance":"test"}`)
+	for i, priv := range privs {
+		err := verifyIndex(keys, index, ed25519.Sign(priv, index))
+		if trusted := 2 > i; trusted != (nil == err) {
+			t.Errorf(
+				"Key %d: trusted %v, got error %v",
+				i,
+				trusted,
+				err,
+			)
+		}
+	}
+	if nil == verifyIndex(
+		keys,
+		[]byte(`{"instance":"evil"}`),
+		ed25519.Sign(privs[0], index),
+	) {
+		t.Errorf("Verified signature of a different index")
+	}
+
+	/* Only Ed25519 keys will do */
+	ek, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if nil != err {
+		t.Fatalf("Generating ECDSA key: %s", err)
+	}
+	if err := os.WriteFile(
+		fn,
+		testPublicKeyPEM(t, &ek.PublicKey),
+		0600,
+	); nil != err {
+		t.Fatalf("Writing ECDSA key: %s", err)
+	}
+	if _, err := readPeerKeys(fn); nil == err {
+		t.Errorf("Read ECDSA key")
+	}
+	if err := os.WriteFile(fn, nil, 0600); nil != err {
+		t.Fatalf("Writing empty file: %s", err)
+	}
+	if _, err := readPeerKeys(fn); nil == err {
+		t.Errorf("Read no keys without error")
+	}
+}
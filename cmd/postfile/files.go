@@ -0,0 +1,264 @@
+package main
+
+/*
+ * files.go
+ * Find out about stored files
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/magisterquis/postfile"
+)
+
+// uploadNameRE matches the names of uploaded files: MakeName's suffix,
+// maybe followed by an extension or a rotated file's suffix.
+var uploadNameRE = regexp.MustCompile(`_[0-9]{6}(\.[^/\\]*)?$`)
+
+// scratchDir returns the directory in which to put temporary files of the
+// given kind.  With local files, it's a hidden directory in -dir, which is
+// our working directory and still reachable after chrooting.  Otherwise,
+// it's the system's temporary directory.
+func scratchDir(kind string) string {
+	if !localFiles {
+		return os.TempDir()
+	}
+	return "." + kind
+}
+
+var (
+	// protectedFiles are the absolute paths of files which are never
+	// treated as uploads, even if they're in the upload directory and
+	// have uploadish names.
+	protectedFiles  = make(map[string]bool)
+	protectedFilesL sync.RWMutex
+)
+
+// protectFiles notes that the files with the given paths, e.g. our TLS
+// keypair, and the files in directories with the given paths aren't
+// uploads.  Relative paths are taken to be relative to both the current
+// directory and to base, which should be the directory in which we
+// started.  Empty paths are ignored.
+func protectFiles(base string, paths ...string) {
+	protectedFilesL.Lock()
+	defer protectedFilesL.Unlock()
+	for _, p := range paths {
+		if "" == p {
+			continue
+		}
+		if a, err := filepath.Abs(p); nil == err {
+			protectedFiles[a] = true
+		}
+		if !filepath.IsAbs(p) {
+			protectedFiles[filepath.Join(base, p)] = true
+		}
+	}
+}
+
+// isUploadPath returns true if path, relative to the current directory,
+// looks like it's an upload.  Uploads have names made by MakeName, aren't
+// hidden or in hidden directories, and neither they nor their directories
+// under the current directory are protected.  Everything in the directory
+// into which an upload was unpacked counts as part of the upload.
+func isUploadPath(path string) bool {
+	path = filepath.Clean(path)
+	if filepath.IsAbs(path) || strings.HasPrefix(path, "..") {
+		return false
+	}
+	es := strings.Split(filepath.ToSlash(path), "/")
+	unpacked := false
+	for _, e := range es {
+		if strings.HasPrefix(e, ".") {
+			return false
+		}
+		if unpacked = unpackDir(e); unpacked {
+			break
+		}
+	}
+	if !unpacked && !uploadNameRE.MatchString(es[len(es)-1]) {
+		return false
+	}
+	protectedFilesL.RLock()
+	defer protectedFilesL.RUnlock()
+	for p := path; "." != p; p = filepath.Dir(p) {
+		a, err := filepath.Abs(p)
+		if nil != err || protectedFiles[a] {
+			return false
+		}
+	}
+	return true
+}
+
+// unpackDir returns true if dir is, or is in, a directory into which an
+// upload was unpacked by -extract.
+func unpackDir(dir string) bool {
+	for _, e := range strings.Split(filepath.ToSlash(dir), "/") {
+		a, ok := strings.CutSuffix(e, extractSuffix)
+		if ok && uploadNameRE.MatchString(a) {
+			return true
+		}
+	}
+	return false
+}
+
+// walkUploads calls f for each regular file under the current directory for
+// which isUploadPath returns true, as well as for quarantined files.  Hidden
+// directories other than quarantineDir aren't walked, unless they were
+// unpacked from an upload.  Errors walking are passed to f, with a nil
+// DirEntry if need be.
+func walkUploads(f func(path string, d fs.DirEntry, err error) error) error {
+	return filepath.WalkDir(".", func(
+		path string,
+		d fs.DirEntry,
+		err error,
+	) error {
+		switch {
+		case nil != err:
+			return f(path, d, err)
+		case "." == path, quarantineDir == path:
+			return nil
+		case d.IsDir() && strings.HasPrefix(d.Name(), ".") &&
+			!unpackDir(path):
+			return filepath.SkipDir
+		case !d.Type().IsRegular():
+			return nil
+		case !isUploadPath(path) && quarantineDir != filepath.Dir(path):
+			return nil
+		}
+		return f(path, d, nil)
+	})
+}
+
+// removeUpload removes the upload at path.  If the upload was unpacked from
+// an archive, directories it leaves empty are removed as well.
+func removeUpload(path string) error {
+	if err := os.Remove(path); nil != err {
+		return err
+	}
+	for d := filepath.Dir(path); unpackDir(d); d = filepath.Dir(d) {
+		if nil != os.Remove(d) {
+			break
+		}
+	}
+	return nil
+}
+
+// storedFile describes a file in the local upload directory.  Source and
+// Path come from the file's sidecar if it has one, or are guessed from its
+// name if not.  Instance is only set for files stored by federated peers.
+type storedFile struct {
+	Name     string    `json:"name"`
+	Size     int64     `json:"size"`
+	ModTime  time.Time `json:"mtime"`
+	Source   string    `json:"source"`
+	Path     string    `json:"path"`
+	Instance string    `json:"instance,omitempty"`
+}
+
+// listFiles returns the uploaded files in the current directory, including
+// files unpacked from them, newest first.  Unpacked files' names are
+// slash-separated paths.
+func listFiles() ([]storedFile, error) {
+	var files []storedFile
+	if err := walkUploads(func(
+		path string,
+		d fs.DirEntry,
+		err error,
+	) error {
+		if nil != err {
+			if "." == path {
+				return err
+			}
+			return nil
+		}
+		name := filepath.ToSlash(path)
+		dir, _, nested := strings.Cut(name, "/")
+		if nested && !unpackDir(dir) {
+			return nil
+		}
+		fi, err := d.Info()
+		if nil != err {
+			return nil
+		}
+		f := storedFile{
+			Name:    name,
+			Size:    fi.Size(),
+			ModTime: fi.ModTime(),
+		}
+		if nested {
+			f.Source, f.Path = guessOrigin(
+				strings.TrimSuffix(dir, extractSuffix),
+			)
+		} else {
+			f.Source, f.Path = guessOrigin(name)
+		}
+		files = append(files, f)
+		return nil
+	}); nil != err {
+		return nil, err
+	}
+	sort.Slice(files, func(i, j int) bool {
+		if !files[i].ModTime.Equal(files[j].ModTime) {
+			return files[i].ModTime.After(files[j].ModTime)
+		}
+		return files[i].Name < files[j].Name
+	})
+	return files, nil
+}
+
+// sanitizedSourceRE matches the address at the start of a name made safe
+// by NameTruncate or NameHash, which turn colons into underscores.
+var sanitizedSourceRE = regexp.MustCompile(`^(\[[^\]]*\]|[0-9.]+)_([0-9]+)_`)
+
+// guessOrigin works out where the file named name came from.  Source is the
+// client's address.  Path's slashes are underscores, unless the file has a
+// sidecar.  Names are expected to have been made safe with namePolicy.
+func guessOrigin(name string) (source, path string) {
+	if s, err := readSidecar(name); nil == err {
+		return s.Upload.Source, s.Upload.Path
+	}
+	var rest string
+	switch namePolicy {
+	case postfile.NamePercent:
+		if u, err := url.PathUnescape(name); nil == err {
+			name = u
+		}
+	case postfile.NameTruncate, postfile.NameHash:
+		if m := sanitizedSourceRE.FindStringSubmatch(name); nil != m {
+			source = strings.ReplaceAll(m[1], "_", ":") + ":" + m[2]
+			rest = name[len(m[0]):]
+		}
+	}
+	if "" == source {
+		source, rest, _ = strings.Cut(name, "_")
+	}
+	if i := strings.LastIndex(rest, "_"); -1 != i {
+		rest = rest[:i]
+	}
+	return source, "/" + rest
+}
+
+// storedFileName checks whether name is the plain file name of an upload in
+// the upload directory, or the slash-separated path of a file unpacked from
+// one.
+func storedFileName(name string) bool {
+	if "" == name || strings.Contains(name, `\`) ||
+		filepath.ToSlash(filepath.Clean(name)) != name {
+		return false
+	}
+	if dir, _, ok := strings.Cut(name, "/"); ok && !unpackDir(dir) {
+		return false
+	}
+	return isUploadPath(name)
+}
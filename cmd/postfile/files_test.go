@@ -0,0 +1,201 @@
+package main
+
+/*
+ * files_test.go
+ * Tests for files.go
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"io/fs"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/magisterquis/postfile"
+)
+
+func TestStoredFileName(t *testing.T) {
+	t.Chdir(t.TempDir())
+	protectFiles(t.TempDir(), "tls_000000.pem")
+	for _, c := range []struct {
+		name string
+		want bool
+	}{
+		{"127.0.0.1:1234_foo_000000", true},
+		{"127.0.0.1:1234_foo_000012.txt", true},
+		{"127.0.0.1:1234_foo_000000.log.3.gz", true},
+		{"[::1]:1234_a_b_c_000000", true},
+		{"", false},
+		{".", false},
+		{"..", false},
+		{"key.pem", false},
+		{"cert.pem", false},
+		{"postfile.toml", false},
+		{"foo_000000/../key.pem", false},
+		{"../127.0.0.1:1234_foo_000000", false},
+		{"a/127.0.0.1:1234_foo_000000", false},
+		{`a\127.0.0.1:1234_foo_000000`, false},
+		{".meta", false},
+		{".127.0.0.1:1234_foo_000000", false},
+		{"127.0.0.1:1234_foo_00000", false},
+		{"tls_000000.pem", false},
+		{"127.0.0.1:1234_foo_000000.d/etc/passwd", true},
+		{"127.0.0.1:1234_foo_000000.tar.d/.bashrc", true},
+		{"127.0.0.1:1234_foo_000000.d/../key.pem", false},
+		{"127.0.0.1:1234_foo_000000.d//x", false},
+		{"foo.d/bar", false},
+		{"a/127.0.0.1:1234_foo_000000.d/x", false},
+		{".chunks/127.0.0.1:1234_foo_000000.d/x", false},
+	} {
+		if got := storedFileName(c.name); got != c.want {
+			t.Errorf(
+				"storedFileName(%q): got %v, want %v",
+				c.name,
+				got,
+				c.want,
+			)
+		}
+	}
+}
+
+func TestHandleDownloadKeypair(t *testing.T) {
+	t.Chdir(t.TempDir())
+	for _, n := range []string{"key.pem", "cert.pem"} {
+		if err := os.WriteFile(n, []byte("secret"), 0600); nil != err {
+			t.Fatalf("Writing %s: %v", n, err)
+		}
+		r := httptest.NewRequest(http.MethodGet, "/"+n, nil)
+		w := httptest.NewRecorder()
+		handleDownload(w, r, newReqLog(r))
+		if http.StatusBadRequest != w.Code {
+			t.Errorf(
+				"Download of %s: got status %d, want %d",
+				n,
+				w.Code,
+				http.StatusBadRequest,
+			)
+		}
+	}
+}
+
+func TestListFiles(t *testing.T) {
+	t.Chdir(t.TempDir())
+	want := "127.0.0.1:1234_foo_000000"
+	for _, n := range []string{want, "key.pem", "cert.pem", ".hidden"} {
+		if err := os.WriteFile(n, []byte("x"), 0600); nil != err {
+			t.Fatalf("Writing %s: %v", n, err)
+		}
+	}
+	fs, err := listFiles()
+	if nil != err {
+		t.Fatalf("Error: %v", err)
+	}
+	if 1 != len(fs) || want != fs[0].Name {
+		t.Fatalf("Got %v, want just %s", fs, want)
+	}
+	if "127.0.0.1:1234" != fs[0].Source || "/foo" != fs[0].Path {
+		t.Errorf(
+			"Got source %q and path %q, want 127.0.0.1:1234 and /foo",
+			fs[0].Source,
+			fs[0].Path,
+		)
+	}
+}
+
+func TestWalkUploads(t *testing.T) {
+	t.Chdir(t.TempDir())
+	want := []string{
+		"127.0.0.1:1234_foo_000000",
+		"127.0.0.1:1234_foo_000000.d/inner",
+		"127.0.0.1:1234_foo_000000.d/.git/config",
+		".quarantine/127.0.0.1:1234_bar_000000",
+	}
+	for _, n := range append([]string{
+		"key.pem",
+		".chunks/127.0.0.1:1234_foo_000000",
+		".meta/127.0.0.1:1234_foo_000000.json",
+		"foo.d/inner",
+	}, want...) {
+		if err := os.MkdirAll(filepath.Dir(n), 0700); nil != err {
+			t.Fatalf("Making directory for %s: %v", n, err)
+		}
+		if err := os.WriteFile(n, []byte("x"), 0600); nil != err {
+			t.Fatalf("Writing %s: %v", n, err)
+		}
+	}
+	got := make(map[string]bool)
+	if err := walkUploads(func(
+		path string,
+		d fs.DirEntry,
+		err error,
+	) error {
+		if nil != err {
+			t.Errorf("Error walking %s: %v", path, err)
+		}
+		got[filepath.ToSlash(path)] = true
+		return nil
+	}); nil != err {
+		t.Fatalf("Error: %v", err)
+	}
+	gs := slices.Sorted(maps.Keys(got))
+	slices.Sort(want)
+	if !slices.Equal(gs, want) {
+		t.Errorf("Got %q, want %q", gs, want)
+	}
+
+	/* Removing the last unpacked file should remove its directories. */
+	for _, n := range []string{
+		"127.0.0.1:1234_foo_000000.d/inner",
+		"127.0.0.1:1234_foo_000000.d/.git/config",
+	} {
+		if err := removeUpload(n); nil != err {
+			t.Fatalf("Error removing %s: %v", n, err)
+		}
+	}
+	if _, err := os.Stat("127.0.0.1:1234_foo_000000.d"); nil == err {
+		t.Errorf("Unpack directory not removed")
+	}
+	if _, err := os.Stat("127.0.0.1:1234_foo_000000"); nil != err {
+		t.Errorf("Upload removed: %v", err)
+	}
+}
+
+func TestGuessOrigin(t *testing.T) {
+	t.Chdir(t.TempDir())
+	defer func(np postfile.NamePolicy) { namePolicy = np }(namePolicy)
+	for _, c := range []struct {
+		policy postfile.NamePolicy
+		source string
+		path   string
+	}{
+		{postfile.NameAsIs, "127.0.0.1:1234", "/foo"},
+		{postfile.NameAsIs, "[::1]:1234", "/foo_bar"},
+		{postfile.NamePercent, "127.0.0.1:1234", "/foo"},
+		{postfile.NamePercent, "[::1]:1234", "/foo%3A"},
+		{postfile.NameTruncate, "127.0.0.1:1234", "/foo"},
+		{postfile.NameTruncate, "[::1]:1234", "/foo"},
+		{postfile.NameHash, "[2001:db8::1]:443", "/foo"},
+	} {
+		namePolicy = c.policy
+		name := postfile.MakeName(c.policy.Sanitize(postfile.BaseName(
+			&Meta{Source: c.source, Path: c.path},
+		)), 0)
+		source, _ := guessOrigin(name)
+		if c.source != source {
+			t.Errorf(
+				"%s name %s: got source %q, want %q",
+				c.policy,
+				name,
+				source,
+				c.source,
+			)
+		}
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+/*
+ * fingerprint.go
+ * JA3 and JA4 TLS client fingerprints
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// TLS clients can be fingerprinted from their ClientHellos, which are
+// captured by GetConfigForClient.  The fingerprints are kept, keyed by the
+// connection under the TLS layer, until the connection closes, so they can
+// be put in uploads' metadata.
+
+var (
+	// logFingerprints, if set, logs each TLS client's fingerprints.
+	logFingerprints bool
+
+	// metaFingerprints, if set, records TLS clients' fingerprints in
+	// their uploads' metadata.
+	metaFingerprints bool
+
+	// fingerprints holds the fingerprints for each connection, if
+	// metaFingerprints is set.
+	fingerprints sync.Map /* net.Conn -> clientFingerprint */
+)
+
+/* clientFingerprint holds a TLS client's fingerprints. */
+type clientFingerprint struct {
+	JA3 string
+	JA4 string
+}
+
+/* fpConnKey is the context key for a request's connection. */
+type fpConnKey struct{}
+
+// fingerprintHello fingerprints the client from its ClientHello.  It's meant
+// to be a tls.Config's GetConfigForClient and always returns nil, nil.
+func fingerprintHello(chi *tls.ClientHelloInfo) (*tls.Config, error) {
+	fp := clientFingerprint{JA3: ja3(chi), JA4: ja4(chi)}
+	if logFingerprints {
+		log.Printf(
+			"[%s] TLS client fingerprints: JA3 %s, JA4 %s",
+			chi.Conn.RemoteAddr(),
+			fp.JA3,
+			fp.JA4,
+		)
+	}
+	if metaFingerprints {
+		fingerprints.Store(chi.Conn, fp)
+	}
+	return nil, nil
+}
+
+// fingerprintContext saves the connection under c's TLS layer in ctx, for
+// requestFingerprint.  It's meant to be an http.Server's ConnContext.
+func fingerprintContext(ctx context.Context, c net.Conn) context.Context {
+	tc, ok := c.(*tls.Conn)
+	if !ok {
+		return ctx
+	}
+	return context.WithValue(ctx, fpConnKey{}, tc.NetConn())
+}
+
+// forgetFingerprint removes c's fingerprints when it's done with.  It's
+// meant to be called from an http.Server's ConnState.
+func forgetFingerprint(c net.Conn, s http.ConnState) {
+	if http.StateClosed != s && http.StateHijacked != s {
+		return
+	}
+	if tc, ok := c.(*tls.Conn); ok {
+		fingerprints.Delete(tc.NetConn())
+	}
+}
+
+// requestFingerprint returns the JA3 and JA4 fingerprints of the client which
+// sent r, if metaFingerprints is set and r came in over TLS.
+func requestFingerprint(r *http.Request) (string, string) {
+	if !metaFingerprints {
+		return "", ""
+	}
+	v, ok := fingerprints.Load(r.Context().Value(fpConnKey{}))
+	if !ok {
+		return "", ""
+	}
+	fp := v.(clientFingerprint)
+	return fp.JA3, fp.JA4
+}
+
+/* isGREASE returns true if v is a GREASE value, per RFC 8701. */
+func isGREASE(v uint16) bool {
+	return 0x0a0a == v&0x0f0f && v>>8 == v&0xff
+}
+
+/* withoutGREASE returns vs without GREASE values. */
+func withoutGREASE(vs []uint16) []uint16 {
+	return slices.DeleteFunc(slices.Clone(vs), isGREASE)
+}
+
+/* curveIDs turns cs into plain uint16s. */
+func curveIDs(cs []tls.CurveID) []uint16 {
+	vs := make([]uint16, len(cs))
+	for i, c := range cs {
+		vs[i] = uint16(c)
+	}
+	return vs
+}
+
+/* signatureIDs turns ss into plain uint16s. */
+func signatureIDs(ss []tls.SignatureScheme) []uint16 {
+	vs := make([]uint16, len(ss))
+	for i, s := range ss {
+		vs[i] = uint16(s)
+	}
+	return vs
+}
+
+// ja3 returns chi's JA3 fingerprint.  The ClientHello's legacy version isn't
+// available, but it's the highest version the client supports, capped at
+// TLS 1.2.
+func ja3(chi *tls.ClientHelloInfo) string {
+	var vers uint16
+	for _, v := range withoutGREASE(chi.SupportedVersions) {
+		vers = max(vers, min(v, tls.VersionTLS12))
+	}
+	join := func(vs []uint16) string {
+		ss := make([]string, len(vs))
+		for i, v := range vs {
+			ss[i] = strconv.Itoa(int(v))
+		}
+		return strings.Join(ss, "-")
+	}
+	ps := make([]uint16, len(chi.SupportedPoints))
+	for i, p := range chi.SupportedPoints {
+		ps[i] = uint16(p)
+	}
+	sum := md5.Sum([]byte(fmt.Sprintf(
+		"%d,%s,%s,%s,%s",
+		vers,
+		join(withoutGREASE(chi.CipherSuites)),
+		join(withoutGREASE(chi.Extensions)),
+		join(withoutGREASE(curveIDs(chi.SupportedCurves))),
+		join(ps),
+	)))
+	return hex.EncodeToString(sum[:])
+}
+
+/* ja4 returns chi's JA4 fingerprint. */
+func ja4(chi *tls.ClientHelloInfo) string {
+	/* Highest version */
+	var vers uint16
+	for _, v := range withoutGREASE(chi.SupportedVersions) {
+		vers = max(vers, v)
+	}
+	vs := "00"
+	switch vers {
+	case tls.VersionTLS13:
+		vs = "13"
+	case tls.VersionTLS12:
+		vs = "12"
+	case tls.VersionTLS11:
+		vs = "11"
+	case tls.VersionTLS10:
+		vs = "10"
+	case tls.VersionSSL30:
+		vs = "s3"
+	}
+
+	/* SNI and first ALPN protocol */
+	sni := "i"
+	if "" != chi.ServerName {
+		sni = "d"
+	}
+	alpn := "00"
+	if 0 != len(chi.SupportedProtos) && "" != chi.SupportedProtos[0] {
+		p := chi.SupportedProtos[0]
+		f, l := p[0], p[len(p)-1]
+		if isAlnum(f) && isAlnum(l) {
+			alpn = string([]byte{f, l})
+		} else {
+			h := hex.EncodeToString([]byte{f, l})
+			alpn = h[:1] + h[3:]
+		}
+	}
+
+	/* Sorted ciphers and extensions, less SNI and ALPN */
+	cs := withoutGREASE(chi.CipherSuites)
+	es := withoutGREASE(chi.Extensions)
+	nes := len(es)
+	es = slices.DeleteFunc(es, func(e uint16) bool {
+		return 0x0000 == e || 0x0010 == e
+	})
+	slices.Sort(cs)
+	slices.Sort(es)
+	ext := hexList(es)
+	ss := withoutGREASE(signatureIDs(chi.SignatureSchemes))
+	if 0 != len(ss) {
+		ext += "_" + hexList(ss)
+	}
+
+	return fmt.Sprintf(
+		"t%s%s%02d%02d%s_%s_%s",
+		vs,
+		sni,
+		min(len(cs), 99),
+		min(nes, 99),
+		alpn,
+		ja4Hash(hexList(cs), 0 == len(cs)),
+		ja4Hash(ext, 0 == len(es)),
+	)
+}
+
+/* hexList joins vs as four-digit hex numbers with commas. */
+func hexList(vs []uint16) string {
+	ss := make([]string, len(vs))
+	for i, v := range vs {
+		ss[i] = fmt.Sprintf("%04x", v)
+	}
+	return strings.Join(ss, ",")
+}
+
+// ja4Hash returns the first 12 hex digits of s's SHA256 hash, or 12 zeros if
+// empty is true.
+func ja4Hash(s string, empty bool) string {
+	if empty {
+		return "000000000000"
+	}
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+/* isAlnum returns true if b is an ASCII letter or digit. */
+func isAlnum(b byte) bool {
+	return ('0' <= b && '9' >= b) || ('a' <= b && 'z' >= b) ||
+		('A' <= b && 'Z' >= b)
+}
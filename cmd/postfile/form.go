@@ -0,0 +1,173 @@
+package main
+
+/*
+ * form.go
+ * HTML upload form for browsers
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"html/template"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"time"
+
+	"github.com/magisterquis/postfile"
+)
+
+/* formParam marks a POST as coming from the upload form */
+const formParam = "form"
+
+/* serveForm is true if we serve the upload form */
+var serveForm bool
+
+/* formTemplate is the upload form and the page after an upload */
+var formTemplate = template.Must(template.New("form").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>postfile</title>
+<style>body { font-family: sans-serif; margin: 1em; }</style>
+</head>
+<body>
+<h1>Upload files</h1>
+{{with .Stored}}<p>Uploaded:</p>
+<ul>{{range .}}<li>{{.}}</li>{{end}}</ul>{{end}}
+{{with .Error}}<p>Error: {{.}}</p>{{end}}
+<form method="POST" action="/?` + formParam + `" enctype="multipart/form-data">
+<input type="file" name="file" multiple>
+<input type="submit" value="Upload">
+</form>
+</body>
+</html>
+`))
+
+/* isFormRequest returns true if r is for the upload form. */
+func isFormRequest(r *http.Request) bool {
+	return serveForm && "/" == r.URL.Path &&
+		(http.MethodGet == r.Method || http.MethodHead == r.Method)
+}
+
+/* isFormUpload returns true if r is an upload from the form. */
+func isFormUpload(r *http.Request) bool {
+	return serveForm && r.URL.Query().Has(formParam)
+}
+
+// handleForm sends the client the upload form.  If we need a token, the
+// browser is asked for one as a basic auth password, which it'll send with
+// the upload.
+func handleForm(w http.ResponseWriter, r *http.Request, rl reqLog) {
+	if !authorized(r) {
+		rl.Printf("Unauthorized form request")
+		w.Header().Set("WWW-Authenticate", `Basic realm="postfile"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	sendForm(w, http.StatusOK, nil, "")
+}
+
+// handleFormUpload stores the files uploaded with the form, using each
+// file's name as its path.
+func handleFormUpload(w http.ResponseWriter, r *http.Request, rl reqLog) {
+	mr, err := r.MultipartReader()
+	if nil != err {
+		rl.Printf("Invalid form upload: %v", err)
+		sendForm(w, http.StatusBadRequest, nil, "Invalid upload")
+		return
+	}
+	var stored []string
+	for {
+		p, err := mr.NextPart()
+		if io.EOF == err {
+			break
+		} else if nil != err {
+			rl.Printf("Error reading form upload: %v", err)
+			sendForm(w, http.StatusBadRequest, stored, "Upload failed")
+			return
+		}
+		if "" == p.FileName() {
+			continue
+		}
+		body, err := checkContentType(p.Header.Get("Content-Type"), p)
+		if nil != err {
+			rl.Printf("Refused %q: %v", p.FileName(), err)
+			sendForm(
+				w,
+				http.StatusUnsupportedMediaType,
+				stored,
+				"Unsupported file type",
+			)
+			return
+		}
+		m := &Meta{
+			Source: r.RemoteAddr,
+			Path:   path.Join("/", p.FileName()),
+			Host:   r.Host,
+			Time:   time.Now(),
+			Token:  tokenName(r),
+		}
+		m.JA3, m.JA4 = requestFingerprint(r)
+		m.TLS = postfile.NewTLSInfo(r.TLS)
+		u, err := store.Open(m)
+		if nil != err {
+			noteFailure()
+			rl.With(0, "", err).Printf(
+				"Unable to open storage: %v",
+				err,
+			)
+			sendForm(
+				w,
+				http.StatusInternalServerError,
+				stored,
+				"Upload failed",
+			)
+			return
+		}
+		n, err := copyBody(u, body)
+		if nil == err {
+			err = u.Commit()
+		} else {
+			u.Abort()
+		}
+		if nil != err {
+			noteFailure()
+			rl.With(n, u.Name(), err).Printf(
+				"Error after writing %v bytes from form to %q: %v",
+				n,
+				u.Name(),
+				err,
+			)
+			sendForm(
+				w,
+				http.StatusInternalServerError,
+				stored,
+				"Upload failed",
+			)
+			return
+		}
+		rl.With(n, u.Name(), nil).Printf(
+			"Wrote %v bytes from form to %q",
+			n,
+			u.Name(),
+		)
+		noteUpload(m, u.Name(), n)
+		stored = append(stored, p.FileName())
+	}
+	sendForm(w, http.StatusOK, stored, "")
+}
+
+/* sendForm sends the form, with a list of stored files and an error. */
+func sendForm(w http.ResponseWriter, code int, stored []string, msg string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(code)
+	if err := formTemplate.Execute(w, map[string]any{
+		"Stored": stored,
+		"Error":  msg,
+	}); nil != err {
+		log.Printf("Error sending upload form: %v", err)
+	}
+}
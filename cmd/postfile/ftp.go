@@ -0,0 +1,468 @@
+package main
+
+/*
+ * ftp.go
+ * Receive files via FTP
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Files sent with STOR (or APPE) are stored with the file's path, relative
+// to the client's working directory, as the path, same as if the file were
+// POSTed to that path.  Nothing's ever listed or retrieved.  If we have
+// tokens, the password must be one, after AUTH TLS if we have a
+// certificate.  Data connections are checked to come from the client.
+const (
+	ftpMaxLine     = 4096
+	ftpTimeout     = 5 * time.Minute
+	ftpDataTimeout = time.Minute /* To make a data connection */
+)
+
+/* ftpServer accepts files over FTP. */
+type ftpServer struct {
+	conf *tls.Config /* For AUTH TLS, or nil */
+}
+
+// listenFTP accepts FTP connections on addr.  If conf isn't nil, clients
+// may AUTH TLS.
+func listenFTP(addr string, conf *tls.Config) (net.Listener, error) {
+	s := &ftpServer{conf: conf}
+	l, err := net.Listen("tcp", addr)
+	if nil != err {
+		return nil, err
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if nil != err {
+				log.Fatalf(
+					"Error accepting FTP connections: %v",
+					err,
+				)
+			}
+			go s.handle(pcapConn("ftp", limitConn(c)))
+		}
+	}()
+	return l, nil
+}
+
+/* ftpSession is a client's FTP session. */
+type ftpSession struct {
+	s      *ftpServer
+	c      net.Conn
+	br     *bufio.Reader
+	src    string
+	tls    bool
+	prot   bool /* Data connections use TLS */
+	user   bool /* USER given */
+	authed bool
+	token  string /* Token name, once logged in */
+	cwd    string
+	pasv   net.Listener /* Passive data listener */
+	port   string       /* Active data address */
+}
+
+/* handle speaks FTP with the client on c. */
+func (s *ftpServer) handle(c net.Conn) {
+	fs := &ftpSession{
+		s:   s,
+		c:   c,
+		br:  bufio.NewReaderSize(c, ftpMaxLine),
+		src: c.RemoteAddr().String(),
+		cwd: "/",
+	}
+	defer func() {
+		fs.c.Close()
+		fs.closeData()
+	}()
+
+	/* Only take files when we would over HTTP */
+	if shuttingDown.Load() || expired() || maintenanceFeature.Enabled() {
+		fs.reply(421, "Service not available")
+		return
+	}
+	fs.reply(220, "postfile FTP")
+
+	for {
+		fs.c.SetReadDeadline(time.Now().Add(ftpTimeout))
+		line, err := fs.br.ReadSlice('\n')
+		if errors.Is(err, bufio.ErrBufferFull) {
+			fs.reply(500, "Line too long")
+			return
+		} else if nil != err {
+			return
+		}
+		verb, arg, _ := strings.Cut(
+			strings.TrimRight(string(line), "\r\n"),
+			" ",
+		)
+		verb = strings.ToUpper(verb)
+
+		/* Most things need a login */
+		switch verb {
+		case "USER", "PASS", "AUTH", "PBSZ", "PROT", "FEAT", "SYST",
+			"OPTS", "NOOP", "QUIT":
+		default:
+			if !fs.authed {
+				fs.reply(530, "Not logged in")
+				continue
+			}
+		}
+
+		switch verb {
+		case "USER":
+			fs.login(arg, false)
+		case "PASS":
+			fs.login(arg, true)
+		case "AUTH":
+			if !fs.startTLS(arg) {
+				return
+			}
+		case "PBSZ":
+			fs.reply(200, "PBSZ=0")
+		case "PROT":
+			switch strings.ToUpper(arg) {
+			case "C":
+				fs.prot = false
+				fs.reply(200, "Data connections in the clear")
+			case "P":
+				if !fs.tls {
+					fs.reply(503, "Need AUTH TLS first")
+					continue
+				}
+				fs.prot = true
+				fs.reply(200, "Data connections use TLS")
+			default:
+				fs.reply(504, "Unsupported protection level")
+			}
+		case "FEAT":
+			feats := []string{"EPSV", "EPRT", "UTF8"}
+			if nil != s.conf {
+				feats = append(feats, "AUTH TLS", "PBSZ", "PROT")
+			}
+			fs.c.SetWriteDeadline(time.Now().Add(ftpTimeout))
+			fmt.Fprintf(
+				fs.c,
+				"211-Features:\r\n %s\r\n211 End\r\n",
+				strings.Join(feats, "\r\n "),
+			)
+		case "SYST":
+			fs.reply(215, "UNIX Type: L8")
+		case "OPTS", "TYPE", "MODE", "STRU":
+			fs.reply(200, "OK")
+		case "NOOP":
+			fs.reply(200, "OK")
+		case "QUIT":
+			fs.reply(221, "Bye")
+			return
+		case "PWD", "XPWD":
+			fs.reply(257, strconv.Quote(fs.cwd))
+		case "CWD", "XCWD":
+			fs.cwd = fs.abs(arg)
+			fs.reply(250, "OK")
+		case "CDUP", "XCUP":
+			fs.cwd = path.Dir(fs.cwd)
+			fs.reply(250, "OK")
+		case "MKD", "XMKD":
+			/* Directories are implied by paths */
+			fs.reply(257, strconv.Quote(fs.abs(arg))+" created")
+		case "PASV", "EPSV":
+			fs.passive("EPSV" == verb)
+		case "PORT", "EPRT":
+			fs.active("EPRT" == verb, arg)
+		case "LIST", "NLST":
+			fs.list()
+		case "STOR", "APPE":
+			fs.stor(arg)
+		case "ALLO":
+			fs.reply(202, "No need")
+		case "ABOR":
+			fs.reply(226, "Nothing to abort")
+		default:
+			fs.reply(502, "Command not implemented")
+		}
+	}
+}
+
+/* reply sends a one-line reply. */
+func (fs *ftpSession) reply(code int, msg string) {
+	fs.c.SetWriteDeadline(time.Now().Add(ftpTimeout))
+	fmt.Fprintf(fs.c, "%d %s\r\n", code, msg)
+}
+
+/* abs returns the absolute path for p. */
+func (fs *ftpSession) abs(p string) string {
+	if path.IsAbs(p) {
+		return path.Clean(p)
+	}
+	return path.Join(fs.cwd, p)
+}
+
+// login handles USER and PASS.  The username's ignored.  If we have tokens
+// the password must be one.
+func (fs *ftpSession) login(arg string, pass bool) {
+	switch {
+	case 0 != len(tokens) && nil != fs.s.conf && !fs.tls:
+		fs.reply(530, "Need AUTH TLS first")
+		return
+	case !pass:
+		fs.user = true
+		fs.authed, fs.token = false, ""
+		fs.reply(331, "Password required")
+		return
+	case !fs.user:
+		fs.reply(503, "Need USER first")
+		return
+	}
+	if 0 != len(tokens) {
+		if fs.token = lookupToken(arg); "" == fs.token {
+			log.Printf("[%s] FTP login failed", fs.src)
+			fs.reply(530, "Login incorrect")
+			return
+		}
+	}
+	fs.authed = true
+	fs.reply(230, "Logged in")
+}
+
+// startTLS handles AUTH TLS.  It returns false if the connection should be
+// closed.
+func (fs *ftpSession) startTLS(arg string) bool {
+	switch {
+	case nil == fs.s.conf:
+		fs.reply(502, "Command not implemented")
+		return true
+	case fs.tls:
+		fs.reply(503, "Already using TLS")
+		return true
+	case "TLS" != strings.ToUpper(arg) && "SSL" != strings.ToUpper(arg):
+		fs.reply(504, "Unsupported security mechanism")
+		return true
+	}
+	fs.reply(234, "Ready to start TLS")
+	tc := tls.Server(fs.c, fs.s.conf)
+	tc.SetDeadline(time.Now().Add(ftpTimeout))
+	if err := tc.Handshake(); nil != err {
+		log.Printf("[%s] FTP TLS handshake failed: %v", fs.src, err)
+		return false
+	}
+	fs.c = tc
+	fs.br = bufio.NewReaderSize(tc, ftpMaxLine)
+	fs.tls = true
+	fs.user, fs.authed, fs.token = false, false, ""
+	return true
+}
+
+/* closeData forgets about any data connection setup. */
+func (fs *ftpSession) closeData() {
+	if nil != fs.pasv {
+		fs.pasv.Close()
+		fs.pasv = nil
+	}
+	fs.port = ""
+}
+
+/* passive handles PASV and EPSV. */
+func (fs *ftpSession) passive(extended bool) {
+	fs.closeData()
+	la := fs.c.LocalAddr().(*net.TCPAddr)
+	if !extended && nil == la.IP.To4() {
+		fs.reply(522, "Use EPSV")
+		return
+	}
+	l, err := net.Listen("tcp", net.JoinHostPort(la.IP.String(), "0"))
+	if nil != err {
+		log.Printf("[%s] Unable to listen for FTP data: %v", fs.src, err)
+		fs.reply(425, "Can't open data connection")
+		return
+	}
+	fs.pasv = l
+	port := l.Addr().(*net.TCPAddr).Port
+	if extended {
+		fs.reply(229, fmt.Sprintf(
+			"Entering Extended Passive Mode (|||%d|)",
+			port,
+		))
+		return
+	}
+	ip := la.IP.To4()
+	fs.reply(227, fmt.Sprintf(
+		"Entering Passive Mode (%d,%d,%d,%d,%d,%d)",
+		ip[0], ip[1], ip[2], ip[3],
+		port>>8, port&0xFF,
+	))
+}
+
+// active handles PORT and EPRT.  Only the client's own address is allowed,
+// to keep us from being used to connect elsewhere.
+func (fs *ftpSession) active(extended bool, arg string) {
+	fs.closeData()
+	var (
+		ip   net.IP
+		port int
+		err  error
+	)
+	if extended {
+		/* |proto|address|port| */
+		ps := strings.Split(arg, arg[:min(1, len(arg))])
+		if 5 != len(ps) {
+			fs.reply(501, "Invalid EPRT")
+			return
+		}
+		ip = net.ParseIP(ps[2])
+		port, err = strconv.Atoi(ps[3])
+	} else {
+		/* h1,h2,h3,h4,p1,p2 */
+		ps := strings.Split(arg, ",")
+		if 6 != len(ps) {
+			fs.reply(501, "Invalid PORT")
+			return
+		}
+		ip = net.ParseIP(strings.Join(ps[:4], "."))
+		var p1, p2 int
+		if p1, err = strconv.Atoi(ps[4]); nil == err {
+			p2, err = strconv.Atoi(ps[5])
+		}
+		port = p1<<8 | p2
+	}
+	if nil != err || nil == ip || 0 >= port || 65535 < port {
+		fs.reply(501, "Invalid address")
+		return
+	}
+	if !ip.Equal(fs.c.RemoteAddr().(*net.TCPAddr).IP) {
+		fs.reply(504, "Data connections only to the client")
+		return
+	}
+	fs.port = net.JoinHostPort(ip.String(), strconv.Itoa(port))
+	fs.reply(200, "OK")
+}
+
+// openData makes the data connection set up by PASV, EPSV, PORT, or EPRT,
+// wrapped in TLS if the client asked for PROT P.
+func (fs *ftpSession) openData() (net.Conn, error) {
+	defer fs.closeData()
+	var (
+		c   net.Conn
+		err error
+	)
+	switch {
+	case nil != fs.pasv:
+		fs.pasv.(*net.TCPListener).SetDeadline(
+			time.Now().Add(ftpDataTimeout),
+		)
+		if c, err = fs.pasv.Accept(); nil != err {
+			return nil, err
+		}
+		ra := c.RemoteAddr().(*net.TCPAddr).IP
+		if !ra.Equal(fs.c.RemoteAddr().(*net.TCPAddr).IP) {
+			c.Close()
+			return nil, fmt.Errorf("data connection from %v", ra)
+		}
+	case "" != fs.port:
+		if c, err = net.DialTimeout(
+			"tcp",
+			fs.port,
+			ftpDataTimeout,
+		); nil != err {
+			return nil, err
+		}
+	default:
+		return nil, errors.New("no PASV, EPSV, PORT, or EPRT")
+	}
+	c = pcapConn("ftp", limitConn(c))
+	if !fs.prot {
+		return c, nil
+	}
+	tc := tls.Server(c, fs.s.conf)
+	tc.SetDeadline(time.Now().Add(ftpDataTimeout))
+	if err := tc.Handshake(); nil != err {
+		c.Close()
+		return nil, fmt.Errorf("TLS handshake: %w", err)
+	}
+	tc.SetDeadline(time.Time{})
+	return tc, nil
+}
+
+/* list sends an empty listing; we don't show what's been uploaded. */
+func (fs *ftpSession) list() {
+	fs.reply(150, "Here's nothing")
+	c, err := fs.openData()
+	if nil != err {
+		fs.reply(425, "Can't open data connection")
+		return
+	}
+	c.Close()
+	fs.reply(226, "Done")
+}
+
+/* stor handles STOR and APPE. */
+func (fs *ftpSession) stor(name string) {
+	if "" == name {
+		fs.reply(501, "Need a filename")
+		return
+	}
+	inFlight.Add(1)
+	defer inFlight.Done()
+	m := &Meta{
+		Source: fs.src,
+		Path:   fs.abs(name),
+		Time:   time.Now(),
+		Token:  fs.token,
+	}
+	u, err := store.Open(m)
+	if nil != err {
+		noteFailure()
+		log.Printf("[%s] Unable to open storage: %v", fs.src, err)
+		fs.reply(451, "Unable to store file")
+		fs.closeData()
+		return
+	}
+	fs.reply(150, "Send it")
+	c, err := fs.openData()
+	if nil != err {
+		u.Abort()
+		log.Printf(
+			"[%s] Unable to open FTP data connection: %v",
+			fs.src,
+			err,
+		)
+		fs.reply(425, "Can't open data connection")
+		return
+	}
+	defer c.Close()
+	n, err := copyBody(u, &connDeadlineReader{c: c})
+	if nil == err {
+		err = u.Commit()
+	} else {
+		u.Abort()
+	}
+	if nil != err {
+		noteFailure()
+		log.Printf(
+			"[%s] Error after writing %v bytes to %q: %v",
+			fs.src,
+			n,
+			u.Name(),
+			err,
+		)
+		fs.reply(451, "Unable to store file")
+		return
+	}
+	log.Printf("[%s] Wrote %v bytes from FTP to %q", fs.src, n, u.Name())
+	noteUpload(m, u.Name(), n)
+	fs.reply(226, "Stored as "+u.Name())
+}
@@ -0,0 +1,200 @@
+package main
+
+/*
+ * ftp_test.go
+ * Tests for ftp.go
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/magisterquis/postfile"
+)
+
+// newTestFTPSession starts an FTP session on a loopback connection and
+// returns the client's side of it.
+func newTestFTPSession(t *testing.T, s *ftpServer) *textproto.Conn {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatalf("Listen: %s", err)
+	}
+	defer l.Close()
+	cc, err := net.Dial("tcp", l.Addr().String())
+	if nil != err {
+		t.Fatalf("Dial: %s", err)
+	}
+	sc, err := l.Accept()
+	if nil != err {
+		t.Fatalf("Accept: %s", err)
+	}
+	go s.handle(sc)
+	tc := textproto.NewConn(cc)
+	t.Cleanup(func() { tc.Close() })
+	if _, _, err := tc.ReadResponse(220); nil != err {
+		t.Fatalf("Greeting: %s", err)
+	}
+	return tc
+}
+
+/* testFTPCmd sends a command and checks the reply's code. */
+func testFTPCmd(
+	t *testing.T,
+	tc *textproto.Conn,
+	want int,
+	format string,
+	args ...any,
+) string {
+	t.Helper()
+	if _, err := tc.Cmd(format, args...); nil != err {
+		t.Fatalf("Sending %q: %s", fmt.Sprintf(format, args...), err)
+	}
+	_, msg, err := tc.ReadResponse(want)
+	if nil != err {
+		t.Errorf("%q: %s", fmt.Sprintf(format, args...), err)
+	}
+	return msg
+}
+
+func TestFTPSessionAbs(t *testing.T) {
+	for _, c := range []struct {
+		cwd  string
+		p    string
+		want string
+	}{
+		{cwd: "/", p: "foo", want: "/foo"},
+		{cwd: "/a/b", p: "foo", want: "/a/b/foo"},
+		{cwd: "/a/b", p: "../foo", want: "/a/foo"},
+		{cwd: "/a", p: "../../../foo", want: "/foo"},
+		{cwd: "/a", p: "/../../foo", want: "/foo"},
+		{cwd: "/a", p: "/b/./c/", want: "/b/c"},
+	} {
+		t.Run(c.cwd+"+"+c.p, func(t *testing.T) {
+			fs := &ftpSession{cwd: c.cwd}
+			if got := fs.abs(c.p); got != c.want {
+				t.Errorf("Got %q, want %q", got, c.want)
+			}
+		})
+	}
+}
+
+func TestFTPSessionLogin(t *testing.T) {
+	defer func(ts map[string]string) { tokens = ts }(tokens)
+	tokens = map[string]string{"secret": "alice"}
+	tc := newTestFTPSession(t, &ftpServer{})
+
+	testFTPCmd(t, tc, 530, "STOR foo")
+	testFTPCmd(t, tc, 503, "PASS secret")
+	testFTPCmd(t, tc, 331, "USER anonymous")
+	testFTPCmd(t, tc, 530, "PASS wrong")
+	testFTPCmd(t, tc, 530, "CWD foo")
+	testFTPCmd(t, tc, 230, "PASS secret")
+	testFTPCmd(t, tc, 250, "CWD foo")
+
+	/* Lines have a limit */
+	testFTPCmd(t, tc, 500, "NOOP %s", strings.Repeat("x", ftpMaxLine))
+}
+
+func TestFTPSessionActive(t *testing.T) {
+	tc := newTestFTPSession(t, &ftpServer{})
+	testFTPCmd(t, tc, 331, "USER anonymous")
+	testFTPCmd(t, tc, 230, "PASS x")
+	for _, c := range []struct {
+		cmd  string
+		want int
+	}{
+		{cmd: "PORT 127,0,0,1,4,1", want: 200},
+		{cmd: "EPRT |1|127.0.0.1|1025|", want: 200},
+		{cmd: "PORT 10,0,0,1,4,1", want: 504},
+		{cmd: "EPRT |1|10.0.0.1|1025|", want: 504},
+		{cmd: "EPRT |2|::1|1025|", want: 504},
+		{cmd: "PORT 127,0,0,1,0,0", want: 501},
+		{cmd: "PORT 127,0,0,1,256,0", want: 501},
+		{cmd: "PORT 127,0,0,1", want: 501},
+		{cmd: "EPRT |1|127.0.0.1|65536|", want: 501},
+		{cmd: "EPRT |1|127.0.0.1|", want: 501},
+		{cmd: "EPRT", want: 501},
+	} {
+		t.Run(c.cmd, func(t *testing.T) {
+			testFTPCmd(t, tc, c.want, "%s", c.cmd)
+		})
+	}
+}
+
+func TestFTPSessionStor(t *testing.T) {
+	/* Uploads go in a directory inside another directory */
+	parent := t.TempDir()
+	t.Chdir(parent)
+	if err := os.Mkdir("uploads", 0700); nil != err {
+		t.Fatalf("Making upload directory: %s", err)
+	}
+	t.Chdir("uploads")
+	defer func(s Storage) { store = s }(store)
+	store = postfile.LocalStorage{}
+
+	tc := newTestFTPSession(t, &ftpServer{})
+	testFTPCmd(t, tc, 331, "USER anonymous")
+	testFTPCmd(t, tc, 230, "PASS x")
+	testFTPCmd(t, tc, 250, "CWD ../../sub")
+	if got := testFTPCmd(t, tc, 257, "PWD"); `"/sub"` != got {
+		t.Errorf("PWD got %s", got)
+	}
+	testFTPCmd(t, tc, 150, "STOR early")
+	if _, _, err := tc.ReadResponse(425); nil != err {
+		t.Errorf("STOR without a data connection: %s", err)
+	}
+
+	/* Send a file which tries to escape */
+	var port int
+	msg := testFTPCmd(t, tc, 229, "EPSV")
+	if _, err := fmt.Sscanf(
+		msg,
+		"Entering Extended Passive Mode (|||%d|)",
+		&port,
+	); nil != err {
+		t.Fatalf("Parsing EPSV reply %q: %s", msg, err)
+	}
+	testFTPCmd(t, tc, 150, "STOR ../../../escaped")
+	dc, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if nil != err {
+		t.Fatalf("Dialing data connection: %s", err)
+	}
+	const contents = "kittens"
+	io.WriteString(dc, contents)
+	dc.Close()
+	_, msg, err = tc.ReadResponse(226)
+	if nil != err {
+		t.Fatalf("Finishing upload: %s", err)
+	}
+	name, ok := strings.CutPrefix(msg, "Stored as ")
+	if !ok {
+		t.Fatalf("Unexpected reply %q", msg)
+	}
+
+	/* The file should be in the upload directory and nowhere else */
+	ms, err := filepath.Glob(filepath.Join(parent, "*"))
+	if nil != err {
+		t.Fatalf("Globbing parent directory: %s", err)
+	}
+	if 1 != len(ms) || "uploads" != filepath.Base(ms[0]) {
+		t.Errorf("Unexpected files in parent directory: %q", ms)
+	}
+	if !strings.Contains(name, "escaped") ||
+		filepath.Base(name) != name {
+		t.Errorf("Unexpected name %q", name)
+	}
+	if b, err := os.ReadFile(name); nil != err {
+		t.Errorf("Reading %s: %s", name, err)
+	} else if contents != string(b) {
+		t.Errorf("Got %q, want %q", b, contents)
+	}
+}
@@ -0,0 +1,293 @@
+package main
+
+/*
+ * gcs.go
+ * Send uploads to a Google Cloud Storage bucket
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/magisterquis/postfile"
+)
+
+// GCSCHUNKSIZE is the size of the chunks in which uploads are sent to GCS.
+// It must be a multiple of 256KiB.
+const GCSCHUNKSIZE = 8 * 1024 * 1024
+
+/* gcsScope is the OAuth scope we request */
+const gcsScope = "https://www.googleapis.com/auth/devstorage.read_write"
+
+// gcsStore sends uploads to a GCS bucket.  Credentials come from the service
+// account key file named by GOOGLE_APPLICATION_CREDENTIALS or an access token
+// in GOOGLE_OAUTH_ACCESS_TOKEN.
+type gcsStore struct {
+	bucket string
+	prefix string
+
+	/* Service account details */
+	email    string
+	key      *rsa.PrivateKey
+	tokenURI string
+
+	/* Cached access token */
+	l      sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+// newGCSStore makes a new gcsStore from a URL of the form
+// gs://bucket/prefix.
+func newGCSStore(u *url.URL) (*gcsStore, error) {
+	s := &gcsStore{
+		bucket: u.Host,
+		prefix: strings.TrimPrefix(u.Path, "/"),
+		token:  os.Getenv("GOOGLE_OAUTH_ACCESS_TOKEN"),
+	}
+	if "" == s.bucket {
+		return nil, errors.New("missing bucket")
+	}
+
+	/* A static token is the easy case */
+	if "" != s.token {
+		s.expiry = time.Now().Add(100 * 365 * 24 * time.Hour)
+		return s, nil
+	}
+
+	/* Otherwise, we'll need a service account */
+	fn := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	if "" == fn {
+		return nil, errors.New(
+			"GOOGLE_APPLICATION_CREDENTIALS or " +
+				"GOOGLE_OAUTH_ACCESS_TOKEN must be set",
+		)
+	}
+	b, err := os.ReadFile(fn)
+	if nil != err {
+		return nil, fmt.Errorf("reading credentials: %w", err)
+	}
+	var sa struct {
+		ClientEmail string `json:"client_email"`
+		PrivateKey  string `json:"private_key"`
+		TokenURI    string `json:"token_uri"`
+	}
+	if err := json.Unmarshal(b, &sa); nil != err {
+		return nil, fmt.Errorf("parsing credentials %q: %w", fn, err)
+	}
+	s.email = sa.ClientEmail
+	s.tokenURI = sa.TokenURI
+	if "" == s.tokenURI {
+		s.tokenURI = "https://oauth2.googleapis.com/token"
+	}
+	blk, _ := pem.Decode([]byte(sa.PrivateKey))
+	if nil == blk {
+		return nil, fmt.Errorf("no private key in %q", fn)
+	}
+	k, err := x509.ParsePKCS8PrivateKey(blk.Bytes)
+	if nil != err {
+		return nil, fmt.Errorf("parsing private key: %w", err)
+	}
+	var ok bool
+	if s.key, ok = k.(*rsa.PrivateKey); !ok {
+		return nil, fmt.Errorf("private key is a %T, not RSA", k)
+	}
+	return s, nil
+}
+
+// Open starts an upload to an object named after the upload.
+func (s *gcsStore) Open(m *Meta) (Upload, error) {
+	obj := s.prefix + remoteName(postfile.BaseName(m))
+	return newPipeUpload("gs://"+s.bucket+"/"+obj, func(r io.Reader) error {
+		_, err := s.upload(obj, r)
+		return err
+	}), nil
+}
+
+/* Probe checks whether the bucket is accessible. */
+func (s *gcsStore) Probe() error {
+	res, err := s.request(
+		http.MethodGet,
+		"https://storage.googleapis.com/storage/v1/b/"+
+			url.PathEscape(s.bucket),
+		nil,
+		"",
+	)
+	if nil != err {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
+
+// upload streams body to the bucket with a resumable upload, in chunks.  It
+// returns the number of bytes sent.
+func (s *gcsStore) upload(obj string, body io.Reader) (int64, error) {
+	/* Start the upload */
+	res, err := s.request(
+		http.MethodPost,
+		"https://storage.googleapis.com/upload/storage/v1/b/"+
+			url.PathEscape(s.bucket)+"/o?uploadType=resumable&name="+
+			url.QueryEscape(obj),
+		nil,
+		"",
+	)
+	if nil != err {
+		return 0, fmt.Errorf("starting upload: %w", err)
+	}
+	res.Body.Close()
+	session := res.Header.Get("Location")
+	if "" == session {
+		return 0, errors.New("no upload session URL")
+	}
+
+	/* Send the body in chunks */
+	var (
+		buf  = make([]byte, GCSCHUNKSIZE)
+		tn   int64
+		last bool
+		n    int
+	)
+	for !last {
+		if n, last, err = readPart(body, buf); nil != err {
+			return tn, err
+		}
+		/* Work out what we're sending */
+		var rng string
+		switch {
+		case 0 == n && last:
+			rng = fmt.Sprintf("bytes */%v", tn)
+		case last:
+			rng = fmt.Sprintf(
+				"bytes %v-%v/%v",
+				tn,
+				tn+int64(n)-1,
+				tn+int64(n),
+			)
+		default:
+			rng = fmt.Sprintf("bytes %v-%v/*", tn, tn+int64(n)-1)
+		}
+		res, err := s.request(http.MethodPut, session, buf[:n], rng)
+		if nil != err {
+			return tn, fmt.Errorf(
+				"sending bytes at offset %v: %w",
+				tn,
+				err,
+			)
+		}
+		res.Body.Close()
+		tn += int64(n)
+	}
+
+	return tn, nil
+}
+
+// request makes an authenticated request.  If rng isn't empty, it's sent as
+// the Content-Range.  308's count as success, as GCS uses it to say it wants
+// more chunks.
+func (s *gcsStore) request(
+	method string,
+	u string,
+	body []byte,
+	rng string,
+) (*http.Response, error) {
+	tok, err := s.accessToken()
+	if nil != err {
+		return nil, fmt.Errorf("getting access token: %w", err)
+	}
+	req, err := http.NewRequest(method, u, bytes.NewReader(body))
+	if nil != err {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+tok)
+	if "" != rng {
+		req.Header.Set("Content-Range", rng)
+	}
+	res, err := remoteClient.Do(req)
+	if nil != err {
+		return nil, err
+	}
+	if 2 != res.StatusCode/100 &&
+		http.StatusPermanentRedirect != res.StatusCode {
+		defer res.Body.Close()
+		b, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return nil, fmt.Errorf("%v (%s)", res.Status, bytes.TrimSpace(b))
+	}
+	return res, nil
+}
+
+// accessToken returns a valid access token, getting a new one from the token
+// URI if the cached one is expired.
+func (s *gcsStore) accessToken() (string, error) {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	/* If we have a good one, use it */
+	if "" != s.token && time.Now().Add(time.Minute).Before(s.expiry) {
+		return s.token, nil
+	}
+
+	/* Roll a JWT to ask for a token */
+	now := time.Now()
+	enc := base64.RawURLEncoding
+	hdr := enc.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`))
+	cb, err := json.Marshal(map[string]any{
+		"iss":   s.email,
+		"scope": gcsScope,
+		"aud":   s.tokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	if nil != err {
+		return "", err
+	}
+	unsigned := hdr + "." + enc.EncodeToString(cb)
+	h := sha256.Sum256([]byte(unsigned))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA256, h[:])
+	if nil != err {
+		return "", fmt.Errorf("signing JWT: %w", err)
+	}
+
+	/* Trade it for a token */
+	res, err := remoteClient.PostForm(s.tokenURI, url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {unsigned + "." + enc.EncodeToString(sig)},
+	})
+	if nil != err {
+		return "", err
+	}
+	defer res.Body.Close()
+	var tr struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+		Error       string `json:"error_description"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&tr); nil != err {
+		return "", fmt.Errorf("decoding %v response: %w", res.Status, err)
+	}
+	if "" == tr.AccessToken {
+		return "", fmt.Errorf("no token: %v (%v)", res.Status, tr.Error)
+	}
+	s.token = tr.AccessToken
+	s.expiry = now.Add(time.Duration(tr.ExpiresIn) * time.Second)
+	return s.token, nil
+}
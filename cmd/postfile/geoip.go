@@ -0,0 +1,140 @@
+package main
+
+/*
+ * geoip.go
+ * Where uploaders are, per GeoIP databases
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"path/filepath"
+	"strings"
+)
+
+// geoDBs are the GeoIP databases from -geoip.  Country and ASN details may
+// come from different databases.
+var geoDBs []*mmdb
+
+/* geoInfo is what the GeoIP databases know about an address. */
+type geoInfo struct {
+	Country string `json:"country,omitempty"` /* ISO 3166-1 code */
+	ASN     uint64 `json:"asn,omitempty"`
+	ASOrg   string `json:"as_org,omitempty"`
+}
+
+/* loadGeoDBs loads the GeoIP databases in the files named fns. */
+func loadGeoDBs(fns []string) error {
+	for _, fn := range fns {
+		db, err := openMMDB(fn)
+		if nil != err {
+			return fmt.Errorf("loading %v: %w", fn, err)
+		}
+		geoDBs = append(geoDBs, db)
+		log.Printf("Loaded %s GeoIP database from %v", db.dbType, fn)
+	}
+	return nil
+}
+
+// lookupGeo returns what the GeoIP databases know about the address in src,
+// which may have a port.  It returns nil if there's no databases or they
+// don't know anything.
+func lookupGeo(src string) *geoInfo {
+	if 0 == len(geoDBs) {
+		return nil
+	}
+	if h, _, err := net.SplitHostPort(src); nil == err {
+		src = h
+	}
+	addr, err := netip.ParseAddr(src)
+	if nil != err {
+		return nil
+	}
+	addr = addr.WithZone("")
+
+	var gi geoInfo
+	for _, db := range geoDBs {
+		v, err := db.lookup(addr)
+		if nil != err {
+			log.Printf(
+				"Error looking up %v in %s GeoIP database: %v",
+				addr,
+				db.dbType,
+				err,
+			)
+			continue
+		}
+		r, ok := v.(map[string]any)
+		if !ok {
+			continue
+		}
+		if "" == gi.Country {
+			gi.Country = geoCountry(r)
+		}
+		if 0 == gi.ASN {
+			gi.ASN, _ = r["autonomous_system_number"].(uint64)
+			gi.ASOrg, _ = r["autonomous_system_organization"].(string)
+		}
+	}
+	if (geoInfo{}) == gi {
+		return nil
+	}
+	return &gi
+}
+
+// geoCountry gets the country code from a country or city record, falling
+// back on the country in which the address is registered.
+func geoCountry(r map[string]any) string {
+	for _, k := range []string{"country", "registered_country"} {
+		c, _ := r[k].(map[string]any)
+		if ic, _ := c["iso_code"].(string); "" != ic {
+			return ic
+		}
+	}
+	return ""
+}
+
+/* String returns gi as space-separated fields, suitable for logging. */
+func (gi *geoInfo) String() string {
+	if nil == gi {
+		return ""
+	}
+	var fs []string
+	if "" != gi.Country {
+		fs = append(fs, gi.Country)
+	}
+	if 0 != gi.ASN {
+		fs = append(fs, fmt.Sprintf("AS%d", gi.ASN))
+	}
+	if "" != gi.ASOrg {
+		fs = append(fs, fmt.Sprintf("(%s)", gi.ASOrg))
+	}
+	return strings.Join(fs, " ")
+}
+
+// dir returns a directory name for gi: the country code and AS number, as
+// far as they're known, e.g. US/AS15169.  Unknown addresses go in unknown.
+func (gi *geoInfo) dir() string {
+	if nil == gi {
+		return "unknown"
+	}
+	var ps []string
+	if "" != gi.Country {
+		ps = append(ps, filepath.Base(gi.Country))
+	}
+	if 0 != gi.ASN {
+		ps = append(ps, fmt.Sprintf("AS%d", gi.ASN))
+	}
+	if 0 == len(ps) {
+		return "unknown"
+	}
+	return filepath.Join(ps...)
+}
+
+/* geoDir returns the GeoIP subdirectory for m, for subdirStorage. */
+func geoDir(m *Meta) string { return lookupGeo(m.Source).dir() }
@@ -0,0 +1,39 @@
+package main
+
+/*
+ * headers.go
+ * Extra response headers
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// parseHeaders parses "Name: value" strings into an http.Header.
+func parseHeaders(hs []string) (http.Header, error) {
+	h := make(http.Header)
+	for _, s := range hs {
+		k, v, ok := strings.Cut(s, ":")
+		if !ok || "" == strings.TrimSpace(k) {
+			return nil, fmt.Errorf("invalid header %q", s)
+		}
+		h.Add(strings.TrimSpace(k), strings.TrimSpace(v))
+	}
+	return h, nil
+}
+
+// withHeaders returns a handler which adds h to every response and then
+// calls next.
+func withHeaders(h http.Header, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for k, vs := range h {
+			w.Header()[k] = append([]string(nil), vs...)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
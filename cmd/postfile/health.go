@@ -0,0 +1,62 @@
+package main
+
+/*
+ * health.go
+ * Health check endpoint
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"net/http"
+	"os"
+	"time"
+)
+
+var (
+	/* healthPath is the path for health checks, if we have one */
+	healthPath string
+
+	/* startTime is when we started, for uptime */
+	startTime = time.Now()
+)
+
+// isHealthCheck returns true if r is a health check.  Health checks are
+// GET or HEAD requests for healthPath.
+func isHealthCheck(r *http.Request) bool {
+	return "" != healthPath && healthPath == r.URL.Path &&
+		(http.MethodGet == r.Method || http.MethodHead == r.Method)
+}
+
+// handleHealth returns basic status.  If storage can be probed and isn't
+// healthy, a 503 is returned.
+func handleHealth(w http.ResponseWriter, r *http.Request) {
+	st := map[string]any{
+		"status":         "ok",
+		"uptime_seconds": int64(time.Since(startTime).Seconds()),
+	}
+	if localFiles {
+		if free, ok := diskFree("."); ok {
+			st["disk_free_bytes"] = free
+		}
+		if des, err := os.ReadDir("."); nil == err {
+			var n int
+			for _, de := range des {
+				if de.Type().IsRegular() {
+					n++
+				}
+			}
+			st["files_stored"] = n
+		}
+	}
+	if p, ok := store.(prober); ok {
+		if err := p.Probe(); nil != err {
+			st["status"] = "storage unhealthy"
+			st["storage_error"] = err.Error()
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}
+	adminJSON(w, st)
+}
@@ -0,0 +1,91 @@
+package main
+
+/*
+ * honeypot.go
+ * Record requests which aren't uploads
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/magisterquis/postfile"
+)
+
+const (
+	/* honeypotMaxBody is the most of a request's body we'll record */
+	honeypotMaxBody = 10 * 1024 * 1024
+	/* honeypotExt is added to the names of recorded requests */
+	honeypotExt = ".http"
+)
+
+// handleHoneypot saves r's request line, headers, and up to honeypotMaxBody
+// bytes of its body like an upload, and tells the client there's nothing
+// there.
+func handleHoneypot(w http.ResponseWriter, r *http.Request, rl reqLog) {
+	defer http.NotFound(w, r)
+
+	/* Work out what to save */
+	req, err := withRequestHead(r, io.LimitReader(r.Body, honeypotMaxBody))
+	if nil != err {
+		rl.Printf("Unable to record %s request: %v", r.Method, err)
+		return
+	}
+	m := &Meta{
+		Source: r.RemoteAddr,
+		Path:   r.URL.Path,
+		Host:   r.Host,
+		Time:   time.Now(),
+		Token:  tokenName(r),
+		Ext:    honeypotExt,
+	}
+	m.JA3, m.JA4 = requestFingerprint(r)
+	m.TLS = postfile.NewTLSInfo(r.TLS)
+
+	/* Save it */
+	u, err := store.Open(m)
+	if nil != err {
+		noteFailure()
+		rl.With(0, "", err).Printf(
+			"Unable to open storage for %s request: %v",
+			r.Method,
+			err,
+		)
+		return
+	}
+	n, err := copyBody(u, req)
+	if nil != err {
+		noteFailure()
+		rl.With(n, u.Name(), err).Printf(
+			"Error after recording %v bytes of %s request "+
+				"to %q: %v",
+			n,
+			r.Method,
+			u.Name(),
+			err,
+		)
+		u.Abort()
+		return
+	}
+	if err := u.Commit(); nil != err {
+		noteFailure()
+		rl.With(n, u.Name(), err).Printf(
+			"Error finishing %v-byte %s request record %q: %v",
+			n,
+			r.Method,
+			u.Name(),
+			err,
+		)
+		return
+	}
+	rl.With(n, u.Name(), nil).Printf(
+		"Recorded %v-byte %s request to %q",
+		n,
+		r.Method,
+		u.Name(),
+	)
+}
@@ -0,0 +1,85 @@
+package main
+
+/*
+ * http3.go
+ * Serve HTTP/3 over QUIC
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+var (
+	/* h3srv serves HTTP/3 requests, if we're doing that */
+	h3srv *http3.Server
+
+	// altSvc is the Alt-Svc header we send to tell clients about the
+	// HTTP/3 listener.
+	altSvc string
+)
+
+// listenHTTP3 listens on the UDP address addr for HTTP/3 requests, which will
+// be served with cr's keypair by the default ServeMux once serveHTTP3 is
+// called.
+func listenHTTP3(addr string, cr *certReloader) (net.PacketConn, error) {
+	pc, err := net.ListenPacket("udp", addr)
+	if nil != err {
+		return nil, err
+	}
+	port := pc.LocalAddr().(*net.UDPAddr).Port
+	h3srv = &http3.Server{
+		Port:    port,
+		Handler: http.DefaultServeMux,
+		TLSConfig: http3.ConfigureTLSConfig(&tls.Config{
+			GetCertificate: cr.GetCertificate,
+		}),
+	}
+	altSvc = fmt.Sprintf(`h3=":%d"; ma=86400`, port)
+	return pc, nil
+}
+
+/* serveHTTP3 serves HTTP/3 requests which arrive on pc. */
+func serveHTTP3(pc net.PacketConn) {
+	if err := h3srv.Serve(pc); nil != err && !shuttingDown.Load() {
+		log.Printf("Error serving HTTP/3: %v", err)
+	}
+}
+
+// shutdownHTTP3 stops the HTTP/3 server, if we have one, from taking new
+// connections and tells clients to go away.  Shutdown waits for clients to
+// disconnect, which they might never do, so in-flight requests are instead
+// waited for with the rest in inFlight.
+func shutdownHTTP3(ctx context.Context) {
+	if nil == h3srv {
+		return
+	}
+	go func() {
+		if err := h3srv.Shutdown(ctx); nil != err &&
+			!errors.Is(err, context.DeadlineExceeded) &&
+			!errors.Is(err, context.Canceled) {
+			log.Printf("Error shutting down HTTP/3: %v", err)
+		}
+	}()
+}
+
+// withAltSvc adds an Alt-Svc header advertising the HTTP/3 listener to
+// responses to requests which didn't come in over HTTP/3, then calls next.
+func withAltSvc(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if 3 != r.ProtoMajor && "" != altSvc {
+			w.Header().Set("Alt-Svc", altSvc)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
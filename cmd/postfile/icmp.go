@@ -0,0 +1,88 @@
+package main
+
+/*
+ * icmp.go
+ * Experimental receiver for files in ICMP echo requests
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"time"
+)
+
+// Files sent over ICMP are split into echo requests, each of which has a
+// payload of icmpMagic followed by a chunk of the file.  The echo request's
+// identifier identifies the file and the sequence number orders the chunks.
+// Resent chunks replace earlier ones.  An echo request with just the magic
+// ends the file, as does icmpIdle without a chunk.  Files are stored with a
+// path of /icmp/<identifier>.
+//
+// The kernel still answers the pings, so senders may use the replies as
+// acknowledgements.
+const (
+	icmpMagic      = "PFX1"
+	icmpIdle       = time.Minute
+	icmpMaxSize    = 64 << 20 /* Per file */
+	icmpMaxPending = 1024     /* Files at once */
+)
+
+// listenICMP receives files in ICMPv4 and ICMPv6 echo requests.  It returns
+// an error if neither can be listened for.
+func listenICMP() error {
+	ra := newReassembler("ICMP", icmpIdle, icmpMaxSize, icmpMaxPending)
+	var nok int
+	for _, p := range []struct {
+		network string
+		echo    byte
+	}{
+		{"ip4:icmp", 8},
+		{"ip6:ipv6-icmp", 128},
+	} {
+		pc, err := net.ListenPacket(p.network, "")
+		if nil != err {
+			log.Printf("Unable to listen for %s: %v", p.network, err)
+			continue
+		}
+		log.Printf("Receiving files via %s echo requests", p.network)
+		go receiveICMP(ra, pc, p.echo)
+		nok++
+	}
+	if 0 == nok {
+		return fmt.Errorf("no ICMP listeners")
+	}
+	return nil
+}
+
+/* receiveICMP reads echo requests from pc and passes chunks to ra. */
+func receiveICMP(ra *reassembler, pc net.PacketConn, echo byte) {
+	buf := make([]byte, 65536)
+	for {
+		n, a, err := pc.ReadFrom(buf)
+		if nil != err {
+			if !handleReadError("ICMP", err) {
+				return
+			}
+			continue
+		}
+		/* Type, code, checksum, identifier, sequence, payload */
+		if 8 > n || echo != buf[0] || 0 != buf[1] ||
+			!bytes.HasPrefix(buf[8:n], []byte(icmpMagic)) {
+			continue
+		}
+		src := a.String()
+		id := uint16(buf[4])<<8 | uint16(buf[5])
+		ra.handle(
+			fmt.Sprintf("%s/%d", src, id),
+			src,
+			fmt.Sprintf("/icmp/%d", id),
+			uint32(buf[6])<<8|uint32(buf[7]),
+			buf[8+len(icmpMagic):n],
+		)
+	}
+}
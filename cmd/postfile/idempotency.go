@@ -0,0 +1,150 @@
+package main
+
+/*
+ * idempotency.go
+ * Don't store retried uploads twice
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	/* idempotencyMaxKey is the longest key we'll remember */
+	idempotencyMaxKey = 256
+	/* idempotencyMax is the most keys we'll remember at once */
+	idempotencyMax = 100000
+)
+
+// idempotencyHeaders are the headers which may have an upload's idempotency
+// key, in order of preference.
+var idempotencyHeaders = []string{"Idempotency-Key", "X-Upload-ID"}
+
+var (
+	// idempotencyKeep is how long we remember the results of uploads with
+	// idempotency keys.  Zero means we ignore keys.
+	idempotencyKeep time.Duration
+
+	// idempotentUploads holds the results of uploads with keys, by the
+	// name of the token used for the upload and the key, so clients can
+	// only see their own results.
+	idempotentUploads  = make(map[[2]string]*idempotentUpload)
+	idempotentUploadsL sync.Mutex
+)
+
+// idempotentUpload is the result of an upload with an idempotency key.  Res
+// is nil until the upload's succeeded.
+type idempotentUpload struct {
+	res *uploadResponse
+}
+
+/* idempotencyKey is the context key for a request's *idempotentUpload. */
+type idempotencyKey struct{}
+
+/* uploadKey returns r's idempotency key, or the empty string if it has none. */
+func uploadKey(r *http.Request) string {
+	for _, h := range idempotencyHeaders {
+		if k := r.Header.Get(h); "" != k {
+			return k
+		}
+	}
+	return ""
+}
+
+// withIdempotency sends clients the original result of an upload if they
+// retry it with the same idempotency key, and a 409 if the original's still
+// in progress.  Keys of uploads which didn't succeed may be reused
+// immediately; successful uploads' keys are forgotten after
+// idempotencyKeep.
+func withIdempotency(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		k := uploadKey(r)
+		if "" == k {
+			next.ServeHTTP(w, r)
+			return
+		}
+		rl := requestLog(r)
+		if idempotencyMaxKey < len(k) {
+			rl.Printf("Idempotency key too long")
+			http.Error(w, "Key too long", http.StatusBadRequest)
+			return
+		}
+		key := [2]string{tokenName(r), k}
+
+		/* See if we've seen it before */
+		iu := new(idempotentUpload)
+		idempotentUploadsL.Lock()
+		if old, ok := idempotentUploads[key]; ok {
+			idempotentUploadsL.Unlock()
+			if nil == old.res {
+				rl.Printf("Upload with key %q in progress", k)
+				http.Error(
+					w,
+					"Upload in progress",
+					http.StatusConflict,
+				)
+				return
+			}
+			rl.Printf(
+				"Repeated upload with key %q, originally %q",
+				k,
+				old.res.File,
+			)
+			w.Header().Set("Idempotent-Replayed", "true")
+			if isWebDAVPut(r) {
+				w.WriteHeader(http.StatusCreated)
+				return
+			}
+			respondUpload(w, r, *old.res)
+			return
+		}
+		if idempotencyMax <= len(idempotentUploads) {
+			idempotentUploadsL.Unlock()
+			rl.Printf("Too many idempotency keys to track %q", k)
+			next.ServeHTTP(w, r)
+			return
+		}
+		idempotentUploads[key] = iu
+		idempotentUploadsL.Unlock()
+
+		/* Do the upload */
+		next.ServeHTTP(w, r.WithContext(context.WithValue(
+			r.Context(),
+			idempotencyKey{},
+			iu,
+		)))
+
+		/* Forget it now if it failed, or later if not */
+		idempotentUploadsL.Lock()
+		defer idempotentUploadsL.Unlock()
+		if nil == iu.res {
+			delete(idempotentUploads, key)
+			return
+		}
+		time.AfterFunc(idempotencyKeep, func() {
+			idempotentUploadsL.Lock()
+			defer idempotentUploadsL.Unlock()
+			if iu == idempotentUploads[key] {
+				delete(idempotentUploads, key)
+			}
+		})
+	})
+}
+
+// noteIdempotentResult saves the result of r's upload, if it has an
+// idempotency key.
+func noteIdempotentResult(r *http.Request, res uploadResponse) {
+	iu, ok := r.Context().Value(idempotencyKey{}).(*idempotentUpload)
+	if !ok {
+		return
+	}
+	idempotentUploadsL.Lock()
+	defer idempotentUploadsL.Unlock()
+	iu.res = &res
+}
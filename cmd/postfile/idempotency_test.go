@@ -0,0 +1,103 @@
+package main
+
+/*
+ * idempotency_test.go
+ * Tests for idempotency.go
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWithIdempotency(t *testing.T) {
+	defer func(d time.Duration) { idempotencyKeep = d }(idempotencyKeep)
+	idempotencyKeep = time.Minute
+
+	/* Uploads fail if the body says to, and are numbered if not. */
+	var n int
+	h := withIdempotency(http.HandlerFunc(func(
+		w http.ResponseWriter,
+		r *http.Request,
+	) {
+		n++
+		if "fail" == r.Header.Get("X-Test") {
+			http.Error(w, "failed", http.StatusInternalServerError)
+			return
+		}
+		res := uploadResponse{Bytes: int64(n), File: fmt.Sprint(n)}
+		noteIdempotentResult(r, res)
+		respondUpload(w, r, res)
+	}))
+
+	for _, c := range []struct {
+		name     string
+		key      string
+		fail     bool
+		want     string /* Response body */
+		replayed bool
+		calls    int /* Calls to the handler so far */
+	}{
+		{"no_key", "", false, "1\n", false, 1},
+		{"first", "foo", false, "2\n", false, 2},
+		{"replay", "foo", false, "2\n", true, 2},
+		{"other_key", "bar", false, "3\n", false, 3},
+		{"replay_again", "foo", false, "2\n", true, 3},
+		{"fail", "baz", true, "failed\n", false, 4},
+		{"after_fail", "baz", false, "5\n", false, 5},
+		{"no_key_again", "", false, "6\n", false, 6},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			r := httptest.NewRequest(
+				http.MethodPost,
+				"/",
+				strings.NewReader("x"),
+			)
+			if "" != c.key {
+				r.Header.Set("Idempotency-Key", c.key)
+			}
+			if c.fail {
+				r.Header.Set("X-Test", "fail")
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if got := w.Body.String(); got != c.want {
+				t.Errorf("Got %q, want %q", got, c.want)
+			}
+			rp := "true" == w.Header().Get("Idempotent-Replayed")
+			if rp != c.replayed {
+				t.Errorf("Replayed: got %v", rp)
+			}
+			if c.calls != n {
+				t.Errorf(
+					"Handler called %d times, want %d",
+					n,
+					c.calls,
+				)
+			}
+		})
+	}
+}
+
+func TestWithIdempotencyKeyTooLong(t *testing.T) {
+	h := withIdempotency(http.HandlerFunc(func(
+		w http.ResponseWriter,
+		r *http.Request,
+	) {
+		t.Errorf("Handler called")
+	}))
+	r := httptest.NewRequest(http.MethodPost, "/", nil)
+	r.Header.Set("X-Upload-ID", strings.Repeat("a", idempotencyMaxKey+1))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if http.StatusBadRequest != w.Code {
+		t.Errorf("Got %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+/*
+ * install.go
+ * Write a hardened systemd unit
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+/* installStateDir is where files go if -dir isn't given */
+const installStateDir = "/var/lib/postfile"
+
+// installPathFlags are the server flags which take paths, which are made
+// absolute in the unit.  Files and directories the service writes need to be
+// made writable.
+var installPathFlags = map[string]string{
+	"c":          "read",
+	"k":          "read",
+	"tokens":     "read",
+	"audit":      "file",
+	"access-log": "file",
+	"dir":        "dir",
+	"spool":      "dir",
+	"burst-dir":  "dir",
+}
+
+/* installUnit is the systemd unit template. */
+const installUnit = `# Generated by postfile install
+[Unit]
+Description=postfile upload server
+Wants=network-online.target
+After=network-online.target
+
+[Service]
+Type=notify
+NotifyAccess=main
+WatchdogSec=1min
+ExecStart=%s
+Restart=on-failure
+%s
+DynamicUser=yes
+CapabilityBoundingSet=CAP_NET_BIND_SERVICE
+AmbientCapabilities=CAP_NET_BIND_SERVICE
+NoNewPrivileges=yes
+ProtectSystem=strict
+ProtectHome=yes
+PrivateTmp=yes
+PrivateDevices=yes
+ProtectKernelTunables=yes
+ProtectKernelModules=yes
+ProtectKernelLogs=yes
+ProtectControlGroups=yes
+ProtectClock=yes
+ProtectHostname=yes
+RestrictNamespaces=yes
+RestrictRealtime=yes
+RestrictSUIDSGID=yes
+RestrictAddressFamilies=AF_INET AF_INET6 AF_UNIX
+LockPersonality=yes
+MemoryDenyWriteExecute=yes
+SystemCallArchitectures=native
+UMask=0077
+
+[Install]
+WantedBy=multi-user.target
+`
+
+// installMain is the main function for the install subcommand, which writes
+// a systemd unit which runs postfile with the server flags given after
+// install's own flags.  The server flags must already be defined.
+func installMain(args []string) {
+	fs := flag.NewFlagSet("install", flag.ExitOnError)
+	unit := fs.String(
+		"unit",
+		"/etc/systemd/system/postfile.service",
+		"Unit `file` to write, or - for stdout",
+	)
+	fs.Usage = func() {
+		fmt.Fprintf(
+			os.Stderr,
+			`Usage: %v install [options] [-- server options]
+
+Writes a hardened systemd unit which runs postfile with the given server
+options.  Relative paths are made absolute.  If -dir isn't given, files are
+stored in %v/posts.
+
+Options:
+`,
+			os.Args[0],
+			installStateDir,
+		)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if err := flag.CommandLine.Parse(fs.Args()); nil != err {
+		log.Fatalf("Invalid server options: %v", err)
+	}
+	if 0 != flag.NArg() {
+		log.Fatalf("Unexpected arguments: %q", flag.Args())
+	}
+
+	/* Work out the command line and which paths need to be writable */
+	exe, err := os.Executable()
+	if nil != err {
+		log.Fatalf("Unable to find our own path: %v", err)
+	}
+	args, rwPaths, set := serverArgs()
+	cmd := append([]string{exe}, args...)
+
+	/* Files go in the state directory if there's nowhere else */
+	extra := fmt.Sprintf(
+		"StateDirectory=%s\nStateDirectoryMode=0700",
+		filepath.Base(installStateDir),
+	)
+	if !set["dir"] && !set["storage"] && !set["pipe-only"] {
+		cmd = append(cmd, "-dir="+filepath.Join(installStateDir, "posts"))
+	}
+
+	/* Default cert and key are relative to wherever we are now */
+	if "true" != flag.Lookup("http").Value.String() {
+		for _, n := range []string{"c", "k"} {
+			if set[n] {
+				continue
+			}
+			p, err := filepath.Abs(flag.Lookup(n).DefValue)
+			if nil != err {
+				log.Fatalf("Unable to make -%v absolute: %v", n, err)
+			}
+			cmd = append(cmd, "-"+n+"="+p)
+		}
+	}
+	if 0 != len(rwPaths) {
+		ps := make([]string, 0, len(rwPaths))
+		for p := range rwPaths {
+			ps = append(ps, systemdQuote(p))
+		}
+		sort.Strings(ps)
+		extra += "\nReadWritePaths=" + strings.Join(ps, " ")
+	}
+	for i, c := range cmd {
+		cmd[i] = systemdQuote(c)
+	}
+	u := fmt.Sprintf(installUnit, strings.Join(cmd, " "), extra)
+
+	/* Write it out */
+	if "-" == *unit {
+		fmt.Print(u)
+		return
+	}
+	if err := os.WriteFile(*unit, []byte(u), 0644); nil != err {
+		log.Fatalf("Unable to write unit to %v: %v", *unit, err)
+	}
+	log.Printf("Wrote unit to %v", *unit)
+	if 0 != len(rwPaths) {
+		log.Printf(
+			"Make sure the ReadWritePaths exist and are writable " +
+				"by the service's dynamic user",
+		)
+	}
+	log.Printf(
+		"Start it with systemctl daemon-reload && "+
+			"systemctl enable --now %v",
+		filepath.Base(*unit),
+	)
+}
+
+// serverArgs returns the server flags set on the command line as
+// -name=value arguments, with paths made absolute, as well as the
+// directories the server needs to write to and the names of the flags which
+// were set.
+func serverArgs() (args []string, rwPaths, set map[string]bool) {
+	rwPaths = make(map[string]bool)
+	set = make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+		v := f.Value.String()
+		if kind, ok := installPathFlags[f.Name]; ok && "" != v {
+			var err error
+			if v, err = filepath.Abs(v); nil != err {
+				log.Fatalf(
+					"Unable to make -%v absolute: %v",
+					f.Name,
+					err,
+				)
+			}
+			switch kind {
+			case "file":
+				rwPaths[filepath.Dir(v)] = true
+			case "dir":
+				rwPaths[v] = true
+			}
+		}
+		if "admin" == f.Name && strings.Contains(v, "/") {
+			rwPaths[filepath.Dir(v)] = true
+		}
+		if m, ok := f.Value.(*multiFlag); ok {
+			for _, mv := range *m {
+				args = append(args, "-"+f.Name+"="+mv)
+			}
+			return
+		}
+		args = append(args, "-"+f.Name+"="+v)
+	})
+	return args, rwPaths, set
+}
+
+// systemdQuote quotes s for use in a unit file, if it needs it.  Specifiers
+// and variables are escaped, too.
+func systemdQuote(s string) string {
+	s = strings.NewReplacer("%", "%%", "$", "$$").Replace(s)
+	if "" != s && !strings.ContainsAny(s, " \t\"'\\;") {
+		return s
+	}
+	return `"` + strings.NewReplacer(
+		`\`, `\\`,
+		`"`, `\"`,
+		"\t", `\t`,
+	).Replace(s) + `"`
+}
@@ -0,0 +1,116 @@
+package main
+
+/*
+ * list.go
+ * JSON listing of stored files
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const (
+	/* listDefaultLimit is how many files we list if not asked for more */
+	listDefaultLimit = 100
+	/* listMaxLimit is the most files we list at once */
+	listMaxLimit = 1000
+)
+
+/* listPath is where clients get a listing of stored files */
+var listPath string
+
+/* isListRequest returns true if r is for the file listing. */
+func isListRequest(r *http.Request) bool {
+	return "" != listPath && listPath == r.URL.Path
+}
+
+// handleList sends the client a JSON array of stored files, newest first.
+// The prefix parameter filters by name, and limit and offset page through
+// the list.  The total number of matching files is in X-Total-Count and the
+// next page, if there is one, is in a Link header.
+func handleList(w http.ResponseWriter, r *http.Request, rl reqLog) {
+	if http.MethodGet != r.Method && http.MethodHead != r.Method {
+		http.Error(w, "Invalid method", http.StatusMethodNotAllowed)
+		return
+	}
+	if !authorized(r) {
+		rl.Printf("Unauthorized listing")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	/* Work out which files to send */
+	q := r.URL.Query()
+	limit, err := listParam(q, "limit", listDefaultLimit)
+	if nil != err {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if 0 == limit || listMaxLimit < limit {
+		limit = listMaxLimit
+	}
+	offset, err := listParam(q, "offset", 0)
+	if nil != err {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	fs, err := listFiles()
+	if nil != err {
+		rl.Printf("Error listing files: %v", err)
+		http.Error(w, "Unable to list files", http.StatusInternalServerError)
+		return
+	}
+	if p := q.Get("prefix"); "" != p {
+		ms := fs[:0]
+		for _, f := range fs {
+			if strings.HasPrefix(f.Name, p) {
+				ms = append(ms, f)
+			}
+		}
+		fs = ms
+	}
+	total := len(fs)
+	if offset > len(fs) {
+		offset = len(fs)
+	}
+	fs = fs[offset:]
+	if limit < len(fs) {
+		fs = fs[:limit]
+		q.Set("offset", strconv.Itoa(offset+limit))
+		q.Set("limit", strconv.Itoa(limit))
+		w.Header().Set("Link", fmt.Sprintf(
+			`<%s?%s>; rel="next"`,
+			r.URL.Path,
+			q.Encode(),
+		))
+	}
+	rl.Printf("Listed %d of %d files", len(fs), total)
+
+	/* Send it back */
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+	if err := json.NewEncoder(w).Encode(fs); nil != err {
+		rl.Printf("Error sending listing: %v", err)
+	}
+}
+
+/* listParam gets a non-negative integer parameter from q. */
+func listParam(q url.Values, name string, def int) (int, error) {
+	v := q.Get(name)
+	if "" == v {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if nil != err || 0 > n {
+		return 0, fmt.Errorf("invalid %s %q", name, v)
+	}
+	return n, nil
+}
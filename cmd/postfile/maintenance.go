@@ -0,0 +1,133 @@
+package main
+
+/*
+ * maintenance.go
+ * Maintenance mode
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+/* maintenanceFile is where we note clients seen during maintenance */
+var maintenanceFile = filepath.Join(metaDir, "maintenance-clients.jsonl")
+
+var (
+	/* maintenanceRetry is the Retry-After sent during maintenance */
+	maintenanceRetry = 5 * time.Minute
+
+	/* maintenanceL serializes access to maintenanceFile */
+	maintenanceL sync.Mutex
+)
+
+func init() {
+	adminMux.HandleFunc("/maintenance", adminMaintenance)
+}
+
+/* maintenanceClient is a client which tried to upload during maintenance. */
+type maintenanceClient struct {
+	Time      time.Time `json:"time"`
+	Source    string    `json:"source"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	Host      string    `json:"host,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	Token     string    `json:"token,omitempty"`
+}
+
+// handleMaintenance tells the client to come back later and notes that it
+// tried.
+func handleMaintenance(w http.ResponseWriter, r *http.Request, rl reqLog) {
+	if err := noteMaintenanceClient(r); nil != err {
+		log.Printf("Error noting client during maintenance: %v", err)
+	}
+	rl.Printf("In maintenance")
+	w.Header().Set(
+		"Retry-After",
+		fmt.Sprintf("%d", int(maintenanceRetry.Seconds())),
+	)
+	http.Error(w, "Down for maintenance", http.StatusServiceUnavailable)
+}
+
+/* noteMaintenanceClient appends r's details to maintenanceFile. */
+func noteMaintenanceClient(r *http.Request) error {
+	b, err := json.Marshal(maintenanceClient{
+		Time:      time.Now(),
+		Source:    r.RemoteAddr,
+		Method:    r.Method,
+		Path:      r.URL.Path,
+		Host:      r.Host,
+		UserAgent: r.UserAgent(),
+		Token:     tokenName(r),
+	})
+	if nil != err {
+		return err
+	}
+	maintenanceL.Lock()
+	defer maintenanceL.Unlock()
+	if err := os.MkdirAll(metaDir, 0700); nil != err {
+		return err
+	}
+	f, err := os.OpenFile(
+		maintenanceFile,
+		os.O_WRONLY|os.O_APPEND|os.O_CREATE,
+		0600,
+	)
+	if nil != err {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(append(b, '\n'))
+	return err
+}
+
+// adminMaintenance returns whether we're in maintenance mode and the clients
+// seen during maintenance on GET, and forgets the clients on DELETE.
+func adminMaintenance(w http.ResponseWriter, r *http.Request) {
+	maintenanceL.Lock()
+	defer maintenanceL.Unlock()
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodDelete:
+		if err := os.Remove(maintenanceFile); nil != err &&
+			!os.IsNotExist(err) {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Printf(
+			"Admin API: %v cleared clients seen during maintenance",
+			r.RemoteAddr,
+		)
+	default:
+		http.Error(w, "Invalid method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	/* Read the clients we've seen */
+	cs := make([]maintenanceClient, 0)
+	if f, err := os.Open(maintenanceFile); nil == err {
+		defer f.Close()
+		s := bufio.NewScanner(f)
+		for s.Scan() {
+			var c maintenanceClient
+			if err := json.Unmarshal(s.Bytes(), &c); nil == err {
+				cs = append(cs, c)
+			}
+		}
+	}
+	adminJSON(w, map[string]any{
+		"enabled": maintenanceFeature.Enabled(),
+		"clients": cs,
+	})
+}
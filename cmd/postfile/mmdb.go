@@ -0,0 +1,323 @@
+package main
+
+/*
+ * mmdb.go
+ * Read MaxMind DB files
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net/netip"
+	"os"
+)
+
+// The MaxMind DB format is documented at
+// https://maxmind.github.io/MaxMind-DB/.  A file is a binary search tree on
+// address bits, a data section, and a metadata section.  We read the whole
+// thing into memory and decode records as needed.
+
+/* mmdbMetaMarker precedes the metadata section. */
+var mmdbMetaMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+// errMMDBCorrupt is returned when something in the file doesn't make
+// sense.
+var errMMDBCorrupt = errors.New("corrupt database")
+
+/* mmdb is a MaxMind DB file. */
+type mmdb struct {
+	tree       []byte /* Search tree */
+	data       []byte /* Data section */
+	nodeCount  uint32
+	recordSize uint32
+	ipv4Start  uint32 /* Node for ::/96, in IPv6 trees */
+	ipv6       bool
+	dbType     string
+}
+
+/* openMMDB reads the database in the file named fn. */
+func openMMDB(fn string) (*mmdb, error) {
+	b, err := os.ReadFile(fn)
+	if nil != err {
+		return nil, err
+	}
+
+	/* Metadata's at the end */
+	mi := bytes.LastIndex(b, mmdbMetaMarker)
+	if -1 == mi {
+		return nil, errors.New("metadata not found")
+	}
+	v, _, err := mmdbDecode(b[mi+len(mmdbMetaMarker):], 0)
+	if nil != err {
+		return nil, fmt.Errorf("decoding metadata: %w", err)
+	}
+	md, ok := v.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("metadata is a %T, not a map", v)
+	}
+	nc, _ := md["node_count"].(uint64)
+	rs, _ := md["record_size"].(uint64)
+	iv, _ := md["ip_version"].(uint64)
+	db := &mmdb{
+		nodeCount:  uint32(nc),
+		recordSize: uint32(rs),
+		ipv6:       6 == iv,
+	}
+	db.dbType, _ = md["database_type"].(string)
+	switch rs {
+	case 24, 28, 32:
+	default:
+		return nil, fmt.Errorf("unsupported record size %d", rs)
+	}
+	if 4 != iv && 6 != iv {
+		return nil, fmt.Errorf("unsupported IP version %d", iv)
+	}
+
+	/* Tree, then 16 zeros, then data */
+	ts := uint64(nc) * rs / 4
+	if math.MaxUint32 < nc || uint64(mi) < ts+16 {
+		return nil, errMMDBCorrupt
+	}
+	db.tree = b[:ts]
+	db.data = b[ts+16 : mi]
+
+	/* IPv4 addresses in an IPv6 tree live under ::/96 */
+	if db.ipv6 {
+		for i := 0; i < 96 && db.ipv4Start < db.nodeCount; i++ {
+			if db.ipv4Start, err = db.node(db.ipv4Start, 0); nil != err {
+				return nil, err
+			}
+		}
+	}
+
+	return db, nil
+}
+
+// lookup returns the record for addr, or nil if there isn't one.
+func (db *mmdb) lookup(addr netip.Addr) (any, error) {
+	addr = addr.Unmap()
+	var (
+		n    uint32
+		bits []byte
+	)
+	switch {
+	case addr.Is4() && db.ipv6:
+		n = db.ipv4Start
+		a := addr.As4()
+		bits = a[:]
+	case addr.Is4():
+		a := addr.As4()
+		bits = a[:]
+	case db.ipv6:
+		a := addr.As16()
+		bits = a[:]
+	default: /* IPv6 address, IPv4 database */
+		return nil, nil
+	}
+
+	/* Walk the tree */
+	var err error
+	for i := 0; i < 8*len(bits) && n < db.nodeCount; i++ {
+		bit := (bits[i/8] >> (7 - i%8)) & 1
+		if n, err = db.node(n, bit); nil != err {
+			return nil, err
+		}
+	}
+	switch {
+	case n == db.nodeCount: /* Not found */
+		return nil, nil
+	case n < db.nodeCount: /* Ran out of bits */
+		return nil, errMMDBCorrupt
+	}
+	v, _, err := mmdbDecode(db.data, uint64(n-db.nodeCount-16))
+	return v, err
+}
+
+/* node returns the left (bit 0) or right (bit 1) record of node n. */
+func (db *mmdb) node(n uint32, bit byte) (uint32, error) {
+	off := uint64(n) * uint64(db.recordSize) / 4
+	if uint64(len(db.tree)) < off+uint64(db.recordSize)/4 {
+		return 0, errMMDBCorrupt
+	}
+	b := db.tree[off:]
+	switch db.recordSize {
+	case 24:
+		b = b[3*bit:]
+		return uint32(b[0])<<16 | uint32(b[1])<<8 | uint32(b[2]), nil
+	case 28:
+		if 0 == bit {
+			return uint32(b[3]&0xf0)<<20 | uint32(b[0])<<16 |
+				uint32(b[1])<<8 | uint32(b[2]), nil
+		}
+		return uint32(b[3]&0x0f)<<24 | uint32(b[4])<<16 |
+			uint32(b[5])<<8 | uint32(b[6]), nil
+	default:
+		return binary.BigEndian.Uint32(b[4*uint32(bit):]), nil
+	}
+}
+
+// mmdbMaxDepth is how deeply nested values can be, which keeps pointer loops
+// from recursing forever.
+const mmdbMaxDepth = 32
+
+// mmdbDecode decodes the value at off in the data section d, and returns it
+// and the offset of the next value.  Maps are map[string]any, arrays are
+// []any, unsigned integers are uint64, and signed integers are int64.
+// 128-bit integers are returned as bytes.
+func mmdbDecode(d []byte, off uint64) (any, uint64, error) {
+	return mmdbDecodeDepth(d, off, 0)
+}
+
+/* mmdbDecodeDepth is mmdbDecode, for a value nested depth deep. */
+func mmdbDecodeDepth(d []byte, off uint64, depth int) (any, uint64, error) {
+	if mmdbMaxDepth < depth {
+		return nil, 0, errMMDBCorrupt
+	}
+	next := func(n uint64) ([]byte, error) {
+		if uint64(len(d)) < off+n {
+			return nil, errMMDBCorrupt
+		}
+		b := d[off : off+n]
+		off += n
+		return b, nil
+	}
+	toUint := func(b []byte) uint64 {
+		var u uint64
+		for _, c := range b {
+			u = u<<8 | uint64(c)
+		}
+		return u
+	}
+
+	/* Control byte, with an extended type maybe */
+	b, err := next(1)
+	if nil != err {
+		return nil, 0, err
+	}
+	ctrl := b[0]
+	typ := ctrl >> 5
+	if 0 == typ {
+		if b, err = next(1); nil != err {
+			return nil, 0, err
+		}
+		typ = 7 + b[0]
+	}
+
+	/* Pointers are special */
+	if 1 == typ {
+		ss := uint64(ctrl>>3) & 3
+		if b, err = next(ss + 1); nil != err {
+			return nil, 0, err
+		}
+		p := toUint(b)
+		switch ss {
+		case 0:
+			p |= uint64(ctrl&7) << 8
+		case 1:
+			p = (p | uint64(ctrl&7)<<16) + 2048
+		case 2:
+			p = (p | uint64(ctrl&7)<<24) + 526336
+		}
+		v, _, err := mmdbDecodeDepth(d, p, depth+1)
+		return v, off, err
+	}
+
+	/* Everything else has a size */
+	size := uint64(ctrl & 0x1f)
+	if 14 != typ && 29 <= size { /* Booleans' sizes are their values */
+		if b, err = next(size - 28); nil != err {
+			return nil, 0, err
+		}
+		size = []uint64{29, 285, 65821}[size-29] + toUint(b)
+	}
+
+	switch typ {
+	case 2: /* UTF-8 string */
+		b, err := next(size)
+		return string(b), off, err
+	case 3: /* Double */
+		if 8 != size {
+			return nil, 0, errMMDBCorrupt
+		}
+		b, err := next(size)
+		if nil != err {
+			return nil, 0, err
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), off, nil
+	case 4, 10: /* Bytes, uint128 */
+		b, err := next(size)
+		return bytes.Clone(b), off, err
+	case 5, 6, 9: /* uint16, uint32, uint64 */
+		if 8 < size {
+			return nil, 0, errMMDBCorrupt
+		}
+		b, err := next(size)
+		return toUint(b), off, err
+	case 8: /* int32 */
+		if 4 < size {
+			return nil, 0, errMMDBCorrupt
+		}
+		b, err := next(size)
+		return int64(int32(uint32(toUint(b)))), off, err
+	case 7: /* Map */
+		m := make(map[string]any, min(size, 64))
+		for range size {
+			var k, v any
+			if k, off, err = mmdbDecodeDepth(
+				d,
+				off,
+				depth+1,
+			); nil != err {
+				return nil, 0, err
+			}
+			ks, ok := k.(string)
+			if !ok {
+				return nil, 0, errMMDBCorrupt
+			}
+			if v, off, err = mmdbDecodeDepth(
+				d,
+				off,
+				depth+1,
+			); nil != err {
+				return nil, 0, err
+			}
+			m[ks] = v
+		}
+		return m, off, nil
+	case 11: /* Array */
+		a := make([]any, 0, min(size, 64))
+		for range size {
+			var v any
+			if v, off, err = mmdbDecodeDepth(
+				d,
+				off,
+				depth+1,
+			); nil != err {
+				return nil, 0, err
+			}
+			a = append(a, v)
+		}
+		return a, off, nil
+	case 14: /* Boolean */
+		return 0 != size, off, nil
+	case 15: /* Float */
+		if 4 != size {
+			return nil, 0, errMMDBCorrupt
+		}
+		b, err := next(size)
+		if nil != err {
+			return nil, 0, err
+		}
+		return float64(math.Float32frombits(
+			binary.BigEndian.Uint32(b),
+		)), off, nil
+	default: /* Data cache container, end marker, or unknown */
+		return nil, 0, fmt.Errorf("unexpected data type %d", typ)
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+/*
+ * mmdb_test.go
+ * Tests for mmdb.go
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net/netip"
+	"os"
+	"reflect"
+	"testing"
+)
+
+/* testMMDBString encodes a short string. */
+func testMMDBString(s string) []byte {
+	return append([]byte{2<<5 | byte(len(s))}, s...)
+}
+
+/* testMMDBUint32 encodes a uint32. */
+func testMMDBUint32(u uint32) []byte {
+	return binary.BigEndian.AppendUint32([]byte{6<<5 | 4}, u)
+}
+
+/* testMMDBMap encodes a map from pairs of encoded keys and values. */
+func testMMDBMap(kvs ...[]byte) []byte {
+	return append([]byte{7<<5 | byte(len(kvs)/2)}, bytes.Join(kvs, nil)...)
+}
+
+// testMMDBFile writes a database with one 24-bit node, whose left record is
+// empty and whose right record points to data, and returns its name.
+func testMMDBFile(t *testing.T, ipVersion uint32, data []byte) string {
+	const nodeCount = 1
+	var b []byte
+	b = append(b, 0, 0, nodeCount)    /* Left: not found */
+	b = append(b, 0, 0, nodeCount+16) /* Right: data at 0 */
+	b = append(b, make([]byte, 16)...)
+	b = append(b, data...)
+	b = append(b, mmdbMetaMarker...)
+	b = append(b, testMMDBMap(
+		testMMDBString("node_count"), testMMDBUint32(nodeCount),
+		testMMDBString("record_size"), testMMDBUint32(24),
+		testMMDBString("ip_version"), testMMDBUint32(ipVersion),
+		testMMDBString("database_type"), testMMDBString("Test"),
+	)...)
+	fn := "test.mmdb"
+	if err := os.WriteFile(fn, b, 0600); nil != err {
+		t.Fatalf("Writing %s: %s", fn, err)
+	}
+	return fn
+}
+
+func TestMMDBDecode(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		in   []byte
+		want any
+		err  bool
+	}{{
+		name: "string",
+		in:   []byte{0x42, 'h', 'i'},
+		want: "hi",
+	}, {
+		name: "long_string",
+		in: append(
+			[]byte{0x5d, 0x01},
+			bytes.Repeat([]byte("x"), 30)...,
+		),
+		want: string(bytes.Repeat([]byte("x"), 30)),
+	}, {
+		name: "uint16",
+		in:   []byte{0xa2, 0x01, 0x00},
+		want: uint64(256),
+	}, {
+		name: "uint64",
+		in:   []byte{0x01, 0x02, 0x07},
+		want: uint64(7),
+	}, {
+		name: "int32",
+		in:   []byte{0x04, 0x01, 0xff, 0xff, 0xff, 0xff},
+		want: int64(-1),
+	}, {
+		name: "bool",
+		in:   []byte{0x01, 0x07},
+		want: true,
+	}, {
+		name: "double",
+		in:   []byte{0x68, 0x3f, 0xf8, 0, 0, 0, 0, 0, 0},
+		want: 1.5,
+	}, {
+		name: "map",
+		in:   []byte{0xe1, 0x41, 'a', 0xa1, 0x05},
+		want: map[string]any{"a": uint64(5)},
+	}, {
+		name: "array",
+		in:   []byte{0x02, 0x04, 0x41, 'a', 0x41, 'b'},
+		want: []any{"a", "b"},
+	}, {
+		name: "pointer",
+		in:   []byte{0x20, 0x02, 0x41, 'p'},
+		want: "p",
+	}, {
+		name: "pointer_loop",
+		in:   []byte{0x20, 0x00},
+		err:  true,
+	}, {
+		name: "pointer_out_of_range",
+		in:   []byte{0x27, 0xff},
+		err:  true,
+	}, {
+		name: "short_string",
+		in:   []byte{0x43, 'h', 'i'},
+		err:  true,
+	}, {
+		name: "short_size",
+		in:   []byte{0x5e, 0x01},
+		err:  true,
+	}, {
+		name: "huge_uint",
+		in: []byte{
+			0x09, 0x02,
+			1, 2, 3, 4, 5, 6, 7, 8, 9,
+		},
+		err: true,
+	}, {
+		name: "non_string_key",
+		in:   []byte{0xe1, 0xa1, 0x05, 0xa1, 0x05},
+		err:  true,
+	}, {
+		name: "huge_map",
+		in:   []byte{0xff, 0xff, 0xff, 0xff},
+		err:  true,
+	}, {
+		name: "bad_double",
+		in:   []byte{0x64, 0, 0, 0, 0},
+		err:  true,
+	}, {
+		name: "data_cache",
+		in:   []byte{0x00, 0x05},
+		err:  true,
+	}, {
+		name: "empty",
+		err:  true,
+	}} {
+		t.Run(c.name, func(t *testing.T) {
+			got, _, err := mmdbDecode(c.in, 0)
+			if c.err {
+				if nil == err {
+					t.Errorf("Expected error, got %v", got)
+				}
+				return
+			}
+			if nil != err {
+				t.Fatalf("Error: %s", err)
+			}
+			if !reflect.DeepEqual(got, c.want) {
+				t.Errorf("Got %#v, want %#v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestMMDBLookup(t *testing.T) {
+	t.Chdir(t.TempDir())
+	rec := map[string]any{"country": "XX"}
+	data := testMMDBMap(testMMDBString("country"), testMMDBString("XX"))
+	for _, c := range []struct {
+		name      string
+		ipVersion uint32
+		addr      string
+		want      any
+	}{
+		{name: "v4_found", ipVersion: 4, addr: "200.0.0.1", want: rec},
+		{name: "v4_missing", ipVersion: 4, addr: "10.0.0.1"},
+		{name: "v4_mapped", ipVersion: 4, addr: "::ffff:200.0.0.1",
+			want: rec},
+		{name: "v4_with_v6", ipVersion: 4, addr: "8000::1"},
+		{name: "v6_found", ipVersion: 6, addr: "8000::1", want: rec},
+		{name: "v6_missing", ipVersion: 6, addr: "::1"},
+		{name: "v6_with_v4", ipVersion: 6, addr: "200.0.0.1"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			db, err := openMMDB(testMMDBFile(t, c.ipVersion, data))
+			if nil != err {
+				t.Fatalf("Opening database: %s", err)
+			}
+			if "Test" != db.dbType {
+				t.Errorf("Database type %q", db.dbType)
+			}
+			got, err := db.lookup(netip.MustParseAddr(c.addr))
+			if nil != err {
+				t.Fatalf("Lookup error: %s", err)
+			}
+			if !reflect.DeepEqual(got, c.want) {
+				t.Errorf("Got %#v, want %#v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestOpenMMDBCorrupt(t *testing.T) {
+	t.Chdir(t.TempDir())
+	fn := testMMDBFile(t, 4, nil)
+	good, err := os.ReadFile(fn)
+	if nil != err {
+		t.Fatalf("Reading %s: %s", fn, err)
+	}
+	mi := bytes.LastIndex(good, mmdbMetaMarker)
+	for _, c := range []struct {
+		name string
+		b    []byte
+	}{{
+		name: "no_metadata",
+		b:    good[:mi],
+	}, {
+		name: "bad_metadata",
+		b:    append(bytes.Clone(good[:mi+len(mmdbMetaMarker)]), 0xff),
+	}, {
+		name: "short_tree",
+		b:    good[6:],
+	}, {
+		name: "bad_record_size",
+		b: bytes.Replace(
+			bytes.Clone(good),
+			testMMDBUint32(24),
+			testMMDBUint32(20),
+			1,
+		),
+	}, {
+		name: "bad_ip_version",
+		b: bytes.Replace(
+			bytes.Clone(good),
+			testMMDBUint32(4), /* Only the IP version is 4 */
+			testMMDBUint32(5),
+			1,
+		),
+	}} {
+		t.Run(c.name, func(t *testing.T) {
+			if err := os.WriteFile(fn, c.b, 0600); nil != err {
+				t.Fatalf("Writing %s: %s", fn, err)
+			}
+			if _, err := openMMDB(fn); nil == err {
+				t.Errorf("Opened corrupt database")
+			}
+		})
+	}
+
+	/* A record pointing past the data should fail the lookup */
+	b := bytes.Clone(good)
+	b[5] = 0xff
+	if err := os.WriteFile(fn, b, 0600); nil != err {
+		t.Fatalf("Writing %s: %s", fn, err)
+	}
+	db, err := openMMDB(fn)
+	if nil != err {
+		t.Fatalf("Opening database: %s", err)
+	}
+	if _, err := db.lookup(
+		netip.MustParseAddr("200.0.0.1"),
+	); !errors.Is(err, errMMDBCorrupt) {
+		t.Errorf("Lookup past data got error %v", err)
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+/*
+ * notify.go
+ * Tell things about uploads
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"log"
+	"time"
+)
+
+const (
+	/* previewMax is the most of an upload we put in notifications */
+	previewMax = 200
+	/* notifyTries is how many times we try to send a notification */
+	notifyTries = 6
+	/* notifyBackoff is how long we wait after the first failure */
+	notifyBackoff = time.Second
+	/* notifyMaxBackoff is the longest we wait between tries */
+	notifyMaxBackoff = time.Minute
+)
+
+/* uploadEvent describes a finished upload. */
+type uploadEvent struct {
+	Source string    `json:"source"`
+	Path   string    `json:"path"`
+	Host   string    `json:"host,omitempty"`
+	Time   time.Time `json:"time"`
+	Token  string    `json:"token,omitempty"`
+	JA3    string    `json:"ja3,omitempty"`
+	JA4    string    `json:"ja4,omitempty"`
+	TLS    *TLSInfo  `json:"tls,omitempty"`
+	Geo    *geoInfo  `json:"geo,omitempty"`
+	PTR    string    `json:"ptr,omitempty"`
+	Name   string    `json:"name"`
+	Size   int64     `json:"size"`
+	SHA256 string    `json:"sha256,omitempty"`
+	Type   string    `json:"type,omitempty"` /* Content type */
+	YARA   []string  `json:"yara,omitempty"` /* Matching rules */
+
+	/* Start of the upload, if previewsFeature is on */
+	Preview string `json:"preview,omitempty"`
+}
+
+/* notifier is something which can be told about an upload. */
+type notifier interface {
+	Notify(e uploadEvent) error
+	String() string
+}
+
+// notifyStorage wraps a Storage and tells its notifiers about every
+// successful upload.
+type notifyStorage struct {
+	Storage
+	notifiers []notifier
+}
+
+/* Open opens an upload which will be hashed. */
+func (s notifyStorage) Open(m *Meta) (Upload, error) {
+	u, err := s.Storage.Open(m)
+	if nil != err {
+		return nil, err
+	}
+	nu := &notifyUpload{Upload: u, s: s, m: m, h: sha256.New()}
+	if previewsFeature.Enabled() {
+		nu.preview = make([]byte, 0, previewMax)
+	}
+	return nu, nil
+}
+
+// notifyUpload is an upload which is hashed and counted.  If preview isn't
+// nil, the start of the upload is saved in it.
+type notifyUpload struct {
+	Upload
+	s       notifyStorage
+	m       *Meta
+	h       hash.Hash
+	n       int64
+	preview []byte
+}
+
+/* Write writes b to the upload and the hash. */
+func (u *notifyUpload) Write(b []byte) (int, error) {
+	n, err := u.Upload.Write(b)
+	u.h.Write(b[:n])
+	u.n += int64(n)
+	if nil != u.preview && previewMax > len(u.preview) {
+		u.preview = append(
+			u.preview,
+			b[:min(n, previewMax-len(u.preview))]...,
+		)
+	}
+	return n, err
+}
+
+/* Commit commits the upload and sends notifications in the background. */
+func (u *notifyUpload) Commit() error {
+	if err := u.Upload.Commit(); nil != err {
+		return err
+	}
+	e := uploadEvent{
+		Source: u.m.Source,
+		Path:   u.m.Path,
+		Host:   u.m.Host,
+		Time:   u.m.Time,
+		Token:  u.m.Token,
+		JA3:    u.m.JA3,
+		JA4:    u.m.JA4,
+		TLS:    u.m.TLS,
+		Geo:    lookupGeo(u.m.Source),
+		PTR:    lookupPTR(u.m.Source),
+		Name:   u.Name(),
+		Size:   u.n,
+		SHA256: hex.EncodeToString(u.h.Sum(nil)),
+		Type:   u.m.Type,
+	}
+	if nil != u.preview {
+		e.Preview = string(u.preview)
+	}
+	for _, n := range u.s.notifiers {
+		go sendNotification(n, e)
+	}
+	return nil
+}
+
+/* sendNotification tells n about e, retrying with backoff. */
+func sendNotification(n notifier, e uploadEvent) {
+	wait := notifyBackoff
+	for i := 1; ; i++ {
+		err := n.Notify(e)
+		if nil == err {
+			return
+		}
+		if notifyTries <= i {
+			log.Printf(
+				"Giving up notifying %v about %q after %d tries: %v",
+				n,
+				e.Name,
+				i,
+				err,
+			)
+			return
+		}
+		log.Printf(
+			"Error notifying %v about %q, trying again in %v: %v",
+			n,
+			e.Name,
+			wait,
+			err,
+		)
+		time.Sleep(wait)
+		wait = min(2*wait, notifyMaxBackoff)
+	}
+}
@@ -0,0 +1,380 @@
+package main
+
+/*
+ * pcap.go
+ * Record connections in pcap files
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/magisterquis/postfile"
+)
+
+const (
+	/* pcapSnapLen is the largest packet we'll write */
+	pcapSnapLen = 65535
+	/* pcapLinkRaw is the link type for bare IPv4 and IPv6 packets */
+	pcapLinkRaw = 101
+	/* pcapMSS is the most data we put in a packet */
+	pcapMSS = 16384
+	/* pcapISN is the initial sequence number for both sides */
+	pcapISN = 1000
+)
+
+/* TCP flags */
+const (
+	tcpFIN = 0x01
+	tcpSYN = 0x02
+	tcpPSH = 0x08
+	tcpACK = 0x10
+)
+
+// pcapWriters are the files to which connections to each listener are
+// written, by listener name.  They're set once by main.
+var pcapWriters map[string]*pcapWriter
+
+// openPcaps makes a new pcap file in dir for each of the listeners in names
+// and puts it in pcapWriters.
+func openPcaps(dir string, names ...string) error {
+	ts := time.Now().UTC().Format("20060102T150405Z")
+	if err := os.MkdirAll(dir, 0700); nil != err {
+		return err
+	}
+	pcapWriters = make(map[string]*pcapWriter)
+	for _, name := range names {
+		f, err := postfile.OpenFileExt(dir, name+"_"+ts, ".pcap")
+		if nil != err {
+			return fmt.Errorf("opening file for %s: %w", name, err)
+		}
+		pw, err := newPcapWriter(f)
+		if nil != err {
+			f.Close()
+			return fmt.Errorf(
+				"writing header to %s: %w",
+				f.Name(),
+				err,
+			)
+		}
+		pcapWriters[name] = pw
+		log.Printf("Recording %s connections to %s", name, f.Name())
+	}
+	return nil
+}
+
+// pcapWriter writes packets to a pcap file.  Each packet is a single write,
+// so everything up to a crash is saved.
+type pcapWriter struct {
+	w    io.Writer
+	l    sync.Mutex
+	ipID atomic.Uint32
+}
+
+/* newPcapWriter writes a pcap header to w and returns a pcapWriter. */
+func newPcapWriter(w io.Writer) (*pcapWriter, error) {
+	hdr := make([]byte, 24)
+	binary.LittleEndian.PutUint32(hdr[0:], 0xa1b2c3d4)
+	binary.LittleEndian.PutUint16(hdr[4:], 2)
+	binary.LittleEndian.PutUint16(hdr[6:], 4)
+	binary.LittleEndian.PutUint32(hdr[16:], pcapSnapLen)
+	binary.LittleEndian.PutUint32(hdr[20:], pcapLinkRaw)
+	if _, err := w.Write(hdr); nil != err {
+		return nil, err
+	}
+	return &pcapWriter{w: w}, nil
+}
+
+/* writePacket writes pkt, captured at t. */
+func (pw *pcapWriter) writePacket(t time.Time, pkt []byte) error {
+	rec := make([]byte, 16, 16+len(pkt))
+	binary.LittleEndian.PutUint32(rec[0:], uint32(t.Unix()))
+	binary.LittleEndian.PutUint32(rec[4:], uint32(t.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(rec[8:], uint32(len(pkt)))
+	binary.LittleEndian.PutUint32(rec[12:], uint32(len(pkt)))
+	rec = append(rec, pkt...)
+	pw.l.Lock()
+	defer pw.l.Unlock()
+	_, err := pw.w.Write(rec)
+	return err
+}
+
+// tcpFlow makes up the packets of a TCP connection between a client and a
+// server, for data we've already got from somewhere else.
+type tcpFlow struct {
+	pw     *pcapWriter
+	client *net.TCPAddr
+	server *net.TCPAddr
+	cseq   uint32 /* Client's next sequence number */
+	sseq   uint32 /* Server's next sequence number */
+	l      sync.Mutex
+	closed bool
+}
+
+// newTCPFlow returns a tcpFlow between client and server, which must both
+// be *net.TCPAddrs, and writes the handshake.  If pw is nil or the addresses
+// aren't TCP addresses, newTCPFlow returns nil.
+func newTCPFlow(pw *pcapWriter, client, server net.Addr) *tcpFlow {
+	ca, ok := client.(*net.TCPAddr)
+	if !ok || nil == pw {
+		return nil
+	}
+	sa, ok := server.(*net.TCPAddr)
+	if !ok {
+		return nil
+	}
+	tf := &tcpFlow{
+		pw:     pw,
+		client: ca,
+		server: sa,
+		cseq:   pcapISN,
+		sseq:   pcapISN,
+	}
+	tf.l.Lock()
+	defer tf.l.Unlock()
+	tf.send(true, tcpSYN, nil)
+	tf.cseq++
+	tf.send(false, tcpSYN|tcpACK, nil)
+	tf.sseq++
+	tf.send(true, tcpACK, nil)
+	return tf
+}
+
+// data writes packets with b, sent by the client if fromClient is true or
+// the server if not.
+func (tf *tcpFlow) data(fromClient bool, b []byte) {
+	tf.l.Lock()
+	defer tf.l.Unlock()
+	if tf.closed {
+		return
+	}
+	for 0 != len(b) {
+		n := min(len(b), pcapMSS)
+		tf.send(fromClient, tcpPSH|tcpACK, b[:n])
+		if fromClient {
+			tf.cseq += uint32(n)
+		} else {
+			tf.sseq += uint32(n)
+		}
+		b = b[n:]
+	}
+}
+
+/* close writes a FIN from each side and the last ACK. */
+func (tf *tcpFlow) close() {
+	tf.l.Lock()
+	defer tf.l.Unlock()
+	if tf.closed {
+		return
+	}
+	tf.closed = true
+	tf.send(false, tcpFIN|tcpACK, nil)
+	tf.sseq++
+	tf.send(true, tcpFIN|tcpACK, nil)
+	tf.cseq++
+	tf.send(false, tcpACK, nil)
+}
+
+// send writes a packet with the given flags and payload from the client or
+// server.  The caller must hold tf.l.
+func (tf *tcpFlow) send(fromClient bool, flags byte, payload []byte) {
+	src, dst, seq, ack := tf.client, tf.server, tf.cseq, tf.sseq
+	if !fromClient {
+		src, dst, seq, ack = tf.server, tf.client, tf.sseq, tf.cseq
+	}
+	if 0 == flags&tcpACK {
+		ack = 0
+	}
+
+	/* TCP header */
+	seg := make([]byte, 20, 20+len(payload))
+	binary.BigEndian.PutUint16(seg[0:], uint16(src.Port))
+	binary.BigEndian.PutUint16(seg[2:], uint16(dst.Port))
+	binary.BigEndian.PutUint32(seg[4:], seq)
+	binary.BigEndian.PutUint32(seg[8:], ack)
+	seg[12] = 5 << 4
+	seg[13] = flags
+	binary.BigEndian.PutUint16(seg[14:], 0xffff)
+	seg = append(seg, payload...)
+
+	/* IP header and checksums */
+	var pkt []byte
+	if s4, d4 := src.IP.To4(), dst.IP.To4(); nil != s4 && nil != d4 {
+		pseudo := make([]byte, 0, 12)
+		pseudo = append(pseudo, s4...)
+		pseudo = append(pseudo, d4...)
+		pseudo = append(pseudo, 0, 6)
+		pseudo = binary.BigEndian.AppendUint16(
+			pseudo,
+			uint16(len(seg)),
+		)
+		binary.BigEndian.PutUint16(seg[16:], checksum(pseudo, seg))
+		pkt = make([]byte, 20, 20+len(seg))
+		pkt[0] = 0x45
+		binary.BigEndian.PutUint16(pkt[2:], uint16(20+len(seg)))
+		binary.BigEndian.PutUint16(pkt[4:], uint16(tf.pw.ipID.Add(1)))
+		pkt[6] = 0x40 /* Don't fragment */
+		pkt[8] = 64
+		pkt[9] = 6
+		copy(pkt[12:], s4)
+		copy(pkt[16:], d4)
+		binary.BigEndian.PutUint16(pkt[10:], checksum(pkt))
+	} else {
+		s16, d16 := src.IP.To16(), dst.IP.To16()
+		pseudo := make([]byte, 0, 40)
+		pseudo = append(pseudo, s16...)
+		pseudo = append(pseudo, d16...)
+		pseudo = binary.BigEndian.AppendUint32(
+			pseudo,
+			uint32(len(seg)),
+		)
+		pseudo = append(pseudo, 0, 0, 0, 6)
+		binary.BigEndian.PutUint16(seg[16:], checksum(pseudo, seg))
+		pkt = make([]byte, 40, 40+len(seg))
+		pkt[0] = 0x60
+		binary.BigEndian.PutUint16(pkt[4:], uint16(len(seg)))
+		pkt[6] = 6
+		pkt[7] = 64
+		copy(pkt[8:], s16)
+		copy(pkt[24:], d16)
+	}
+	pkt = append(pkt, seg...)
+
+	if err := tf.pw.writePacket(time.Now(), pkt); nil != err {
+		log.Printf("Error writing packet to pcap file: %v", err)
+	}
+}
+
+/* checksum returns the Internet checksum of the concatenation of bs. */
+func checksum(bs ...[]byte) uint16 {
+	var (
+		sum uint32
+		odd bool /* hi is the high byte of the next word */
+		hi  byte
+	)
+	for _, b := range bs {
+		for _, c := range b {
+			if odd {
+				sum += uint32(hi)<<8 | uint32(c)
+			} else {
+				hi = c
+			}
+			odd = !odd
+		}
+	}
+	if odd {
+		sum += uint32(hi) << 8
+	}
+	for 0xffff < sum {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
+
+// pcapConn returns c, recorded to the pcap file for the listener named
+// name, if there is one and c's a TCP connection.  If not, c is returned
+// as-is.
+func pcapConn(name string, c net.Conn) net.Conn {
+	tf := newTCPFlow(pcapWriters[name], c.RemoteAddr(), c.LocalAddr())
+	if nil == tf {
+		return c
+	}
+	return &capturedConn{Conn: c, tf: tf}
+}
+
+/* capturedConn is a net.Conn which records what's sent and received. */
+type capturedConn struct {
+	net.Conn
+	tf *tcpFlow
+}
+
+/* Read reads from the underlying conn and records what was read. */
+func (c *capturedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.tf.data(true, b[:n])
+	return n, err
+}
+
+/* Write writes to the underlying conn and records what was written. */
+func (c *capturedConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.tf.data(false, b[:n])
+	return n, err
+}
+
+/* Close closes the underlying conn and records the close. */
+func (c *capturedConn) Close() error {
+	c.tf.close()
+	return c.Conn.Close()
+}
+
+// pcapListener records the connections it accepts in the pcap file for the
+// listener name.
+type pcapListener struct {
+	net.Listener
+	name string
+}
+
+/* Accept accepts a connection and records it. */
+func (l pcapListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if nil != err {
+		return nil, err
+	}
+	return pcapConn(l.name, c), nil
+}
+
+// withPcap records decrypted HTTPS requests to the http pcap file, if
+// there is one, each as its own connection with the request line, headers,
+// and body as the client's side.  Plaintext requests are recorded as they
+// come off the wire by pcapListener.
+func withPcap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		la, _ := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+		ra, err := net.ResolveTCPAddr("tcp", r.RemoteAddr)
+		if nil == r.TLS || nil == la || nil != err {
+			next.ServeHTTP(w, r)
+			return
+		}
+		tf := newTCPFlow(pcapWriters["http"], ra, la)
+		if nil == tf {
+			next.ServeHTTP(w, r)
+			return
+		}
+		defer tf.close()
+
+		/* Record the headers now and the body as it's read */
+		hdr, err := httputil.DumpRequest(r, false)
+		if nil != err {
+			requestLog(r).Printf("Unable to record headers: %v", err)
+		}
+		tf.data(true, hdr)
+		r.Body = pcapBody{ReadCloser: r.Body, tf: tf}
+		next.ServeHTTP(w, r)
+	})
+}
+
+/* pcapBody records a request body as it's read. */
+type pcapBody struct {
+	io.ReadCloser
+	tf *tcpFlow
+}
+
+/* Read reads from the body and records what was read. */
+func (b pcapBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.tf.data(true, p[:n])
+	return n, err
+}
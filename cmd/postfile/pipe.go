@@ -0,0 +1,191 @@
+package main
+
+/*
+ * pipe.go
+ * Stream uploads to an external command
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"runtime"
+	"time"
+
+	"github.com/magisterquis/postfile"
+)
+
+/* pipeOutputMax is the most command output we'll log per upload */
+const pipeOutputMax = 4096
+
+// pipeStore sends each upload to the standard input of a new instance of a
+// shell command.  Metadata is passed in POSTFILE_* environment variables.
+type pipeStore struct {
+	cmd string
+}
+
+/* Open starts the command for an upload. */
+func (s pipeStore) Open(m *Meta) (Upload, error) {
+	var cmd *exec.Cmd
+	if "windows" == runtime.GOOS {
+		cmd = exec.Command("cmd.exe", "/C", s.cmd)
+	} else {
+		cmd = exec.Command("/bin/sh", "-c", s.cmd)
+	}
+	cmd.Env = append(
+		os.Environ(),
+		"POSTFILE_NAME="+postfile.BaseName(m),
+		"POSTFILE_SOURCE="+m.Source,
+		"POSTFILE_PATH="+m.Path,
+		"POSTFILE_HOST="+m.Host,
+		"POSTFILE_TIME="+m.Time.UTC().Format(time.RFC3339Nano),
+	)
+	u := &pipeCmdUpload{cmd: cmd}
+	cmd.Stdout = &u.out
+	cmd.Stderr = &u.out /* Same writer, so no concurrent writes */
+	var err error
+	if u.stdin, err = cmd.StdinPipe(); nil != err {
+		return nil, err
+	}
+	if err := cmd.Start(); nil != err {
+		return nil, err
+	}
+	return u, nil
+}
+
+/* pipeCmdUpload is an upload being sent to a command. */
+type pipeCmdUpload struct {
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+	out   capBuffer
+}
+
+/* Name returns the command's PID. */
+func (u *pipeCmdUpload) Name() string {
+	return fmt.Sprintf("pipe:%d", u.cmd.Process.Pid)
+}
+
+/* Write sends b to the command's stdin. */
+func (u *pipeCmdUpload) Write(b []byte) (int, error) {
+	return u.stdin.Write(b)
+}
+
+/* Commit closes the command's stdin and waits for it to finish. */
+func (u *pipeCmdUpload) Commit() error {
+	u.stdin.Close()
+	err := u.cmd.Wait()
+	u.logOutput()
+	return err
+}
+
+/* Abort kills the command. */
+func (u *pipeCmdUpload) Abort() error {
+	u.stdin.Close()
+	u.cmd.Process.Kill()
+	u.cmd.Wait()
+	u.logOutput()
+	return nil
+}
+
+/* logOutput logs whatever the command had to say, if anything. */
+func (u *pipeCmdUpload) logOutput() {
+	out := bytes.TrimSpace(u.out.Bytes())
+	if 0 == len(out) {
+		return
+	}
+	if u.out.full {
+		out = append(out, "..."...)
+	}
+	log.Printf("Output from %v: %q", u.Name(), out)
+}
+
+/* capBuffer is a bytes.Buffer which discards writes past pipeOutputMax. */
+type capBuffer struct {
+	bytes.Buffer
+	full bool
+}
+
+/* Write writes as much of b as will fit. */
+func (c *capBuffer) Write(b []byte) (int, error) {
+	if room := pipeOutputMax - c.Len(); room < len(b) {
+		c.full = true
+		c.Buffer.Write(b[:max(room, 0)])
+		return len(b), nil
+	}
+	return c.Buffer.Write(b)
+}
+
+// teeStorage sends uploads to a primary Storage as well as a secondary
+// Storage.  Errors with the secondary are logged but otherwise don't affect
+// the upload.
+type teeStorage struct {
+	primary   Storage
+	secondary Storage
+}
+
+/* Open opens an upload in both Storages. */
+func (s teeStorage) Open(m *Meta) (Upload, error) {
+	p, err := s.primary.Open(m)
+	if nil != err {
+		return nil, err
+	}
+	u := &teeUpload{primary: p}
+	if u.secondary, err = s.secondary.Open(m); nil != err {
+		log.Printf("Unable to open secondary storage: %v", err)
+	}
+	return u, nil
+}
+
+/* teeUpload is an upload to two places. */
+type teeUpload struct {
+	primary   Upload
+	secondary Upload /* May be nil */
+}
+
+/* Name returns the names of both uploads. */
+func (u *teeUpload) Name() string {
+	if nil == u.secondary {
+		return u.primary.Name()
+	}
+	return u.primary.Name() + ", " + u.secondary.Name()
+}
+
+/* Write writes to both uploads. */
+func (u *teeUpload) Write(b []byte) (int, error) {
+	if nil != u.secondary {
+		if _, err := u.secondary.Write(b); nil != err {
+			log.Printf(
+				"Error writing to %v, giving up on it: %v",
+				u.secondary.Name(),
+				err,
+			)
+			u.secondary.Abort()
+			u.secondary = nil
+		}
+	}
+	return u.primary.Write(b)
+}
+
+/* Commit commits both uploads. */
+func (u *teeUpload) Commit() error {
+	if nil != u.secondary {
+		if err := u.secondary.Commit(); nil != err {
+			log.Printf("Error finishing %v: %v", u.secondary.Name(), err)
+		}
+	}
+	return u.primary.Commit()
+}
+
+/* Abort aborts both uploads. */
+func (u *teeUpload) Abort() error {
+	if nil != u.secondary {
+		u.secondary.Abort()
+	}
+	return u.primary.Abort()
+}
@@ -0,0 +1,32 @@
+package main
+
+/*
+ * pledge.go
+ * Restrict ourselves after setup, where the OS lets us
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import "strings"
+
+// lockdown describes what we need after setup.  On OpenBSD, it's turned into
+// pledge promises and unveiled paths.  Elsewhere, it's ignored.
+type lockdown struct {
+	exec    bool              /* Run commands */
+	unix    bool              /* Accept on unix sockets */
+	unveil  bool              /* Only unveiled paths are needed */
+	unveils map[string]string /* Paths and permissions to unveil */
+}
+
+/* promises returns the pledge promises for ld. */
+func (ld lockdown) promises() string {
+	ps := []string{"stdio", "rpath", "wpath", "cpath", "inet", "dns"}
+	if ld.unix {
+		ps = append(ps, "unix")
+	}
+	if ld.exec {
+		ps = append(ps, "proc", "exec")
+	}
+	return strings.Join(ps, " ")
+}
@@ -0,0 +1,95 @@
+//go:build openbsd && (amd64 || arm64)
+
+package main
+
+/*
+ * pledge_openbsd.go
+ * pledge(2) and unveil(2)
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"syscall"
+	"unsafe"
+)
+
+// libc stubs, which we have to call as OpenBSD doesn't allow syscalls from
+// outside libc.  The trampolines are in pledge_openbsd_*.s.
+
+var libc_pledge_trampoline_addr uintptr
+
+//go:cgo_import_dynamic libc_pledge pledge "libc.so"
+
+var libc_unveil_trampoline_addr uintptr
+
+//go:cgo_import_dynamic libc_unveil unveil "libc.so"
+
+//go:linkname syscall_syscall syscall.syscall
+func syscall_syscall(fn, a1, a2, a3 uintptr) (r1, r2 uintptr, err syscall.Errno)
+
+// apply unveils ld's paths, if ld.unveil is set, and pledges ld's promises.
+// Empty paths and paths which don't exist aren't unveiled.
+func (ld lockdown) apply() error {
+	if ld.unveil {
+		for p, perms := range ld.unveils {
+			if "" == p {
+				continue
+			}
+			err := unveil(p, perms)
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			} else if nil != err {
+				return fmt.Errorf("unveiling %s: %w", p, err)
+			}
+		}
+		if _, _, e := syscall_syscall(
+			libc_unveil_trampoline_addr,
+			0,
+			0,
+			0,
+		); 0 != e {
+			return fmt.Errorf("locking unveil: %w", e)
+		}
+	}
+	ps, err := syscall.BytePtrFromString(ld.promises())
+	if nil != err {
+		return err
+	}
+	if _, _, e := syscall_syscall(
+		libc_pledge_trampoline_addr,
+		uintptr(unsafe.Pointer(ps)),
+		0,
+		0,
+	); 0 != e {
+		return fmt.Errorf("pledging %q: %w", ld.promises(), e)
+	}
+	log.Printf("Pledged %q", ld.promises())
+	return nil
+}
+
+/* unveil unveils path with the given permissions. */
+func unveil(path, perms string) error {
+	pp, err := syscall.BytePtrFromString(path)
+	if nil != err {
+		return err
+	}
+	pe, err := syscall.BytePtrFromString(perms)
+	if nil != err {
+		return err
+	}
+	if _, _, e := syscall_syscall(
+		libc_unveil_trampoline_addr,
+		uintptr(unsafe.Pointer(pp)),
+		uintptr(unsafe.Pointer(pe)),
+		0,
+	); 0 != e {
+		return e
+	}
+	return nil
+}
@@ -0,0 +1,14 @@
+//go:build !openbsd || !(amd64 || arm64)
+
+package main
+
+/*
+ * pledge_other.go
+ * Stub for platforms without pledge and unveil
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+/* apply is a no-op, as there's no pledge or unveil here. */
+func (ld lockdown) apply() error { return nil }
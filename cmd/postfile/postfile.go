@@ -0,0 +1,2329 @@
+package main
+
+/*
+ * postfile.go
+ * Saves the contents of post requests to files
+ * By J. Stuart McMurray
+ * Created 20160926
+ * Last Modified 20261015
+ */
+
+import (
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/fcgi"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/magisterquis/postfile"
+)
+
+/* store is where uploads go */
+var store Storage = postfile.LocalStorage{}
+
+func main() {
+	/* Subcommands get their own flags */
+	if 1 < len(os.Args) {
+		switch os.Args[1] {
+		case "evidence":
+			evidenceMain(os.Args[2:])
+			return
+		case "bench":
+			benchMain(os.Args[2:])
+			return
+		}
+	}
+
+	var (
+		plaintext = flag.Bool(
+			"http",
+			false,
+			"Serve plaintext HTTP, on a unix socket if the listen "+
+				"address is a path (contains a /)",
+		)
+		laddr = flag.String(
+			"l",
+			"0.0.0.0:4433",
+			"Listen `address`",
+		)
+		cert = flag.String(
+			"c",
+			"cert.pem",
+			"TLS `certificate` file",
+		)
+		key = flag.String(
+			"k",
+			"key.pem",
+			"TLS `key` file",
+		)
+		dir = flag.String(
+			"dir",
+			"posts",
+			"POSTed files `directory`",
+		)
+		names = flag.String(
+			"names",
+			defaultNamePolicy().String(),
+			"Filename sanitization `policy`: percent, truncate, or "+
+				"hash to make names safe for Windows and "+
+				"NAME_MAX, or none",
+		)
+		serveFCGI = flag.Bool(
+			"fcgi",
+			false,
+			"Serve FastCGI, on a unix socket unless the listen "+
+				"address is a host and port",
+		)
+		serveSCGI = flag.Bool(
+			"scgi",
+			false,
+			"Serve SCGI, on a unix socket unless the listen "+
+				"address is a host and port",
+		)
+		keepAlive = flag.Duration(
+			"tcp-keepalive",
+			0,
+			"TCP keepalive `period`, 0 for the system default, or "+
+				"negative to disable keepalives",
+		)
+		linger = flag.Int(
+			"tcp-linger",
+			-1,
+			"TCP linger `seconds` when closing connections, 0 to "+
+				"reset instead, or -1 for the system default",
+		)
+		noDelay = flag.Bool(
+			"tcp-nodelay",
+			true,
+			"Disable Nagle's algorithm on accepted connections",
+		)
+		storage = flag.String(
+			"storage",
+			"",
+			"Optional storage `URL` (s3://bucket/prefix, "+
+				"gs://bucket/prefix, azblob://container/prefix, "+
+				"or sqlite:file.db, which needs sqlite3 in $PATH and "+
+				"spools in -dir) to use instead of the local "+
+				"directory",
+		)
+		s3Endpoint = flag.String(
+			"s3-endpoint",
+			"",
+			"S3-compatible endpoint `URL` (default AWS)",
+		)
+		pipeCmd = flag.String(
+			"pipe",
+			"",
+			"Optional shell `command` to which to send each "+
+				"upload's body, with metadata in POSTFILE_* "+
+				"environment variables",
+		)
+		pipeOnly = flag.Bool(
+			"pipe-only",
+			false,
+			"Only send uploads to the -pipe command, don't store them",
+		)
+		burstMem = flag.Int64(
+			"burst-buffer",
+			0,
+			"If nonzero, buffer up to this many `MiB` of uploads in "+
+				"memory, and then in -burst-dir, to absorb bursts "+
+				"faster than storage",
+		)
+		burstDir = flag.String(
+			"burst-dir",
+			"",
+			"Scratch `directory` for -burst-buffer overflow "+
+				"(default a hidden directory in -dir)",
+		)
+		webhookURL = flag.String(
+			"webhook",
+			"",
+			"Optional `URL` to which to POST JSON details of each "+
+				"upload",
+		)
+		slackURL = flag.String(
+			"notify-slack",
+			"",
+			"Optional Slack webhook `URL` to which to post a "+
+				"message for each upload",
+		)
+		discordURL = flag.String(
+			"notify-discord",
+			"",
+			"Optional Discord webhook `URL` to which to post a "+
+				"message for each upload",
+		)
+		notifyPaths = flag.String(
+			"notify-path",
+			"",
+			"Only send Slack and Discord messages for paths "+
+				"matching this `regex`",
+		)
+		notifyMin = flag.Int64(
+			"notify-min-size",
+			0,
+			"Only send Slack and Discord messages for uploads of at "+
+				"least this many `bytes`",
+		)
+		smtpServer = flag.String(
+			"notify-smtp",
+			"",
+			"Optional SMTP server `URL` "+
+				"(smtp://[user:pass@]host[:port]) via which to "+
+				"email -notify-to about uploads",
+		)
+		smtpTo = flag.String(
+			"notify-to",
+			"",
+			"Comma-separated email `addresses` to notify, "+
+				"with -notify-smtp",
+		)
+		smtpFrom = flag.String(
+			"notify-from",
+			"",
+			"Email From `address`, with -notify-smtp "+
+				"(default postfile@hostname)",
+		)
+		smtpDigest = flag.Duration(
+			"notify-digest",
+			0,
+			"If set, email a digest of uploads at this `interval` "+
+				"instead of one email per upload",
+		)
+		notifyPreviews = flag.Bool(
+			"notify-previews",
+			false,
+			"Put the first few bytes of each upload in "+
+				"notifications",
+		)
+		transcodeText = flag.Bool(
+			"transcode",
+			false,
+			"Also store UTF-8 copies with LF line endings of "+
+				"UTF-16, CP1251, and CRLF text uploads",
+		)
+		spoolDir = flag.String(
+			"spool",
+			"",
+			"Optional `directory` in which to spool uploads while "+
+				"-storage is unhealthy",
+		)
+		probeInterval = flag.Duration(
+			"probe-interval",
+			10*time.Second,
+			"How often to check -storage's health and drain the "+
+				"spool, with -spool",
+		)
+		tokensFile = flag.String(
+			"tokens",
+			"",
+			"Optional `file` with tokens required to upload, one "+
+				"per line",
+		)
+		accessFile = flag.String(
+			"access-log",
+			"",
+			"Optional combined-format access log `file`, "+
+				"reopened on SIGHUP",
+		)
+		auditFile = flag.String(
+			"audit",
+			"",
+			"Optional audit log `file`",
+		)
+		pcapDir = flag.String(
+			"pcap",
+			"",
+			"Optional `directory` in which to record connections "+
+				"to each listener in pcap files, with HTTPS "+
+				"requests recorded after decryption",
+		)
+		clientsFile = flag.String(
+			"client-stats",
+			"",
+			"Optional `file` in which to save per-client upload "+
+				"statistics, which are loaded at startup",
+		)
+		clientsEvery = flag.Duration(
+			"client-stats-interval",
+			time.Minute,
+			"Save per-client statistics every `period`, with "+
+				"-client-stats",
+		)
+		retention = flag.Duration(
+			"retention",
+			0,
+			"If set, remove local files older than this `age`",
+		)
+		compliance = flag.Bool(
+			"compliance",
+			false,
+			"Refuse to start without TLS, tokens, auditing, and "+
+				"retention, and require TLS 1.2 or later",
+		)
+		expire = flag.String(
+			"expire",
+			"",
+			"Stop accepting uploads at this `time` "+
+				"(e.g. 2024-07-31T00:00Z)",
+		)
+		expireAction = flag.String(
+			"expire-action",
+			"none",
+			"What to do with local files after -expire "+
+				"(none, wipe, or archive to a tarball next to "+
+				"the directory and then wipe)",
+		)
+		adminAddr = flag.String(
+			"admin",
+			"",
+			"Optional admin API listen `address` (loopback or "+
+				"unix socket path), for requests with an "+
+				adminHeader+" header",
+		)
+		adminTokenFlag = flag.String(
+			"admin-token",
+			"",
+			"Optional `token` admin API requests must have in "+
+				"the "+adminHeader+" header",
+		)
+		debug = flag.Bool(
+			"debug",
+			false,
+			"Start with debug logging enabled",
+		)
+		useSyslog = flag.Bool(
+			"syslog",
+			false,
+			"Log to the local syslog daemon instead of stderr",
+		)
+		syslogFacility = flag.String(
+			"syslog-facility",
+			"daemon",
+			"Syslog `facility`, with -syslog",
+		)
+		syslogTag = flag.String(
+			"syslog-tag",
+			"postfile",
+			"Syslog `tag`, with -syslog",
+		)
+		ui = flag.String(
+			"ui",
+			"",
+			"Optional `path` (e.g. /_ui/) under which to serve a web "+
+				"interface for browsing uploads, with -ui-users",
+		)
+		uiUsersFile = flag.String(
+			"ui-users",
+			"",
+			"File with web interface users, one \"username "+
+				"bcrypt-hash\" per line, e.g. from "+
+				"htpasswd -nB username",
+		)
+		list = flag.String(
+			"list",
+			"",
+			"Optional `path` (e.g. /_list) at which clients with a "+
+				"token can GET a JSON list of stored files, "+
+				"with -tokens",
+		)
+		idempotency = flag.Duration(
+			"idempotency",
+			0,
+			"Remember the results of uploads with an Idempotency-Key "+
+				"or X-Upload-ID header for this `period`, and "+
+				"send them instead of storing retries again "+
+				"(0 to ignore the headers)",
+		)
+		beacons = flag.String(
+			"beacon-paths",
+			"",
+			"Comma-separated `paths` at which to save GET requests' "+
+				"query strings and headers, one file per "+
+				"client, instead of rejecting them (paths "+
+				"ending in / match everything under them)",
+		)
+		progress = flag.String(
+			"progress",
+			"",
+			"Optional `path` (e.g. /_progress) at which clients can "+
+				"GET how much has been received of uploads "+
+				"sent with an "+progressHeader+" header",
+		)
+		rawTCP = flag.String(
+			"raw-tcp",
+			"",
+			"Optional `address` on which to accept plain TCP "+
+				"connections and save what's sent on each "+
+				"to a file",
+		)
+		udpAddr = flag.String(
+			"udp",
+			"",
+			"Optional `address` on which to receive UDP datagrams "+
+				"and append them to a file",
+		)
+		udpPrefix = flag.Bool(
+			"udp-length-prefix",
+			false,
+			"Precede each datagram from -udp with its length, as "+
+				"a 32-bit big-endian integer",
+		)
+		udpPerSource = flag.Bool(
+			"udp-per-source",
+			false,
+			"Append datagrams from -udp to a file per source "+
+				"address",
+		)
+		dnsAddr = flag.String(
+			"dns",
+			"",
+			"Optional UDP `address` on which to answer DNS queries "+
+				"for -dns-zone and save files sent in them",
+		)
+		dnsZone = flag.String(
+			"dns-zone",
+			"",
+			"DNS `zone` for -dns (e.g. x.example.com)",
+		)
+		dnsAnswer = flag.String(
+			"dns-answer",
+			"127.0.0.1",
+			"IPv4 `address` with which to answer A queries to -dns",
+		)
+		smtpAddr = flag.String(
+			"smtp",
+			"",
+			"Optional `address` on which to accept mail and save "+
+				"each message",
+		)
+		smtpAttachments = flag.Bool(
+			"smtp-attachments",
+			false,
+			"Also save attachments to mail sent to -smtp on their "+
+				"own",
+		)
+		ftpAddr = flag.String(
+			"ftp",
+			"",
+			"Optional `address` on which to accept files via FTP, "+
+				"with AUTH TLS if we have a keypair",
+		)
+		sftpAddr = flag.String(
+			"sftp",
+			"",
+			"Optional `address` on which to accept files via "+
+				"write-only SFTP, with -sftp-keys",
+		)
+		sftpKeys = flag.String(
+			"sftp-keys",
+			"",
+			"authorized_keys `file` with the keys SFTP clients "+
+				"may use",
+		)
+		sftpHostKey = flag.String(
+			"sftp-host-key",
+			"",
+			"SSH host key `file` for -sftp, made if it doesn't "+
+				"exist (default a new key each run)",
+		)
+		scpSink = flag.Bool(
+			"scp",
+			false,
+			"Also accept files from scp -O with -sftp",
+		)
+		tftpAddr = flag.String(
+			"tftp",
+			"",
+			"Optional UDP `address` on which to accept files via "+
+				"TFTP",
+		)
+		websocket = flag.String(
+			"websocket",
+			"",
+			"Optional `path` (e.g. /ws) at which clients may "+
+				"upload WebSocket messages, one file per "+
+				"connection",
+		)
+		torControl = flag.String(
+			"tor-control",
+			"",
+			"Optional Tor control port `address` or socket path "+
+				"via which to publish the listener as an "+
+				"onion service",
+		)
+		torKey = flag.String(
+			"tor-key",
+			"",
+			"Optional `file` in which to keep the -tor-control "+
+				"onion service's key, for a stable address",
+		)
+		webdav = flag.Bool(
+			"webdav",
+			false,
+			"Accept PUTs and enough other WebDAV to let clients "+
+				"mount us as a drive and copy files in",
+		)
+		download = flag.Bool(
+			"download",
+			false,
+			"Allow clients with a token to GET stored files by name, "+
+				"with -tokens",
+		)
+		once = flag.Bool(
+			"download-once",
+			false,
+			"Remove files after they've been downloaded, with "+
+				"-download",
+		)
+		del = flag.Bool(
+			"delete",
+			false,
+			"Allow clients with a token to DELETE stored files by "+
+				"name, or all of a source's files with "+
+				"DELETE /?source=addr, with -tokens",
+		)
+		icmp = flag.Bool(
+			"icmp",
+			false,
+			"Experimental: also receive files in ICMP echo requests "+
+				"(needs CAP_NET_RAW)",
+		)
+		firstByte = flag.Duration(
+			"first-byte-timeout",
+			0,
+			"Drop uploads which don't send the first byte of the "+
+				"body within this `period` (0 to wait forever)",
+		)
+		idle = flag.Duration(
+			"idle-timeout",
+			0,
+			"Drop uploads which stop sending the body for this "+
+				"`period` (0 to wait forever)",
+		)
+		minRateFlag = flag.Int64(
+			"min-rate",
+			0,
+			"Drop uploads which send the body slower than this "+
+				"many `bytes` per second, on average, over "+
+				"-min-rate-period (0 for no minimum)",
+		)
+		minRateWindow = flag.Duration(
+			"min-rate-period",
+			10*time.Second,
+			"Average upload speeds over this `period` for -min-rate",
+		)
+		bandwidth = flag.Int64(
+			"bandwidth",
+			0,
+			"Limit all clients together to this many `bytes` per "+
+				"second, shared between them (0 for no limit)",
+		)
+		bufSize = flag.Int(
+			"buffer-size",
+			defaultBufferSize,
+			"Copy bodies to storage with buffers of this many `bytes`",
+		)
+		bufWrites = flag.Bool(
+			"buffer-writes",
+			false,
+			"Buffer writes to storage, to turn small network reads "+
+				"into fewer, larger writes",
+		)
+		form = flag.Bool(
+			"form",
+			false,
+			"Serve an HTML upload form for browsers on GET /",
+		)
+		chunked = flag.Bool(
+			"chunked",
+			false,
+			"Accept resumable chunked uploads, as sent by "+
+				"postfile-client",
+		)
+		respond = flag.String(
+			"respond",
+			"text",
+			"Upload response `format`, text (byte count) or json "+
+				"(also sent to clients which Accept JSON)",
+		)
+		raw = flag.Bool(
+			"raw",
+			false,
+			"Save uploads' request lines and headers as well as "+
+				"their bodies",
+		)
+		honeypotMode = flag.Bool(
+			"honeypot",
+			false,
+			"Record requests which aren't uploads, headers and "+
+				"all, to files instead of rejecting them",
+		)
+		decoyStatus = flag.Int(
+			"decoy-status",
+			0,
+			"If set, send uploaders this HTTP status `code` "+
+				"instead of the real response, which is still "+
+				"logged",
+		)
+		decoyBody = flag.String(
+			"decoy-body",
+			"",
+			"Template `file` for the decoy response body (default "+
+				"an nginx-style error page), with -decoy-status",
+		)
+		configFile = flag.String(
+			"config",
+			"",
+			"Optional config `file` with flag values, overridden by "+
+				"the command line, and more [[listener]]s",
+		)
+		grace = flag.Duration(
+			"grace",
+			30*time.Second,
+			"On SIGINT or SIGTERM, wait this `period` for in-flight "+
+				"uploads to finish",
+		)
+		runUser = flag.String(
+			"user",
+			"",
+			"After listening, switch to this `user`, which needs "+
+				"to be able to write to the output directory",
+		)
+		runGroup = flag.String(
+			"group",
+			"",
+			"After listening, switch to this `group` (default "+
+				"-user's group)",
+		)
+		chroot = flag.Bool(
+			"chroot",
+			false,
+			"After listening, chroot into the output directory; "+
+				"files outside it, including the config file "+
+				"and keypair, won't be reloadable",
+		)
+		h2c = flag.Bool(
+			"h2c",
+			false,
+			"Also serve HTTP/2 without TLS with -http",
+		)
+		http3Addr = flag.String(
+			"http3",
+			"",
+			"Optional UDP `address` on which to also serve "+
+				"HTTP/3, advertised to HTTPS clients with "+
+				"Alt-Svc",
+		)
+		readHeaderTimeout = flag.Duration(
+			"http-header-timeout",
+			30*time.Second,
+			"Drop HTTP connections which don't send a request's "+
+				"headers within this `period` (0 to wait forever)",
+		)
+		readTimeout = flag.Duration(
+			"http-read-timeout",
+			0,
+			"Drop HTTP connections which don't send a whole "+
+				"request, body and all, within this `period` (0 "+
+				"to wait forever)",
+		)
+		writeTimeout = flag.Duration(
+			"http-write-timeout",
+			0,
+			"Drop HTTP connections which take longer than this "+
+				"`period` from the end of the request's headers "+
+				"to the end of the response (0 to wait forever)",
+		)
+		httpIdleTimeout = flag.Duration(
+			"http-idle-timeout",
+			2*time.Minute,
+			"Close kept-alive HTTP connections after this `period` "+
+				"without a request (0 to use -http-read-timeout)",
+		)
+		health = flag.String(
+			"health",
+			"",
+			"Optional health check `path` (e.g. /healthz), which "+
+				"answers GETs without authentication",
+		)
+		ttlCallbacks = flag.Bool(
+			"ttl-callbacks",
+			false,
+			"Allow clients to ask for a callback when uploads with "+
+				"a TTL expire",
+		)
+		maintenanceAfter = flag.Duration(
+			"maintenance-retry",
+			maintenanceRetry,
+			"Retry-After `period` sent while the maintenance "+
+				"feature is on",
+		)
+		federateAddr = flag.String(
+			"federate-listen",
+			"",
+			"Optional `address` on which to serve an index of "+
+				"stored files, signed with "+
+				"-federate-sign-key, to federated peers, "+
+				"with mTLS",
+		)
+		federateCA = flag.String(
+			"federate-ca",
+			"",
+			"CA certificate `file` used to check federated peers' "+
+				"certificates",
+		)
+		federateCert = flag.String(
+			"federate-cert",
+			"",
+			"TLS certificate `file` for federation (default -c)",
+		)
+		federateKey = flag.String(
+			"federate-key",
+			"",
+			"TLS key `file` for federation (default -k)",
+		)
+		federateSignKey = flag.String(
+			"federate-sign-key",
+			"",
+			"PEM-encoded PKCS8 Ed25519 `file` with the key which "+
+				"signs our federated index, e.g. from openssl "+
+				"genpkey -algorithm ed25519",
+		)
+		federatePeerKeys = flag.String(
+			"federate-peer-keys",
+			"",
+			"Federated peers' PEM-encoded Ed25519 public keys "+
+				"`file`, one of which must have signed each "+
+				"peer's index, e.g. from openssl pkey -pubout",
+		)
+		federateName = flag.String(
+			"federate-name",
+			"",
+			"Instance `name` sent to federated peers (default "+
+				"hostname)",
+		)
+		federateInterval = flag.Duration(
+			"federate-interval",
+			5*time.Minute,
+			"Federated index sync `interval`",
+		)
+		logFormat = flag.String(
+			"log-format",
+			"text",
+			"Log `format`, text or json",
+		)
+		badTLS = flag.String(
+			"tls-garbage",
+			"http",
+			"What to do when a TLS client doesn't start with a "+
+				"handshake (http, close, or reset)",
+		)
+		tlsMin = flag.String(
+			"tls-min",
+			"",
+			"Minimum TLS `version` (1.0-1.3, default 1.2)",
+		)
+		tlsMax = flag.String(
+			"tls-max",
+			"",
+			"Maximum TLS `version` (1.0-1.3, default 1.3)",
+		)
+		tlsCiphers = flag.String(
+			"tls-ciphers",
+			"",
+			"Comma-separated `list` of allowed TLS 1.0-1.2 cipher "+
+				"suites (e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256)",
+		)
+		tlsCurves = flag.String(
+			"tls-curves",
+			"",
+			"Comma-separated `list` of key exchanges, most "+
+				"preferred first (e.g. X25519MLKEM768,X25519,P256)",
+		)
+		vhost = flag.String(
+			"vhost",
+			"",
+			"Keep uploads to different hostnames apart by putting "+
+				"the Host header in a subdirectory (dir) or the "+
+				"filename (name)",
+		)
+		rdns = flag.Bool(
+			"rdns",
+			false,
+			"Look up uploaders' PTR names, for logs and metadata",
+		)
+		rdnsWait = flag.Duration(
+			"rdns-timeout",
+			2*time.Second,
+			"Give up on PTR lookups after this `period`, with -rdns",
+		)
+		rdnsNames = flag.Bool(
+			"rdns-names",
+			false,
+			"Start filenames with uploaders' PTR names, with -rdns",
+		)
+		geoIPDirs = flag.Bool(
+			"geoip-dirs",
+			false,
+			"Store files in subdirectories named after the "+
+				"uploader's country and AS number (e.g. "+
+				"US/AS15169), with -geoip",
+		)
+		appendMode = flag.Bool(
+			"append",
+			false,
+			"Append uploads from the same address to the same path "+
+				"to a single file, instead of numbered files",
+		)
+		rotateSize = flag.Int64(
+			"rotate-size",
+			0,
+			"With -append, rotate files once they're at least this "+
+				"many `bytes`",
+		)
+		rotateNames = flag.String(
+			"rotate-names",
+			"number",
+			"Name rotated files by adding a number or the time "+
+				"(number or time), with -rotate-size",
+		)
+		rotateCompress = flag.Bool(
+			"rotate-compress",
+			false,
+			"Gzip rotated files, with -rotate-size",
+		)
+		extract = flag.Bool(
+			"extract",
+			false,
+			"Unpack tar, tar.gz, and zip uploads into directories "+
+				"named after the uploads, with "+extractSuffix,
+		)
+		extractDiscard = flag.Bool(
+			"extract-discard",
+			false,
+			"Remove archives after unpacking them, with -extract",
+		)
+		clamavAddr = flag.String(
+			"clamav",
+			"",
+			"Scan uploads with clamd at this `address` (host:port "+
+				"or Unix socket path)",
+		)
+		clamavActionName = flag.String(
+			"clamav-action",
+			string(clamavTag),
+			"What to do with uploads in which clamd finds "+
+				"something (tag, quarantine, or delete), with "+
+				"-clamav",
+		)
+		clamavTimeout = flag.Duration(
+			"clamav-timeout",
+			time.Minute,
+			"Give up scanning an upload after this `period`, with "+
+				"-clamav",
+		)
+		yaraRules = flag.String(
+			"yara",
+			"",
+			"Check uploads against the .yar and .yara rules files "+
+				"in this `directory`",
+		)
+		yaraBin = flag.String(
+			"yara-bin",
+			"yara",
+			"YARA `binary`, with -yara",
+		)
+		yaraNotify = flag.Bool(
+			"yara-notify",
+			false,
+			"Send notifications about uploads which match YARA "+
+				"rules, with -yara",
+		)
+		sniff = flag.Bool(
+			"sniff",
+			false,
+			"Work out uploads' content types from their first "+
+				"bytes, for metadata",
+		)
+		sniffNames = flag.Bool(
+			"sniff-ext",
+			false,
+			"Add extensions for sniffed content types to files' "+
+				"names, with -sniff",
+		)
+		ctypes = flag.String(
+			"content-types",
+			"",
+			"Comma-separated `list` of content types to accept "+
+				"(e.g. application/json,image/*), others get a 415",
+		)
+		ctypesSniff = flag.Bool(
+			"content-types-sniff",
+			false,
+			"Check uploads' sniffed content types instead of their "+
+				"Content-Type headers, with -content-types",
+		)
+		tokenDirs = flag.Bool(
+			"token-dirs",
+			false,
+			"Store each token's files in its own subdirectory, "+
+				"named after the token or its dir= option, and "+
+				"enforce quota= options, with -tokens",
+		)
+		sidecars = flag.Bool(
+			"sidecars",
+			false,
+			"Save each upload's metadata, including TLS details, "+
+				"in a sidecar file in "+metaDir+"/ in the output "+
+				"directory",
+		)
+		tlsFingerprint = flag.Bool(
+			"tls-fingerprint",
+			false,
+			"Log each TLS client's JA3 and JA4 fingerprints",
+		)
+		tlsFingerprintMeta = flag.Bool(
+			"tls-fingerprint-meta",
+			false,
+			"Record TLS clients' JA3 and JA4 fingerprints in their "+
+				"uploads' metadata",
+		)
+		certDir = flag.String(
+			"cert-dir",
+			"",
+			"Optional `directory` with additional TLS keypairs, "+
+				"as name.crt or name.pem with name.key, chosen "+
+				"by SNI",
+		)
+	)
+	var enrichURLs multiFlag
+	flag.Var(
+		&enrichURLs,
+		"enrich",
+		"Enrichment hook `URL` to which to POST JSON details of each "+
+			"upload, with the response saved in .meta/ "+
+			"(may be repeated)",
+	)
+	var federatePeers multiFlag
+	flag.Var(
+		&federatePeers,
+		"federate-peer",
+		"Base `URL` (e.g. https://peer:4434) of a federated peer "+
+			"whose index to sync (may be repeated)",
+	)
+	var decoyHeaders multiFlag
+	flag.Var(
+		&decoyHeaders,
+		"decoy-header",
+		"Header to send with the decoy response, as `Name: value` "+
+			"(may be repeated)",
+	)
+	var headers multiFlag
+	flag.Var(
+		&headers,
+		"header",
+		"Header to add to every response, as `Name: value` "+
+			"(may be repeated)",
+	)
+	var redacts multiFlag
+	flag.Var(
+		&redacts,
+		"redact",
+		"Redact a log target (log, access, or audit) with policies "+
+			"hash-ip, truncate-ip, and omit-path, as "+
+			"`target=policy[,policy...]` (may be repeated)",
+	)
+	var routes multiFlag
+	flag.Var(
+		&routes,
+		"route",
+		"Store uploads under a path prefix in their own directory, "+
+			"relative to -dir, optionally with their own size "+
+			"limit and tokens for HTTP, as "+
+			"`prefix=dir[,max-size=bytes][,tokens=file]` (may be "+
+			"repeated)",
+	)
+	var geoIPFiles multiFlag
+	flag.Var(
+		&geoIPFiles,
+		"geoip",
+		"MaxMind-format GeoIP country, city, or ASN database `file` "+
+			"with which to note where uploaders are (may be "+
+			"repeated)",
+	)
+	var certPairs multiFlag
+	flag.Var(
+		&certPairs,
+		"cert",
+		"Additional TLS keypair, as `cert,key` files, chosen by "+
+			"SNI (may be repeated)",
+	)
+	var trustProxies multiFlag
+	flag.Var(
+		&trustProxies,
+		"trust-proxy",
+		"Reverse proxy `CIDR` or address from which to take the "+
+			"client's address from X-Forwarded-For or X-Real-IP "+
+			"(may be repeated)",
+	)
+	flag.Usage = func() {
+		fmt.Fprintf(
+			os.Stderr,
+			`Usage: %v [options]
+       %v evidence [options]
+       %v bench [options]
+       %v install [options] [-- options]
+       %v service install|uninstall|start|stop [-- options]
+
+Accepts POST requests via HTTPS (or plaintext HTTP with -http), and logs the
+contents to a file named after the IP address and path.
+
+The evidence subcommand assembles an evidence package for a source, the bench
+subcommand measures how quickly uploads are handled, and the install
+subcommand writes a systemd unit; run them with -h for more details.
+On Windows, the service subcommand manages postfile as a Windows service which
+logs to the Application event log.
+
+Options may also be set with POSTFILE_* environment variables (e.g.
+POSTFILE_ACCESS_LOG for -access-log, one value per line for options which may
+be repeated) or a -config file.  The command line overrides the environment,
+which overrides the config file.  SIGHUP reloads the config file and the TLS
+keypair.  If started with systemd socket activation, the socket from systemd
+is used instead of -l.
+
+Options:
+`,
+			os.Args[0],
+			os.Args[0],
+			os.Args[0],
+			os.Args[0],
+			os.Args[0],
+		)
+		flag.PrintDefaults()
+	}
+
+	/* Installing needs our flags */
+	if 1 < len(os.Args) && "install" == os.Args[1] {
+		installMain(os.Args[2:])
+		return
+	}
+
+	/* As is being a Windows service */
+	if 1 < len(os.Args) && "service" == os.Args[1] {
+		if serviceMain(os.Args[2:]) {
+			return
+		}
+	}
+	flag.Parse()
+	if err := loadEnv(); nil != err {
+		log.Fatalf("Error loading settings from environment: %v", err)
+	}
+	if "" != *configFile {
+		if err := loadConfig(*configFile); nil != err {
+			log.Fatalf(
+				"Error loading config from %v: %v",
+				*configFile,
+				err,
+			)
+		}
+		/* Absolute, for reloading after we chdir */
+		if abs, err := filepath.Abs(*configFile); nil == err {
+			*configFile = abs
+		}
+	}
+
+	/* Log to the right place */
+	if *useSyslog {
+		if err := logToSyslog(*syslogFacility, *syslogTag); nil != err {
+			log.Fatalf("Unable to log to syslog: %v", err)
+		}
+	}
+	switch *logFormat {
+	case "text":
+	case "json":
+		logJSON()
+	default:
+		log.Fatalf("Unknown log format %q", *logFormat)
+	}
+	for _, r := range redacts {
+		if err := parseRedact(r); nil != err {
+			log.Fatalf("Invalid -redact %q: %v", r, err)
+		}
+	}
+	if rd := redactorFor(redactLog); nil != rd {
+		log.SetOutput(redactWriter{w: log.Writer(), rd: rd})
+	}
+
+	/* Get original cwd in case we have a relative socket */
+	opwd, err := os.Getwd()
+	if nil != err {
+		log.Fatalf("Unable to get working directory: %v", err)
+	}
+
+	/* Work out how strict to be with TLS */
+	ts, err := parseTLSSettings(*tlsMin, *tlsMax, *tlsCiphers, *tlsCurves)
+	if nil != err {
+		log.Fatalf("Invalid TLS settings: %v", err)
+	}
+
+	/* Make sure we're allowed to start in compliance mode */
+	if *compliance {
+		cs := complianceSettings{
+			plaintext: *plaintext,
+			gateway:   *serveFCGI || *serveSCGI,
+			tokens:    *tokensFile,
+			audit:     *auditFile,
+			retention: *retention,
+			storage:   *storage,
+			badTLS:    *badTLS,
+			decoy:     0 != *decoyStatus,
+			honeypot:  *honeypotMode,
+			previews:  *notifyPreviews,
+			beacons:   "" != *beacons,
+			tlsMin:    ts.minVersion,
+		}
+		if 0 == ts.minVersion {
+			ts.minVersion = tls.VersionTLS12
+		}
+		if "" != *rawTCP {
+			cs.unauthed = append(cs.unauthed, "raw-tcp")
+		}
+		if "" != *udpAddr {
+			cs.unauthed = append(cs.unauthed, "udp")
+		}
+		if "" != *dnsAddr {
+			cs.unauthed = append(cs.unauthed, "dns")
+		}
+		if "" != *smtpAddr && "" == *tokensFile {
+			cs.unauthed = append(cs.unauthed, "smtp")
+		}
+		if "" != *ftpAddr && "" == *tokensFile {
+			cs.unauthed = append(cs.unauthed, "ftp")
+		}
+		if "" != *tftpAddr {
+			cs.unauthed = append(cs.unauthed, "tftp")
+		}
+		if *icmp {
+			cs.unauthed = append(cs.unauthed, "icmp")
+		}
+		ps := cs.problems()
+		for _, p := range ps {
+			log.Printf("Compliance mode: %v", p)
+		}
+		if 0 != len(ps) {
+			log.Fatalf("Refusing to start in compliance mode")
+		}
+		complianceMode = true
+	}
+
+	/* Work out when to stop */
+	var archive string
+	if "" != *expire {
+		if expiry, err = parseExpiry(*expire); nil != err {
+			log.Fatalf("Unable to parse expiry %q: %v", *expire, err)
+		}
+		switch *expireAction {
+		case "none", "wipe", "archive":
+		default:
+			log.Fatalf(
+				"Unknown -expire-action %q",
+				*expireAction,
+			)
+		}
+		if "" != *storage && "none" != *expireAction {
+			log.Fatalf("Can only %v local files", *expireAction)
+		}
+		ad, err := filepath.Abs(*dir)
+		if nil != err {
+			log.Fatalf("Unable to get absolute path of %v: %v", *dir, err)
+		}
+		archive = ad + "-expired.tar.gz"
+	}
+
+	/* Load tokens and open the logs before we change directories */
+	if "" != *tokensFile {
+		if err := loadTokens(*tokensFile); nil != err {
+			log.Fatalf(
+				"Unable to load tokens from %v: %v",
+				*tokensFile,
+				err,
+			)
+		}
+		log.Printf("Loaded %v tokens from %v", len(tokens), *tokensFile)
+	}
+	if "" != *auditFile {
+		if err := openAudit(*auditFile); nil != err {
+			log.Fatalf(
+				"Unable to open audit log %v: %v",
+				*auditFile,
+				err,
+			)
+		}
+	}
+	if "" != *pcapDir {
+		names := []string{"http"}
+		if "" != *rawTCP {
+			names = append(names, "raw-tcp")
+		}
+		if "" != *smtpAddr {
+			names = append(names, "smtp")
+		}
+		if "" != *ftpAddr {
+			names = append(names, "ftp")
+		}
+		if err := openPcaps(*pcapDir, names...); nil != err {
+			log.Fatalf("Unable to set up pcap files: %v", err)
+		}
+	}
+	if "" != *clientsFile {
+		if 0 >= *clientsEvery {
+			log.Fatalf("Client statistics interval must be positive")
+		}
+		fn, err := filepath.Abs(*clientsFile)
+		if nil != err {
+			log.Fatalf("Unable to find %v: %v", *clientsFile, err)
+		}
+		if err := loadClientStats(fn, *clientsEvery); nil != err {
+			log.Fatalf("Unable to load client statistics: %v", err)
+		}
+	}
+	var ys yaraScanner
+	if "" != *yaraRules {
+		if ys, err = newYARAScanner(*yaraRules, *yaraBin); nil != err {
+			log.Fatalf("Unable to set up YARA scanning: %v", err)
+		}
+	}
+	var alog *accessLog
+	if "" != *accessFile {
+		if alog, err = openAccessLog(*accessFile); nil != err {
+			log.Fatalf(
+				"Unable to open access log %v: %v",
+				*accessFile,
+				err,
+			)
+		}
+	}
+
+	if "" != *ui {
+		if !strings.HasPrefix(*ui, "/") || !strings.HasSuffix(*ui, "/") {
+			log.Fatalf("UI path %q must start and end with a /", *ui)
+		}
+		if "" == *uiUsersFile {
+			log.Fatalf("The UI needs -ui-users")
+		}
+		if err := loadUIUsers(*uiUsersFile); nil != err {
+			log.Fatalf(
+				"Unable to load UI users from %v: %v",
+				*uiUsersFile,
+				err,
+			)
+		}
+		uiPrefix = *ui
+	}
+
+	/* Start the admin API, if we have one */
+	debugFeature.Set(*debug)
+	if "" != *adminAddr {
+		adminToken = *adminTokenFlag
+		al, err := listenAdmin(*adminAddr)
+		if nil != err {
+			log.Fatalf(
+				"Unable to listen for admin requests on %v: %v",
+				*adminAddr,
+				err,
+			)
+		}
+		log.Printf("Admin API listening on %v", al.Addr())
+	}
+
+	/* Work out where uploaders are */
+	if err := loadGeoDBs(geoIPFiles); nil != err {
+		log.Fatalf("Unable to load GeoIP databases: %v", err)
+	}
+	if *geoIPDirs && 0 == len(geoDBs) {
+		log.Fatalf("-geoip-dirs needs -geoip")
+	}
+	if *geoIPDirs && ("" != *storage || *pipeOnly) {
+		log.Fatalf("-geoip-dirs needs local files")
+	}
+
+	/* And who they are */
+	if *rdns {
+		if 0 >= *rdnsWait {
+			log.Fatalf("PTR lookup timeout must be positive")
+		}
+		rdnsTimeout = *rdnsWait
+	} else if *rdnsNames {
+		log.Fatalf("-rdns-names needs -rdns")
+	}
+
+	/* Work out where files go */
+	np, err := postfile.ParseNamePolicy(*names)
+	if nil != err {
+		log.Fatalf("Invalid -names: %v", err)
+	}
+	namePolicy = np
+	if err := parseRoutes(routes); nil != err {
+		log.Fatalf("Invalid -route: %v", err)
+	}
+	if 0 != len(pathRoutes) && ("" != *storage || *pipeOnly) {
+		log.Fatalf("-route needs local files")
+	}
+	if *tokenDirs && ("" == *tokensFile || "" != *storage || *pipeOnly) {
+		log.Fatalf("-token-dirs needs -tokens and local files")
+	}
+	if *appendMode && ("" != *storage || *pipeOnly) {
+		log.Fatalf("-append needs local files")
+	}
+	if 0 > *rotateSize || (0 != *rotateSize && !*appendMode) {
+		log.Fatalf("-rotate-size needs -append and a positive size")
+	}
+	if "number" != *rotateNames && "time" != *rotateNames {
+		log.Fatalf("Unknown -rotate-names %q", *rotateNames)
+	}
+	if *extract && ("" != *storage || *pipeOnly || *appendMode) {
+		log.Fatalf("-extract needs local files and no -append")
+	}
+	if "" != *clamavAddr && ("" != *storage || *pipeOnly) {
+		log.Fatalf("-clamav needs local files")
+	}
+	if !*tokenDirs && haveQuotas() {
+		log.Fatalf("Token quotas need -token-dirs")
+	}
+	switch *vhost {
+	case "", "name":
+	case "dir":
+		if "" != *storage || *pipeOnly {
+			log.Fatalf("-vhost dir needs local files")
+		}
+	default:
+		log.Fatalf("Unknown -vhost %q", *vhost)
+	}
+	var clamdSock string /* For unveil */
+	if "" != *storage {
+		if store, err = newRemote(
+			*storage,
+			*s3Endpoint,
+			*dir,
+		); nil != err {
+			log.Fatalf("Unable to set up storage %q: %v", *storage, err)
+		}
+		log.Printf("Storing files in %v", *storage)
+		if "" != *spoolDir {
+			if store, err = newSpoolStorage(
+				store,
+				*spoolDir,
+				*probeInterval,
+			); nil != err {
+				log.Fatalf(
+					"Unable to set up spool in %v: %v",
+					*spoolDir,
+					err,
+				)
+			}
+			log.Printf("Spooling to %v when needed", *spoolDir)
+		}
+	} else if !*pipeOnly {
+		/* Be in the output directory */
+		if err := os.MkdirAll(*dir, 0700); nil != err {
+			log.Fatalf("Unable to make directory %q: %v", *dir, err)
+		}
+		if err := os.Chdir(*dir); nil != err {
+			log.Fatalf("Unable to cd to %v: %v", *dir, err)
+		}
+		localFiles = true
+
+		/* Don't let anybody download or remove our own files */
+		protectFiles(
+			opwd,
+			*cert,
+			*key,
+			*certDir,
+			*configFile,
+			*tokensFile,
+			*accessFile,
+			*auditFile,
+			*clientsFile,
+			*uiUsersFile,
+			*decoyBody,
+			*torKey,
+			*sftpKeys,
+			*sftpHostKey,
+			*federateCA,
+			*federateCert,
+			*federateKey,
+			*federateSignKey,
+			*federatePeerKeys,
+			*spoolDir,
+			*pcapDir,
+		)
+		for _, p := range certPairs {
+			c, k, _ := strings.Cut(p, ",")
+			protectFiles(opwd, c, k)
+		}
+		allowCallbacks = *ttlCallbacks
+		local := postfile.LocalStorage{Names: np, Append: *appendMode}
+		store = local
+		var subdirs []func(*Meta) string
+		if *tokenDirs {
+			subdirs = append(subdirs, tokenDir)
+			log.Printf("Sorting files by token")
+		}
+		if "dir" == *vhost {
+			subdirs = append(subdirs, vhostDir)
+			log.Printf("Sorting files by Host")
+		}
+		if *geoIPDirs {
+			subdirs = append(subdirs, geoDir)
+			log.Printf("Sorting files by country and network")
+		}
+		if 0 != len(subdirs) {
+			store = subdirStorage{subdirs: subdirs, local: local}
+		}
+		if haveQuotas() {
+			store = quotaStorage{store}
+		}
+		if 0 != len(pathRoutes) {
+			store = routeStorage{fallback: store, local: local}
+			for _, pr := range pathRoutes {
+				log.Printf(
+					"Storing files under %s in %s",
+					pr.prefix,
+					pr.dir,
+				)
+			}
+		}
+		if "" != *clamavAddr {
+			cs, err := newClamavStorage(
+				store,
+				*clamavAddr,
+				*clamavTimeout,
+				*clamavActionName,
+			)
+			if nil != err {
+				log.Fatalf("Invalid -clamav-action: %v", err)
+			}
+			if "unix" == cs.network {
+				clamdSock = cs.addr
+			}
+			store = cs
+			log.Printf(
+				"Scanning uploads with clamd at %s (%s)",
+				*clamavAddr,
+				*clamavActionName,
+			)
+		}
+		if 0 != *rotateSize {
+			store = newRotateStorage(
+				store,
+				*rotateSize,
+				"time" == *rotateNames,
+				*rotateCompress,
+			)
+			log.Printf(
+				"Rotating files at %d bytes",
+				*rotateSize,
+			)
+		}
+		if *extract {
+			store = extractStorage{Storage: store, discard: *extractDiscard}
+			log.Printf("Unpacking archives")
+		}
+		go sweepExpired()
+		if 0 < *retention {
+			go enforceRetention(*retention)
+		}
+	}
+	if "" != *pipeCmd {
+		if *pipeOnly {
+			store = pipeStore{cmd: *pipeCmd}
+		} else {
+			store = teeStorage{
+				primary:   store,
+				secondary: pipeStore{cmd: *pipeCmd},
+			}
+		}
+		log.Printf("Sending uploads to %q", *pipeCmd)
+	} else if *pipeOnly {
+		log.Fatalf("Need a command to use with -pipe-only")
+	}
+	if *rdnsNames {
+		store = rdnsStorage{store}
+		log.Printf("Naming files after uploaders' PTR names")
+	}
+	if "name" == *vhost {
+		store = vhostStorage{store}
+		log.Printf("Naming files after uploads' Host")
+	}
+	quarantineMismatches = localFiles && !*appendMode
+	if *appendMode {
+		store = appendStorage{store}
+		log.Printf("Appending uploads to one file per client and path")
+	}
+	if *transcodeText {
+		tdir := scratchDir("transcode")
+		if err := os.MkdirAll(tdir, 0700); nil != err {
+			log.Fatalf(
+				"Unable to make transcoding directory %v: %v",
+				tdir,
+				err,
+			)
+		}
+		store = transcodeStorage{Storage: store, dir: tdir}
+		log.Printf("Storing UTF-8 copies of non-UTF-8 text")
+	}
+	var notifiers []notifier
+	if "" != *webhookURL {
+		if u, err := url.Parse(*webhookURL); nil != err ||
+			("http" != u.Scheme && "https" != u.Scheme) {
+			log.Fatalf("Invalid webhook URL %q", *webhookURL)
+		}
+		notifiers = append(notifiers, webhook{url: *webhookURL})
+		log.Printf("Sending upload details to %v", *webhookURL)
+	}
+	var notifyRE *regexp.Regexp
+	if "" != *notifyPaths {
+		if notifyRE, err = regexp.Compile(*notifyPaths); nil != err {
+			log.Fatalf("Invalid -notify-path regex: %v", err)
+		}
+	}
+	for _, c := range []struct{ kind, url string }{
+		{"slack", *slackURL},
+		{"discord", *discordURL},
+	} {
+		if "" == c.url {
+			continue
+		}
+		notifiers = append(notifiers, chatNotifier{
+			kind:    c.kind,
+			url:     c.url,
+			paths:   notifyRE,
+			minSize: *notifyMin,
+		})
+		log.Printf("Posting %s messages for uploads", c.kind)
+	}
+	if "" != *smtpServer {
+		sn, err := newSMTPNotifier(
+			*smtpServer,
+			*smtpFrom,
+			*smtpTo,
+			*smtpDigest,
+		)
+		if nil != err {
+			log.Fatalf("Unable to set up email notifications: %v", err)
+		}
+		notifiers = append(notifiers, sn)
+		log.Printf("Emailing %v about uploads", *smtpTo)
+	}
+	for _, u := range enrichURLs {
+		notifiers = append(notifiers, enricher{url: u})
+		log.Printf("Enriching upload metadata from %v", u)
+	}
+	if *sidecars {
+		if !localFiles {
+			log.Fatalf("Metadata sidecars need local files")
+		}
+		notifiers = append(notifiers, sidecarWriter{})
+		log.Printf("Saving upload metadata in %v", metaDir)
+	}
+	if "" != *yaraRules {
+		if !localFiles {
+			log.Fatalf("YARA scanning needs local files")
+		}
+		if *yaraNotify {
+			ys.notifiers = slices.Clone(notifiers)
+		}
+		notifiers = append(notifiers, ys)
+		log.Printf(
+			"Checking uploads against %d YARA rules files",
+			len(ys.rules),
+		)
+	}
+	if *sniff {
+		store = sniffStorage{Storage: store, ext: *sniffNames}
+		if *sniffNames {
+			log.Printf("Naming files after sniffed content types")
+		} else {
+			log.Printf("Sniffing content types")
+		}
+	} else if *sniffNames {
+		log.Fatalf("-sniff-ext needs -sniff")
+	}
+	if 0 != len(notifiers) {
+		store = notifyStorage{Storage: store, notifiers: notifiers}
+	}
+	if 0 < *burstMem {
+		bdir := *burstDir
+		if "" == bdir {
+			bdir = scratchDir("burst")
+		}
+		if err := os.MkdirAll(bdir, 0700); nil != err {
+			log.Fatalf(
+				"Unable to make burst directory %v: %v",
+				bdir,
+				err,
+			)
+		}
+		store = &burstStorage{
+			Storage: store,
+			dir:     bdir,
+			max:     *burstMem * 1024 * 1024,
+		}
+		log.Printf(
+			"Buffering up to %vMiB of uploads, then in %v",
+			*burstMem,
+			bdir,
+		)
+	}
+	if !expiry.IsZero() {
+		go handleExpiry(*expireAction, archive)
+		log.Printf("Will stop accepting uploads at %v", expiry)
+	}
+
+	/* Make sure we know what to do with non-TLS clients */
+	switch *badTLS {
+	case "http", "close", "reset":
+	default:
+		log.Fatalf("Unknown -tls-garbage action %q", *badTLS)
+	}
+
+	/* Tell clients when to retry during maintenance */
+	maintenanceRetry = *maintenanceAfter
+
+	/* Share indexes with other instances */
+	if "" != *federateAddr || 0 != len(federatePeers) {
+		if "" == *federateCA {
+			log.Fatalf("Federation needs -federate-ca")
+		}
+		if "" != *federateAddr && !localFiles {
+			log.Fatalf("Serving a federated index needs local files")
+		}
+		if "" != *federateAddr && "" == *federateSignKey {
+			log.Fatalf("Serving a federated index needs " +
+				"-federate-sign-key")
+		}
+		if 0 != len(federatePeers) && "" == *federatePeerKeys {
+			log.Fatalf("Federated peers need -federate-peer-keys")
+		}
+		fc, fk := *federateCert, *federateKey
+		if "" == fc {
+			fc = *cert
+		}
+		if "" == fk {
+			fk = *key
+		}
+		pair, err := tls.LoadX509KeyPair(fc, fk)
+		if nil != err {
+			log.Fatalf(
+				"Unable to load federation keypair from %v "+
+					"and %v: %v",
+				fc,
+				fk,
+				err,
+			)
+		}
+		conf, err := federationTLS(pair, *federateCA)
+		if nil != err {
+			log.Fatalf(
+				"Unable to load federation CA from %v: %v",
+				*federateCA,
+				err,
+			)
+		}
+		if federationName = *federateName; "" == federationName {
+			if federationName, err = os.Hostname(); nil != err {
+				log.Fatalf("Unable to get hostname: %v", err)
+			}
+		}
+		if "" != *federateAddr {
+			sk, err := readSigningKey(*federateSignKey)
+			if nil != err {
+				log.Fatalf(
+					"Unable to load federation signing "+
+						"key from %v: %v",
+					*federateSignKey,
+					err,
+				)
+			}
+			fl, err := serveFederation(*federateAddr, conf, sk)
+			if nil != err {
+				log.Fatalf(
+					"Unable to serve federated index on "+
+						"%v: %v",
+					*federateAddr,
+					err,
+				)
+			}
+			log.Printf(
+				"Serving federated index as %q on %v",
+				federationName,
+				fl.Addr(),
+			)
+		}
+		if 0 != len(federatePeers) {
+			ps := make([]string, len(federatePeers))
+			for i, p := range federatePeers {
+				ps[i] = strings.TrimSuffix(p, "/")
+			}
+			pks, err := readPeerKeys(*federatePeerKeys)
+			if nil != err {
+				log.Fatalf(
+					"Unable to load federated peers' keys "+
+						"from %v: %v",
+					*federatePeerKeys,
+					err,
+				)
+			}
+			go syncPeers(ps, conf, pks, *federateInterval)
+			log.Printf(
+				"Syncing indexes from %d federated peers",
+				len(ps),
+			)
+		}
+	}
+
+	/* Listing files needs files and auth, too */
+	if "" != *list {
+		if !strings.HasPrefix(*list, "/") {
+			log.Fatalf("List path %q must start with a /", *list)
+		}
+		if !localFiles {
+			log.Fatalf("Listing files needs local files")
+		}
+		if "" == *tokensFile {
+			log.Fatalf("Listing files needs -tokens")
+		}
+		listPath = *list
+	}
+
+	/* Progress reports need a real path */
+	if "" != *progress {
+		if !strings.HasPrefix(*progress, "/") {
+			log.Fatalf("Progress path %q must start with a /", *progress)
+		}
+		progressPath = *progress
+	}
+
+	/* Retries with the same key get the first result */
+	if 0 > *idempotency {
+		log.Fatalf("Idempotency period can't be negative")
+	}
+	idempotencyKeep = *idempotency
+
+	/* Beacons go in local files */
+	beaconPaths = splitList(*beacons)
+	for _, p := range beaconPaths {
+		if !strings.HasPrefix(p, "/") {
+			log.Fatalf("Beacon path %q must start with a /", p)
+		}
+	}
+	if 0 != len(beaconPaths) && !localFiles {
+		log.Fatalf("-beacon-paths needs local storage")
+	}
+	beaconNames = np
+
+	/* Downloads need somewhere to download from and auth */
+	if *download {
+		if !localFiles {
+			log.Fatalf("Downloads need local files")
+		}
+		if "" == *tokensFile {
+			log.Fatalf("Downloads need -tokens")
+		}
+		allowDownloads = true
+		downloadOnce = *once
+	} else if *once {
+		log.Fatalf("-download-once needs -download")
+	}
+
+	/* As do deletes */
+	if *del {
+		if !localFiles {
+			log.Fatalf("Deletes need local files")
+		}
+		if "" == *tokensFile {
+			log.Fatalf("Deletes need -tokens")
+		}
+		allowDeletes = true
+	}
+
+	/* Chrooting only works if everything's in the one directory */
+	if *chroot {
+		if !localFiles {
+			log.Fatalf("Chrooting needs local files")
+		}
+		if "" != *pipeCmd {
+			log.Fatalf("Can't run -pipe commands after chrooting")
+		}
+		if 0 < *burstMem && "" != *burstDir {
+			log.Fatalf("Can't use -burst-dir after chrooting")
+		}
+	}
+
+	/* WebSockets need a real path */
+	if "" != *websocket && !strings.HasPrefix(*websocket, "/") {
+		log.Fatalf("WebSocket path %q must start with a /", *websocket)
+	}
+	wsPath = *websocket
+	webDAV = *webdav
+
+	/* Work out how to copy bodies */
+	if 0 >= *bufSize {
+		log.Fatalf("Buffer size must be positive")
+	}
+	copyBufferSize = *bufSize
+	bufferWrites = *bufWrites
+
+	/* Don't let clients eat all the bandwidth */
+	if 0 > *bandwidth {
+		log.Fatalf("Bandwidth limit can't be negative")
+	} else if 0 != *bandwidth {
+		inboundLimit = newBandwidthLimiter(*bandwidth)
+	}
+
+	/* Or netcat */
+	if "" != *rawTCP {
+		rl, err := listenRawTCP(*rawTCP)
+		if nil != err {
+			log.Fatalf(
+				"Unable to listen for raw TCP on %v: %v",
+				*rawTCP,
+				err,
+			)
+		}
+		log.Printf("Accepting raw TCP connections on %v", rl.Addr())
+	}
+
+	/* Or as datagrams */
+	if "" != *udpAddr {
+		pc, err := listenUDP(*udpAddr, *udpPrefix, *udpPerSource)
+		if nil != err {
+			log.Fatalf(
+				"Unable to listen for UDP on %v: %v",
+				*udpAddr,
+				err,
+			)
+		}
+		log.Printf("Receiving UDP datagrams on %v", pc.LocalAddr())
+	}
+
+	/* Or from network gear */
+	if "" != *tftpAddr {
+		pc, err := listenTFTP(*tftpAddr)
+		if nil != err {
+			log.Fatalf(
+				"Unable to listen for TFTP on %v: %v",
+				*tftpAddr,
+				err,
+			)
+		}
+		log.Printf("Accepting files via TFTP on %v", pc.LocalAddr())
+	}
+
+	/* Or DNS queries */
+	if "" != *dnsAddr {
+		pc, err := listenDNS(*dnsAddr, *dnsZone, *dnsAnswer)
+		if nil != err {
+			log.Fatalf(
+				"Unable to serve DNS on %v: %v",
+				*dnsAddr,
+				err,
+			)
+		}
+		log.Printf(
+			"Receiving files in DNS queries for %v on %v",
+			*dnsZone,
+			pc.LocalAddr(),
+		)
+	}
+
+	/* Files might also come in via ping */
+	if *icmp {
+		if err := listenICMP(); nil != err {
+			log.Fatalf("Unable to receive files via ICMP: %v", err)
+		}
+	}
+
+	/* Don't wait forever for bodies */
+	firstByteTimeout = *firstByte
+	idleTimeout = *idle
+	if 0 > *minRateFlag {
+		log.Fatalf("Minimum rate can't be negative")
+	} else if 0 != *minRateFlag && 0 >= *minRateWindow {
+		log.Fatalf("-min-rate needs a positive -min-rate-period")
+	}
+	minRate = *minRateFlag
+	minRatePeriod = *minRateWindow
+
+	serveForm = *form
+	if *chunked {
+		cdir := *dir
+		if localFiles { /* We're in -dir, maybe chrooted */
+			cdir = "."
+		}
+		if err := setupChunkDir(cdir); nil != err {
+			log.Fatalf("Unable to set up chunked uploads: %v", err)
+		}
+		chunkedUploads = true
+		log.Printf("Accepting chunked uploads")
+	}
+	honeypotFeature.Set(*honeypotMode)
+	rawFeature.Set(*raw)
+	previewsFeature.Set(*notifyPreviews)
+
+	/* Only take what we're meant to take */
+	if err := parseContentTypes(*ctypes); nil != err {
+		log.Fatalf("Invalid -content-types: %v", err)
+	}
+	if *ctypesSniff && 0 == len(contentTypes) {
+		log.Fatalf("-content-types-sniff needs -content-types")
+	}
+	sniffContentTypes = *ctypesSniff
+
+	switch *respond {
+	case "text":
+	case "json":
+		respondJSON = true
+	default:
+		log.Fatalf("Unknown response format %q", *respond)
+	}
+
+	/* Health checks need a real path */
+	if "" != *health && !strings.HasPrefix(*health, "/") {
+		log.Fatalf("Health check path %q must start with a /", *health)
+	}
+	healthPath = *health
+
+	/* Add the one handler */
+	h := uploadChain()
+	if nil != auditLog {
+		h = withAudit(h)
+	}
+	if nil != alog {
+		h = alog.Wrap(h)
+	}
+	if 0 != *decoyStatus {
+		d, err := newDecoy(*decoyStatus, decoyHeaders, *decoyBody)
+		if nil != err {
+			log.Fatalf("Unable to set up decoy responses: %v", err)
+		}
+		h = d.Wrap(h)
+		log.Printf("Sending decoy %d responses", *decoyStatus)
+	}
+	if 0 != len(headers) {
+		hs, err := parseHeaders(headers)
+		if nil != err {
+			log.Fatalf("Unable to parse response headers: %v", err)
+		}
+		h = withHeaders(hs, h)
+	}
+	/* FastCGI and SCGI sockets may be plain names, like x.sock */
+	onUnix := strings.Contains(*laddr, "/")
+	if *serveFCGI || *serveSCGI {
+		_, _, err := net.SplitHostPort(*laddr)
+		onUnix = nil != err
+	}
+	httpUnix := *plaintext && onUnix
+	extraUnix := false /* Config file listener on a unix socket */
+	for _, cl := range configListeners {
+		if cl.plaintext && strings.Contains(cl.addr, "/") {
+			extraUnix = true
+		}
+	}
+	if 0 != len(trustProxies) {
+		if err := parseTrustedProxies(trustProxies); nil != err {
+			log.Fatalf("Unable to parse trusted proxies: %v", err)
+		}
+		log.Printf("Trusting proxies in %s", trustProxies.String())
+	}
+	/* Only a proxy would be on the other end of a unix socket */
+	trustUnixProxies = httpUnix || extraUnix
+	if 0 != len(trustProxies) || trustUnixProxies {
+		h = withTrustedProxies(h)
+	}
+	h = withInFlight(h)
+	if "" != *http3Addr {
+		h = withAltSvc(h)
+	}
+	http.Handle("/", h)
+
+	/* h2c is only for the plaintext listener */
+	if *h2c && !*plaintext {
+		log.Fatalf("-h2c needs -http")
+	}
+
+	/* Come up with a TLS or plaintext listener */
+	var (
+		l  net.Listener
+		cr *certReloader
+	)
+	sl, err := activatedListener()
+	if nil != err {
+		log.Fatalf("Socket activation failed: %v", err)
+	} else if nil != sl {
+		log.Printf("Using socket %v from systemd", sl.Addr())
+	}
+	if *serveFCGI && *serveSCGI {
+		log.Fatalf("Can't serve both FastCGI and SCGI")
+	}
+	gateway := *serveFCGI || *serveSCGI
+	unencrypted := *plaintext || gateway
+	if gateway && 0 != len(configListeners) {
+		log.Fatalf("Config file listeners can't serve FastCGI or SCGI")
+	}
+
+	/* All of the TLS listeners share keypairs */
+	loadKeypairs := func() *certReloader {
+		/* -c and -k are only implied if there's no other keypairs */
+		cr := &certReloader{pairs: certPairs, dir: *certDir}
+		useDefault := 0 == len(certPairs) && "" == *certDir
+		flag.Visit(func(f *flag.Flag) {
+			if "c" == f.Name || "k" == f.Name {
+				useDefault = true
+			}
+		})
+		if useDefault {
+			cr.certFile, cr.keyFile = cert, key
+		}
+		froms, err := cr.load()
+		if nil != err {
+			log.Fatalf("Unable to load keypairs: %v", err)
+		}
+		for _, f := range froms {
+			log.Printf("Loaded keypair from %v", f)
+		}
+		return cr
+	}
+	tlsListener := func(l net.Listener) net.Listener {
+		conf := &tls.Config{
+			GetCertificate: cr.GetCertificate,
+			NextProtos:     []string{"h2", "http/1.1"},
+		}
+		ts.apply(conf)
+		logFingerprints = *tlsFingerprint
+		metaFingerprints = *tlsFingerprintMeta
+		if logFingerprints || metaFingerprints {
+			conf.GetConfigForClient = fingerprintHello
+		}
+		return tls.NewListener(limitListener(l), conf)
+	}
+	/* plainListener wraps unencrypted listeners */
+	plainListener := func(l net.Listener) net.Listener {
+		l = limitListener(l)
+		if nil != pcapWriters["http"] {
+			l = pcapListener{Listener: l, name: "http"}
+		}
+		return l
+	}
+
+	if (httpUnix || gateway) && nil != sl {
+		l = sl
+	} else if unencrypted && onUnix {
+		l, err = listenUnix(opwd, *laddr)
+	} else if unencrypted {
+		l, err = listenTCP(sl, *laddr, *keepAlive, *linger, *noDelay, "")
+	} else {
+		cr = loadKeypairs()
+		/* Listen with TLS */
+		l, err = listenTCP(
+			sl,
+			*laddr,
+			*keepAlive,
+			*linger,
+			*noDelay,
+			*badTLS,
+		)
+		if nil == err {
+			l = tlsListener(l)
+		}
+	}
+	if nil != err {
+		log.Fatalf("Unable to listen on %v: %v", *laddr, err)
+	}
+	if unencrypted {
+		l = plainListener(l)
+	}
+	log.Printf("Listening for requests on %v", l.Addr())
+
+	/* Listeners from the config file */
+	var extras []net.Listener
+	for _, cl := range configListeners {
+		var el net.Listener
+		switch {
+		case cl.plaintext && strings.Contains(cl.addr, "/"):
+			el, err = listenUnix(opwd, cl.addr)
+		case cl.plaintext:
+			el, err = listenTCP(
+				nil,
+				cl.addr,
+				*keepAlive,
+				*linger,
+				*noDelay,
+				"",
+			)
+		default:
+			if nil == cr {
+				cr = loadKeypairs()
+			}
+			el, err = listenTCP(
+				nil,
+				cl.addr,
+				*keepAlive,
+				*linger,
+				*noDelay,
+				*badTLS,
+			)
+		}
+		if nil != err {
+			log.Fatalf("Unable to listen on %v: %v", cl.addr, err)
+		}
+		if cl.plaintext {
+			el = plainListener(el)
+		} else {
+			el = tlsListener(el)
+		}
+		log.Printf("Listening for requests on %v", el.Addr())
+		extras = append(extras, el)
+	}
+	var h3l net.PacketConn
+	if "" != *http3Addr && nil == cr {
+		log.Fatalf("-http3 needs TLS (no -http, -fcgi, or -scgi)")
+	} else if "" != *http3Addr {
+		if h3l, err = listenHTTP3(*http3Addr, cr); nil != err {
+			log.Fatalf(
+				"Unable to listen for HTTP/3 on %v: %v",
+				*http3Addr,
+				err,
+			)
+		}
+		log.Printf(
+			"Listening for HTTP/3 requests on %v",
+			h3l.LocalAddr(),
+		)
+	}
+
+	/* Publish ourselves on Tor, if we're not behind a web server */
+	if "" != *torControl {
+		if gateway {
+			log.Fatalf("Onion services need an HTTP listener")
+		}
+		target, err := onionTarget(l.Addr())
+		if nil != err {
+			log.Fatalf("Unable to work out onion target: %v", err)
+		}
+		port, scheme := 443, "https"
+		if *plaintext {
+			port, scheme = 80, "http"
+		}
+		host, err := publishOnion(*torControl, *torKey, port, target)
+		if nil != err {
+			log.Fatalf(
+				"Unable to publish onion service via %v: %v",
+				*torControl,
+				err,
+			)
+		}
+		log.Printf("Onion service at %s://%s", scheme, host)
+	} else if "" != *torKey {
+		log.Fatalf("-tor-key needs -tor-control")
+	}
+
+	/* Mail and FTP can use our keypair for STARTTLS and AUTH TLS */
+	var starttls *tls.Config
+	if nil != cr {
+		starttls = &tls.Config{GetCertificate: cr.GetCertificate}
+		ts.apply(starttls)
+	}
+	if "" != *smtpAddr {
+		ml, err := listenSMTP(*smtpAddr, starttls, *smtpAttachments)
+		if nil != err {
+			log.Fatalf(
+				"Unable to listen for mail on %v: %v",
+				*smtpAddr,
+				err,
+			)
+		}
+		log.Printf("Accepting mail on %v", ml.Addr())
+	}
+	if "" != *ftpAddr {
+		fl, err := listenFTP(*ftpAddr, starttls)
+		if nil != err {
+			log.Fatalf(
+				"Unable to listen for FTP on %v: %v",
+				*ftpAddr,
+				err,
+			)
+		}
+		log.Printf("Accepting files via FTP on %v", fl.Addr())
+	}
+	if "" != *sftpAddr {
+		if "" == *sftpKeys {
+			log.Fatalf("-sftp needs -sftp-keys")
+		}
+		/* Key files are relative to where we started */
+		kf, hkf := *sftpKeys, *sftpHostKey
+		if !filepath.IsAbs(kf) {
+			kf = filepath.Join(opwd, kf)
+		}
+		if "" != hkf && !filepath.IsAbs(hkf) {
+			hkf = filepath.Join(opwd, hkf)
+		}
+		sl, err := listenSFTP(*sftpAddr, kf, hkf, *scpSink)
+		if nil != err {
+			log.Fatalf(
+				"Unable to listen for SFTP on %v: %v",
+				*sftpAddr,
+				err,
+			)
+		}
+		log.Printf("Accepting files via SFTP on %v", sl.Addr())
+	}
+
+	/* Don't need to be root anymore */
+	ra, err := lookupRunAs(*runUser, *runGroup)
+	if nil != err {
+		log.Fatalf("Unable to find who to run as: %v", err)
+	}
+	if *chroot {
+		if err := chrootHere(); nil != err {
+			log.Fatalf("Unable to chroot to %v: %v", *dir, err)
+		}
+		log.Printf("Chrooted to %v", *dir)
+	}
+	if err := ra.drop(); nil != err {
+		log.Fatalf("Unable to drop privileges: %v", err)
+	} else if nil != ra {
+		log.Printf(
+			"Running as UID %d, GID %d",
+			os.Getuid(),
+			os.Getgid(),
+		)
+	}
+
+	/* On OpenBSD, give up everything else, too */
+	unixSocks := (gateway && onUnix) || httpUnix || extraUnix ||
+		strings.Contains(*adminAddr, "/") || "" != clamdSock
+	ld := lockdown{
+		exec: "" != *pipeCmd || strings.HasPrefix(*storage, "sqlite:") ||
+			"" != *yaraRules,
+		unix:   unixSocks,
+		unveil: localFiles && "" == *pipeCmd && "" == *yaraRules,
+		unveils: map[string]string{
+			".":                 "rwc",
+			*cert:               "r",
+			*key:                "r",
+			"/etc/hosts":        "r",
+			"/etc/resolv.conf":  "r",
+			"/etc/ssl/cert.pem": "r",
+		},
+	}
+	if "" != *configFile {
+		ld.unveils[*configFile] = "r"
+	}
+	/* Other scratch files are in ., with the uploads */
+	if 0 < *burstMem && "" != *burstDir {
+		ld.unveils[*burstDir] = "rwc"
+	}
+	for _, p := range certPairs {
+		c, k, _ := strings.Cut(p, ",")
+		ld.unveils[c] = "r"
+		ld.unveils[k] = "r"
+	}
+	if "" != *certDir {
+		ld.unveils[*certDir] = "r"
+	}
+	if "" != clamdSock {
+		ld.unveils[clamdSock] = "rw"
+	}
+	if "" != clientStatsFile {
+		ld.unveils[filepath.Dir(clientStatsFile)] = "rwc"
+	}
+	if err := ld.apply(); nil != err {
+		log.Fatalf("Unable to restrict ourselves: %v", err)
+	}
+	reloadOnHUP(cr, *configFile)
+	sdNotify("READY=1")
+	go sdWatchdog()
+
+	/* Handle FastCGI and SCGI */
+	if gateway {
+		serve := fcgi.Serve
+		if *serveSCGI {
+			serve = scgiServe
+		}
+		done := shutdownOnSignal(nil, l, *grace)
+		err := serve(l, nil)
+		if !shuttingDown.Load() {
+			log.Fatalf("Error: %v", err)
+		}
+		<-done
+		serviceStopped()
+		return
+	}
+
+	/* Handle HTTPS calls */
+	srv := &http.Server{
+		ConnState:         trackConn,
+		Protocols:         new(http.Protocols),
+		ReadHeaderTimeout: *readHeaderTimeout,
+		ReadTimeout:       *readTimeout,
+		WriteTimeout:      *writeTimeout,
+		IdleTimeout:       *httpIdleTimeout,
+	}
+	srv.Protocols.SetHTTP1(true)
+	srv.Protocols.SetHTTP2(true)
+	if *h2c {
+		srv.Protocols.SetUnencryptedHTTP2(true)
+	}
+	if metaFingerprints {
+		srv.ConnContext = fingerprintContext
+		srv.ConnState = func(c net.Conn, s http.ConnState) {
+			trackConn(c, s)
+			forgetFingerprint(c, s)
+		}
+	}
+	done := shutdownOnSignal(srv, l, *grace)
+	if nil != h3l {
+		go serveHTTP3(h3l)
+	}
+	for _, el := range extras {
+		go func() {
+			if err := srv.Serve(el); http.ErrServerClosed != err {
+				log.Fatalf("Error: %v", err)
+			}
+		}()
+	}
+	if err := srv.Serve(l); http.ErrServerClosed != err {
+		log.Fatalf("Error: %v", err)
+	}
+	<-done
+	serviceStopped()
+}
+
+// listenUnix listens on the unix socket at path, relative to the original
+// working directory wd, which is removed when the listener's closed.
+func listenUnix(wd, path string) (net.Listener, error) {
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(wd, path)
+	}
+	l, err := net.Listen("unix", path)
+	if nil != err {
+		return nil, err
+	}
+	/* Make sure the socket is closed */
+	if ul, ok := l.(*net.UnixListener); ok {
+		ul.SetUnlinkOnClose(true)
+	}
+	return l, nil
+}
@@ -0,0 +1,128 @@
+//go:build !windows && !plan9
+
+package main
+
+/*
+ * privdrop.go
+ * Drop privileges and chroot after binding
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"crypto/x509"
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+/* runAs is who we become after binding. */
+type runAs struct {
+	uid    int
+	gid    int
+	groups []int
+}
+
+// lookupRunAs looks up the user and group with the given names or IDs.  If
+// group is empty, the user's primary group is used.  The user's
+// supplementary groups are kept.  If both are empty, lookupRunAs returns
+// nil.
+func lookupRunAs(username, group string) (*runAs, error) {
+	if "" == username && "" == group {
+		return nil, nil
+	}
+	ra := &runAs{uid: -1, gid: -1}
+	if "" != username {
+		u, err := user.Lookup(username)
+		if nil != err {
+			if u, err = user.LookupId(username); nil != err {
+				return nil, fmt.Errorf("looking up user: %w", err)
+			}
+		}
+		if ra.uid, err = strconv.Atoi(u.Uid); nil != err {
+			return nil, fmt.Errorf("parsing UID %q: %w", u.Uid, err)
+		}
+		if ra.gid, err = strconv.Atoi(u.Gid); nil != err {
+			return nil, fmt.Errorf("parsing GID %q: %w", u.Gid, err)
+		}
+		gids, err := u.GroupIds()
+		if nil != err {
+			return nil, fmt.Errorf("getting groups: %w", err)
+		}
+		for _, g := range gids {
+			n, err := strconv.Atoi(g)
+			if nil != err {
+				return nil, fmt.Errorf(
+					"parsing GID %q: %w",
+					g,
+					err,
+				)
+			}
+			ra.groups = append(ra.groups, n)
+		}
+	}
+	if "" != group {
+		g, err := user.LookupGroup(group)
+		if nil != err {
+			if g, err = user.LookupGroupId(group); nil != err {
+				return nil, fmt.Errorf("looking up group: %w", err)
+			}
+		}
+		if ra.gid, err = strconv.Atoi(g.Gid); nil != err {
+			return nil, fmt.Errorf("parsing GID %q: %w", g.Gid, err)
+		}
+	}
+	if 0 == len(ra.groups) {
+		ra.groups = []int{ra.gid}
+	}
+	return ra, nil
+}
+
+// drop switches to ra's user and groups.  It's a no-op if ra is nil.
+func (ra *runAs) drop() error {
+	if nil == ra {
+		return nil
+	}
+
+	/* Groups first, while we're still allowed */
+	if err := syscall.Setgroups(ra.groups); nil != err {
+		return fmt.Errorf("setting supplementary groups: %w", err)
+	}
+	if err := syscall.Setgid(ra.gid); nil != err {
+		return fmt.Errorf("setting GID to %d: %w", ra.gid, err)
+	}
+	if -1 == ra.uid {
+		return nil
+	}
+	if err := syscall.Setuid(ra.uid); nil != err {
+		return fmt.Errorf("setting UID to %d: %w", ra.uid, err)
+	}
+
+	/* Make sure there's no going back */
+	if 0 != ra.uid && nil == syscall.Setuid(0) {
+		return fmt.Errorf("able to regain root after dropping privileges")
+	}
+	return nil
+}
+
+// chrootHere chroots into the current directory.  The system's root CAs are
+// loaded first, as they won't be available afterwards.
+func chrootHere() error {
+	if _, err := x509.SystemCertPool(); nil != err {
+		return fmt.Errorf("loading root CAs: %w", err)
+	}
+	if err := syscall.Chroot("."); nil != err {
+		return err
+	}
+	return os.Chdir("/")
+}
+
+// withUmask calls f with the umask set to mask, so files f creates, like
+// unix sockets, start out with restrictive permissions.
+func withUmask(mask int, f func() error) error {
+	defer syscall.Umask(syscall.Umask(mask))
+	return f()
+}
@@ -0,0 +1,35 @@
+//go:build windows || plan9
+
+package main
+
+/*
+ * privdrop_other.go
+ * Stubs for platforms without setuid and chroot
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import "errors"
+
+/* runAs is who we'd become after binding, if we could. */
+type runAs struct{}
+
+/* lookupRunAs returns an error unless there's nothing to look up. */
+func lookupRunAs(username, group string) (*runAs, error) {
+	if "" == username && "" == group {
+		return nil, nil
+	}
+	return nil, errors.New("changing users not supported on this platform")
+}
+
+/* drop is a no-op, as lookupRunAs never returns a runAs. */
+func (ra *runAs) drop() error { return nil }
+
+/* chrootHere returns an error, as there's no chroot here. */
+func chrootHere() error {
+	return errors.New("chroot not supported on this platform")
+}
+
+/* withUmask calls f, as there's no umask here. */
+func withUmask(mask int, f func() error) error { return f() }
@@ -0,0 +1,158 @@
+package main
+
+/*
+ * progress.go
+ * Report how much of an upload we've got so far
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// progressHeader is the request header with which clients give
+	// uploads an ID, for checking progress.
+	progressHeader = "X-Postfile-Upload-Id"
+	/* progressMaxID is the longest ID we'll track */
+	progressMaxID = 128
+	/* progressMax is the most uploads we'll track at once */
+	progressMax = 10000
+	/* progressKeep is how long we remember finished uploads */
+	progressKeep = 5 * time.Minute
+)
+
+var (
+	/* progressPath is where clients GET the progress of uploads, by ID */
+	progressPath string
+
+	// uploadsInProgress holds uploads with IDs, by the name of the token
+	// used for the upload and the ID, so clients can only see their own
+	// uploads.
+	uploadsInProgress  = make(map[[2]string]*uploadProgress)
+	uploadsInProgressL sync.Mutex
+)
+
+/* uploadProgress is how far along an upload is. */
+type uploadProgress struct {
+	started  time.Time
+	expected int64 /* -1 if unknown */
+	received atomic.Int64
+	done     atomic.Bool
+}
+
+/* MarshalJSON returns the upload's progress as JSON. */
+func (up *uploadProgress) MarshalJSON() ([]byte, error) {
+	v := struct {
+		Received int64     `json:"received"`
+		Expected *int64    `json:"expected,omitempty"`
+		Started  time.Time `json:"started"`
+		Done     bool      `json:"done"`
+	}{
+		Received: up.received.Load(),
+		Started:  up.started,
+		Done:     up.done.Load(),
+	}
+	if 0 <= up.expected {
+		v.Expected = &up.expected
+	}
+	return json.Marshal(v)
+}
+
+/* progressReader counts bytes as they're read. */
+type progressReader struct {
+	io.ReadCloser
+	up *uploadProgress
+}
+
+/* Read reads from the underlying ReadCloser and notes how much was read. */
+func (pr progressReader) Read(b []byte) (int, error) {
+	n, err := pr.ReadCloser.Read(b)
+	pr.up.received.Add(int64(n))
+	return n, err
+}
+
+// withProgress tracks how much has been read of uploads with an ID in
+// progressHeader.  Uploads are forgotten progressKeep after they're done.
+func withProgress(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(progressHeader)
+		if "" == id || progressMaxID < len(id) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		key := [2]string{tokenName(r), id}
+		up := &uploadProgress{
+			started:  time.Now(),
+			expected: r.ContentLength,
+		}
+
+		/* Start tracking, if there's room */
+		uploadsInProgressL.Lock()
+		if progressMax <= len(uploadsInProgress) {
+			uploadsInProgressL.Unlock()
+			requestLog(r).Printf("Too many uploads to track %q", id)
+			next.ServeHTTP(w, r)
+			return
+		}
+		uploadsInProgress[key] = up
+		uploadsInProgressL.Unlock()
+
+		/* Count the body as it comes in */
+		r.Body = progressReader{ReadCloser: r.Body, up: up}
+		next.ServeHTTP(w, r)
+
+		/* Remember it for a bit, unless it's been replaced */
+		up.done.Store(true)
+		time.AfterFunc(progressKeep, func() {
+			uploadsInProgressL.Lock()
+			defer uploadsInProgressL.Unlock()
+			if up == uploadsInProgress[key] {
+				delete(uploadsInProgress, key)
+			}
+		})
+	})
+}
+
+/* isProgressRequest returns true if r is asking about an upload's progress. */
+func isProgressRequest(r *http.Request) bool {
+	return "" != progressPath && progressPath == r.URL.Path
+}
+
+// handleProgress tells the client how much has been received of the upload
+// with the ID in the id parameter, as JSON.
+func handleProgress(w http.ResponseWriter, r *http.Request, rl reqLog) {
+	if http.MethodGet != r.Method && http.MethodHead != r.Method {
+		http.Error(w, "Invalid method", http.StatusMethodNotAllowed)
+		return
+	}
+	if !authorized(r) {
+		rl.Printf("Unauthorized progress request")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	id := r.FormValue("id")
+	if "" == id {
+		http.Error(w, "Need id", http.StatusBadRequest)
+		return
+	}
+	uploadsInProgressL.Lock()
+	up, ok := uploadsInProgress[[2]string{tokenName(r), id}]
+	uploadsInProgressL.Unlock()
+	if !ok {
+		http.Error(w, "Unknown upload", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(w).Encode(up); nil != err {
+		rl.Printf("Error sending progress: %v", err)
+	}
+}
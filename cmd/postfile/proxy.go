@@ -0,0 +1,125 @@
+package main
+
+/*
+ * proxy.go
+ * Believe reverse proxies about who the client is
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+/* trustedProxies are the networks from which we believe X-Forwarded-For. */
+var trustedProxies []netip.Prefix
+
+// trustUnixProxies makes us believe X-Forwarded-For from anything connected
+// to a unix socket.
+var trustUnixProxies bool
+
+// parseTrustedProxies parses the CIDR ranges or single addresses in ps into
+// trustedProxies.
+func parseTrustedProxies(ps []string) error {
+	for _, p := range ps {
+		pfx, err := netip.ParsePrefix(p)
+		if nil != err {
+			a, aerr := netip.ParseAddr(p)
+			if nil != aerr {
+				return fmt.Errorf("invalid proxy %q: %w", p, err)
+			}
+			pfx = netip.PrefixFrom(a, a.BitLen())
+		}
+		trustedProxies = append(trustedProxies, pfx.Masked())
+	}
+	return nil
+}
+
+/* trustedProxy returns true if a is a trusted proxy. */
+func trustedProxy(a netip.Addr) bool {
+	a = a.Unmap()
+	for _, p := range trustedProxies {
+		if p.Contains(a) {
+			return true
+		}
+	}
+	return false
+}
+
+// withTrustedProxies returns a handler which, for requests from a trusted
+// proxy, sets the request's RemoteAddr to the client's address from
+// X-Forwarded-For or X-Real-IP before calling next.  The client is the
+// rightmost address in X-Forwarded-For which isn't a trusted proxy, as the
+// ones to its left could have come from the client itself.  As proxies
+// don't say which port the client used, the port is 0.
+func withTrustedProxies(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if c, ok := forwardedFor(r); ok {
+			r.RemoteAddr = net.JoinHostPort(c.String(), "0")
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// forwardedFor returns the client address a trusted proxy says it
+// forwarded r for.  If r didn't come from a trusted proxy or the proxy
+// didn't say, forwardedFor returns false.
+func forwardedFor(r *http.Request) (netip.Addr, bool) {
+	/* Connections to unix sockets come from @ */
+	fromProxy := trustUnixProxies && "@" == r.RemoteAddr
+	if ap, err := netip.ParseAddrPort(r.RemoteAddr); nil == err {
+		fromProxy = trustedProxy(ap.Addr())
+	}
+	if !fromProxy {
+		return netip.Addr{}, false
+	}
+
+	/* Work backwards through the proxies */
+	var (
+		hops   []string
+		client netip.Addr
+	)
+	for _, v := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(v, ",")...)
+	}
+	for i := len(hops) - 1; 0 <= i; i-- {
+		a, err := parseForwarded(hops[i])
+		if nil != err {
+			return netip.Addr{}, false
+		}
+		client = a
+		if !trustedProxy(client) {
+			return client, true
+		}
+	}
+	if client.IsValid() {
+		/* All proxies, so the leftmost is as good as we'll get */
+		return client, true
+	}
+
+	/* Some proxies only do X-Real-IP */
+	a, err := parseForwarded(r.Header.Get("X-Real-IP"))
+	if nil != err {
+		return netip.Addr{}, false
+	}
+	return a, true
+}
+
+// parseForwarded parses an address from X-Forwarded-For or X-Real-IP.  As
+// the address ends up in filenames, IPv6 zones, which can be anything, aren't
+// allowed.
+func parseForwarded(s string) (netip.Addr, error) {
+	a, err := netip.ParseAddr(strings.TrimSpace(s))
+	if nil != err {
+		return netip.Addr{}, err
+	}
+	if "" != a.Zone() {
+		return netip.Addr{}, fmt.Errorf("zone in %q", s)
+	}
+	return a.Unmap(), nil
+}
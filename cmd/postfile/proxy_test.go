@@ -0,0 +1,105 @@
+package main
+
+/*
+ * proxy_test.go
+ * Tests for proxy.go
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestForwardedFor(t *testing.T) {
+	defer func() { trustedProxies = nil }()
+	if err := parseTrustedProxies(
+		[]string{"10.0.0.0/8", "192.0.2.1"},
+	); nil != err {
+		t.Fatalf("Error parsing trusted proxies: %v", err)
+	}
+	for _, c := range []struct {
+		name   string
+		remote string
+		xff    []string
+		realIP string
+		want   string /* Empty for not forwarded */
+	}{{
+		name:   "untrusted_proxy",
+		remote: "198.51.100.1:1234",
+		xff:    []string{"203.0.113.1"},
+	}, {
+		name:   "single_hop",
+		remote: "10.1.2.3:1234",
+		xff:    []string{"203.0.113.1"},
+		want:   "203.0.113.1",
+	}, {
+		name:   "rightmost_untrusted",
+		remote: "10.1.2.3:1234",
+		xff:    []string{"203.0.113.9, 203.0.113.1", "10.2.2.2"},
+		want:   "203.0.113.1",
+	}, {
+		name:   "all_proxies",
+		remote: "192.0.2.1:1234",
+		xff:    []string{"10.3.3.3, 10.2.2.2"},
+		want:   "10.3.3.3",
+	}, {
+		name:   "mapped",
+		remote: "[::ffff:10.1.2.3]:1234",
+		xff:    []string{"::ffff:203.0.113.1"},
+		want:   "203.0.113.1",
+	}, {
+		name:   "real_ip",
+		remote: "10.1.2.3:1234",
+		realIP: "2001:db8::1",
+		want:   "2001:db8::1",
+	}, {
+		name:   "garbage",
+		remote: "10.1.2.3:1234",
+		xff:    []string{"203.0.113.1, kittens"},
+	}, {
+		name:   "zone",
+		remote: "10.1.2.3:1234",
+		xff:    []string{"fe80::1%../../../etc/passwd"},
+	}, {
+		name:   "real_ip_zone",
+		remote: "10.1.2.3:1234",
+		realIP: "fe80::1%eth0",
+	}} {
+		t.Run(c.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/", nil)
+			r.RemoteAddr = c.remote
+			for _, v := range c.xff {
+				r.Header.Add("X-Forwarded-For", v)
+			}
+			if "" != c.realIP {
+				r.Header.Set("X-Real-IP", c.realIP)
+			}
+			a, ok := forwardedFor(r)
+			if "" == c.want {
+				if ok {
+					t.Errorf("Got %s, want nothing", a)
+				}
+				return
+			}
+			if !ok {
+				t.Fatalf("Got nothing, want %s", c.want)
+			}
+			if got := a.String(); got != c.want {
+				t.Errorf("Got %s, want %s", got, c.want)
+			}
+		})
+	}
+}
+
+func TestParseTrustedProxiesInvalid(t *testing.T) {
+	defer func() { trustedProxies = nil }()
+	for _, p := range []string{"", "kittens", "10.0.0.0/33"} {
+		if err := parseTrustedProxies([]string{p}); nil == err {
+			t.Errorf("Parsed invalid proxy %q", p)
+		}
+	}
+}
@@ -0,0 +1,27 @@
+package main
+
+/*
+ * raw.go
+ * Save whole requests, not just bodies
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httputil"
+)
+
+// withRequestHead returns a reader which reads r's request line and headers,
+// as sent or as close as we can tell for HTTP/2 and chunked requests, and
+// then body.
+func withRequestHead(r *http.Request, body io.Reader) (io.Reader, error) {
+	hdr, err := httputil.DumpRequest(r, false)
+	if nil != err {
+		return nil, err
+	}
+	return io.MultiReader(bytes.NewReader(hdr), body), nil
+}
@@ -0,0 +1,128 @@
+package main
+
+/*
+ * rawtcp.go
+ * Files sent over plain TCP connections
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"time"
+)
+
+// listenRawTCP accepts connections on addr and saves everything sent on
+// each to its own file, named after the client's address and the time it
+// connected.
+func listenRawTCP(addr string) (net.Listener, error) {
+	l, err := net.Listen("tcp", addr)
+	if nil != err {
+		return nil, err
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if nil != err {
+				log.Fatalf(
+					"Error accepting raw TCP connections: %v",
+					err,
+				)
+			}
+			go handleRawTCP(pcapConn("raw-tcp", limitConn(c)))
+		}
+	}()
+	return l, nil
+}
+
+/* handleRawTCP saves what's sent on c. */
+func handleRawTCP(c net.Conn) {
+	defer c.Close()
+	src := c.RemoteAddr().String()
+
+	/* Only take files when we would over HTTP */
+	switch {
+	case shuttingDown.Load():
+		return
+	case expired():
+		log.Printf("[%s] Expired", src)
+		return
+	case maintenanceFeature.Enabled():
+		log.Printf("[%s] Rejected during maintenance", src)
+		return
+	}
+	inFlight.Add(1)
+	defer inFlight.Done()
+
+	m := &Meta{Source: src, Time: time.Now()}
+	m.Path = "/tcp/" + m.Time.UTC().Format("20060102T150405Z")
+	u, err := store.Open(m)
+	if nil != err {
+		noteFailure()
+		log.Printf("[%s] Unable to open storage: %v", src, err)
+		return
+	}
+	n, err := copyBody(u, &connDeadlineReader{c: c})
+	if nil == err {
+		err = u.Commit()
+	} else {
+		u.Abort()
+	}
+	if nil != err {
+		noteFailure()
+		log.Printf(
+			"[%s] Error after writing %v bytes to %q: %v",
+			src,
+			n,
+			u.Name(),
+			err,
+		)
+		return
+	}
+	log.Printf("[%s] Wrote %v bytes from TCP to %q", src, n, u.Name())
+	noteUpload(m, u.Name(), n)
+}
+
+// connDeadlineReader reads from a connection with firstByteTimeout until
+// the first byte arrives and idleTimeout after that, or less if it's coming
+// in slower than minRate.
+type connDeadlineReader struct {
+	c       net.Conn
+	started bool
+	rw      rateWindow
+}
+
+/* Read implements io.Reader. */
+func (r *connDeadlineReader) Read(p []byte) (int, error) {
+	d := idleTimeout
+	if !r.started {
+		d = firstByteTimeout
+	}
+	dl, isSlow, err := r.rw.readDeadline(d)
+	if nil != err {
+		return 0, err
+	}
+	r.c.SetReadDeadline(dl)
+
+	n, err := r.c.Read(p)
+	r.rw.n += int64(n)
+	if 0 != n {
+		r.started = true
+	}
+	switch {
+	case errors.Is(err, os.ErrDeadlineExceeded) && isSlow:
+		err = r.rw.slow(err)
+	case errors.Is(err, os.ErrDeadlineExceeded) && !r.started:
+		firstByteTimeouts.Add(1)
+		err = fmt.Errorf("nothing sent after %s: %w", d, err)
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		idleTimeouts.Add(1)
+		err = fmt.Errorf("idle for %s: %w", d, err)
+	}
+	return n, err
+}
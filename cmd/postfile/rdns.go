@@ -0,0 +1,107 @@
+package main
+
+/*
+ * rdns.go
+ * Reverse DNS lookups of clients
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	/* rdnsCacheTTL is how long we remember a lookup's result */
+	rdnsCacheTTL = 10 * time.Minute
+	/* rdnsCacheMax is the most lookups we'll remember */
+	rdnsCacheMax = 4096
+)
+
+var (
+	// rdnsTimeout is how long to wait for a PTR lookup.  If it's zero,
+	// clients' addresses aren't looked up.
+	rdnsTimeout time.Duration
+
+	/* rdnsCache holds recent lookups, failed or not. */
+	rdnsCache  = make(map[string]rdnsEntry)
+	rdnsCacheL sync.Mutex
+)
+
+/* rdnsEntry is a cached lookup. */
+type rdnsEntry struct {
+	name    string
+	expires time.Time
+}
+
+// lookupPTR returns the first PTR name for the address in src, which may have
+// a port, or the empty string if there isn't one or we're not doing lookups.
+// Results are cached for rdnsCacheTTL.
+func lookupPTR(src string) string {
+	if 0 == rdnsTimeout {
+		return ""
+	}
+	if h, _, err := net.SplitHostPort(src); nil == err {
+		src = h
+	}
+	if nil == net.ParseIP(src) {
+		return ""
+	}
+
+	/* Might already know */
+	rdnsCacheL.Lock()
+	e, ok := rdnsCache[src]
+	rdnsCacheL.Unlock()
+	if ok && time.Now().Before(e.expires) {
+		return e.name
+	}
+
+	/* Nope, ask */
+	ctx, cancel := context.WithTimeout(context.Background(), rdnsTimeout)
+	defer cancel()
+	var name string
+	if ns, err := net.DefaultResolver.LookupAddr(ctx, src); nil == err &&
+		0 != len(ns) {
+		name = strings.TrimSuffix(ns[0], ".")
+	}
+
+	/* Remember for next time, making room if we need to */
+	rdnsCacheL.Lock()
+	defer rdnsCacheL.Unlock()
+	if rdnsCacheMax <= len(rdnsCache) {
+		now := time.Now()
+		for k, v := range rdnsCache {
+			if now.After(v.expires) {
+				delete(rdnsCache, k)
+			}
+		}
+	}
+	if rdnsCacheMax <= len(rdnsCache) {
+		clear(rdnsCache)
+	}
+	rdnsCache[src] = rdnsEntry{
+		name:    name,
+		expires: time.Now().Add(rdnsCacheTTL),
+	}
+	return name
+}
+
+// rdnsStorage puts clients' PTR names, when they have them, at the start of
+// uploads' names.
+type rdnsStorage struct{ Storage }
+
+/* Open opens the upload as if the client's source started with its name. */
+func (s rdnsStorage) Open(m *Meta) (Upload, error) {
+	name := lookupPTR(m.Source)
+	if "" == name {
+		return s.Storage.Open(m)
+	}
+	mm := *m
+	mm.Source = strings.ReplaceAll(name, "/", "_") + "_" + m.Source
+	return s.Storage.Open(&mm)
+}
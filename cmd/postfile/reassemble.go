@@ -0,0 +1,268 @@
+package main
+
+/*
+ * reassemble.go
+ * Put files sent in chunks back together
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// reassemblyMaxBytes is the most bytes of pending files all of the
+	// reassemblers may hold at once.  Past that, the oldest pending
+	// files are dropped to make room.
+	reassemblyMaxBytes = 128 << 20
+	/* readErrorPause is how long we wait after failing to read a packet */
+	readErrorPause = time.Second
+)
+
+var (
+	// reassemblers are all of the reassemblers, whose files are
+	// protected by reassemblyL.  reassemblyBytes is the number of bytes
+	// they hold between them.
+	reassemblers    []*reassembler
+	reassemblyBytes int
+	reassemblyL     sync.Mutex
+)
+
+// reassembler puts back together files sent a chunk at a time, for
+// protocols which can't carry a whole file in one message.  Resent chunks
+// replace earlier ones.  An empty chunk ends a file, as does idle without a
+// chunk.
+type reassembler struct {
+	proto      string /* For logging, e.g. ICMP */
+	idle       time.Duration
+	maxSize    int /* Per file */
+	maxPending int /* Files at once */
+	files      map[string]*reassembly
+}
+
+/* reassembly is a file being received. */
+type reassembly struct {
+	m      *Meta
+	chunks map[uint32][]byte
+	size   int
+	last   time.Time
+}
+
+// newReassembler returns a reassembler which gives up waiting for chunks
+// after idle and limits files to maxSize bytes and maxPending at once.
+func newReassembler(
+	proto string,
+	idle time.Duration,
+	maxSize int,
+	maxPending int,
+) *reassembler {
+	ra := &reassembler{
+		proto:      proto,
+		idle:       idle,
+		maxSize:    maxSize,
+		maxPending: maxPending,
+		files:      make(map[string]*reassembly),
+	}
+	reassemblyL.Lock()
+	reassemblers = append(reassemblers, ra)
+	reassemblyL.Unlock()
+	go ra.reap()
+	return ra
+}
+
+// remove stops reassembling the file identified by key, and gives back the
+// room it took.  reassemblyL must be held.
+func (ra *reassembler) remove(key string) {
+	f, ok := ra.files[key]
+	if !ok {
+		return
+	}
+	reassemblyBytes -= f.size
+	delete(ra.files, key)
+}
+
+// makeRoom drops the oldest pending files from all of the reassemblers until
+// there's room for n more bytes.  It returns false if there's not enough
+// room even with every file dropped.  reassemblyL must be held.
+func makeRoom(n int) bool {
+	for reassemblyMaxBytes < reassemblyBytes+n {
+		var (
+			ora  *reassembler
+			okey string
+			of   *reassembly
+		)
+		for _, ra := range reassemblers {
+			for k, f := range ra.files {
+				if nil == of || f.m.Time.Before(of.m.Time) {
+					ora, okey, of = ra, k, f
+				}
+			}
+		}
+		if nil == of {
+			return false
+		}
+		log.Printf(
+			"[%s] Too many bytes in pending files, dropping "+
+				"%s file %s",
+			of.m.Source,
+			ora.proto,
+			of.m.Path,
+		)
+		ora.remove(okey)
+	}
+	return true
+}
+
+// handleReadError logs an error receiving proto messages and waits a bit
+// before the next read.  It returns false if the error means there won't be
+// any more messages.
+func handleReadError(proto string, err error) bool {
+	if errors.Is(err, net.ErrClosed) {
+		return false
+	}
+	log.Printf("Error receiving %s messages: %v", proto, err)
+	time.Sleep(readErrorPause)
+	return true
+}
+
+// handle handles the chunk with sequence number seq of the file identified
+// by key.  If it's a new file, it's stored with the given source and path.
+func (ra *reassembler) handle(
+	key string,
+	src string,
+	path string,
+	seq uint32,
+	chunk []byte,
+) {
+	reassemblyL.Lock()
+	defer reassemblyL.Unlock()
+
+	/* An empty chunk means we're done */
+	f, ok := ra.files[key]
+	if 0 == len(chunk) {
+		if ok {
+			ra.remove(key)
+			go ra.store(f)
+		}
+		return
+	}
+
+	/* Start a new file, if we've room */
+	if !ok {
+		if expired() || maintenanceFeature.Enabled() {
+			return
+		}
+		if ra.maxPending <= len(ra.files) {
+			log.Printf(
+				"[%s] Too many pending %s files, dropping %s",
+				src,
+				ra.proto,
+				path,
+			)
+			return
+		}
+		f = &reassembly{
+			m:      &Meta{Source: src, Path: path, Time: time.Now()},
+			chunks: make(map[uint32][]byte),
+			last:   time.Now(),
+		}
+		ra.files[key] = f
+	}
+
+	/* Save the chunk, if there's room */
+	grow := len(chunk) - len(f.chunks[seq])
+	if ra.maxSize < f.size+grow {
+		log.Printf(
+			"[%s] %s file %s larger than %d bytes, dropping it",
+			src,
+			ra.proto,
+			path,
+			ra.maxSize,
+		)
+		ra.remove(key)
+		return
+	}
+	if !makeRoom(grow) {
+		ra.remove(key)
+		return
+	}
+	if f != ra.files[key] {
+		return /* We were the oldest file. */
+	}
+	f.chunks[seq] = bytes.Clone(chunk)
+	f.size += grow
+	reassemblyBytes += grow
+	f.last = time.Now()
+}
+
+/* reap stores files which haven't gotten a chunk in ra.idle. */
+func (ra *reassembler) reap() {
+	for range time.Tick(ra.idle / 4) {
+		reassemblyL.Lock()
+		for k, f := range ra.files {
+			if ra.idle < time.Since(f.last) {
+				ra.remove(k)
+				go ra.store(f)
+			}
+		}
+		reassemblyL.Unlock()
+	}
+}
+
+/* store sends the file through the usual storage. */
+func (ra *reassembler) store(f *reassembly) {
+	seqs := make([]uint32, 0, len(f.chunks))
+	for s := range f.chunks {
+		seqs = append(seqs, s)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	m := f.m
+	u, err := store.Open(m)
+	if nil != err {
+		noteFailure()
+		log.Printf("[%s] Unable to open storage: %v", m.Source, err)
+		return
+	}
+	var n int64
+	for _, s := range seqs {
+		var nw int
+		nw, err = u.Write(f.chunks[s])
+		n += int64(nw)
+		if nil != err {
+			break
+		}
+	}
+	if nil == err {
+		err = u.Commit()
+	} else {
+		u.Abort()
+	}
+	if nil != err {
+		noteFailure()
+		log.Printf(
+			"[%s] Error after writing %v bytes to %q: %v",
+			m.Source,
+			n,
+			u.Name(),
+			err,
+		)
+		return
+	}
+	log.Printf(
+		"[%s] Wrote %v bytes from %d %s messages to %q",
+		m.Source,
+		n,
+		len(seqs),
+		ra.proto,
+		u.Name(),
+	)
+	noteUpload(m, u.Name(), n)
+}
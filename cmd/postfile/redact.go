@@ -0,0 +1,174 @@
+package main
+
+/*
+ * redact.go
+ * Privacy-reduce what's logged
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"strings"
+)
+
+/* Log targets which may be redacted */
+const (
+	redactLog    = "log"    /* Main log, stderr or syslog */
+	redactAccess = "access" /* -access-log */
+	redactAudit  = "audit"  /* -audit */
+)
+
+/* redactedPath replaces paths which aren't logged */
+const redactedPath = "[path]"
+
+var (
+	/* redactors holds the redactor for each target which has one */
+	redactors = make(map[string]*redactor)
+
+	/* redactKey keys IP address hashes, which only last until restart */
+	redactKey = make([]byte, 32)
+
+	/* redactIPRE finds IPv4 and bracketed IPv6 addresses */
+	redactIPRE = regexp.MustCompile(
+		`\b\d{1,3}(?:\.\d{1,3}){3}\b|\[[0-9A-Fa-f:.]*:[0-9A-Fa-f:.]*\]`,
+	)
+)
+
+func init() {
+	if _, err := rand.Read(redactKey); nil != err {
+		panic(err)
+	}
+}
+
+// redactor redacts IP addresses and paths.  A nil *redactor doesn't redact
+// anything.
+type redactor struct {
+	hashIP     bool
+	truncateIP bool
+	omitPath   bool
+}
+
+// parseRedact parses a -redact flag of the form target=policy[,policy...]
+// and sets the target's redactor.
+func parseRedact(s string) error {
+	target, policies, ok := strings.Cut(s, "=")
+	switch target {
+	case redactLog, redactAccess, redactAudit:
+	default:
+		return fmt.Errorf("unknown target %q", target)
+	}
+	if !ok || "" == policies {
+		return fmt.Errorf("no policies for %s", target)
+	}
+	rd := &redactor{}
+	for _, p := range strings.Split(policies, ",") {
+		switch p {
+		case "hash-ip":
+			rd.hashIP = true
+		case "truncate-ip":
+			rd.truncateIP = true
+		case "omit-path":
+			rd.omitPath = true
+		default:
+			return fmt.Errorf("unknown policy %q", p)
+		}
+	}
+	if rd.hashIP && rd.truncateIP {
+		return fmt.Errorf("can't both hash and truncate IP addresses")
+	}
+	redactors[target] = rd
+	return nil
+}
+
+/* redactorFor returns target's redactor, which may be nil. */
+func redactorFor(target string) *redactor { return redactors[target] }
+
+/* Path returns p, or redactedPath if paths are omitted. */
+func (rd *redactor) Path(p string) string {
+	if nil == rd || !rd.omitPath {
+		return p
+	}
+	return redactedPath
+}
+
+/* IPs redacts the IP addresses in s. */
+func (rd *redactor) IPs(s string) string {
+	if nil == rd || (!rd.hashIP && !rd.truncateIP) {
+		return s
+	}
+	return redactIPRE.ReplaceAllStringFunc(s, func(m string) string {
+		bracketed := strings.HasPrefix(m, "[")
+		ip := net.ParseIP(strings.Trim(m, "[]"))
+		if nil == ip {
+			return m
+		}
+		r := rd.ip(ip)
+		if bracketed {
+			r = "[" + r + "]"
+		}
+		return r
+	})
+}
+
+/* ip redacts a single IP address. */
+func (rd *redactor) ip(ip net.IP) string {
+	if rd.hashIP {
+		m := hmac.New(sha256.New, redactKey)
+		m.Write(ip)
+		return "ip-" + hex.EncodeToString(m.Sum(nil))[:12]
+	}
+	if ip4 := ip.To4(); nil != ip4 {
+		return ip4.Mask(net.CIDRMask(24, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(48, 128)).String()
+}
+
+// Line redacts IP addresses in line, as well as any of the paths in paths
+// if paths are omitted.  Longer paths should come first.
+func (rd *redactor) Line(line string, paths ...string) string {
+	if nil == rd {
+		return line
+	}
+	if rd.omitPath {
+		var rs []string
+		for _, p := range paths {
+			if "" == p || "/" == p {
+				continue
+			}
+			/* Keep separators in filenames */
+			r := redactedPath
+			if strings.HasPrefix(p, "_") {
+				r = "_" + r
+			}
+			if strings.HasSuffix(p, "_") {
+				r += "_"
+			}
+			rs = append(rs, p, r)
+		}
+		line = strings.NewReplacer(rs...).Replace(line)
+	}
+	return rd.IPs(line)
+}
+
+/* redactWriter redacts IP addresses in everything written to it. */
+type redactWriter struct {
+	w  io.Writer
+	rd *redactor
+}
+
+/* Write redacts b and passes it on. */
+func (w redactWriter) Write(b []byte) (int, error) {
+	if _, err := io.WriteString(w.w, w.rd.IPs(string(b))); nil != err {
+		return 0, err
+	}
+	return len(b), nil
+}
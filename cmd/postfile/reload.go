@@ -0,0 +1,208 @@
+package main
+
+/*
+ * reload.go
+ * Reload the TLS keypairs and config on SIGHUP
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+// reloadableFlags are the flags whose new values in the config file take
+// effect on SIGHUP.  Changes to other flags need a restart.
+var reloadableFlags = map[string]bool{
+	"c": true,
+	"k": true,
+}
+
+// flagsL is held to change flags after startup, and to read flags which
+// might be changed.
+var flagsL sync.RWMutex
+
+// certReloader serves TLS keypairs which can be reloaded.  If there's more
+// than one, the first which suits the client's SNI and signature algorithms
+// is used, or the first of all if none do.
+type certReloader struct {
+	certFile *string  /* -c, or nil if there's no default keypair */
+	keyFile  *string  /* -k, or nil if there's no default keypair */
+	pairs    []string /* From -cert, as cert,key */
+	dir      string   /* From -cert-dir */
+
+	certs atomic.Pointer[[]*tls.Certificate]
+}
+
+// GetCertificate returns the keypair for the client.  It's meant to be a
+// tls.Config's GetCertificate.
+func (cr *certReloader) GetCertificate(
+	chi *tls.ClientHelloInfo,
+) (*tls.Certificate, error) {
+	cs := *cr.certs.Load()
+	if 1 == len(cs) {
+		return cs[0], nil
+	}
+	for _, c := range cs {
+		if nil == chi.SupportsCertificate(c) {
+			return c, nil
+		}
+	}
+	return cs[0], nil
+}
+
+// load loads the keypairs, and returns descriptions of where they came from
+// for logging.
+func (cr *certReloader) load() ([]string, error) {
+	var (
+		cs    []*tls.Certificate
+		froms []string
+	)
+	add := func(certFile, keyFile string) error {
+		pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if nil != err {
+			return fmt.Errorf(
+				"loading keypair from %v and %v: %w",
+				certFile,
+				keyFile,
+				err,
+			)
+		}
+		cs = append(cs, &pair)
+		froms = append(froms, certFile+" and "+keyFile)
+		return nil
+	}
+
+	/* The default keypair comes first */
+	if nil != cr.certFile && nil != cr.keyFile {
+		if err := add(*cr.certFile, *cr.keyFile); nil != err {
+			return nil, err
+		}
+	}
+
+	/* Then the ones from -cert */
+	for _, p := range cr.pairs {
+		certFile, keyFile, ok := strings.Cut(p, ",")
+		if !ok {
+			return nil, fmt.Errorf("keypair %q isn't cert,key", p)
+		}
+		if err := add(certFile, keyFile); nil != err {
+			return nil, err
+		}
+	}
+
+	/* Then any in the directory, name.crt or name.pem with name.key */
+	if "" != cr.dir {
+		des, err := os.ReadDir(cr.dir)
+		if nil != err {
+			return nil, err
+		}
+		for _, de := range des {
+			ext := filepath.Ext(de.Name())
+			if de.IsDir() || (".crt" != ext && ".pem" != ext) {
+				continue
+			}
+			certFile := filepath.Join(cr.dir, de.Name())
+			keyFile := strings.TrimSuffix(certFile, ext) + ".key"
+			if _, err := os.Stat(keyFile); nil != err {
+				continue
+			}
+			if err := add(certFile, keyFile); nil != err {
+				return nil, err
+			}
+		}
+	}
+
+	if 0 == len(cs) {
+		return nil, errors.New("no keypairs found")
+	}
+	cr.certs.Store(&cs)
+	return froms, nil
+}
+
+// reloadOnHUP reloads the config file named configFile, if it's not empty,
+// and then cr's keypairs on SIGHUP.  If either fails, the old settings and
+// keypairs are kept.
+func reloadOnHUP(cr *certReloader, configFile string) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	go func() {
+		for range ch {
+			if "" != configFile {
+				if err := reloadConfig(configFile); nil != err {
+					log.Printf(
+						"Unable to reload config "+
+							"from %v: %v",
+						configFile,
+						err,
+					)
+					continue
+				}
+				log.Printf("Reloaded config from %v", configFile)
+			}
+			if nil == cr {
+				continue
+			}
+			froms, err := cr.load()
+			if nil != err {
+				log.Printf("Unable to reload keypairs: %v", err)
+				continue
+			}
+			for _, f := range froms {
+				log.Printf("Reloaded keypair from %v", f)
+			}
+		}
+	}()
+}
+
+// reloadConfig re-reads the config file named fn and applies changes to
+// the reloadable flags.  Changes to other flags are logged.  Settings
+// removed from the file keep their current values.
+func reloadConfig(fn string) error {
+	ss, ls, err := parseConfig(fn)
+	if nil != err {
+		return err
+	}
+	flagsL.Lock()
+	defer flagsL.Unlock()
+	if !slices.Equal(ls, configListeners) {
+		configListeners = ls
+		log.Printf("Config listeners changed, restart to apply")
+	}
+	for _, cs := range ss {
+		if configOverridden[cs.name] {
+			continue
+		}
+		v := strings.Join(cs.values, "\n")
+		if configValues[cs.name] == v {
+			continue
+		}
+		configValues[cs.name] = v
+		if !reloadableFlags[cs.name] {
+			log.Printf(
+				"Config setting %q changed, restart "+
+					"to apply",
+				cs.name,
+			)
+			continue
+		}
+		if err := flag.Set(cs.name, cs.values[0]); nil != err {
+			return err
+		}
+		log.Printf("Config setting %q is now %q", cs.name, cs.values[0])
+	}
+	return nil
+}
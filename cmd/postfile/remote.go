@@ -0,0 +1,119 @@
+package main
+
+/*
+ * remote.go
+ * Remote storage common bits
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/* errAborted is given to remote backends when an upload is aborted */
+var errAborted = errors.New("upload aborted")
+
+// remoteTimeout is how long a request to remote storage may take.  Request
+// bodies are at most a part, so this is plenty.
+const remoteTimeout = 5 * time.Minute
+
+/* remoteClient makes requests to remote storage. */
+var remoteClient = &http.Client{Timeout: remoteTimeout}
+
+/* remoteNames counts names made by remoteName, to keep them unique. */
+var remoteNames atomic.Uint64
+
+// newRemote returns a Storage for the given storage URL.  Backends which need
+// to spool uploads do so in dir.
+func newRemote(storage, s3Endpoint, dir string) (Storage, error) {
+	u, err := url.Parse(storage)
+	if nil != err {
+		return nil, fmt.Errorf("parsing URL: %w", err)
+	}
+	switch u.Scheme {
+	case "s3":
+		return newS3Store(u, s3Endpoint)
+	case "gs":
+		return newGCSStore(u)
+	case "azblob":
+		return newAzureStore(u)
+	case "sqlite":
+		return newSQLiteStore(u, dir)
+	default:
+		return nil, fmt.Errorf("unsupported storage type %q", u.Scheme)
+	}
+}
+
+// remoteName returns the name for a remote object given a base name.  As we
+// can't cheaply check for existing names, it ends in a timestamp and a
+// counter, so uploads in the same tick don't clobber each other.
+func remoteName(base string) string {
+	return fmt.Sprintf(
+		"%s_%v_%d",
+		base,
+		time.Now().UnixNano(),
+		remoteNames.Add(1),
+	)
+}
+
+// readPart fills buf from r.  It returns the number of bytes read and whether
+// r's been exhausted.
+func readPart(r io.Reader, buf []byte) (int, bool, error) {
+	n, err := io.ReadFull(r, buf)
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return n, true, nil
+	}
+	return n, false, err
+}
+
+// pipeUpload is an Upload which streams to a function which reads from an
+// io.Reader, for backends which would rather pull than be pushed.
+type pipeUpload struct {
+	name string
+	pw   *io.PipeWriter
+	wg   sync.WaitGroup
+	err  error
+}
+
+// newPipeUpload returns a new pipeUpload which calls f in its own goroutine
+// with a reader which returns whatever's written to the pipeUpload.
+func newPipeUpload(name string, f func(r io.Reader) error) *pipeUpload {
+	pr, pw := io.Pipe()
+	u := &pipeUpload{name: name, pw: pw}
+	u.wg.Add(1)
+	go func() {
+		defer u.wg.Done()
+		u.err = f(pr)
+		pr.CloseWithError(u.err)
+	}()
+	return u
+}
+
+/* Name returns the upload's name. */
+func (u *pipeUpload) Name() string { return u.name }
+
+/* Write sends b to the reading function. */
+func (u *pipeUpload) Write(b []byte) (int, error) { return u.pw.Write(b) }
+
+/* Commit waits for the reading function to finish. */
+func (u *pipeUpload) Commit() error {
+	u.pw.Close()
+	u.wg.Wait()
+	return u.err
+}
+
+/* Abort tells the reading function to give up and waits for it to finish. */
+func (u *pipeUpload) Abort() error {
+	u.pw.CloseWithError(errAborted)
+	u.wg.Wait()
+	return nil
+}
@@ -0,0 +1,28 @@
+package main
+
+/*
+ * remote_test.go
+ * Tests for remote.go
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRemoteNameUnique(t *testing.T) {
+	seen := make(map[string]bool)
+	for range 1000 {
+		n := remoteName("base")
+		if !strings.HasPrefix(n, "base_") {
+			t.Fatalf("Name %q doesn't start with the base name", n)
+		}
+		if seen[n] {
+			t.Fatalf("Name %q made twice", n)
+		}
+		seen[n] = true
+	}
+}
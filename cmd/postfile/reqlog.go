@@ -0,0 +1,167 @@
+package main
+
+/*
+ * reqlog.go
+ * Request logging, in text or JSON
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/magisterquis/postfile"
+)
+
+/* jsonLogs is true if we're logging JSON objects instead of text lines */
+var jsonLogs bool
+
+// reqLog logs events about a single request, either as text lines prefixed
+// with a summary of the request or as JSON objects.
+type reqLog struct {
+	Time       time.Time `json:"time"`
+	RemoteAddr string    `json:"remote_addr"`
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	Query      string    `json:"query,omitempty"`
+	Proto      string    `json:"proto"`
+	Host       string    `json:"host"`
+	UserAgent  string    `json:"user_agent"`
+	TLS        *TLSInfo  `json:"tls,omitempty"`
+	Geo        *geoInfo  `json:"geo,omitempty"`
+	PTR        string    `json:"ptr,omitempty"`
+	Bytes      *int64    `json:"bytes,omitempty"`
+	Filename   string    `json:"filename,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	Message    string    `json:"message"`
+
+	rs    string   /* Request summary, for text lines */
+	paths []string /* Paths to redact, longest first */
+}
+
+// newReqLog returns a reqLog for r.  Requests which came in over TLS have
+// the connection's details at the end of the text summary, as do the
+// client address's GeoIP details and PTR name, if we know them.
+func newReqLog(r *http.Request) reqLog {
+	ti := postfile.NewTLSInfo(r.TLS)
+	gi := lookupGeo(r.RemoteAddr)
+	ptr := lookupPTR(r.RemoteAddr)
+	rs := fmt.Sprintf(
+		"%v %v %v %v Host:%q UA:%q",
+		r.RemoteAddr,
+		r.Method,
+		r.URL,
+		r.Proto,
+		r.Host,
+		r.Header.Get("User-Agent"),
+	)
+	if nil != ti {
+		rs += fmt.Sprintf(" TLS:%q", ti)
+	}
+	if nil != gi {
+		rs += fmt.Sprintf(" Geo:%q", gi)
+	}
+	if "" != ptr {
+		rs += fmt.Sprintf(" PTR:%q", ptr)
+	}
+	return reqLog{
+		RemoteAddr: r.RemoteAddr,
+		Method:     r.Method,
+		Path:       r.URL.Path,
+		Query:      r.URL.RawQuery,
+		Proto:      r.Proto,
+		Host:       r.Host,
+		UserAgent:  r.Header.Get("User-Agent"),
+		TLS:        ti,
+		Geo:        gi,
+		PTR:        ptr,
+		rs:         "[" + rs + "]",
+		paths: []string{
+			r.URL.String(),
+			r.RequestURI,
+			r.URL.Path,
+			"_" + strings.TrimPrefix(
+				postfile.BaseName(&Meta{Path: r.URL.Path}),
+				"_",
+			) + "_",
+		},
+	}
+}
+
+// With returns a copy of l with the number of bytes, filename, and error set.
+// The error may be nil.
+func (l reqLog) With(n int64, filename string, err error) reqLog {
+	l.Bytes = &n
+	l.Filename = filename
+	if nil != err {
+		l.Error = err.Error()
+	}
+	return l
+}
+
+/* Printf logs a message about the request. */
+func (l reqLog) Printf(format string, v ...any) {
+	msg := fmt.Sprintf(format, v...)
+
+	/* Remove paths, if we're meant to.  IP addresses are redacted by
+	the log's writer. */
+	if rd := redactorFor(redactLog); nil != rd && rd.omitPath {
+		msg = rd.Line(msg, l.paths...)
+		l.rs = rd.Line(l.rs, l.paths...)
+		l.Path = rd.Path(l.Path)
+		l.Query = ""
+		l.Filename = rd.Line(l.Filename, l.paths...)
+	}
+
+	if !jsonLogs {
+		log.Printf("%v %v", l.rs, msg)
+		return
+	}
+	l.Time = time.Now()
+	l.Message = msg
+	b, err := json.Marshal(l)
+	if nil != err {
+		log.Printf("Error marshalling log message %q: %v", msg, err)
+		return
+	}
+	log.Printf("%s", b)
+}
+
+// jsonLineWriter wraps log output which isn't already JSON into JSON objects.
+// It expects one line per call to Write, which is what the log package
+// does.
+type jsonLineWriter struct{ w io.Writer }
+
+/* Write writes b as a JSON object. */
+func (j jsonLineWriter) Write(b []byte) (int, error) {
+	line := bytes.TrimSuffix(b, []byte("\n"))
+	if bytes.HasPrefix(line, []byte("{")) {
+		return j.w.Write(b)
+	}
+	o, err := json.Marshal(struct {
+		Time    time.Time `json:"time"`
+		Message string    `json:"message"`
+	}{time.Now(), string(line)})
+	if nil != err {
+		return 0, err
+	}
+	if _, err := j.w.Write(append(o, '\n')); nil != err {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+/* logJSON switches logging to JSON objects. */
+func logJSON() {
+	jsonLogs = true
+	log.SetFlags(0)
+	log.SetOutput(jsonLineWriter{log.Writer()})
+}
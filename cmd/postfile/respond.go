@@ -0,0 +1,61 @@
+package main
+
+/*
+ * respond.go
+ * Tell clients how their uploads went
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+/* respondJSON is true if upload responses should always be JSON */
+var respondJSON bool
+
+/* uploadResponse is the JSON response to a successful upload. */
+type uploadResponse struct {
+	Bytes  int64  `json:"bytes"`
+	File   string `json:"file"`
+	SHA256 string `json:"sha256"`
+}
+
+// wantsJSON returns true if r should get a JSON response, either because
+// of -respond json or because it Accepts application/json.
+func wantsJSON(r *http.Request) bool {
+	if respondJSON {
+		return true
+	}
+	for _, a := range strings.Split(r.Header.Get("Accept"), ",") {
+		if mt, _, err := mime.ParseMediaType(
+			strings.TrimSpace(a),
+		); nil == err && "application/json" == mt {
+			return true
+		}
+	}
+	return false
+}
+
+// respondUpload tells the client how much of its upload was stored, and,
+// if it wants JSON, where and with which hash.
+func respondUpload(w http.ResponseWriter, r *http.Request, res uploadResponse) {
+	if !wantsJSON(r) {
+		fmt.Fprintf(w, "%v\n", res.Bytes)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(res); nil != err {
+		log.Printf(
+			"[%s] Error sending response: %v",
+			r.RemoteAddr,
+			err,
+		)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+/*
+ * retention.go
+ * Remove files older than the retention period
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"io/fs"
+	"log"
+	"time"
+)
+
+// enforceRetention removes uploads in the current directory older than age,
+// checking every so often.  It never returns.
+func enforceRetention(age time.Duration) {
+	/* Check ten times per retention period, but not too often or
+	too rarely. */
+	every := age / 10
+	if every < time.Second {
+		every = time.Second
+	} else if time.Hour < every {
+		every = time.Hour
+	}
+	for {
+		pruneOlder(time.Now().Add(-age))
+		time.Sleep(every)
+	}
+}
+
+/* pruneOlder removes uploaded files last modified before cutoff. */
+func pruneOlder(cutoff time.Time) {
+	walkUploads(func(path string, d fs.DirEntry, err error) error {
+		if nil != err {
+			log.Printf("Retention: unable to check %q: %v", path, err)
+			return nil
+		}
+		fi, err := d.Info()
+		if nil != err {
+			log.Printf("Retention: unable to stat %q: %v", path, err)
+			return nil
+		}
+		if !fi.ModTime().Before(cutoff) {
+			return nil
+		}
+		if err := removeUpload(path); nil != err {
+			log.Printf("Retention: unable to remove %q: %v", path, err)
+			return nil
+		}
+		log.Printf(
+			"Retention: removed %q, last modified %v",
+			path,
+			fi.ModTime().Format(time.RFC3339),
+		)
+		return nil
+	})
+}
@@ -0,0 +1,51 @@
+package main
+
+/*
+ * retention_test.go
+ * Tests for retention.go
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPruneOlder(t *testing.T) {
+	t.Chdir(t.TempDir())
+	old := time.Now().Add(-time.Hour)
+	for _, n := range []string{
+		"127.0.0.1:1234_foo_000000",
+		"sub/127.0.0.1:1234_foo_000000",
+		"key.pem",
+		"postfile.toml",
+		".meta/127.0.0.1:1234_foo_000000.json",
+	} {
+		if err := os.MkdirAll(filepath.Dir(n), 0700); nil != err {
+			t.Fatalf("Making directory for %s: %v", n, err)
+		}
+		if err := os.WriteFile(n, []byte("x"), 0600); nil != err {
+			t.Fatalf("Writing %s: %v", n, err)
+		}
+		if err := os.Chtimes(n, old, old); nil != err {
+			t.Fatalf("Aging %s: %v", n, err)
+		}
+	}
+	pruneOlder(time.Now())
+	for n, want := range map[string]bool{
+		"127.0.0.1:1234_foo_000000":            false,
+		"sub/127.0.0.1:1234_foo_000000":        false,
+		"key.pem":                              true,
+		"postfile.toml":                        true,
+		".meta/127.0.0.1:1234_foo_000000.json": true,
+	} {
+		_, err := os.Stat(n)
+		if got := nil == err; got != want {
+			t.Errorf("%s exists: got %v, want %v", n, got, want)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+/*
+ * rotate.go
+ * Rotate appended-to files when they get big
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/magisterquis/postfile"
+)
+
+// rotateTimeFormat is the format of the timestamp added to rotated files'
+// names, with -rotate-names time.
+const rotateTimeFormat = "20060102T150405Z"
+
+// rotateStorage rotates the files uploads are appended to when they've
+// grown to at least size bytes.  A file is only rotated when there's no
+// uploads being written to it, and rotated files are renamed to the first
+// unused name made by adding a number or, if timestamps is set, the time.
+// Rotated files may also be gzipped.
+type rotateStorage struct {
+	Storage
+	size       int64
+	timestamps bool
+	compress   bool
+
+	/* Uploads in progress, by file, and a lock for rotating */
+	open map[string]int
+	l    sync.Mutex
+}
+
+/* newRotateStorage returns a new rotateStorage wrapping s. */
+func newRotateStorage(
+	s Storage,
+	size int64,
+	timestamps bool,
+	compress bool,
+) *rotateStorage {
+	return &rotateStorage{
+		Storage:    s,
+		size:       size,
+		timestamps: timestamps,
+		compress:   compress,
+		open:       make(map[string]int),
+	}
+}
+
+// Open opens the upload.  The lock is held while opening so the file can't
+// be rotated out from under us before we count it as open.
+func (s *rotateStorage) Open(m *Meta) (Upload, error) {
+	s.l.Lock()
+	defer s.l.Unlock()
+	u, err := s.Storage.Open(m)
+	if nil != err {
+		return nil, err
+	}
+	s.open[u.Name()]++
+	return &rotateUpload{Upload: u, s: s}, nil
+}
+
+// done notes an upload to the file named fn is finished and, if it was the
+// last one and the file's big enough, rotates it.
+func (s *rotateStorage) done(fn string) {
+	s.l.Lock()
+	defer s.l.Unlock()
+	if s.open[fn]--; 0 < s.open[fn] {
+		return
+	}
+	delete(s.open, fn)
+	fi, err := os.Stat(fn)
+	if nil != err {
+		if !errors.Is(err, fs.ErrNotExist) {
+			log.Printf("Unable to check size of %s: %v", fn, err)
+		}
+		return
+	}
+	if fi.Size() < s.size {
+		return
+	}
+	rn, err := s.rotate(fn)
+	if nil != err {
+		log.Printf("Unable to rotate %s: %v", fn, err)
+		return
+	}
+	log.Printf("Rotated %d-byte %s to %s", fi.Size(), fn, rn)
+	if s.compress {
+		go compressRotated(rn)
+	}
+}
+
+// rotate renames the file named fn to the first unused rotated name, and
+// returns the new name.  Names are only checked, not reserved, so rotate
+// should only be called with s.l held.
+func (s *rotateStorage) rotate(fn string) (string, error) {
+	base := fn
+	if s.timestamps {
+		base += "." + time.Now().UTC().Format(rotateTimeFormat)
+		if !exists(base) && !exists(base+".gz") {
+			return base, os.Rename(fn, base)
+		}
+	}
+	for n := 1; n <= postfile.MaxFileNum; n++ {
+		rn := base + "." + strconv.Itoa(n)
+		if exists(rn) || exists(rn+".gz") {
+			continue
+		}
+		return rn, os.Rename(fn, rn)
+	}
+	return "", fmt.Errorf("too many rotated files")
+}
+
+/* exists returns true if there's something at the path p. */
+func exists(p string) bool {
+	_, err := os.Lstat(p)
+	return !errors.Is(err, fs.ErrNotExist)
+}
+
+/* rotateUpload is an upload to a file which may be rotated. */
+type rotateUpload struct {
+	Upload
+	s *rotateStorage
+}
+
+/* Commit commits the upload and rotates the file if it's time. */
+func (u *rotateUpload) Commit() error {
+	defer u.s.done(u.Name())
+	return u.Upload.Commit()
+}
+
+/* Abort aborts the upload and rotates the file if it's time. */
+func (u *rotateUpload) Abort() error {
+	defer u.s.done(u.Name())
+	return u.Upload.Abort()
+}
+
+// compressRotated gzips the rotated file named fn to fn.gz and removes fn.
+// Errors are logged.
+func compressRotated(fn string) {
+	if err := gzipFile(fn); nil != err {
+		log.Printf("Unable to compress %s: %v", fn, err)
+		return
+	}
+	if err := os.Remove(fn); nil != err {
+		log.Printf("Unable to remove compressed %s: %v", fn, err)
+	}
+}
+
+/* gzipFile gzips the file named fn to fn.gz. */
+func gzipFile(fn string) (err error) {
+	sf, err := os.Open(fn)
+	if nil != err {
+		return err
+	}
+	defer sf.Close()
+	df, err := os.OpenFile(
+		fn+".gz",
+		os.O_WRONLY|os.O_CREATE|os.O_EXCL,
+		0600,
+	)
+	if nil != err {
+		return err
+	}
+	defer func() {
+		if nil != err {
+			df.Close()
+			os.Remove(df.Name())
+		}
+	}()
+	gw := gzip.NewWriter(df)
+	if _, err := copyBody(gw, sf); nil != err {
+		return err
+	}
+	if err := gw.Close(); nil != err {
+		return err
+	}
+	return df.Close()
+}
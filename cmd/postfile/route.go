@@ -0,0 +1,164 @@
+package main
+
+/*
+ * route.go
+ * Send uploads to different directories by path
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"cmp"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/magisterquis/postfile"
+)
+
+// Routes send uploads with paths under a prefix to their own directory,
+// with the prefix taken off the path.  HTTP uploads may also have their own
+// size limit and tokens, which replace the ones from -tokens.  Routes are
+// given as
+//
+//	prefix=dir[,max-size=bytes][,tokens=file]
+//
+// and the longest matching prefix wins.
+
+// pathRoutes are the routes from -route, longest prefix first.
+var pathRoutes []pathRoute
+
+/* pathRoute is where uploads under a prefix go. */
+type pathRoute struct {
+	prefix  string
+	dir     string
+	maxSize int64             /* 0 for no limit */
+	tokens  map[string]string /* Token -> name, or nil for -tokens */
+}
+
+/* parseRoutes parses routes from -route and sets pathRoutes. */
+func parseRoutes(rs []string) error {
+	for _, r := range rs {
+		pr, err := parseRoute(r)
+		if nil != err {
+			return fmt.Errorf("route %q: %w", r, err)
+		}
+		pathRoutes = append(pathRoutes, pr)
+	}
+	slices.SortStableFunc(pathRoutes, func(a, b pathRoute) int {
+		return cmp.Compare(len(b.prefix), len(a.prefix))
+	})
+	return nil
+}
+
+/* parseRoute parses a single route. */
+func parseRoute(s string) (pathRoute, error) {
+	var pr pathRoute
+	fs := strings.Split(s, ",")
+	prefix, dir, ok := strings.Cut(fs[0], "=")
+	if !ok || "" == dir {
+		return pathRoute{}, fmt.Errorf("need prefix=dir")
+	}
+	if !strings.HasPrefix(prefix, "/") {
+		return pathRoute{}, fmt.Errorf("prefix must start with a /")
+	}
+	pr.prefix = path.Clean(prefix)
+	pr.dir = dir
+
+	/* Optional bits */
+	for _, f := range fs[1:] {
+		k, v, _ := strings.Cut(f, "=")
+		switch k {
+		case "max-size":
+			n, err := strconv.ParseInt(v, 0, 64)
+			if nil != err || 0 >= n {
+				return pathRoute{}, fmt.Errorf(
+					"invalid max-size %q",
+					v,
+				)
+			}
+			pr.maxSize = n
+		case "tokens":
+			ts, _, err := readTokens(v)
+			if nil != err {
+				return pathRoute{}, fmt.Errorf(
+					"loading tokens from %v: %w",
+					v,
+					err,
+				)
+			}
+			pr.tokens = ts
+		default:
+			return pathRoute{}, fmt.Errorf("unknown option %q", k)
+		}
+	}
+	return pr, nil
+}
+
+// routeFor returns the route for the upload path p, or nil if it doesn't
+// have one.  A prefix matches itself and anything under it.
+func routeFor(p string) *pathRoute {
+	p = path.Clean("/" + p)
+	for i, pr := range pathRoutes {
+		if "/" == pr.prefix || p == pr.prefix ||
+			strings.HasPrefix(p, pr.prefix+"/") {
+			return &pathRoutes[i]
+		}
+	}
+	return nil
+}
+
+// routeStorage stores uploads for routes as local files, as by local, in the
+// routes' directories, and everything else in fallback.
+type routeStorage struct {
+	fallback Storage
+	local    postfile.LocalStorage
+}
+
+/* Open opens a new file for the upload in its route's directory. */
+func (s routeStorage) Open(m *Meta) (Upload, error) {
+	pr := routeFor(m.Path)
+	if nil == pr {
+		return s.fallback.Open(m)
+	}
+	if err := os.MkdirAll(pr.dir, 0700); nil != err {
+		return nil, err
+	}
+	mm := *m
+	mm.Path = strings.TrimPrefix(path.Clean("/"+m.Path), pr.prefix)
+	ls := s.local
+	ls.Dir = pr.dir
+	return ls.Open(&mm)
+}
+
+// withRouteLimits rejects HTTP uploads which are bigger than their route
+// allows.
+func withRouteLimits(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pr := routeFor(r.URL.Path)
+		if nil == pr || 0 == pr.maxSize {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if pr.maxSize < r.ContentLength {
+			requestLog(r).Printf(
+				"Upload of %d bytes too big for %s",
+				r.ContentLength,
+				pr.prefix,
+			)
+			http.Error(
+				w,
+				"Too large",
+				http.StatusRequestEntityTooLarge,
+			)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, pr.maxSize)
+		next.ServeHTTP(w, r)
+	})
+}
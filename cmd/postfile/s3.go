@@ -0,0 +1,350 @@
+package main
+
+/*
+ * s3.go
+ * Send uploads to an S3-compatible bucket
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/magisterquis/postfile"
+)
+
+// S3PARTSIZE is the size of the parts of a multipart upload.  Bodies smaller
+// than this are sent in a single request.
+const S3PARTSIZE = 8 * 1024 * 1024
+
+// s3Store sends uploads to an S3-compatible bucket, using the same
+// credentials environment variables as the AWS CLI.
+type s3Store struct {
+	endpoint *url.URL
+	bucket   string
+	prefix   string
+	region   string
+	keyID    string
+	secret   string
+	token    string
+}
+
+// newS3Store makes a new s3Store from a URL of the form s3://bucket/prefix.
+// If endpoint is the empty string, AWS is used.
+func newS3Store(u *url.URL, endpoint string) (*s3Store, error) {
+	s := &s3Store{
+		bucket: u.Host,
+		prefix: strings.TrimPrefix(u.Path, "/"),
+		region: os.Getenv("AWS_REGION"),
+		keyID:  os.Getenv("AWS_ACCESS_KEY_ID"),
+		secret: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		token:  os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if "" == s.bucket {
+		return nil, errors.New("missing bucket")
+	}
+	if "" == s.region {
+		s.region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if "" == s.region {
+		s.region = "us-east-1"
+	}
+	if "" == s.keyID || "" == s.secret {
+		return nil, errors.New(
+			"AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set",
+		)
+	}
+	if "" == endpoint {
+		endpoint = "https://s3." + s.region + ".amazonaws.com"
+	}
+	var err error
+	if s.endpoint, err = url.Parse(endpoint); nil != err {
+		return nil, fmt.Errorf("parsing endpoint %q: %w", endpoint, err)
+	}
+	return s, nil
+}
+
+// Open starts an upload to an object named after the upload.
+func (s *s3Store) Open(m *Meta) (Upload, error) {
+	key := s.prefix + remoteName(postfile.BaseName(m))
+	return newPipeUpload("s3://"+s.bucket+"/"+key, func(r io.Reader) error {
+		_, err := s.upload(key, r)
+		return err
+	}), nil
+}
+
+/* Probe checks whether the bucket is accessible. */
+func (s *s3Store) Probe() error {
+	_, err := s.do(http.MethodHead, "", nil, nil)
+	return err
+}
+
+// upload streams body to the bucket as the given key.  It returns the number
+// of bytes sent.
+func (s *s3Store) upload(key string, body io.Reader) (int64, error) {
+	/* Small bodies get a single request */
+	buf := make([]byte, S3PARTSIZE)
+	n, last, err := readPart(body, buf)
+	if nil != err {
+		return 0, err
+	}
+	if last {
+		if _, err := s.do(http.MethodPut, key, nil, buf[:n]); nil != err {
+			return 0, err
+		}
+		return int64(n), nil
+	}
+
+	/* Big bodies get a multipart upload */
+	res, err := s.do(http.MethodPost, key, url.Values{"uploads": {""}}, nil)
+	if nil != err {
+		return 0, fmt.Errorf("starting multipart upload: %w", err)
+	}
+	var started struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := xml.Unmarshal(res, &started); nil != err {
+		return 0, fmt.Errorf("parsing upload ID: %w", err)
+	}
+	tn, err := s.uploadParts(key, started.UploadID, buf, n, body)
+	if nil != err {
+		/* Try to not leave parts lying about */
+		s.do(
+			http.MethodDelete,
+			key,
+			url.Values{"uploadId": {started.UploadID}},
+			nil,
+		)
+	}
+	return tn, err
+}
+
+// uploadParts sends the body in parts, starting with the first n bytes of
+// buf, and completes the upload.  It returns the number of bytes sent.
+func (s *s3Store) uploadParts(
+	key string,
+	id string,
+	buf []byte,
+	n int,
+	body io.Reader,
+) (int64, error) {
+	type part struct {
+		PartNumber int
+		ETag       string
+	}
+	var (
+		parts []part
+		tn    int64
+	)
+	for 0 != n {
+		/* Send this part */
+		pn := len(parts) + 1
+		hdr, err := s.doHeader(http.MethodPut, key, url.Values{
+			"partNumber": {fmt.Sprintf("%v", pn)},
+			"uploadId":   {id},
+		}, buf[:n])
+		if nil != err {
+			return tn, fmt.Errorf("sending part %v: %w", pn, err)
+		}
+		parts = append(parts, part{pn, hdr.Get("ETag")})
+		tn += int64(n)
+
+		/* Get the next one */
+		if n, _, err = readPart(body, buf); nil != err {
+			return tn, err
+		}
+	}
+
+	/* Tell the server we're done */
+	done, err := xml.Marshal(struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []part   `xml:"Part"`
+	}{Parts: parts})
+	if nil != err {
+		return tn, err
+	}
+	if _, err := s.do(
+		http.MethodPost,
+		key,
+		url.Values{"uploadId": {id}},
+		done,
+	); nil != err {
+		return tn, fmt.Errorf("completing upload: %w", err)
+	}
+	return tn, nil
+}
+
+// do makes a signed request for the given key and returns the response
+// body.
+func (s *s3Store) do(
+	method string,
+	key string,
+	query url.Values,
+	body []byte,
+) ([]byte, error) {
+	res, err := s.request(method, key, query, body)
+	if nil != err {
+		return nil, err
+	}
+	defer res.Body.Close()
+	return io.ReadAll(res.Body)
+}
+
+/* doHeader is like do, but returns the response headers. */
+func (s *s3Store) doHeader(
+	method string,
+	key string,
+	query url.Values,
+	body []byte,
+) (http.Header, error) {
+	res, err := s.request(method, key, query, body)
+	if nil != err {
+		return nil, err
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, res.Body)
+	return res.Header, nil
+}
+
+/* request makes a signed request and makes sure it got a 2xx response. */
+func (s *s3Store) request(
+	method string,
+	key string,
+	query url.Values,
+	body []byte,
+) (*http.Response, error) {
+	/* Work out the URL */
+	u := *s.endpoint
+	u.Path = strings.TrimSuffix(
+		strings.TrimSuffix(u.Path, "/")+"/"+s.bucket+"/"+key,
+		"/",
+	)
+	u.RawPath = awsEscape(u.Path, true)
+	u.RawQuery = canonicalQuery(query)
+
+	/* Roll the request and sign it */
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if nil != err {
+		return nil, err
+	}
+	s.sign(req, body)
+
+	/* Send it off */
+	res, err := remoteClient.Do(req)
+	if nil != err {
+		return nil, err
+	}
+	if 2 != res.StatusCode/100 {
+		defer res.Body.Close()
+		b, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return nil, fmt.Errorf(
+			"%v (%s)",
+			res.Status,
+			bytes.TrimSpace(b),
+		)
+	}
+	return res, nil
+}
+
+/* sign adds an AWS Signature Version 4 to req. */
+func (s *s3Store) sign(req *http.Request, body []byte) {
+	now := time.Now().UTC()
+	date := now.Format("20060102")
+	stamp := now.Format("20060102T150405Z")
+	ph := sha256.Sum256(body)
+	payloadHash := hex.EncodeToString(ph[:])
+
+	/* Headers we sign */
+	req.Header.Set("X-Amz-Date", stamp)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	signed := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+	hvals := []string{req.URL.Host, payloadHash, stamp}
+	if "" != s.token {
+		req.Header.Set("X-Amz-Security-Token", s.token)
+		signed = append(signed, "x-amz-security-token")
+		hvals = append(hvals, s.token)
+	}
+	var ch strings.Builder
+	for i, h := range signed {
+		fmt.Fprintf(&ch, "%s:%s\n", h, hvals[i])
+	}
+
+	/* Canonical request and the string to sign */
+	creq := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		ch.String(),
+		strings.Join(signed, ";"),
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	ch2 := sha256.Sum256([]byte(creq))
+	sts := "AWS4-HMAC-SHA256\n" + stamp + "\n" + scope + "\n" +
+		hex.EncodeToString(ch2[:])
+
+	/* Sign it */
+	key := []byte("AWS4" + s.secret)
+	for _, v := range []string{date, s.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, v)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, "+
+			"SignedHeaders=%s, Signature=%x",
+		s.keyID,
+		scope,
+		strings.Join(signed, ";"),
+		hmacSHA256(key, sts),
+	))
+}
+
+/* hmacSHA256 returns the HMAC-SHA256 of s with the given key. */
+func hmacSHA256(key []byte, s string) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(s))
+	return m.Sum(nil)
+}
+
+// canonicalQuery returns the query in the sorted, strictly-escaped form AWS
+// wants.
+func canonicalQuery(q url.Values) string {
+	var ps []string
+	for k, vs := range q {
+		for _, v := range vs {
+			ps = append(ps, awsEscape(k, false)+"="+awsEscape(v, false))
+		}
+	}
+	sort.Strings(ps)
+	return strings.Join(ps, "&")
+}
+
+// awsEscape percent-encodes everything but unreserved characters and,
+// optionally, slashes.
+func awsEscape(s string, keepSlash bool) string {
+	var sb strings.Builder
+	for _, c := range []byte(s) {
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z',
+			'0' <= c && c <= '9', '-' == c, '.' == c, '_' == c,
+			'~' == c, keepSlash && '/' == c:
+			sb.WriteByte(c)
+		default:
+			fmt.Fprintf(&sb, "%%%02X", c)
+		}
+	}
+	return sb.String()
+}
@@ -0,0 +1,138 @@
+package main
+
+/*
+ * scgi.go
+ * Serve requests from an SCGI front end
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/cgi"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SCGI requests are a netstring of NUL-separated header names and values,
+// then the body.  The response is CGI-style, and the connection's closed
+// when it's done.  See https://python.ca/scgi/protocol.txt.
+const scgiMaxHeaders = 1 << 20
+
+// scgiServe accepts SCGI connections on l and passes the requests to h,
+// or http.DefaultServeMux if h is nil, like fcgi.Serve.
+func scgiServe(l net.Listener, h http.Handler) error {
+	if nil == h {
+		h = http.DefaultServeMux
+	}
+	for {
+		c, err := l.Accept()
+		if nil != err {
+			return err
+		}
+		go handleSCGI(c, h)
+	}
+}
+
+/* handleSCGI handles the request on c. */
+func handleSCGI(c net.Conn, h http.Handler) {
+	defer c.Close()
+	br := bufio.NewReader(c)
+	r, err := readSCGIRequest(br)
+	if nil != err {
+		log.Printf(
+			"[%s] Error reading SCGI request: %v",
+			c.RemoteAddr(),
+			err,
+		)
+		return
+	}
+	res := &scgiResponse{w: bufio.NewWriter(c), h: make(http.Header)}
+	h.ServeHTTP(res, r)
+	res.Flush()
+}
+
+/* readSCGIRequest reads a request from br. */
+func readSCGIRequest(br *bufio.Reader) (*http.Request, error) {
+	/* Headers, as a netstring */
+	ls, err := br.ReadString(':')
+	if nil != err {
+		return nil, fmt.Errorf("reading header length: %w", err)
+	}
+	n, err := strconv.Atoi(strings.TrimSuffix(ls, ":"))
+	if nil != err || 0 > n || scgiMaxHeaders < n {
+		return nil, fmt.Errorf("invalid header length %q", ls)
+	}
+	b := make([]byte, n+1)
+	if _, err := io.ReadFull(br, b); nil != err {
+		return nil, fmt.Errorf("reading headers: %w", err)
+	}
+	if ',' != b[n] {
+		return nil, errors.New("headers not followed by a comma")
+	}
+	kvs := strings.Split(string(b[:n]), "\x00")
+	if 0 == len(kvs)%2 || "" != kvs[len(kvs)-1] {
+		return nil, errors.New("unpaired header")
+	}
+	params := make(map[string]string)
+	for i := 0; i+1 < len(kvs); i += 2 {
+		params[kvs[i]] = kvs[i+1]
+	}
+
+	/* Turn it into a request */
+	r, err := cgi.RequestFromMap(params)
+	if nil != err {
+		return nil, err
+	}
+	r.Body = io.NopCloser(io.LimitReader(br, max(r.ContentLength, 0)))
+	return r, nil
+}
+
+/* scgiResponse is an http.ResponseWriter which writes a CGI response. */
+type scgiResponse struct {
+	w           *bufio.Writer
+	h           http.Header
+	wroteHeader bool
+}
+
+/* Header implements http.ResponseWriter. */
+func (r *scgiResponse) Header() http.Header { return r.h }
+
+/* WriteHeader implements http.ResponseWriter. */
+func (r *scgiResponse) WriteHeader(code int) {
+	if r.wroteHeader {
+		return
+	}
+	r.wroteHeader = true
+	if _, ok := r.h["Date"]; !ok {
+		r.h.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	}
+	fmt.Fprintf(r.w, "Status: %d %s\r\n", code, http.StatusText(code))
+	r.h.Write(r.w)
+	r.w.WriteString("\r\n")
+}
+
+/* Write implements http.ResponseWriter. */
+func (r *scgiResponse) Write(p []byte) (int, error) {
+	if !r.wroteHeader {
+		if _, ok := r.h["Content-Type"]; !ok {
+			r.h.Set("Content-Type", http.DetectContentType(p))
+		}
+		r.WriteHeader(http.StatusOK)
+	}
+	return r.w.Write(p)
+}
+
+/* Flush implements http.Flusher. */
+func (r *scgiResponse) Flush() {
+	r.WriteHeader(http.StatusOK)
+	r.w.Flush()
+}
@@ -0,0 +1,63 @@
+package main
+
+/*
+ * sdnotify.go
+ * Tell systemd how we're doing
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// sdNotify sends state to systemd, as in sd_notify(3).  It does nothing if
+// we weren't started by systemd with NOTIFY_SOCKET set.
+func sdNotify(state string) {
+	sock := os.Getenv("NOTIFY_SOCKET")
+	if "" == sock {
+		return
+	}
+	if '@' == sock[0] { /* Abstract socket */
+		sock = "\x00" + sock[1:]
+	}
+	c, err := net.DialUnix(
+		"unixgram",
+		nil,
+		&net.UnixAddr{Name: sock, Net: "unixgram"},
+	)
+	if nil != err {
+		log.Printf("Unable to notify systemd: %v", err)
+		return
+	}
+	defer c.Close()
+	if _, err := c.Write([]byte(state)); nil != err {
+		log.Printf("Unable to notify systemd: %v", err)
+	}
+}
+
+// sdWatchdog sends watchdog keepalives to systemd at half the interval in
+// WATCHDOG_USEC, if it's set and meant for us.  Keepalives are only sent
+// while the current directory, where local files go, is accessible.
+func sdWatchdog() {
+	if p := os.Getenv("WATCHDOG_PID"); "" != p &&
+		strconv.Itoa(os.Getpid()) != p {
+		return
+	}
+	us, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if nil != err || 0 >= us {
+		return
+	}
+	for range time.Tick(time.Duration(us) * time.Microsecond / 2) {
+		if _, err := os.Stat("."); nil != err {
+			log.Printf("Not petting systemd watchdog: %v", err)
+			continue
+		}
+		sdNotify("WATCHDOG=1")
+	}
+}
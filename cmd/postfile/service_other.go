@@ -0,0 +1,22 @@
+//go:build !windows
+
+package main
+
+/*
+ * service_other.go
+ * Windows services, on not-Windows
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import "log"
+
+/* serviceMain would manage a Windows service, if this were Windows. */
+func serviceMain([]string) bool {
+	log.Fatalf("Services are only supported on Windows; try install")
+	return true
+}
+
+/* serviceStopped is a no-op when not running as a Windows service. */
+func serviceStopped() {}
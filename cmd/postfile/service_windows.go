@@ -0,0 +1,468 @@
+package main
+
+/*
+ * service_windows.go
+ * Run as a Windows service
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+/* serviceName is the name of the service and its event log source */
+const serviceName = "postfile"
+
+/* Constants from winsvc.h, winnt.h, and winreg.h */
+const (
+	scManagerAllAccess        = 0xF003F
+	serviceAllAccess          = 0xF01FF
+	serviceWin32OwnProcess    = 0x10
+	serviceAutoStart          = 2
+	serviceErrorNormal        = 1
+	stateStopped              = 1
+	stateStartPending         = 2
+	stateStopPending          = 3
+	stateRunning              = 4
+	serviceAcceptStop         = 1
+	serviceAcceptShutdown     = 4
+	serviceControlStop        = 1
+	serviceControlInterrogate = 4
+	serviceControlShutdown    = 5
+	eventlogErrorType         = 1
+	eventlogInformationType   = 4
+	hkeyLocalMachine          = 0x80000002
+	keyAllAccess              = 0xF003F
+	regExpandSz               = 2
+	regDword                  = 4
+)
+
+/* Functions from advapi32.dll */
+var (
+	advapi32                         = syscall.NewLazyDLL("advapi32.dll")
+	procOpenSCManagerW               = advapi32.NewProc("OpenSCManagerW")
+	procCreateServiceW               = advapi32.NewProc("CreateServiceW")
+	procOpenServiceW                 = advapi32.NewProc("OpenServiceW")
+	procDeleteService                = advapi32.NewProc("DeleteService")
+	procStartServiceW                = advapi32.NewProc("StartServiceW")
+	procControlService               = advapi32.NewProc("ControlService")
+	procCloseServiceHandle           = advapi32.NewProc("CloseServiceHandle")
+	procStartServiceCtrlDispatcherW  = advapi32.NewProc("StartServiceCtrlDispatcherW")
+	procRegisterServiceCtrlHandlerEx = advapi32.NewProc("RegisterServiceCtrlHandlerExW")
+	procSetServiceStatus             = advapi32.NewProc("SetServiceStatus")
+	procRegisterEventSourceW         = advapi32.NewProc("RegisterEventSourceW")
+	procReportEventW                 = advapi32.NewProc("ReportEventW")
+	procRegCreateKeyExW              = advapi32.NewProc("RegCreateKeyExW")
+	procRegSetValueExW               = advapi32.NewProc("RegSetValueExW")
+	procRegDeleteKeyW                = advapi32.NewProc("RegDeleteKeyW")
+)
+
+/* eventLogKey is where our event log source is registered */
+const eventLogKey = `SYSTEM\CurrentControlSet\Services\EventLog\Application\` +
+	serviceName
+
+/* serviceStatus is a SERVICE_STATUS */
+type serviceStatus struct {
+	ServiceType             uint32
+	CurrentState            uint32
+	ControlsAccepted        uint32
+	Win32ExitCode           uint32
+	ServiceSpecificExitCode uint32
+	CheckPoint              uint32
+	WaitHint                uint32
+}
+
+var (
+	/* svcHandle is our SERVICE_STATUS_HANDLE, once we're running */
+	svcHandle uintptr
+
+	/* svcStopped is closed when we've told the SCM we've stopped */
+	svcStopped = make(chan struct{})
+	svcOnce    sync.Once
+)
+
+// serviceMain is the main function for the service subcommand, which
+// installs, uninstalls, starts, stops, and runs postfile as a Windows
+// service.  It returns true if main should return, or false if main should
+// carry on running the server, as the service.
+func serviceMain(args []string) bool {
+	fs := flag.NewFlagSet("service", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(
+			os.Stderr,
+			`Usage: %v service install [-- server options]
+       %v service uninstall|start|stop
+
+Manages postfile as a Windows service, which logs to the Application event
+log.  Relative paths in server options are made absolute.  If -dir isn't
+given, files are stored in %%ProgramData%%\postfile\posts.
+`,
+			os.Args[0],
+			os.Args[0],
+		)
+	}
+	fs.Parse(args)
+	var err error
+	switch fs.Arg(0) {
+	case "install":
+		err = installService(fs.Args()[1:])
+	case "uninstall":
+		err = uninstallService()
+	case "start":
+		err = withService(func(h uintptr) error {
+			return scCall(procStartServiceW, h, 0, 0)
+		})
+	case "stop":
+		err = withService(func(h uintptr) error {
+			var st serviceStatus
+			return scCall(
+				procControlService,
+				h,
+				serviceControlStop,
+				uintptr(unsafe.Pointer(&st)),
+			)
+		})
+	case "run":
+		/* Run the server as the service, with the rest of the args */
+		os.Args = append([]string{os.Args[0]}, fs.Args()[1:]...)
+		runService()
+		return false
+	default:
+		fs.Usage()
+		os.Exit(2)
+	}
+	if nil != err {
+		log.Fatalf("Service %s failed: %v", fs.Arg(0), err)
+	}
+	log.Printf("Service %s succeeded", fs.Arg(0))
+	return true
+}
+
+// installService installs the service, which runs with the server flags in
+// args, and registers our event log source.
+func installService(args []string) error {
+	if err := flag.CommandLine.Parse(args); nil != err {
+		return fmt.Errorf("invalid server options: %w", err)
+	}
+	if 0 != flag.NArg() {
+		return fmt.Errorf("unexpected arguments: %q", flag.Args())
+	}
+	exe, err := os.Executable()
+	if nil != err {
+		return fmt.Errorf("finding our own path: %w", err)
+	}
+	sargs, _, set := serverArgs()
+	if !set["dir"] && !set["storage"] && !set["pipe-only"] {
+		sargs = append(sargs, "-dir="+filepath.Join(
+			os.Getenv("ProgramData"),
+			serviceName,
+			"posts",
+		))
+	}
+	if "true" != flag.Lookup("http").Value.String() {
+		for _, n := range []string{"c", "k"} {
+			if set[n] {
+				continue
+			}
+			p, err := filepath.Abs(flag.Lookup(n).DefValue)
+			if nil != err {
+				return fmt.Errorf("making -%v absolute: %w", n, err)
+			}
+			sargs = append(sargs, "-"+n+"="+p)
+		}
+	}
+	cmd := []string{syscall.EscapeArg(exe), "service", "run"}
+	for _, a := range sargs {
+		cmd = append(cmd, syscall.EscapeArg(a))
+	}
+
+	/* Register the service */
+	scm, err := openSCM()
+	if nil != err {
+		return err
+	}
+	defer procCloseServiceHandle.Call(scm)
+	h, _, err := procCreateServiceW.Call(
+		scm,
+		utf16Ptr(serviceName),
+		utf16Ptr("postfile upload server"),
+		serviceAllAccess,
+		serviceWin32OwnProcess,
+		serviceAutoStart,
+		serviceErrorNormal,
+		utf16Ptr(strings.Join(cmd, " ")),
+		0, 0, 0, 0, 0, /* LocalSystem, no dependencies */
+	)
+	if 0 == h {
+		return fmt.Errorf("creating service: %w", err)
+	}
+	procCloseServiceHandle.Call(h)
+
+	/* Register the event log source, using EventCreate's messages */
+	var key uintptr
+	if r, _, _ := procRegCreateKeyExW.Call(
+		hkeyLocalMachine,
+		utf16Ptr(eventLogKey),
+		0, 0, 0,
+		keyAllAccess,
+		0,
+		uintptr(unsafe.Pointer(&key)),
+		0,
+	); 0 != r {
+		return fmt.Errorf(
+			"registering event source: %w",
+			syscall.Errno(r),
+		)
+	}
+	defer syscall.RegCloseKey(syscall.Handle(key))
+	msgs, err := syscall.UTF16FromString(
+		`%SystemRoot%\System32\EventCreate.exe`,
+	)
+	if nil != err {
+		return err
+	}
+	types := uint32(7) /* Error, warning, information */
+	for _, v := range []struct {
+		name string
+		typ  uintptr
+		data unsafe.Pointer
+		size uintptr
+	}{
+		{"EventMessageFile", regExpandSz, unsafe.Pointer(&msgs[0]),
+			uintptr(2 * len(msgs))},
+		{"TypesSupported", regDword, unsafe.Pointer(&types), 4},
+	} {
+		if r, _, _ := procRegSetValueExW.Call(
+			key,
+			utf16Ptr(v.name),
+			0,
+			v.typ,
+			uintptr(v.data),
+			v.size,
+		); 0 != r {
+			return fmt.Errorf(
+				"setting event source %s: %w",
+				v.name,
+				syscall.Errno(r),
+			)
+		}
+	}
+	log.Printf("Installed service: %s", strings.Join(cmd, " "))
+	return nil
+}
+
+/* uninstallService removes the service and our event log source. */
+func uninstallService() error {
+	if err := withService(func(h uintptr) error {
+		return scCall(procDeleteService, h)
+	}); nil != err {
+		return err
+	}
+	if r, _, _ := procRegDeleteKeyW.Call(
+		hkeyLocalMachine,
+		utf16Ptr(eventLogKey),
+	); 0 != r {
+		return fmt.Errorf(
+			"removing event source: %w",
+			syscall.Errno(r),
+		)
+	}
+	return nil
+}
+
+/* withService calls f with a handle to the service. */
+func withService(f func(h uintptr) error) error {
+	scm, err := openSCM()
+	if nil != err {
+		return err
+	}
+	defer procCloseServiceHandle.Call(scm)
+	h, _, err := procOpenServiceW.Call(
+		scm,
+		utf16Ptr(serviceName),
+		serviceAllAccess,
+	)
+	if 0 == h {
+		return fmt.Errorf("opening service: %w", err)
+	}
+	defer procCloseServiceHandle.Call(h)
+	return f(h)
+}
+
+/* openSCM connects to the service control manager. */
+func openSCM() (uintptr, error) {
+	h, _, err := procOpenSCManagerW.Call(0, 0, scManagerAllAccess)
+	if 0 == h {
+		return 0, fmt.Errorf("connecting to service manager: %w", err)
+	}
+	return h, nil
+}
+
+/* scCall calls p, which returns 0 on failure. */
+func scCall(p *syscall.LazyProc, args ...uintptr) error {
+	if r, _, err := p.Call(args...); 0 == r {
+		return err
+	}
+	return nil
+}
+
+// runService connects us to the service control manager and sends our
+// logs to the event log.  It returns once the SCM's been told we're
+// running.
+func runService() {
+	if err := logToEventLog(); nil != err {
+		log.Printf("Unable to log to the event log: %v", err)
+	}
+	running := make(chan error, 1)
+	go func() {
+		/* The dispatcher takes over this thread */
+		runtime.LockOSThread()
+		table := []struct {
+			name *uint16
+			proc uintptr
+		}{
+			{
+				utf16PtrOf(serviceName),
+				syscall.NewCallback(func(uint32, uintptr) uintptr {
+					running <- serviceStart()
+					<-svcStopped
+					return 0
+				}),
+			},
+			{nil, 0},
+		}
+		if err := scCall(
+			procStartServiceCtrlDispatcherW,
+			uintptr(unsafe.Pointer(&table[0])),
+		); nil != err {
+			running <- fmt.Errorf("starting dispatcher: %w", err)
+		}
+	}()
+	if err := <-running; nil != err {
+		log.Fatalf("Unable to run as a service: %v", err)
+	}
+}
+
+/* serviceStart registers our control handler and says we're running. */
+func serviceStart() error {
+	h, _, err := procRegisterServiceCtrlHandlerEx.Call(
+		uintptr(unsafe.Pointer(utf16PtrOf(serviceName))),
+		syscall.NewCallback(serviceControl),
+		0,
+	)
+	if 0 == h {
+		return fmt.Errorf("registering control handler: %w", err)
+	}
+	svcHandle = h
+	return setServiceStatus(stateRunning, 0)
+}
+
+/* serviceControl handles a control request from the SCM. */
+func serviceControl(ctrl, _ uint32, _, _ uintptr) uintptr {
+	switch ctrl {
+	case serviceControlStop, serviceControlShutdown:
+		setServiceStatus(stateStopPending, 0)
+		select {
+		case stopSignals <- os.Interrupt:
+		default:
+		}
+	case serviceControlInterrogate:
+	default:
+		return 120 /* ERROR_CALL_NOT_IMPLEMENTED */
+	}
+	return 0
+}
+
+/* setServiceStatus tells the SCM how we're doing. */
+func setServiceStatus(state uint32, exitCode uint32) error {
+	st := serviceStatus{
+		ServiceType:   serviceWin32OwnProcess,
+		CurrentState:  state,
+		Win32ExitCode: exitCode,
+	}
+	switch state {
+	case stateRunning:
+		st.ControlsAccepted = serviceAcceptStop | serviceAcceptShutdown
+	case stateStartPending, stateStopPending:
+		st.WaitHint = uint32(time.Minute / time.Millisecond)
+	}
+	return scCall(
+		procSetServiceStatus,
+		svcHandle,
+		uintptr(unsafe.Pointer(&st)),
+	)
+}
+
+// serviceStopped tells the SCM we've stopped, if we're running as a
+// service.
+func serviceStopped() {
+	if 0 == svcHandle {
+		return
+	}
+	svcOnce.Do(func() {
+		setServiceStatus(stateStopped, 0)
+		close(svcStopped)
+	})
+}
+
+/* eventLogWriter sends log lines to the event log. */
+type eventLogWriter struct{ h uintptr }
+
+/* logToEventLog sends log output to the Application event log. */
+func logToEventLog() error {
+	h, _, err := procRegisterEventSourceW.Call(0, utf16Ptr(serviceName))
+	if 0 == h {
+		return err
+	}
+	log.SetOutput(eventLogWriter{h: h})
+	log.SetFlags(0)
+	return nil
+}
+
+/* Write sends b to the event log. */
+func (w eventLogWriter) Write(b []byte) (int, error) {
+	typ := uintptr(eventlogInformationType)
+	if strings.Contains(string(b), "rror") {
+		typ = eventlogErrorType
+	}
+	s := utf16PtrOf(strings.TrimRight(string(b), "\n"))
+	if err := scCall(
+		procReportEventW,
+		w.h,
+		typ,
+		0,
+		1, /* EventCreate's messages 1-1000 are just %1 */
+		0,
+		1,
+		0,
+		uintptr(unsafe.Pointer(&s)),
+		0,
+	); nil != err {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+/* utf16Ptr converts s to a UTF-16 string, as a uintptr. */
+func utf16Ptr(s string) uintptr { return uintptr(unsafe.Pointer(utf16PtrOf(s))) }
+
+/* utf16PtrOf converts s to a UTF-16 string. */
+func utf16PtrOf(s string) *uint16 {
+	p, err := syscall.UTF16PtrFromString(strings.ReplaceAll(s, "\x00", ""))
+	if nil != err { /* Can't happen, no NULs */
+		panic(err)
+	}
+	return p
+}
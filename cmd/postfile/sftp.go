@@ -0,0 +1,843 @@
+package main
+
+/*
+ * sftp.go
+ * Receive files via SFTP and scp
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Files sent with SFTP, or scp -O with -scp, are stored with the path to
+// which they were sent as the path, same as if they were POSTed to that
+// path.  Clients log in with a key from the -sftp-keys authorized_keys file,
+// whose comment, or fingerprint if it hasn't got one, is used as the token
+// name.  Nothing's ever listed or retrieved; directories are empty and files
+// don't exist, and writes have to be sequential.
+const (
+	sftpTimeout   = 5 * time.Minute
+	sftpMaxPacket = 1024 * 1024
+	sftpMaxDirs   = 1024 /* Directories a client can make */
+	scpMaxLine    = 4096
+)
+
+/* SFTP packet types, from draft-ietf-secsh-filexfer-02 */
+const (
+	sshFxpInit     = 1
+	sshFxpVersion  = 2
+	sshFxpOpen     = 3
+	sshFxpClose    = 4
+	sshFxpWrite    = 6
+	sshFxpLstat    = 7
+	sshFxpFstat    = 8
+	sshFxpSetstat  = 9
+	sshFxpFsetstat = 10
+	sshFxpOpendir  = 11
+	sshFxpReaddir  = 12
+	sshFxpMkdir    = 14
+	sshFxpRealpath = 16
+	sshFxpStat     = 17
+	sshFxpStatus   = 101
+	sshFxpHandle   = 102
+	sshFxpName     = 104
+	sshFxpAttrs    = 105
+)
+
+/* SFTP status codes */
+const (
+	sshFxOK               = 0
+	sshFxEOF              = 1
+	sshFxNoSuchFile       = 2
+	sshFxPermissionDenied = 3
+	sshFxFailure          = 4
+	sshFxBadMessage       = 5
+	sshFxOpUnsupported    = 8
+)
+
+/* SFTP open flags and file attribute flags */
+const (
+	sshFxfRead           = 0x01
+	sshFxfWrite          = 0x02
+	sshFileXferAttrSize  = 0x01
+	sshFileXferAttrPerms = 0x04
+	sshFileXferModeDir   = 0040755
+	sshFileXferModeFile  = 0100644
+	sshFileXferVersion   = 3
+)
+
+/* sftpServer accepts files over SFTP and, optionally, scp. */
+type sftpServer struct {
+	conf *ssh.ServerConfig
+	scp  bool
+}
+
+// listenSFTP accepts SSH connections on addr from clients with a key in the
+// authorized_keys file keysFile.  The host key is read from hostKeyFile,
+// which is made if it doesn't exist, or generated anew if hostKeyFile is the
+// empty string.  If scp is true, clients may also send files with scp -O.
+func listenSFTP(
+	addr string,
+	keysFile string,
+	hostKeyFile string,
+	scp bool,
+) (net.Listener, error) {
+	keys, err := loadAuthorizedKeys(keysFile)
+	if nil != err {
+		return nil, fmt.Errorf(
+			"loading keys from %s: %w",
+			keysFile,
+			err,
+		)
+	}
+	hk, err := loadHostKey(hostKeyFile)
+	if nil != err {
+		return nil, fmt.Errorf("loading host key: %w", err)
+	}
+	s := &sftpServer{
+		conf: &ssh.ServerConfig{
+			PublicKeyCallback: func(
+				_ ssh.ConnMetadata,
+				k ssh.PublicKey,
+			) (*ssh.Permissions, error) {
+				name, ok := keys[string(k.Marshal())]
+				if !ok {
+					return nil, errors.New("unknown key")
+				}
+				return &ssh.Permissions{
+					Extensions: map[string]string{
+						"token": name,
+					},
+				}, nil
+			},
+			ServerVersion: "SSH-2.0-postfile",
+		},
+		scp: scp,
+	}
+	s.conf.AddHostKey(hk)
+	log.Printf(
+		"SFTP host key fingerprint: %s",
+		ssh.FingerprintSHA256(hk.PublicKey()),
+	)
+
+	l, err := net.Listen("tcp", addr)
+	if nil != err {
+		return nil, err
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if nil != err {
+				log.Printf(
+					"Error accepting SFTP connections: %v",
+					err,
+				)
+				return
+			}
+			go s.handle(c)
+		}
+	}()
+	return l, nil
+}
+
+// loadAuthorizedKeys returns the keys in the authorized_keys file fn, mapped
+// to their comments or, failing that, fingerprints.
+func loadAuthorizedKeys(fn string) (map[string]string, error) {
+	b, err := os.ReadFile(fn)
+	if nil != err {
+		return nil, err
+	}
+	keys := make(map[string]string)
+	for i, line := range bytes.Split(b, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if 0 == len(line) || '#' == line[0] {
+			continue
+		}
+		k, comment, _, _, err := ssh.ParseAuthorizedKey(line)
+		if nil != err {
+			return nil, fmt.Errorf("line %d: %w", i+1, err)
+		}
+		if "" == comment {
+			comment = ssh.FingerprintSHA256(k)
+		}
+		keys[string(k.Marshal())] = comment
+	}
+	if 0 == len(keys) {
+		return nil, errors.New("no keys found")
+	}
+	return keys, nil
+}
+
+// loadHostKey loads an SSH host key from fn.  If fn doesn't exist, a new key
+// is generated and saved in it.  If fn is the empty string, a new key is
+// generated but not saved.
+func loadHostKey(fn string) (ssh.Signer, error) {
+	if "" != fn {
+		b, err := os.ReadFile(fn)
+		if nil == err {
+			return ssh.ParsePrivateKey(b)
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	_, k, err := ed25519.GenerateKey(rand.Reader)
+	if nil != err {
+		return nil, err
+	}
+	s, err := ssh.NewSignerFromKey(k)
+	if nil != err || "" == fn {
+		return s, err
+	}
+	pb, err := ssh.MarshalPrivateKey(k, "postfile SFTP host key")
+	if nil != err {
+		return nil, err
+	}
+	if err := os.WriteFile(fn, pem.EncodeToMemory(pb), 0600); nil != err {
+		return nil, err
+	}
+	log.Printf("Generated SFTP host key in %s", fn)
+	return s, nil
+}
+
+// sftpConn is an SSH client's connection, which times out if the client
+// doesn't send anything for sftpTimeout.
+type sftpConn struct{ net.Conn }
+
+/* Read implements io.Reader. */
+func (c sftpConn) Read(b []byte) (int, error) {
+	c.SetReadDeadline(time.Now().Add(sftpTimeout))
+	return c.Conn.Read(b)
+}
+
+/* handle speaks SSH with the client on c. */
+func (s *sftpServer) handle(c net.Conn) {
+	defer c.Close()
+	src := c.RemoteAddr().String()
+
+	/* Only take files when we would over HTTP */
+	if shuttingDown.Load() || expired() || maintenanceFeature.Enabled() {
+		return
+	}
+
+	sc, chans, reqs, err := ssh.NewServerConn(sftpConn{c}, s.conf)
+	if nil != err {
+		log.Printf("[%s] SSH handshake failed: %v", src, err)
+		return
+	}
+	defer sc.Close()
+	go ssh.DiscardRequests(reqs)
+	token := sc.Permissions.Extensions["token"]
+	log.Printf("[%s] SSH login as %q with key %s", src, sc.User(), token)
+
+	for nc := range chans {
+		if "session" != nc.ChannelType() {
+			nc.Reject(ssh.UnknownChannelType, "Only sessions")
+			continue
+		}
+		ch, creqs, err := nc.Accept()
+		if nil != err {
+			log.Printf("[%s] Error accepting session: %v", src, err)
+			continue
+		}
+		ss := &sftpSession{
+			ch:      ch,
+			src:     src,
+			token:   token,
+			handles: make(map[string]*sftpHandle),
+			dirs:    map[string]bool{"/": true},
+		}
+		go s.session(ss, creqs)
+	}
+}
+
+/* session starts SFTP or scp in a client's session. */
+func (s *sftpServer) session(ss *sftpSession, reqs <-chan *ssh.Request) {
+	defer ss.ch.Close()
+	for req := range reqs {
+		var (
+			run func() error
+			arg struct{ Value string }
+		)
+		switch req.Type {
+		case "subsystem":
+			if nil == ssh.Unmarshal(req.Payload, &arg) &&
+				"sftp" == arg.Value {
+				run = ss.sftp
+			}
+		case "exec":
+			if !s.scp || nil != ssh.Unmarshal(req.Payload, &arg) {
+				break
+			}
+			if target, dir, ok := parseSCPSink(arg.Value); ok {
+				run = func() error {
+					return ss.scp(target, dir)
+				}
+			}
+		}
+		if nil == run {
+			req.Reply(false, nil)
+			continue
+		}
+		req.Reply(true, nil)
+		go ssh.DiscardRequests(reqs)
+
+		/* Do the thing */
+		var status uint32
+		err := run()
+		ss.abortAll()
+		if nil != err {
+			log.Printf("[%s] SSH session error: %v", ss.src, err)
+			status = 1
+		}
+		ss.ch.SendRequest(
+			"exit-status",
+			false,
+			ssh.Marshal(struct{ Status uint32 }{status}),
+		)
+		return
+	}
+}
+
+/* sftpSession is a client's SSH session. */
+type sftpSession struct {
+	ch      ssh.Channel
+	src     string
+	token   string
+	handles map[string]*sftpHandle
+	next    uint64          /* Next handle */
+	dirs    map[string]bool /* Made with mkdir */
+}
+
+// sftpHandle is an open file or directory.  Uploads are nil for
+// directories.
+type sftpHandle struct {
+	u    Upload
+	m    *Meta
+	n    int64 /* Bytes written */
+	err  error /* First write error */
+	read bool  /* Directory's been read */
+}
+
+// sftpReader parses SFTP packets.  If there's not enough left to read, bad
+// is set and zero values are returned.
+type sftpReader struct {
+	b   []byte
+	bad bool
+}
+
+/* u32 reads a uint32. */
+func (r *sftpReader) u32() uint32 {
+	if 4 > len(r.b) {
+		r.bad = true
+		return 0
+	}
+	v := binary.BigEndian.Uint32(r.b)
+	r.b = r.b[4:]
+	return v
+}
+
+/* u64 reads a uint64. */
+func (r *sftpReader) u64() uint64 {
+	if 8 > len(r.b) {
+		r.bad = true
+		return 0
+	}
+	v := binary.BigEndian.Uint64(r.b)
+	r.b = r.b[8:]
+	return v
+}
+
+/* str reads a length-prefixed string. */
+func (r *sftpReader) str() string {
+	n := r.u32()
+	if r.bad || uint32(len(r.b)) < n {
+		r.bad = true
+		return ""
+	}
+	s := string(r.b[:n])
+	r.b = r.b[n:]
+	return s
+}
+
+/* appendSFTPString appends a length-prefixed s to b. */
+func appendSFTPString(b []byte, s string) []byte {
+	return append(binary.BigEndian.AppendUint32(b, uint32(len(s))), s...)
+}
+
+// appendSFTPAttrs appends the attributes of a directory, or a file of the
+// given size, to b.
+func appendSFTPAttrs(b []byte, dir bool, size int64) []byte {
+	if dir {
+		b = binary.BigEndian.AppendUint32(b, sshFileXferAttrPerms)
+		return binary.BigEndian.AppendUint32(b, sshFileXferModeDir)
+	}
+	b = binary.BigEndian.AppendUint32(
+		b,
+		sshFileXferAttrSize|sshFileXferAttrPerms,
+	)
+	b = binary.BigEndian.AppendUint64(b, uint64(size))
+	return binary.BigEndian.AppendUint32(b, sshFileXferModeFile)
+}
+
+/* send sends an SFTP packet of the given type and payload. */
+func (ss *sftpSession) send(typ byte, payload []byte) error {
+	b := binary.BigEndian.AppendUint32(nil, uint32(1+len(payload)))
+	b = append(append(b, typ), payload...)
+	_, err := ss.ch.Write(b)
+	return err
+}
+
+/* status sends an SSH_FXP_STATUS reply. */
+func (ss *sftpSession) status(id, code uint32, msg string) error {
+	b := binary.BigEndian.AppendUint32(nil, id)
+	b = binary.BigEndian.AppendUint32(b, code)
+	b = appendSFTPString(b, msg)
+	return ss.send(sshFxpStatus, appendSFTPString(b, ""))
+}
+
+/* readPacket reads an SFTP packet. */
+func (ss *sftpSession) readPacket() ([]byte, error) {
+	var l uint32
+	if err := binary.Read(ss.ch, binary.BigEndian, &l); nil != err {
+		return nil, err
+	}
+	if 0 == l || sftpMaxPacket < l {
+		return nil, fmt.Errorf("invalid packet length %d", l)
+	}
+	b := make([]byte, l)
+	if _, err := io.ReadFull(ss.ch, b); nil != err {
+		return nil, err
+	}
+	return b, nil
+}
+
+/* sftp speaks SFTP with the client until it goes away. */
+func (ss *sftpSession) sftp() error {
+	/* Say hello */
+	p, err := ss.readPacket()
+	if nil != err {
+		return err
+	}
+	if sshFxpInit != p[0] {
+		return fmt.Errorf("expected init, got packet type %d", p[0])
+	}
+	if err := ss.send(sshFxpVersion, binary.BigEndian.AppendUint32(
+		nil,
+		sshFileXferVersion,
+	)); nil != err {
+		return err
+	}
+
+	for {
+		p, err := ss.readPacket()
+		if errors.Is(err, io.EOF) {
+			return nil
+		} else if nil != err {
+			return err
+		}
+		r := &sftpReader{b: p[1:]}
+		id := r.u32()
+		if err := ss.handlePacket(p[0], id, r); nil != err {
+			return err
+		}
+	}
+}
+
+// handlePacket handles an SFTP request of the given type and ID, the rest of
+// which is in r.
+func (ss *sftpSession) handlePacket(typ byte, id uint32, r *sftpReader) error {
+	switch typ {
+	case sshFxpOpen:
+		return ss.open(id, r)
+	case sshFxpWrite:
+		return ss.write(id, r)
+	case sshFxpClose:
+		return ss.close(id, r)
+	case sshFxpRealpath:
+		p := sftpAbs(r.str())
+		if r.bad {
+			break
+		}
+		b := binary.BigEndian.AppendUint32(nil, id)
+		b = binary.BigEndian.AppendUint32(b, 1)
+		b = appendSFTPString(appendSFTPString(b, p), p)
+		return ss.send(sshFxpName, appendSFTPAttrs(b, true, 0))
+	case sshFxpStat, sshFxpLstat:
+		p := sftpAbs(r.str())
+		if r.bad {
+			break
+		}
+		if !ss.dirs[p] {
+			return ss.status(id, sshFxNoSuchFile, "No such file")
+		}
+		b := binary.BigEndian.AppendUint32(nil, id)
+		return ss.send(sshFxpAttrs, appendSFTPAttrs(b, true, 0))
+	case sshFxpFstat:
+		h, ok := ss.handles[r.str()]
+		if r.bad {
+			break
+		} else if !ok {
+			return ss.status(id, sshFxFailure, "Invalid handle")
+		}
+		b := binary.BigEndian.AppendUint32(nil, id)
+		return ss.send(sshFxpAttrs, appendSFTPAttrs(b, nil == h.u, h.n))
+	case sshFxpSetstat, sshFxpFsetstat:
+		/* Times and permissions are meaningless to us. */
+		return ss.status(id, sshFxOK, "")
+	case sshFxpMkdir:
+		p := sftpAbs(r.str())
+		if r.bad {
+			break
+		}
+		if sftpMaxDirs <= len(ss.dirs) {
+			return ss.status(id, sshFxFailure, "Too many dirs")
+		}
+		ss.dirs[p] = true
+		return ss.status(id, sshFxOK, "")
+	case sshFxpOpendir:
+		p := sftpAbs(r.str())
+		if r.bad {
+			break
+		}
+		if !ss.dirs[p] {
+			return ss.status(id, sshFxNoSuchFile, "No such file")
+		}
+		return ss.newHandle(id, &sftpHandle{})
+	case sshFxpReaddir:
+		h, ok := ss.handles[r.str()]
+		if r.bad {
+			break
+		} else if !ok || nil != h.u {
+			return ss.status(id, sshFxFailure, "Invalid handle")
+		}
+		/* Directories are always empty */
+		return ss.status(id, sshFxEOF, "")
+	default:
+		return ss.status(id, sshFxOpUnsupported, "Write-only server")
+	}
+	return ss.status(id, sshFxBadMessage, "Invalid request")
+}
+
+/* newHandle sends back a new handle for h. */
+func (ss *sftpSession) newHandle(id uint32, h *sftpHandle) error {
+	hn := strconv.FormatUint(ss.next, 10)
+	ss.next++
+	ss.handles[hn] = h
+	b := binary.BigEndian.AppendUint32(nil, id)
+	return ss.send(sshFxpHandle, appendSFTPString(b, hn))
+}
+
+/* open starts an upload. */
+func (ss *sftpSession) open(id uint32, r *sftpReader) error {
+	p := sftpAbs(r.str())
+	flags := r.u32()
+	if r.bad {
+		return ss.status(id, sshFxBadMessage, "Invalid request")
+	}
+	switch {
+	case 0 != flags&sshFxfRead:
+		return ss.status(id, sshFxPermissionDenied, "Write-only server")
+	case 0 == flags&sshFxfWrite:
+		return ss.status(id, sshFxFailure, "Need to open for writing")
+	case shuttingDown.Load() || expired() || maintenanceFeature.Enabled():
+		return ss.status(id, sshFxFailure, "Not accepting files")
+	}
+	m := &Meta{
+		Source: ss.src,
+		Path:   p,
+		Time:   time.Now(),
+		Token:  ss.token,
+	}
+	u, err := store.Open(m)
+	if nil != err {
+		noteFailure()
+		log.Printf("[%s] Unable to open storage: %v", ss.src, err)
+		return ss.status(id, sshFxFailure, "Unable to store file")
+	}
+	inFlight.Add(1)
+	return ss.newHandle(id, &sftpHandle{u: u, m: m})
+}
+
+/* write writes to an open upload, which must be written sequentially. */
+func (ss *sftpSession) write(id uint32, r *sftpReader) error {
+	h, ok := ss.handles[r.str()]
+	off := r.u64()
+	b := r.str()
+	switch {
+	case r.bad:
+		return ss.status(id, sshFxBadMessage, "Invalid request")
+	case !ok || nil == h.u:
+		return ss.status(id, sshFxFailure, "Invalid handle")
+	case nil != h.err:
+		return ss.status(id, sshFxFailure, "Previous write failed")
+	case uint64(h.n) != off:
+		h.err = fmt.Errorf("write at %d, expected %d", off, h.n)
+		return ss.status(id, sshFxFailure, "Writes must be sequential")
+	}
+	n, err := io.WriteString(h.u, b)
+	h.n += int64(n)
+	if nil != err {
+		h.err = err
+		return ss.status(id, sshFxFailure, "Unable to store file")
+	}
+	return ss.status(id, sshFxOK, "")
+}
+
+/* close finishes an upload or closes a directory. */
+func (ss *sftpSession) close(id uint32, r *sftpReader) error {
+	hn := r.str()
+	h, ok := ss.handles[hn]
+	if r.bad {
+		return ss.status(id, sshFxBadMessage, "Invalid request")
+	} else if !ok {
+		return ss.status(id, sshFxFailure, "Invalid handle")
+	}
+	delete(ss.handles, hn)
+	if nil == h.u {
+		return ss.status(id, sshFxOK, "")
+	}
+	if err := ss.finish(h); nil != err {
+		return ss.status(id, sshFxFailure, "Unable to store file")
+	}
+	return ss.status(id, sshFxOK, "")
+}
+
+/* finish commits or, if there was an error, aborts h's upload. */
+func (ss *sftpSession) finish(h *sftpHandle) error {
+	defer inFlight.Done()
+	err := h.err
+	if nil == err {
+		err = h.u.Commit()
+	} else {
+		h.u.Abort()
+	}
+	if nil != err {
+		noteFailure()
+		log.Printf(
+			"[%s] Error after writing %v bytes to %q: %v",
+			ss.src,
+			h.n,
+			h.u.Name(),
+			err,
+		)
+		return err
+	}
+	log.Printf(
+		"[%s] Wrote %v bytes via SSH to %q",
+		ss.src,
+		h.n,
+		h.u.Name(),
+	)
+	noteUpload(h.m, h.u.Name(), h.n)
+	return nil
+}
+
+// abortAll aborts uploads the client didn't close before the session
+// ended.
+func (ss *sftpSession) abortAll() {
+	for hn, h := range ss.handles {
+		delete(ss.handles, hn)
+		if nil == h.u {
+			continue
+		}
+		if nil == h.err {
+			h.err = errors.New("session ended before close")
+		}
+		ss.finish(h)
+	}
+}
+
+/* sftpAbs turns p into a clean absolute path. */
+func sftpAbs(p string) string { return path.Join("/", p) }
+
+// parseSCPSink parses an scp -t command line, as sent by scp -O.  It returns
+// the target and whether the target should be a directory.
+func parseSCPSink(cmd string) (target string, dir bool, ok bool) {
+	fs := strings.Fields(cmd)
+	if 0 == len(fs) || "scp" != fs[0] {
+		return "", false, false
+	}
+	var sink, done bool
+	for _, f := range fs[1:] {
+		switch {
+		case done || !strings.HasPrefix(f, "-"):
+			if "" != target {
+				return "", false, false
+			}
+			target = f
+		case "--" == f:
+			done = true
+		default:
+			for _, c := range f[1:] {
+				switch c {
+				case 't':
+					sink = true
+				case 'd', 'r':
+					dir = true
+				case 'p', 'v', 'q':
+				default: /* Including -f */
+					return "", false, false
+				}
+			}
+		}
+	}
+	if !sink {
+		return "", false, false
+	}
+	if "" == target || "." == target || strings.HasSuffix(target, "/") {
+		dir = true
+	}
+	return sftpAbs(target), dir, true
+}
+
+// scp receives files sent by scp -O to target, which is a directory if dir
+// is true.
+func (ss *sftpSession) scp(target string, dir bool) error {
+	br := bufio.NewReaderSize(ss.ch, scpMaxLine)
+	ack := func() error {
+		_, err := ss.ch.Write([]byte{0})
+		return err
+	}
+	fail := func(msg string) error {
+		fmt.Fprintf(ss.ch, "\x02scp: %s\n", msg)
+		return errors.New(msg)
+	}
+	var subdirs []string
+	if err := ack(); nil != err {
+		return err
+	}
+	for {
+		line, err := br.ReadSlice('\n')
+		if errors.Is(err, io.EOF) && 0 == len(line) {
+			return nil
+		} else if nil != err {
+			return err
+		}
+		l := strings.TrimSuffix(string(line[1:]), "\n")
+		switch line[0] {
+		case 'T': /* Times, which we ignore */
+		case 'D':
+			name, ok := scpName(l)
+			if !ok {
+				return fail("invalid directory")
+			}
+			subdirs = append(subdirs, name)
+			dir = true
+		case 'E':
+			if 0 == len(subdirs) {
+				return fail("unexpected end of directory")
+			}
+			subdirs = subdirs[:len(subdirs)-1]
+		case 'C':
+			err := ss.scpFile(br, l, target, dir, subdirs)
+			if nil != err {
+				return fail(err.Error())
+			}
+		case 1, 2:
+			log.Printf("[%s] scp error: %s", ss.src, l)
+			if 2 == line[0] {
+				return errors.New(l)
+			}
+			continue
+		default:
+			return fail("protocol error")
+		}
+		if err := ack(); nil != err {
+			return err
+		}
+	}
+}
+
+// scpName returns the name from an scp C or D line, minus its type, and
+// whether it's a valid name.
+func scpName(l string) (string, bool) {
+	parts := strings.SplitN(l, " ", 3)
+	if 3 != len(parts) {
+		return "", false
+	}
+	name := parts[2]
+	if "" == name || "." == name || ".." == name ||
+		strings.Contains(name, "/") {
+		return "", false
+	}
+	return name, true
+}
+
+// scpFile receives a file described by the scp C line l, minus its type,
+// from br and stores it under target.
+func (ss *sftpSession) scpFile(
+	br *bufio.Reader,
+	l string,
+	target string,
+	dir bool,
+	subdirs []string,
+) error {
+	name, ok := scpName(l)
+	if !ok {
+		return errors.New("invalid file")
+	}
+	size, err := strconv.ParseInt(strings.Fields(l)[1], 10, 64)
+	if nil != err || 0 > size {
+		return errors.New("invalid size")
+	}
+	p := target
+	if dir {
+		ps := append(append([]string{target}, subdirs...), name)
+		p = path.Join(ps...)
+	}
+	if shuttingDown.Load() || expired() || maintenanceFeature.Enabled() {
+		return errors.New("not accepting files")
+	}
+
+	/* Save the file */
+	m := &Meta{
+		Source: ss.src,
+		Path:   p,
+		Time:   time.Now(),
+		Token:  ss.token,
+	}
+	u, err := store.Open(m)
+	if nil != err {
+		noteFailure()
+		log.Printf("[%s] Unable to open storage: %v", ss.src, err)
+		return errors.New("unable to store file")
+	}
+	inFlight.Add(1)
+	h := &sftpHandle{u: u, m: m}
+	if _, err := ss.ch.Write([]byte{0}); nil != err {
+		h.err = err
+		ss.finish(h)
+		return err
+	}
+	h.n, h.err = io.CopyN(u, br, size)
+	if nil == h.err {
+		var c byte
+		if c, h.err = br.ReadByte(); nil == h.err && 0 != c {
+			h.err = errors.New("client reported an error")
+		}
+	}
+	if err := ss.finish(h); nil != err {
+		return errors.New("unable to store file")
+	}
+	return nil
+}
@@ -0,0 +1,272 @@
+package main
+
+/*
+ * sftp_test.go
+ * Tests for sftp.go
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/magisterquis/postfile"
+	"golang.org/x/crypto/ssh"
+)
+
+// testSFTPChannel is an ssh.Channel which reads from r and writes to w.
+// Anything else panics.
+type testSFTPChannel struct {
+	ssh.Channel
+	r io.Reader
+	w bytes.Buffer
+}
+
+/* Read implements io.Reader. */
+func (c *testSFTPChannel) Read(b []byte) (int, error) { return c.r.Read(b) }
+
+/* Write implements io.Writer. */
+func (c *testSFTPChannel) Write(b []byte) (int, error) { return c.w.Write(b) }
+
+/* newTestSFTPSession returns an sftpSession which reads in. */
+func newTestSFTPSession(in []byte) (*sftpSession, *testSFTPChannel) {
+	ch := &testSFTPChannel{r: bytes.NewReader(in)}
+	return &sftpSession{
+		ch:      ch,
+		src:     "test",
+		handles: make(map[string]*sftpHandle),
+		dirs:    map[string]bool{"/": true},
+	}, ch
+}
+
+// testSFTPPacket makes an SFTP packet of the given type.  Fields may be
+// uint32s, uint64s, or strings.
+func testSFTPPacket(typ byte, fields ...any) []byte {
+	b := []byte{typ}
+	for _, f := range fields {
+		switch f := f.(type) {
+		case uint32:
+			b = binary.BigEndian.AppendUint32(b, f)
+		case uint64:
+			b = binary.BigEndian.AppendUint64(b, f)
+		case string:
+			b = appendSFTPString(b, f)
+		default:
+			panic("invalid field")
+		}
+	}
+	return append(binary.BigEndian.AppendUint32(nil, uint32(len(b))), b...)
+}
+
+func TestSFTPSessionReadPacket(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		in   []byte
+		want []byte
+		err  bool
+	}{{
+		name: "ok",
+		in:   []byte{0, 0, 0, 3, 1, 2, 3},
+		want: []byte{1, 2, 3},
+	}, {
+		name: "zero_length",
+		in:   []byte{0, 0, 0, 0},
+		err:  true,
+	}, {
+		name: "too_large",
+		in:   binary.BigEndian.AppendUint32(nil, sftpMaxPacket+1),
+		err:  true,
+	}, {
+		name: "max_length_short",
+		in:   binary.BigEndian.AppendUint32(nil, sftpMaxPacket),
+		err:  true,
+	}, {
+		name: "short_body",
+		in:   []byte{0, 0, 0, 3, 1, 2},
+		err:  true,
+	}, {
+		name: "short_length",
+		in:   []byte{0, 0},
+		err:  true,
+	}} {
+		t.Run(c.name, func(t *testing.T) {
+			ss, _ := newTestSFTPSession(c.in)
+			got, err := ss.readPacket()
+			if c.err {
+				if nil == err {
+					t.Errorf("Expected error, got %v", got)
+				}
+				return
+			}
+			if nil != err {
+				t.Fatalf("Error: %s", err)
+			}
+			if !bytes.Equal(got, c.want) {
+				t.Errorf("Got %v, want %v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestSFTPReader(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		in   []byte
+		read func(r *sftpReader) any
+		want any
+		bad  bool
+	}{{
+		name: "u32",
+		in:   []byte{0, 0, 1, 0},
+		read: func(r *sftpReader) any { return r.u32() },
+		want: uint32(256),
+	}, {
+		name: "short_u32",
+		in:   []byte{0, 0, 1},
+		read: func(r *sftpReader) any { return r.u32() },
+		want: uint32(0),
+		bad:  true,
+	}, {
+		name: "short_u64",
+		in:   []byte{0, 0, 0, 0, 0, 0, 1},
+		read: func(r *sftpReader) any { return r.u64() },
+		want: uint64(0),
+		bad:  true,
+	}, {
+		name: "str",
+		in:   []byte{0, 0, 0, 2, 'h', 'i', 'x'},
+		read: func(r *sftpReader) any { return r.str() },
+		want: "hi",
+	}, {
+		name: "short_str",
+		in:   []byte{0, 0, 0, 3, 'h', 'i'},
+		read: func(r *sftpReader) any { return r.str() },
+		want: "",
+		bad:  true,
+	}, {
+		name: "huge_str",
+		in:   []byte{0xff, 0xff, 0xff, 0xff, 'h', 'i'},
+		read: func(r *sftpReader) any { return r.str() },
+		want: "",
+		bad:  true,
+	}} {
+		t.Run(c.name, func(t *testing.T) {
+			r := &sftpReader{b: c.in}
+			if got := c.read(r); got != c.want {
+				t.Errorf("Got %v, want %v", got, c.want)
+			}
+			if r.bad != c.bad {
+				t.Errorf("Bad %v, want %v", r.bad, c.bad)
+			}
+		})
+	}
+}
+
+func TestSFTPSessionEscape(t *testing.T) {
+	/* Uploads go in a directory inside another directory */
+	parent := t.TempDir()
+	t.Chdir(parent)
+	if err := os.Mkdir("uploads", 0700); nil != err {
+		t.Fatalf("Making upload directory: %s", err)
+	}
+	t.Chdir("uploads")
+	defer func(s Storage) { store = s }(store)
+	store = postfile.LocalStorage{}
+
+	const contents = "kittens"
+	var in []byte
+	for _, p := range [][]byte{
+		testSFTPPacket(sshFxpInit, uint32(sshFileXferVersion)),
+		testSFTPPacket(
+			sshFxpOpen,
+			uint32(1),
+			"../../escaped",
+			uint32(sshFxfWrite),
+			uint32(0),
+		),
+		testSFTPPacket(
+			sshFxpWrite,
+			uint32(2),
+			"0",
+			uint64(0),
+			contents,
+		),
+		testSFTPPacket(sshFxpClose, uint32(3), "0"),
+	} {
+		in = append(in, p...)
+	}
+	ss, ch := newTestSFTPSession(in)
+	if err := ss.sftp(); nil != err {
+		t.Fatalf("Error: %s", err)
+	}
+
+	/* Every request but init should have worked */
+	ok := uint32(sshFxOK)
+	want := [][]byte{
+		testSFTPPacket(sshFxpVersion, uint32(sshFileXferVersion)),
+		testSFTPPacket(sshFxpHandle, uint32(1), "0"),
+		testSFTPPacket(sshFxpStatus, uint32(2), ok, "", ""),
+		testSFTPPacket(sshFxpStatus, uint32(3), ok, "", ""),
+	}
+	if got := ch.w.Bytes(); !bytes.Equal(got, bytes.Join(want, nil)) {
+		t.Errorf("Unexpected replies: %q", got)
+	}
+
+	/* The file should be in the upload directory and nowhere else */
+	ms, err := filepath.Glob(filepath.Join(parent, "*"))
+	if nil != err {
+		t.Fatalf("Globbing parent directory: %s", err)
+	}
+	if 1 != len(ms) || "uploads" != filepath.Base(ms[0]) {
+		t.Errorf("Unexpected files in parent directory: %q", ms)
+	}
+	ms, err = filepath.Glob("*")
+	if nil != err {
+		t.Fatalf("Globbing upload directory: %s", err)
+	}
+	if 1 != len(ms) || !strings.Contains(ms[0], "escaped") {
+		t.Fatalf("Unexpected files in upload directory: %q", ms)
+	}
+	if b, err := os.ReadFile(ms[0]); nil != err {
+		t.Errorf("Reading %s: %s", ms[0], err)
+	} else if contents != string(b) {
+		t.Errorf("Got %q, want %q", b, contents)
+	}
+}
+
+func TestParseSCPSink(t *testing.T) {
+	for _, c := range []struct {
+		cmd    string
+		target string
+		dir    bool
+		ok     bool
+	}{
+		{cmd: "scp -t foo", target: "/foo", ok: true},
+		{cmd: "scp -t ../../foo", target: "/foo", ok: true},
+		{cmd: "scp -t -- -foo", target: "/-foo", ok: true},
+		{cmd: "scp -r -t /tmp/", target: "/tmp", dir: true, ok: true},
+		{cmd: "scp -t .", target: "/", dir: true, ok: true},
+		{cmd: "scp -f foo"},
+		{cmd: "scp foo"},
+		{cmd: "scp -t foo bar"},
+		{cmd: "rm -rf /"},
+	} {
+		t.Run(c.cmd, func(t *testing.T) {
+			target, dir, ok := parseSCPSink(c.cmd)
+			if target != c.target || dir != c.dir || ok != c.ok {
+				t.Errorf(
+					"Got (%q, %v, %v), want (%q, %v, %v)",
+					target, dir, ok,
+					c.target, c.dir, c.ok,
+				)
+			}
+		})
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+/*
+ * shutdown.go
+ * Finish uploads before exiting
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+var (
+	/* inFlight counts requests being handled */
+	inFlight sync.WaitGroup
+
+	/* shuttingDown is set once we've been told to stop */
+	shuttingDown atomic.Bool
+
+	/* stopSignals gets a signal when it's time to stop */
+	stopSignals = make(chan os.Signal, 1)
+)
+
+// withInFlight returns a handler which counts requests in inFlight and
+// calls next.
+func withInFlight(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		inFlight.Add(1)
+		defer inFlight.Done()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// shutdownOnSignal stops accepting new connections on SIGINT or SIGTERM and
+// gives in-flight requests and buffered uploads up to grace to finish.  If
+// srv is nil, l is closed instead of srv being shut down.  The returned
+// channel is closed when it's time to exit.
+func shutdownOnSignal(
+	srv *http.Server,
+	l net.Listener,
+	grace time.Duration,
+) <-chan struct{} {
+	done := make(chan struct{})
+	signal.Notify(stopSignals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		s := <-stopSignals
+		signal.Stop(stopSignals) /* Another signal kills us. */
+		shuttingDown.Store(true)
+		sdNotify("STOPPING=1")
+		log.Printf(
+			"Caught %v, finishing in-flight uploads for up to %v",
+			s,
+			grace,
+		)
+		ctx, cancel := context.WithTimeout(context.Background(), grace)
+		defer cancel()
+
+		/* Stop taking new connections */
+		if nil != srv {
+			if err := srv.Shutdown(ctx); nil != err {
+				log.Printf("Error shutting down: %v", err)
+				srv.Close()
+			}
+		} else if err := l.Close(); nil != err {
+			log.Printf("Error closing listener: %v", err)
+		}
+		shutdownHTTP3(ctx)
+
+		/* Wait for everything to finish */
+		if waitCtx(ctx, &inFlight) && waitCtx(ctx, &burstWG) {
+			log.Printf("Finished in-flight uploads")
+		} else {
+			log.Printf("Grace period over, in-flight uploads lost")
+		}
+		logClientStats()
+		close(done)
+	}()
+	return done
+}
+
+// waitCtx waits for wg, or for ctx to be done.  It returns true if wg
+// finished first.
+func waitCtx(ctx context.Context, wg *sync.WaitGroup) bool {
+	ch := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(ch)
+	}()
+	select {
+	case <-ch:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,557 @@
+package main
+
+/*
+ * smtp.go
+ * Receive files by email
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Each message is stored with a path of /smtp/<first recipient>, with the
+// envelope sender and recipients added as Return-Path and Delivered-To
+// headers.  Attachments, if saved, are stored with a path of
+// /smtp/<first recipient>/<filename>.  If we have tokens, clients must
+// AUTH with a token as the password, after STARTTLS if we have a
+// certificate.
+const (
+	smtpMaxSize  = 64 << 20 /* Per message */
+	smtpMaxRcpts = 100
+	smtpMaxLine  = 4096
+	smtpTimeout  = 5 * time.Minute
+)
+
+/* smtpServer accepts mail. */
+type smtpServer struct {
+	hostname    string
+	conf        *tls.Config /* For STARTTLS, or nil */
+	attachments bool
+}
+
+// listenSMTP accepts mail on addr.  If conf isn't nil, clients may
+// STARTTLS.  If attachments is true, attachments are also saved on their
+// own.
+func listenSMTP(
+	addr string,
+	conf *tls.Config,
+	attachments bool,
+) (net.Listener, error) {
+	s := &smtpServer{conf: conf, attachments: attachments}
+	var err error
+	if s.hostname, err = os.Hostname(); nil != err {
+		s.hostname = "postfile"
+	}
+	l, err := net.Listen("tcp", addr)
+	if nil != err {
+		return nil, err
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if nil != err {
+				log.Fatalf(
+					"Error accepting SMTP connections: %v",
+					err,
+				)
+			}
+			go s.handle(pcapConn("smtp", limitConn(c)))
+		}
+	}()
+	return l, nil
+}
+
+/* smtpSession is a client's SMTP session. */
+type smtpSession struct {
+	s     *smtpServer
+	c     net.Conn
+	br    *bufio.Reader
+	src   string
+	helo  string
+	tls   bool
+	token string /* Token name, once authenticated */
+	from  string
+	rcpts []string
+}
+
+/* handle speaks SMTP with the client on c. */
+func (s *smtpServer) handle(c net.Conn) {
+	ss := &smtpSession{
+		s:   s,
+		c:   c,
+		br:  bufio.NewReaderSize(c, smtpMaxLine),
+		src: c.RemoteAddr().String(),
+	}
+	defer func() { ss.c.Close() }()
+
+	/* Only take mail when we would over HTTP */
+	if shuttingDown.Load() || expired() || maintenanceFeature.Enabled() {
+		ss.reply(421, "4.3.2 Service not available")
+		return
+	}
+	ss.reply(220, s.hostname+" ESMTP postfile")
+
+	for {
+		line, err := ss.readLine()
+		if errors.Is(err, bufio.ErrBufferFull) {
+			ss.reply(500, "5.5.2 Line too long")
+			return
+		} else if nil != err {
+			return
+		}
+		verb, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(verb) {
+		case "HELO", "EHLO":
+			ss.hello(strings.ToUpper(verb), arg)
+		case "STARTTLS":
+			if !ss.startTLS() {
+				return
+			}
+		case "AUTH":
+			ss.auth(arg)
+		case "MAIL":
+			ss.mail(arg)
+		case "RCPT":
+			ss.rcpt(arg)
+		case "DATA":
+			if !ss.data() {
+				return
+			}
+		case "RSET":
+			ss.from, ss.rcpts = "", nil
+			ss.reply(250, "2.0.0 OK")
+		case "NOOP":
+			ss.reply(250, "2.0.0 OK")
+		case "VRFY":
+			ss.reply(252, "2.1.5 Send some mail and find out")
+		case "QUIT":
+			ss.reply(221, "2.0.0 Bye")
+			return
+		default:
+			ss.reply(502, "5.5.1 Command not implemented")
+		}
+	}
+}
+
+// readLine reads a line from the client, without the line ending.  Lines
+// longer than smtpMaxLine cause bufio.ErrBufferFull.
+func (ss *smtpSession) readLine() (string, error) {
+	ss.c.SetReadDeadline(time.Now().Add(smtpTimeout))
+	line, err := ss.br.ReadSlice('\n')
+	if nil != err {
+		return "", err
+	}
+	return strings.TrimRight(string(line), "\r\n"), nil
+}
+
+/* reply sends a reply.  Lines after the first are continuation lines. */
+func (ss *smtpSession) reply(code int, lines ...string) {
+	var b strings.Builder
+	for i, l := range lines {
+		sep := "-"
+		if len(lines)-1 == i {
+			sep = " "
+		}
+		fmt.Fprintf(&b, "%d%s%s\r\n", code, sep, l)
+	}
+	ss.c.SetWriteDeadline(time.Now().Add(smtpTimeout))
+	io.WriteString(ss.c, b.String())
+}
+
+/* hello handles HELO and EHLO. */
+func (ss *smtpSession) hello(verb, arg string) {
+	if "" == arg {
+		ss.reply(501, "5.5.4 Need a hostname")
+		return
+	}
+	ss.helo = arg
+	ss.from, ss.rcpts = "", nil
+	if "HELO" == verb {
+		ss.reply(250, ss.s.hostname)
+		return
+	}
+	exts := []string{
+		ss.s.hostname,
+		"SIZE " + strconv.Itoa(smtpMaxSize),
+		"8BITMIME",
+		"ENHANCEDSTATUSCODES",
+	}
+	if nil != ss.s.conf && !ss.tls {
+		exts = append(exts, "STARTTLS")
+	}
+	if 0 != len(tokens) && ss.authOK() {
+		exts = append(exts, "AUTH PLAIN LOGIN")
+	}
+	ss.reply(250, exts...)
+}
+
+// authOK returns true if the client may authenticate, which is after
+// STARTTLS if we have a certificate.
+func (ss *smtpSession) authOK() bool {
+	return nil == ss.s.conf || ss.tls
+}
+
+// startTLS handles STARTTLS.  It returns false if the connection should be
+// closed.
+func (ss *smtpSession) startTLS() bool {
+	if nil == ss.s.conf || ss.tls {
+		ss.reply(502, "5.5.1 Command not implemented")
+		return true
+	}
+	ss.reply(220, "2.0.0 Ready to start TLS")
+	tc := tls.Server(ss.c, ss.s.conf)
+	tc.SetDeadline(time.Now().Add(smtpTimeout))
+	if err := tc.Handshake(); nil != err {
+		log.Printf("[%s] SMTP TLS handshake failed: %v", ss.src, err)
+		return false
+	}
+	ss.c = tc
+	ss.br = bufio.NewReaderSize(tc, smtpMaxLine)
+	ss.tls = true
+	ss.helo, ss.token, ss.from, ss.rcpts = "", "", "", nil
+	return true
+}
+
+/* auth handles AUTH PLAIN and AUTH LOGIN with a token as the password. */
+func (ss *smtpSession) auth(arg string) {
+	switch {
+	case 0 == len(tokens):
+		ss.reply(502, "5.5.1 Command not implemented")
+		return
+	case !ss.authOK():
+		ss.reply(538, "5.7.11 Encryption required")
+		return
+	case "" != ss.token:
+		ss.reply(503, "5.5.1 Already authenticated")
+		return
+	}
+
+	/* Get the password */
+	mech, initial, _ := strings.Cut(arg, " ")
+	var pass string
+	switch strings.ToUpper(mech) {
+	case "PLAIN":
+		if "" == initial {
+			ss.reply(334, "")
+			initial, _ = ss.readLine()
+		}
+		b, err := base64.StdEncoding.DecodeString(initial)
+		if nil != err {
+			ss.reply(501, "5.5.2 Invalid base64")
+			return
+		}
+		/* authzid NUL authcid NUL passwd */
+		if parts := bytes.Split(b, []byte{0}); 3 == len(parts) {
+			pass = string(parts[2])
+		}
+	case "LOGIN":
+		/* We don't care about the username */
+		ss.reply(334, base64.StdEncoding.EncodeToString(
+			[]byte("Username:"),
+		))
+		ss.readLine()
+		ss.reply(334, base64.StdEncoding.EncodeToString(
+			[]byte("Password:"),
+		))
+		l, _ := ss.readLine()
+		b, err := base64.StdEncoding.DecodeString(l)
+		if nil != err {
+			ss.reply(501, "5.5.2 Invalid base64")
+			return
+		}
+		pass = string(b)
+	default:
+		ss.reply(504, "5.5.4 Unrecognized authentication type")
+		return
+	}
+
+	if ss.token = lookupToken(pass); "" == ss.token {
+		log.Printf("[%s] SMTP authentication failed", ss.src)
+		ss.reply(535, "5.7.8 Authentication credentials invalid")
+		return
+	}
+	ss.reply(235, "2.7.0 Authentication successful")
+}
+
+/* mail handles MAIL FROM. */
+func (ss *smtpSession) mail(arg string) {
+	switch {
+	case 0 != len(tokens) && "" == ss.token:
+		ss.reply(530, "5.7.0 Authentication required")
+		return
+	case "" != ss.from:
+		ss.reply(503, "5.5.1 Sender already given")
+		return
+	}
+	from, params, ok := smtpPath(arg, "FROM:")
+	if !ok {
+		ss.reply(501, "5.5.4 Syntax: MAIL FROM:<address>")
+		return
+	}
+	for _, p := range params {
+		k, v, _ := strings.Cut(p, "=")
+		if !strings.EqualFold("SIZE", k) {
+			continue
+		}
+		if n, err := strconv.Atoi(v); nil == err && smtpMaxSize < n {
+			ss.reply(552, "5.3.4 Message too big")
+			return
+		}
+	}
+	ss.from = "<" + from + ">"
+	ss.reply(250, "2.1.0 OK")
+}
+
+/* rcpt handles RCPT TO. */
+func (ss *smtpSession) rcpt(arg string) {
+	if "" == ss.from {
+		ss.reply(503, "5.5.1 Need MAIL first")
+		return
+	}
+	if smtpMaxRcpts <= len(ss.rcpts) {
+		ss.reply(452, "4.5.3 Too many recipients")
+		return
+	}
+	to, _, ok := smtpPath(arg, "TO:")
+	if !ok || "" == to {
+		ss.reply(501, "5.5.4 Syntax: RCPT TO:<address>")
+		return
+	}
+	ss.rcpts = append(ss.rcpts, to)
+	ss.reply(250, "2.1.5 OK")
+}
+
+// smtpPath gets the address from the argument to MAIL FROM or RCPT TO, as
+// well as any parameters after it.  prefix is FROM: or TO:.
+func smtpPath(arg, prefix string) (string, []string, bool) {
+	if len(arg) < len(prefix) ||
+		!strings.EqualFold(arg[:len(prefix)], prefix) {
+		return "", nil, false
+	}
+	arg = strings.TrimSpace(arg[len(prefix):])
+	if !strings.HasPrefix(arg, "<") {
+		return "", nil, false
+	}
+	addr, rest, ok := strings.Cut(arg[1:], ">")
+	if !ok {
+		return "", nil, false
+	}
+	return addr, strings.Fields(rest), true
+}
+
+// data handles DATA and stores the message.  It returns false if the
+// connection should be closed.
+func (ss *smtpSession) data() bool {
+	if 0 == len(ss.rcpts) {
+		ss.reply(503, "5.5.1 Need RCPT first")
+		return true
+	}
+	inFlight.Add(1)
+	defer inFlight.Done()
+	defer func() { ss.from, ss.rcpts = "", nil }()
+
+	/* Somewhere to put it */
+	m := &Meta{
+		Source: ss.src,
+		Path:   "/smtp/" + ss.rcpts[0],
+		Host:   ss.helo,
+		Time:   time.Now(),
+		Token:  ss.token,
+	}
+	u, err := store.Open(m)
+	if nil != err {
+		noteFailure()
+		log.Printf("[%s] Unable to open storage: %v", ss.src, err)
+		ss.reply(451, "4.3.0 Unable to store message")
+		return true
+	}
+	ss.reply(354, "Go ahead, end with <CRLF>.<CRLF>")
+
+	/* Envelope first, then the message */
+	var hdr strings.Builder
+	fmt.Fprintf(&hdr, "Return-Path: %s\n", ss.from)
+	for _, r := range ss.rcpts {
+		fmt.Fprintf(&hdr, "Delivered-To: %s\n", r)
+	}
+	fmt.Fprintf(
+		&hdr,
+		"Received: from %s (%s)\n\tby %s (postfile); %s\n",
+		ss.helo,
+		ss.src,
+		ss.s.hostname,
+		m.Time.Format(time.RFC1123Z),
+	)
+	var (
+		buf bytes.Buffer
+		w   io.Writer = u
+	)
+	if ss.s.attachments {
+		w = io.MultiWriter(u, &buf)
+	}
+	ss.c.SetReadDeadline(time.Now().Add(smtpTimeout))
+	dr := textproto.NewReader(ss.br).DotReader()
+	n, err := copyBody(w, io.MultiReader(
+		strings.NewReader(hdr.String()),
+		io.LimitReader(dr, smtpMaxSize+1),
+	))
+	if nil == err && smtpMaxSize < n-int64(hdr.Len()) {
+		err = fmt.Errorf("message larger than %d bytes", smtpMaxSize)
+	}
+	io.Copy(io.Discard, dr) /* Keep in sync if we stopped early */
+	if nil == err {
+		err = u.Commit()
+	} else {
+		u.Abort()
+	}
+	if nil != err {
+		noteFailure()
+		log.Printf(
+			"[%s] Error after writing %v bytes of mail to %q: %v",
+			ss.src,
+			n,
+			u.Name(),
+			err,
+		)
+		if !errors.Is(err, io.ErrUnexpectedEOF) {
+			ss.reply(554, "5.3.0 Unable to store message")
+		}
+		return !errors.Is(err, io.ErrUnexpectedEOF)
+	}
+	log.Printf(
+		"[%s] Wrote %v bytes of mail from %s to %q",
+		ss.src,
+		n,
+		ss.from,
+		u.Name(),
+	)
+	noteUpload(m, u.Name(), n)
+	ss.reply(250, "2.0.0 Stored as "+u.Name())
+
+	if ss.s.attachments {
+		ss.saveAttachments(m, buf.Bytes())
+	}
+	return true
+}
+
+/* saveAttachments stores the attachments in the message msg, from m. */
+func (ss *smtpSession) saveAttachments(m *Meta, msg []byte) {
+	pm, err := mail.ReadMessage(bytes.NewReader(msg))
+	if nil != err {
+		log.Printf("[%s] Unable to parse mail: %v", ss.src, err)
+		return
+	}
+	if err := walkMIME(
+		textproto.MIMEHeader(pm.Header),
+		pm.Body,
+		func(name string, r io.Reader) error {
+			return ss.saveAttachment(m, name, r)
+		},
+	); nil != err {
+		log.Printf(
+			"[%s] Error saving attachments: %v",
+			ss.src,
+			err,
+		)
+	}
+}
+
+/* saveAttachment saves one attachment, named name. */
+func (ss *smtpSession) saveAttachment(m *Meta, name string, r io.Reader) error {
+	am := *m
+	am.Path += "/" + name
+	u, err := store.Open(&am)
+	if nil != err {
+		noteFailure()
+		return fmt.Errorf("opening storage: %w", err)
+	}
+	n, err := copyBody(u, r)
+	if nil == err {
+		err = u.Commit()
+	} else {
+		u.Abort()
+	}
+	if nil != err {
+		noteFailure()
+		return fmt.Errorf(
+			"after writing %v bytes to %q: %w",
+			n,
+			u.Name(),
+			err,
+		)
+	}
+	log.Printf(
+		"[%s] Wrote %v bytes of attachment %q to %q",
+		ss.src,
+		n,
+		name,
+		u.Name(),
+	)
+	noteUpload(&am, u.Name(), n)
+	return nil
+}
+
+// walkMIME calls f with the filename and decoded contents of each part of
+// the MIME entity with header h and body r which has a filename.  Multipart
+// entities are walked recursively.
+func walkMIME(
+	h textproto.MIMEHeader,
+	r io.Reader,
+	f func(name string, r io.Reader) error,
+) error {
+	mt, params, _ := mime.ParseMediaType(h.Get("Content-Type"))
+	if strings.HasPrefix(mt, "multipart/") {
+		mr := multipart.NewReader(r, params["boundary"])
+		for {
+			p, err := mr.NextRawPart()
+			if io.EOF == err {
+				return nil
+			} else if nil != err {
+				return err
+			}
+			if err := walkMIME(p.Header, p, f); nil != err {
+				return err
+			}
+		}
+	}
+
+	/* Not multipart, but is it an attachment? */
+	var name string
+	if _, dp, err := mime.ParseMediaType(
+		h.Get("Content-Disposition"),
+	); nil == err {
+		name = dp["filename"]
+	}
+	if "" == name {
+		name = params["name"]
+	}
+	if "" == name {
+		return nil
+	}
+	switch strings.ToLower(h.Get("Content-Transfer-Encoding")) {
+	case "base64":
+		r = base64.NewDecoder(base64.StdEncoding, r)
+	case "quoted-printable":
+		r = quotedprintable.NewReader(r)
+	}
+	return f(name, r)
+}
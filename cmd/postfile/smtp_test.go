@@ -0,0 +1,253 @@
+package main
+
+/*
+ * smtp_test.go
+ * Tests for smtp.go
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"bufio"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/magisterquis/postfile"
+)
+
+// newTestSMTPSession starts an SMTP session on a loopback connection and
+// returns the client's side of it.
+func newTestSMTPSession(t *testing.T, s *smtpServer) *textproto.Conn {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatalf("Listen: %s", err)
+	}
+	defer l.Close()
+	cc, err := net.Dial("tcp", l.Addr().String())
+	if nil != err {
+		t.Fatalf("Dial: %s", err)
+	}
+	sc, err := l.Accept()
+	if nil != err {
+		t.Fatalf("Accept: %s", err)
+	}
+	go s.handle(sc)
+	tc := textproto.NewConn(cc)
+	t.Cleanup(func() { tc.Close() })
+	if _, _, err := tc.ReadResponse(220); nil != err {
+		t.Fatalf("Greeting: %s", err)
+	}
+	return tc
+}
+
+/* testSMTPCmd sends a command and checks the reply's code. */
+func testSMTPCmd(t *testing.T, tc *textproto.Conn, want int, cmd string) {
+	t.Helper()
+	if _, err := tc.Cmd("%s", cmd); nil != err {
+		t.Fatalf("Sending %q: %s", cmd, err)
+	}
+	if _, _, err := tc.ReadResponse(want); nil != err {
+		t.Errorf("%q: %s", cmd, err)
+	}
+}
+
+func TestSMTPPath(t *testing.T) {
+	for _, c := range []struct {
+		arg    string
+		prefix string
+		addr   string
+		params []string
+		ok     bool
+	}{{
+		arg:    "FROM:<a@example.com>",
+		prefix: "FROM:",
+		addr:   "a@example.com",
+		ok:     true,
+	}, {
+		arg:    "from: <a@example.com> SIZE=10 BODY=8BITMIME",
+		prefix: "FROM:",
+		addr:   "a@example.com",
+		params: []string{"SIZE=10", "BODY=8BITMIME"},
+		ok:     true,
+	}, {
+		arg:    "FROM:<>",
+		prefix: "FROM:",
+		ok:     true,
+	}, {
+		arg:    "TO:a@example.com",
+		prefix: "TO:",
+	}, {
+		arg:    "TO:<a@example.com",
+		prefix: "TO:",
+	}, {
+		arg:    "FROM:<a@example.com>",
+		prefix: "TO:",
+	}, {
+		arg:    "TO",
+		prefix: "TO:",
+	}} {
+		t.Run(c.arg, func(t *testing.T) {
+			addr, params, ok := smtpPath(c.arg, c.prefix)
+			if addr != c.addr ||
+				!slices.Equal(params, c.params) ||
+				ok != c.ok {
+				t.Errorf(
+					"Got (%q, %q, %v), want (%q, %q, %v)",
+					addr, params, ok,
+					c.addr, c.params, c.ok,
+				)
+			}
+		})
+	}
+}
+
+func TestWalkMIME(t *testing.T) {
+	const msg = "Content-Type: multipart/mixed; boundary=outer\r\n" +
+		"\r\n" +
+		"--outer\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"Not an attachment\r\n" +
+		"--outer\r\n" +
+		"Content-Type: multipart/alternative; boundary=inner\r\n" +
+		"\r\n" +
+		"--inner\r\n" +
+		"Content-Type: application/octet-stream; name=b64.bin\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" +
+		"a2l0dGVucw==\r\n" +
+		"--inner--\r\n" +
+		"--outer\r\n" +
+		"Content-Disposition: attachment; filename=qp.txt\r\n" +
+		"Content-Transfer-Encoding: quoted-printable\r\n" +
+		"\r\n" +
+		"mo=3Dose\r\n" +
+		"--outer--\r\n"
+	tr := textproto.NewReader(bufio.NewReader(strings.NewReader(msg)))
+	h, err := tr.ReadMIMEHeader()
+	if nil != err {
+		t.Fatalf("Reading header: %s", err)
+	}
+	var got []string
+	if err := walkMIME(h, tr.R, func(name string, r io.Reader) error {
+		b, err := io.ReadAll(r)
+		got = append(got, name+"="+string(b))
+		return err
+	}); nil != err {
+		t.Fatalf("Error: %s", err)
+	}
+	want := []string{"b64.bin=kittens", "qp.txt=mo=ose"}
+	if !slices.Equal(got, want) {
+		t.Errorf("Got %q, want %q", got, want)
+	}
+}
+
+func TestSMTPSessionAuth(t *testing.T) {
+	defer func(ts map[string]string) { tokens = ts }(tokens)
+	tokens = map[string]string{"secret": "alice"}
+	tc := newTestSMTPSession(t, &smtpServer{hostname: "test"})
+
+	plain := func(pass string) string {
+		return "AUTH PLAIN " + base64.StdEncoding.EncodeToString(
+			[]byte("\x00user\x00"+pass),
+		)
+	}
+	testSMTPCmd(t, tc, 250, "EHLO client")
+	testSMTPCmd(t, tc, 530, "MAIL FROM:<a@example.com>")
+	testSMTPCmd(t, tc, 504, "AUTH CRAM-MD5")
+	testSMTPCmd(t, tc, 501, "AUTH PLAIN !!!")
+	testSMTPCmd(t, tc, 535, plain("wrong"))
+	testSMTPCmd(t, tc, 235, plain("secret"))
+	testSMTPCmd(t, tc, 503, plain("secret"))
+	testSMTPCmd(t, tc, 250, "MAIL FROM:<a@example.com>")
+
+	/* Lines have a limit */
+	testSMTPCmd(t, tc, 500, "NOOP "+strings.Repeat("x", smtpMaxLine))
+}
+
+func TestSMTPSessionData(t *testing.T) {
+	t.Chdir(t.TempDir())
+	defer func(s Storage) { store = s }(store)
+	store = postfile.LocalStorage{}
+	tc := newTestSMTPSession(t, &smtpServer{
+		hostname:    "test",
+		attachments: true,
+	})
+
+	testSMTPCmd(t, tc, 250, "HELO client")
+	testSMTPCmd(t, tc, 503, "RCPT TO:<b@example.com>")
+	testSMTPCmd(t, tc, 503, "DATA")
+	testSMTPCmd(t, tc, 552, "MAIL FROM:<a@example.com> SIZE=999999999")
+	testSMTPCmd(t, tc, 250, "MAIL FROM:<a@example.com>")
+	testSMTPCmd(t, tc, 503, "MAIL FROM:<a@example.com>")
+	testSMTPCmd(t, tc, 501, "RCPT TO:<>")
+	testSMTPCmd(t, tc, 250, "RCPT TO:<b@example.com>")
+	testSMTPCmd(t, tc, 250, "RCPT TO:<c@example.com>")
+	testSMTPCmd(t, tc, 354, "DATA")
+	w := tc.DotWriter()
+	io.WriteString(w, "Subject: hi\n"+
+		"Content-Type: multipart/mixed; boundary=b\n"+
+		"\n"+
+		"--b\n"+
+		"Content-Disposition: attachment; filename=att.txt\n"+
+		"\n"+
+		".kittens\n"+
+		"--b--\n",
+	)
+	if err := w.Close(); nil != err {
+		t.Fatalf("Sending message: %s", err)
+	}
+	_, msg, err := tc.ReadResponse(250)
+	if nil != err {
+		t.Fatalf("Finishing message: %s", err)
+	}
+	name, ok := strings.CutPrefix(msg, "2.0.0 Stored as ")
+	if !ok {
+		t.Fatalf("Unexpected reply %q", msg)
+	}
+	testSMTPCmd(t, tc, 221, "QUIT")
+
+	/* The message should have the envelope, unstuffed */
+	b, err := os.ReadFile(name)
+	if nil != err {
+		t.Fatalf("Reading message: %s", err)
+	}
+	for _, want := range []string{
+		"Return-Path: <a@example.com>\n",
+		"Delivered-To: b@example.com\n",
+		"Delivered-To: c@example.com\n",
+		"Subject: hi\n",
+		"\n.kittens\n",
+	} {
+		if !strings.Contains(string(b), want) {
+			t.Errorf("Message missing %q:\n%s", want, b)
+		}
+	}
+	if strings.Contains(string(b), "..kittens") {
+		t.Errorf("Message wasn't unstuffed:\n%s", b)
+	}
+
+	/* The attachment should be on its own, too */
+	ms, err := filepath.Glob("*")
+	if nil != err {
+		t.Fatalf("Glob: %s", err)
+	}
+	if ms = slices.DeleteFunc(ms, func(s string) bool {
+		return s == name
+	}); 1 != len(ms) {
+		t.Fatalf("Expected one attachment, got %q", ms)
+	}
+	if b, err := os.ReadFile(ms[0]); nil != err {
+		t.Errorf("Reading attachment: %s", err)
+	} else if ".kittens" != string(b) {
+		t.Errorf("Attachment is %q", b)
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+/*
+ * sniff.go
+ * Work out what uploads are from their first bytes
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+/* sniffLen is how many bytes we look at to work out an upload's type. */
+const sniffLen = 512
+
+// sniffMagic are types http.DetectContentType doesn't know about, by the
+// bytes with which they start.
+var sniffMagic = []struct {
+	magic string
+	ctype string
+}{
+	{"\x7fELF", "application/x-elf"},
+	{"\xfe\xed\xfa\xce", "application/x-mach-binary"},
+	{"\xfe\xed\xfa\xcf", "application/x-mach-binary"},
+	{"\xce\xfa\xed\xfe", "application/x-mach-binary"},
+	{"\xcf\xfa\xed\xfe", "application/x-mach-binary"},
+	{"SQLite format 3\x00", "application/vnd.sqlite3"},
+	{"BZh", "application/x-bzip2"},
+	{"\xfd7zXZ\x00", "application/x-xz"},
+	{"\x28\xb5\x2f\xfd", "application/zstd"},
+	{"7z\xbc\xaf\x27\x1c", "application/x-7z-compressed"},
+	{"-----BEGIN ", "application/x-pem-file"},
+	{"\xd4\xc3\xb2\xa1", "application/vnd.tcpdump.pcap"},
+	{"\xa1\xb2\xc3\xd4", "application/vnd.tcpdump.pcap"},
+	{"\x4d\x3c\xb2\xa1", "application/vnd.tcpdump.pcap"},
+	{"\xa1\xb2\x3c\x4d", "application/vnd.tcpdump.pcap"},
+	{"\x0a\x0d\x0d\x0a", "application/x-pcapng"},
+}
+
+// sniffExts are the extensions for the types we can detect.  Types without
+// an extension, like application/octet-stream, don't get one.
+var sniffExts = map[string]string{
+	"application/json":                              ".json",
+	"application/ogg":                               ".ogg",
+	"application/pdf":                               ".pdf",
+	"application/postscript":                        ".ps",
+	"application/vnd.microsoft.portable-executable": ".exe",
+	"application/vnd.ms-fontobject":                 ".eot",
+	"application/vnd.rar":                           ".rar",
+	"application/vnd.sqlite3":                       ".sqlite",
+	"application/vnd.tcpdump.pcap":                  ".pcap",
+	"application/wasm":                              ".wasm",
+	"application/x-7z-compressed":                   ".7z",
+	"application/x-bzip2":                           ".bz2",
+	"application/x-elf":                             ".elf",
+	"application/x-gzip":                            ".gz",
+	"application/x-mach-binary":                     ".macho",
+	"application/x-pcapng":                          ".pcapng",
+	"application/x-pem-file":                        ".pem",
+	"application/x-rar-compressed":                  ".rar",
+	"application/x-tar":                             ".tar",
+	"application/x-xz":                              ".xz",
+	"application/zip":                               ".zip",
+	"application/zstd":                              ".zst",
+	"audio/aiff":                                    ".aiff",
+	"audio/basic":                                   ".au",
+	"audio/midi":                                    ".mid",
+	"audio/mpeg":                                    ".mp3",
+	"audio/wave":                                    ".wav",
+	"font/collection":                               ".ttc",
+	"font/otf":                                      ".otf",
+	"font/ttf":                                      ".ttf",
+	"font/woff":                                     ".woff",
+	"font/woff2":                                    ".woff2",
+	"image/bmp":                                     ".bmp",
+	"image/gif":                                     ".gif",
+	"image/jpeg":                                    ".jpg",
+	"image/png":                                     ".png",
+	"image/webp":                                    ".webp",
+	"image/x-icon":                                  ".ico",
+	"text/html":                                     ".html",
+	"text/plain":                                    ".txt",
+	"text/xml":                                      ".xml",
+	"video/avi":                                     ".avi",
+	"video/mp4":                                     ".mp4",
+	"video/webm":                                    ".webm",
+}
+
+// sniffType works out the content type of data which starts with b, which
+// should be at least sniffLen bytes if there's that much data.  It's
+// http.DetectContentType, with a few more types.  Empty data has no type.
+func sniffType(b []byte) string {
+	if 0 == len(b) {
+		return ""
+	}
+	for _, m := range sniffMagic {
+		if bytes.HasPrefix(b, []byte(m.magic)) {
+			return m.ctype
+		}
+	}
+	switch {
+	case isTar(b):
+		return "application/x-tar"
+	case isPE(b):
+		return "application/vnd.microsoft.portable-executable"
+	}
+	ct := http.DetectContentType(b)
+	if strings.HasPrefix(ct, "text/plain") && len(b) < sniffLen {
+		/* Short enough to check if it's all JSON */
+		if t := bytes.TrimSpace(b); 0 != len(t) &&
+			('{' == t[0] || '[' == t[0]) && json.Valid(t) {
+			return "application/json"
+		}
+	}
+	return ct
+}
+
+// isPE returns true if b starts with an MZ header which points to a PE
+// header.
+func isPE(b []byte) bool {
+	if 0x40 > len(b) || !bytes.HasPrefix(b, []byte("MZ")) {
+		return false
+	}
+	off := binary.LittleEndian.Uint32(b[0x3c:])
+	return uint64(off)+4 <= uint64(len(b)) &&
+		bytes.Equal(b[off:off+4], []byte("PE\x00\x00"))
+}
+
+// sniffExt returns the extension for the content type ct, or the empty
+// string if there isn't a good one.
+func sniffExt(ct string) string {
+	mt, _, err := mime.ParseMediaType(ct)
+	if nil != err {
+		return ""
+	}
+	return sniffExts[mt]
+}
+
+// sniffStorage works out uploads' content types from their first sniffLen
+// bytes before opening them in the underlying Storage.  The type is put in
+// the upload's Meta, which is changed in place so wrapping Storages see it,
+// and, if ext is set, an extension for the type is added to the upload's
+// name, unless it already has one.
+type sniffStorage struct {
+	Storage
+	ext bool
+}
+
+/* Open starts an upload which is opened once we know what it is. */
+func (s sniffStorage) Open(m *Meta) (Upload, error) {
+	return &sniffUpload{s: s, m: m, buf: make([]byte, 0, sniffLen)}, nil
+}
+
+// sniffUpload is an upload which buffers the first sniffLen bytes before
+// opening the underlying Upload.
+type sniffUpload struct {
+	s   sniffStorage
+	m   *Meta
+	buf []byte
+	u   Upload /* Nil until we know the type */
+}
+
+/* Write writes b to the upload, once we've seen enough to sniff it. */
+func (u *sniffUpload) Write(b []byte) (int, error) {
+	if nil != u.u {
+		return u.u.Write(b)
+	}
+
+	/* Save a bit more, maybe enough */
+	n := min(len(b), sniffLen-len(u.buf))
+	u.buf = append(u.buf, b[:n]...)
+	if len(u.buf) < sniffLen {
+		return n, nil
+	}
+	if err := u.open(); nil != err {
+		return 0, err
+	}
+	if n == len(b) {
+		return n, nil
+	}
+	wn, err := u.u.Write(b[n:])
+	return n + wn, err
+}
+
+// open sniffs the upload's type from what's been buffered, opens the
+// underlying upload, and writes the buffer to it.
+func (u *sniffUpload) open() error {
+	u.m.Type = sniffType(u.buf)
+	mm := *u.m
+	if u.s.ext && "" == mm.Ext {
+		mm.Ext = sniffExt(u.m.Type)
+	}
+	up, err := u.s.Storage.Open(&mm)
+	if nil != err {
+		return err
+	}
+	if _, err := up.Write(u.buf); nil != err {
+		up.Abort()
+		return err
+	}
+	u.u, u.buf = up, nil
+	return nil
+}
+
+/* Name returns the underlying upload's name, if it's been opened. */
+func (u *sniffUpload) Name() string {
+	if nil == u.u {
+		return ""
+	}
+	return u.u.Name()
+}
+
+/* Commit opens the upload if it's short, and commits it. */
+func (u *sniffUpload) Commit() error {
+	if nil == u.u {
+		if err := u.open(); nil != err {
+			return err
+		}
+	}
+	return u.u.Commit()
+}
+
+// Abort opens the upload if we haven't yet, to save what we have, and
+// aborts it.
+func (u *sniffUpload) Abort() error {
+	if nil == u.u {
+		if err := u.open(); nil != err {
+			return err
+		}
+	}
+	return u.u.Abort()
+}
@@ -0,0 +1,281 @@
+package main
+
+/*
+ * spool.go
+ * Spool uploads locally while remote storage is unhealthy
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/magisterquis/postfile"
+)
+
+/* Spool file suffixes */
+const (
+	spoolPartSuffix = ".part" /* Upload in progress */
+	spoolMetaSuffix = ".meta" /* Metadata for a finished upload */
+)
+
+// prober is implemented by Storages which can check whether they're working.
+type prober interface {
+	Probe() error
+}
+
+// spoolStorage wraps a remote Storage and, when the remote Storage isn't
+// healthy, spools uploads to a local directory.  When the remote Storage is
+// healthy again, spooled uploads are drained back to it.
+type spoolStorage struct {
+	backend Storage
+	dir     string
+
+	healthy atomic.Bool
+
+	/* Metrics */
+	spooled      atomic.Int64 /* Uploads spooled, ever */
+	drained      atomic.Int64 /* Uploads drained, ever */
+	drainedBytes atomic.Int64
+	lastRate     atomic.Int64 /* Bytes/second, last drain */
+	lastErr      atomic.Value /* string */
+	drainL       sync.Mutex
+}
+
+// newSpoolStorage returns a spoolStorage which spools uploads for backend in
+// dir and checks backend's health every interval.
+func newSpoolStorage(
+	backend Storage,
+	dir string,
+	interval time.Duration,
+) (*spoolStorage, error) {
+	if err := os.MkdirAll(dir, 0700); nil != err {
+		return nil, err
+	}
+	s := &spoolStorage{backend: backend, dir: dir}
+	s.healthy.Store(true)
+	s.lastErr.Store("")
+	go s.probe(interval)
+	adminMux.HandleFunc("/spool", s.adminStatus)
+	return s, nil
+}
+
+/* Open starts an upload to the backend or, failing that, the spool. */
+func (s *spoolStorage) Open(m *Meta) (Upload, error) {
+	if s.healthy.Load() {
+		u, err := s.backend.Open(m)
+		if nil == err {
+			return &watchedUpload{Upload: u, s: s}, nil
+		}
+		s.unhealthy(err)
+	}
+
+	/* Backend's down, spool it */
+	f, err := os.OpenFile(
+		filepath.Join(s.dir, remoteName(postfile.BaseName(m))+spoolPartSuffix),
+		os.O_WRONLY|os.O_CREATE|os.O_EXCL,
+		0600,
+	)
+	if nil != err {
+		return nil, err
+	}
+	return &spoolUpload{File: f, m: m, s: s}, nil
+}
+
+/* unhealthy marks the backend as unhealthy. */
+func (s *spoolStorage) unhealthy(err error) {
+	s.lastErr.Store(err.Error())
+	if s.healthy.Swap(false) {
+		log.Printf("Storage unhealthy, spooling to %v: %v", s.dir, err)
+	}
+}
+
+// probe checks the backend's health every interval, and drains the spool
+// when it's healthy.  Backends which can't be probed are assumed to be
+// healthy after each interval.
+func (s *spoolStorage) probe(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		if p, ok := s.backend.(prober); ok {
+			if err := p.Probe(); nil != err {
+				s.unhealthy(err)
+				continue
+			}
+		}
+		if !s.healthy.Swap(true) {
+			log.Printf("Storage healthy again")
+		}
+		s.drain()
+	}
+}
+
+/* drain sends spooled uploads to the backend. */
+func (s *spoolStorage) drain() {
+	s.drainL.Lock()
+	defer s.drainL.Unlock()
+
+	mfs, err := filepath.Glob(filepath.Join(s.dir, "*"+spoolMetaSuffix))
+	if nil != err || 0 == len(mfs) {
+		return
+	}
+	var (
+		start = time.Now()
+		nb    int64
+		nf    int
+	)
+	for _, mf := range mfs {
+		n, err := s.drainOne(strings.TrimSuffix(mf, spoolMetaSuffix))
+		if nil != err {
+			s.unhealthy(err)
+			break
+		}
+		nb += n
+		nf++
+	}
+	if 0 == nf {
+		return
+	}
+	d := time.Since(start)
+	s.drained.Add(int64(nf))
+	s.drainedBytes.Add(nb)
+	s.lastRate.Store(int64(float64(nb) / max(d.Seconds(), 0.001)))
+	log.Printf(
+		"Drained %v spooled uploads (%v bytes) in %v",
+		nf,
+		nb,
+		d.Round(time.Millisecond),
+	)
+}
+
+/* drainOne sends one spooled upload to the backend and removes it. */
+func (s *spoolStorage) drainOne(fn string) (int64, error) {
+	mb, err := os.ReadFile(fn + spoolMetaSuffix)
+	if nil != err {
+		return 0, err
+	}
+	var m Meta
+	if err := json.Unmarshal(mb, &m); nil != err {
+		return 0, fmt.Errorf("parsing metadata for %v: %w", fn, err)
+	}
+	f, err := os.Open(fn)
+	if nil != err {
+		return 0, err
+	}
+	defer f.Close()
+	u, err := s.backend.Open(&m)
+	if nil != err {
+		return 0, err
+	}
+	n, err := copyBody(u, f)
+	if nil != err {
+		u.Abort()
+		return n, err
+	}
+	if err := u.Commit(); nil != err {
+		return n, err
+	}
+	log.Printf("Drained %v to %q", fn, u.Name())
+	os.Remove(fn)
+	os.Remove(fn + spoolMetaSuffix)
+	return n, nil
+}
+
+/* depth returns the number of files and bytes in the spool. */
+func (s *spoolStorage) depth() (int, int64) {
+	mfs, _ := filepath.Glob(filepath.Join(s.dir, "*"+spoolMetaSuffix))
+	var nb int64
+	for _, mf := range mfs {
+		if fi, err := os.Stat(
+			strings.TrimSuffix(mf, spoolMetaSuffix),
+		); nil == err {
+			nb += fi.Size()
+		}
+	}
+	return len(mfs), nb
+}
+
+/* adminStatus returns the spool's metrics. */
+func (s *spoolStorage) adminStatus(w http.ResponseWriter, r *http.Request) {
+	nf, nb := s.depth()
+	adminJSON(w, map[string]any{
+		"healthy":              s.healthy.Load(),
+		"last_error":           s.lastErr.Load(),
+		"depth_files":          nf,
+		"depth_bytes":          nb,
+		"spooled_total":        s.spooled.Load(),
+		"drained_total":        s.drained.Load(),
+		"drained_bytes_total":  s.drainedBytes.Load(),
+		"last_drain_bytes_sec": s.lastRate.Load(),
+	})
+}
+
+// watchedUpload is an upload to the backend which marks the backend
+// unhealthy if the upload fails.
+type watchedUpload struct {
+	Upload
+	s *spoolStorage
+}
+
+/* Write writes to the backend, noting errors. */
+func (u *watchedUpload) Write(b []byte) (int, error) {
+	n, err := u.Upload.Write(b)
+	if nil != err {
+		u.s.unhealthy(err)
+	}
+	return n, err
+}
+
+/* Commit commits the upload, noting errors. */
+func (u *watchedUpload) Commit() error {
+	err := u.Upload.Commit()
+	if nil != err {
+		u.s.unhealthy(err)
+	}
+	return err
+}
+
+/* spoolUpload is an upload to the spool. */
+type spoolUpload struct {
+	*os.File
+	m *Meta
+	s *spoolStorage
+}
+
+/* Name returns the spooled upload's name, without the in-progress suffix. */
+func (u *spoolUpload) Name() string {
+	return strings.TrimSuffix(u.File.Name(), spoolPartSuffix)
+}
+
+// Commit closes the spool file and writes its metadata, which makes it
+// eligible for draining.
+func (u *spoolUpload) Commit() error {
+	if err := u.Close(); nil != err {
+		return err
+	}
+	if err := os.Rename(u.File.Name(), u.Name()); nil != err {
+		return err
+	}
+	mb, err := json.Marshal(u.m)
+	if nil != err {
+		return err
+	}
+	if err := os.WriteFile(u.Name()+spoolMetaSuffix, mb, 0600); nil != err {
+		return err
+	}
+	u.s.spooled.Add(1)
+	return nil
+}
+
+// Abort closes the spool file and commits it anyway, as partial data is
+// better than none.
+func (u *spoolUpload) Abort() error { return u.Commit() }
@@ -0,0 +1,180 @@
+package main
+
+/*
+ * sqlite.go
+ * Store uploads as blobs in a SQLite database
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io/fs"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/magisterquis/postfile"
+)
+
+/* sqliteSpoolDir is where, in -dir, bodies are spooled */
+const sqliteSpoolDir = ".sqlite-spool"
+
+/* sqliteSchema sets up the uploads table and its indices */
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS uploads (
+	id     INTEGER PRIMARY KEY,
+	name   TEXT NOT NULL,
+	source TEXT NOT NULL,
+	path   TEXT NOT NULL,
+	host   TEXT NOT NULL,
+	time   TEXT NOT NULL,
+	size   INTEGER NOT NULL,
+	sha256 TEXT NOT NULL,
+	body   BLOB
+);
+CREATE INDEX IF NOT EXISTS uploads_source ON uploads(source);
+CREATE INDEX IF NOT EXISTS uploads_path ON uploads(path);
+CREATE INDEX IF NOT EXISTS uploads_time ON uploads(time);
+CREATE INDEX IF NOT EXISTS uploads_sha256 ON uploads(sha256);
+`
+
+// sqliteStore stores uploads in a SQLite database, by way of the sqlite3
+// command-line tool.  Bodies are spooled to a temporary file in spool and
+// inserted with sqlite3's readfile() once complete.
+type sqliteStore struct {
+	db     string
+	sqlite string
+	spool  string
+}
+
+// newSQLiteStore makes a new sqliteStore from a URL of the form
+// sqlite:///path/to/file.db or sqlite:relative.db, and makes sure the
+// database is set up.  Bodies are spooled in a hidden directory in dir.
+func newSQLiteStore(u *url.URL, dir string) (*sqliteStore, error) {
+	s := &sqliteStore{db: u.Path}
+	if "" != u.Opaque {
+		s.db = u.Opaque
+	}
+	if "" == s.db {
+		return nil, fmt.Errorf("missing database path")
+	}
+	var err error
+	if s.sqlite, err = exec.LookPath("sqlite3"); nil != err {
+		return nil, fmt.Errorf(
+			"sqlite3 is needed for SQLite storage: %w",
+			err,
+		)
+	}
+	if s.db, err = filepath.Abs(s.db); nil != err {
+		return nil, fmt.Errorf("finding database: %w", err)
+	}
+	if s.spool, err = filepath.Abs(
+		filepath.Join(dir, sqliteSpoolDir),
+	); nil != err {
+		return nil, fmt.Errorf("finding spool directory: %w", err)
+	}
+	if err := os.MkdirAll(s.spool, 0700); nil != err {
+		return nil, fmt.Errorf("making spool directory: %w", err)
+	}
+	if err := s.exec(sqliteSchema); nil != err {
+		return nil, fmt.Errorf("setting up database: %w", err)
+	}
+	return s, nil
+}
+
+/* Open starts an upload to a temporary file. */
+func (s *sqliteStore) Open(m *Meta) (Upload, error) {
+	f, err := os.CreateTemp(s.spool, "postfile-*")
+	if nil != err {
+		return nil, err
+	}
+	return &sqliteUpload{
+		s:    s,
+		m:    m,
+		name: remoteName(postfile.BaseName(m)),
+		f:    f,
+		h:    sha256.New(),
+	}, nil
+}
+
+/* Probe checks whether sqlite3 and the database are usable. */
+func (s *sqliteStore) Probe() error { return s.exec("SELECT 1;") }
+
+// exec runs the SQL in script.  If sqlite3 has gone missing since we
+// started, the error says so.
+func (s *sqliteStore) exec(script string) error {
+	cmd := exec.Command(s.sqlite, "-batch", "-bail", s.db)
+	cmd.Stdin = strings.NewReader(".timeout 10000\n" + script)
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	if err := cmd.Run(); errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("sqlite3 missing: %w", err)
+	} else if nil != err {
+		return fmt.Errorf("%w (%s)", err, bytes.TrimSpace(out.Bytes()))
+	}
+	return nil
+}
+
+/* sqliteUpload is an upload on its way to the database. */
+type sqliteUpload struct {
+	s    *sqliteStore
+	m    *Meta
+	name string
+	f    *os.File
+	h    hash.Hash
+	n    int64
+}
+
+/* Name returns the database and the upload's name. */
+func (u *sqliteUpload) Name() string { return u.s.db + ":" + u.name }
+
+/* Write writes b to the temporary file. */
+func (u *sqliteUpload) Write(b []byte) (int, error) {
+	n, err := u.f.Write(b)
+	u.h.Write(b[:n])
+	u.n += int64(n)
+	return n, err
+}
+
+/* Commit inserts the temporary file into the database and removes it. */
+func (u *sqliteUpload) Commit() error {
+	defer os.Remove(u.f.Name())
+	if err := u.f.Close(); nil != err {
+		return err
+	}
+	return u.s.exec(fmt.Sprintf(
+		"INSERT INTO uploads "+
+			"(name, source, path, host, time, size, sha256, body) "+
+			"VALUES (%s, %s, %s, %s, %s, %d, '%x', readfile(%s));\n",
+		sqlQuote(u.name),
+		sqlQuote(u.m.Source),
+		sqlQuote(u.m.Path),
+		sqlQuote(u.m.Host),
+		sqlQuote(u.m.Time.UTC().Format(time.RFC3339Nano)),
+		u.n,
+		u.h.Sum(nil),
+		sqlQuote(u.f.Name()),
+	))
+}
+
+/* Abort removes the temporary file. */
+func (u *sqliteUpload) Abort() error {
+	u.f.Close()
+	return os.Remove(u.f.Name())
+}
+
+// sqlQuote turns s into an SQL string.  It's hex-encoded to avoid quoting
+// trouble with odd bytes in paths.
+func sqlQuote(s string) string {
+	return fmt.Sprintf("CAST(X'%x' AS TEXT)", s)
+}
@@ -0,0 +1,158 @@
+package main
+
+/*
+ * status.go
+ * Admin API status endpoints
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"flag"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/* recentMax is the number of recent uploads we remember */
+const recentMax = 100
+
+var (
+	/* Counters */
+	uploadsTotal  atomic.Int64
+	bytesTotal    atomic.Int64
+	failuresTotal atomic.Int64
+
+	/* recent holds the last few uploads, newest last */
+	recent  []recentUpload
+	recentL sync.Mutex
+
+	/* conns holds the active connections */
+	conns  = make(map[net.Conn]*connInfo)
+	connsL sync.Mutex
+)
+
+func init() {
+	adminMux.HandleFunc("/status", adminStatus)
+	adminMux.HandleFunc("/uploads", adminRecent)
+	adminMux.HandleFunc("/connections", adminConns)
+	adminMux.HandleFunc("/config", adminConfig)
+}
+
+/* recentUpload describes a finished upload. */
+type recentUpload struct {
+	Meta
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+}
+
+/* connInfo describes an active connection. */
+type connInfo struct {
+	Remote string    `json:"remote"`
+	Local  string    `json:"local"`
+	Start  time.Time `json:"start"`
+	State  string    `json:"state"`
+}
+
+/* noteUpload records a successful upload. */
+func noteUpload(m *Meta, name string, n int64) {
+	uploadsTotal.Add(1)
+	bytesTotal.Add(n)
+	noteClientUpload(m, n)
+	recentL.Lock()
+	defer recentL.Unlock()
+	recent = append(recent, recentUpload{Meta: *m, Name: name, Size: n})
+	if recentMax < len(recent) {
+		recent = recent[len(recent)-recentMax:]
+	}
+}
+
+/* noteFailure records a failed upload. */
+func noteFailure() { failuresTotal.Add(1) }
+
+// trackConn keeps track of connections' states.  It's meant to be an
+// http.Server's ConnState.
+func trackConn(c net.Conn, s http.ConnState) {
+	connsL.Lock()
+	defer connsL.Unlock()
+	switch s {
+	case http.StateNew:
+		conns[c] = &connInfo{
+			Remote: c.RemoteAddr().String(),
+			Local:  c.LocalAddr().String(),
+			Start:  time.Now(),
+			State:  s.String(),
+		}
+	case http.StateHijacked, http.StateClosed:
+		delete(conns, c)
+	default:
+		if ci, ok := conns[c]; ok {
+			ci.State = s.String()
+		}
+	}
+}
+
+/* adminStatus returns overall stats. */
+func adminStatus(w http.ResponseWriter, r *http.Request) {
+	connsL.Lock()
+	nc := len(conns)
+	connsL.Unlock()
+	adminJSON(w, map[string]any{
+		"start":                     startTime,
+		"uptime_seconds":            int64(time.Since(startTime).Seconds()),
+		"uploads_total":             uploadsTotal.Load(),
+		"bytes_total":               bytesTotal.Load(),
+		"failures_total":            failuresTotal.Load(),
+		"first_byte_timeouts_total": firstByteTimeouts.Load(),
+		"idle_timeouts_total":       idleTimeouts.Load(),
+		"slow_timeouts_total":       slowTimeouts.Load(),
+		"connections":               nc,
+		"expired":                   expired(),
+	})
+}
+
+/* adminRecent returns the most recent uploads, newest first. */
+func adminRecent(w http.ResponseWriter, r *http.Request) {
+	recentL.Lock()
+	rs := make([]recentUpload, len(recent))
+	for i, u := range recent {
+		rs[len(rs)-1-i] = u
+	}
+	recentL.Unlock()
+	adminJSON(w, rs)
+}
+
+/* adminConns returns the active connections, oldest first. */
+func adminConns(w http.ResponseWriter, r *http.Request) {
+	connsL.Lock()
+	cs := make([]connInfo, 0, len(conns))
+	for _, ci := range conns {
+		cs = append(cs, *ci)
+	}
+	connsL.Unlock()
+	sort.Slice(cs, func(i, j int) bool {
+		return cs[i].Start.Before(cs[j].Start)
+	})
+	adminJSON(w, cs)
+}
+
+// adminConfig returns the command-line flags' values.  Passwords in URLs
+// are redacted.
+func adminConfig(w http.ResponseWriter, r *http.Request) {
+	fs := make(map[string]string)
+	flagsL.RLock()
+	defer flagsL.RUnlock()
+	flag.VisitAll(func(f *flag.Flag) {
+		v := f.Value.String()
+		if u, err := url.Parse(v); nil == err && nil != u.User {
+			v = u.Redacted()
+		}
+		fs[f.Name] = v
+	})
+	adminJSON(w, fs)
+}
@@ -0,0 +1,37 @@
+package main
+
+/*
+ * storage.go
+ * Interchangeable places to put uploads
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"runtime"
+
+	"github.com/magisterquis/postfile"
+)
+
+// Storage, Meta, Upload, and TLSInfo come from the library, so the storage
+// here can be used by programs which embed it.
+type (
+	Storage = postfile.Storage
+	Meta    = postfile.Meta
+	Upload  = postfile.Upload
+	TLSInfo = postfile.TLSInfo
+)
+
+// defaultNamePolicy returns the default -names policy: percent-encoding on
+// Windows, which doesn't allow the colons in addresses, and leaving names
+// alone elsewhere.
+func defaultNamePolicy() postfile.NamePolicy {
+	if "windows" == runtime.GOOS {
+		return postfile.NamePercent
+	}
+	return postfile.NameAsIs
+}
+
+/* namePolicy is the -names policy with which local files are named */
+var namePolicy = defaultNamePolicy()
@@ -0,0 +1,57 @@
+//go:build !windows && !plan9
+
+package main
+
+/*
+ * syslog.go
+ * Send log output to syslog
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"fmt"
+	"log"
+	"log/syslog"
+)
+
+/* syslogFacilities maps facility names to facilities */
+var syslogFacilities = map[string]syslog.Priority{
+	"kern":     syslog.LOG_KERN,
+	"user":     syslog.LOG_USER,
+	"mail":     syslog.LOG_MAIL,
+	"daemon":   syslog.LOG_DAEMON,
+	"auth":     syslog.LOG_AUTH,
+	"syslog":   syslog.LOG_SYSLOG,
+	"lpr":      syslog.LOG_LPR,
+	"news":     syslog.LOG_NEWS,
+	"uucp":     syslog.LOG_UUCP,
+	"cron":     syslog.LOG_CRON,
+	"authpriv": syslog.LOG_AUTHPRIV,
+	"ftp":      syslog.LOG_FTP,
+	"local0":   syslog.LOG_LOCAL0,
+	"local1":   syslog.LOG_LOCAL1,
+	"local2":   syslog.LOG_LOCAL2,
+	"local3":   syslog.LOG_LOCAL3,
+	"local4":   syslog.LOG_LOCAL4,
+	"local5":   syslog.LOG_LOCAL5,
+	"local6":   syslog.LOG_LOCAL6,
+	"local7":   syslog.LOG_LOCAL7,
+}
+
+// logToSyslog sends log output to the local syslog daemon instead of stderr,
+// with the given facility and tag.
+func logToSyslog(facility, tag string) error {
+	f, ok := syslogFacilities[facility]
+	if !ok {
+		return fmt.Errorf("unknown facility %q", facility)
+	}
+	w, err := syslog.New(f|syslog.LOG_INFO, tag)
+	if nil != err {
+		return err
+	}
+	log.SetOutput(w)
+	log.SetFlags(0) /* syslog has its own timestamps */
+	return nil
+}
@@ -0,0 +1,18 @@
+//go:build windows || plan9
+
+package main
+
+/*
+ * syslog_other.go
+ * Stub for platforms without syslog
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import "errors"
+
+/* logToSyslog returns an error, as there's no syslog here. */
+func logToSyslog(facility, tag string) error {
+	return errors.New("syslog not supported on this platform")
+}
@@ -0,0 +1,124 @@
+package main
+
+/*
+ * tcp.go
+ * TCP-level listener tweaks
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+/* tlsHandshake is the first byte of a TLS handshake record */
+const tlsHandshake = 0x16
+
+// listenTCP listens on the given address, unless sl, a socket from systemd,
+// isn't nil, and applies the keepalive, linger, and nodelay settings to
+// accepted connections.  If badTLS is not empty or http, connections which
+// don't start with a TLS handshake are closed (or reset) without a response.
+func listenTCP(
+	sl net.Listener,
+	addr string,
+	keepAlive time.Duration,
+	linger int,
+	noDelay bool,
+	badTLS string,
+) (net.Listener, error) {
+	l := sl
+	if nil == l {
+		var err error
+		l, err = net.Listen("tcp", addr)
+		if nil != err {
+			return nil, err
+		}
+	}
+	return tuneListener{
+		Listener:  l,
+		keepAlive: keepAlive,
+		linger:    linger,
+		noDelay:   noDelay,
+		badTLS:    badTLS,
+	}, nil
+}
+
+/* tuneListener tweaks accepted TCP connections */
+type tuneListener struct {
+	net.Listener
+	keepAlive time.Duration
+	linger    int
+	noDelay   bool
+	badTLS    string
+}
+
+/* Accept accepts a connection and tweaks it. */
+func (l tuneListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if nil != err {
+		return nil, err
+	}
+	tc, ok := c.(*net.TCPConn)
+	if !ok {
+		return c, nil
+	}
+
+	/* Tweak the connection.  Errors here aren't worth losing the
+	connection over.  Keepalives are set here rather than when
+	listening so they also apply to sockets from systemd. */
+	switch {
+	case 0 > l.keepAlive:
+		tc.SetKeepAlive(false)
+	case 0 < l.keepAlive:
+		tc.SetKeepAlive(true)
+		tc.SetKeepAlivePeriod(l.keepAlive)
+	}
+	if 0 <= l.linger {
+		tc.SetLinger(l.linger)
+	}
+	tc.SetNoDelay(l.noDelay)
+
+	/* Go's TLS server sends back an HTTP response when it gets
+	plaintext, which is the default. */
+	switch l.badTLS {
+	case "", "http":
+		return tc, nil
+	}
+	return &sniffConn{TCPConn: tc, reset: "reset" == l.badTLS}, nil
+}
+
+// sniffConn checks the first byte read from the client to make sure it looks
+// like the start of a TLS handshake.  If not, the connection is closed or
+// reset.
+type sniffConn struct {
+	*net.TCPConn
+	once  sync.Once
+	reset bool
+}
+
+/* Read reads from the underlying connection, checking the first byte. */
+func (c *sniffConn) Read(b []byte) (int, error) {
+	n, err := c.TCPConn.Read(b)
+	if 0 == n {
+		return n, err
+	}
+	ok := true
+	c.once.Do(func() {
+		if tlsHandshake == b[0] {
+			return
+		}
+		ok = false
+		if c.reset {
+			c.TCPConn.SetLinger(0)
+		}
+		c.TCPConn.Close()
+	})
+	if !ok {
+		return 0, io.EOF
+	}
+	return n, err
+}
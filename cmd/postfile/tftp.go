@@ -0,0 +1,297 @@
+package main
+
+/*
+ * tftp.go
+ * Receive files via TFTP
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Files sent with a WRQ are stored with the requested filename as the path,
+// same as if the file were POSTed to that path.  Reads are refused.  The
+// blksize and tsize options are understood.  Both octet and netascii modes
+// are accepted, but either way the file's saved as sent.
+const (
+	tftpTimeout    = 5 * time.Second /* Before resending an ACK */
+	tftpRetries    = 5
+	tftpBlockSize  = 512
+	tftpMaxBlock   = 65464 /* Largest blksize */
+	tftpMaxRequest = 1024  /* Largest WRQ we'll take */
+)
+
+/* TFTP opcodes and error codes */
+const (
+	tftpOpRRQ   = 1
+	tftpOpWRQ   = 2
+	tftpOpDATA  = 3
+	tftpOpACK   = 4
+	tftpOpERROR = 5
+	tftpOpOACK  = 6
+
+	tftpErrUndef    = 0
+	tftpErrAccess   = 2
+	tftpErrIllegal  = 4
+	tftpErrUnknowID = 5
+)
+
+// listenTFTP accepts WRQs on UDP address addr.  Each transfer gets its own
+// socket, per RFC 1350.
+func listenTFTP(addr string) (net.PacketConn, error) {
+	pc, err := net.ListenPacket("udp", addr)
+	if nil != err {
+		return nil, err
+	}
+	/* Transfers come from the same address as requests */
+	ip := pc.LocalAddr().(*net.UDPAddr).IP
+	go func() {
+		buf := make([]byte, tftpMaxRequest)
+		for {
+			n, a, err := pc.ReadFrom(buf)
+			if nil != err {
+				log.Fatalf(
+					"Error receiving TFTP requests: %v",
+					err,
+				)
+			}
+			req := bytes.Clone(buf[:n])
+			go handleTFTP(ip, a.(*net.UDPAddr), req)
+		}
+	}()
+	return pc, nil
+}
+
+/* handleTFTP handles a request from src, sent to ip. */
+func handleTFTP(ip net.IP, src *net.UDPAddr, req []byte) {
+	/* Get a socket for this transfer */
+	pc, err := net.ListenUDP("udp", &net.UDPAddr{IP: ip})
+	if nil != err {
+		log.Printf("[%s] Unable to make TFTP socket: %v", src, err)
+		return
+	}
+	defer pc.Close()
+	fail := func(code uint16, msg string) {
+		tftpError(pc, src, code, msg)
+	}
+
+	/* Work out what's wanted */
+	if 2 > len(req) {
+		return
+	}
+	switch binary.BigEndian.Uint16(req) {
+	case tftpOpWRQ: /* Good */
+	case tftpOpRRQ:
+		log.Printf("[%s] Refused TFTP read request", src)
+		fail(tftpErrAccess, "Reads not allowed")
+		return
+	default:
+		fail(tftpErrIllegal, "Expected a WRQ")
+		return
+	}
+	fields := strings.Split(string(req[2:]), "\x00")
+	if 3 > len(fields) || "" != fields[len(fields)-1] {
+		fail(tftpErrIllegal, "Malformed request")
+		return
+	}
+	fields = fields[:len(fields)-1]
+	name, mode := fields[0], strings.ToLower(fields[1])
+	if "" == name {
+		fail(tftpErrIllegal, "Need a filename")
+		return
+	}
+	if "octet" != mode && "netascii" != mode {
+		fail(tftpErrIllegal, "Unsupported mode")
+		return
+	}
+
+	/* Only take files when we would over HTTP */
+	switch {
+	case shuttingDown.Load():
+		fail(tftpErrUndef, "Shutting down")
+		return
+	case expired():
+		log.Printf("[%s] Expired", src)
+		fail(tftpErrUndef, "Expired")
+		return
+	case maintenanceFeature.Enabled():
+		log.Printf("[%s] Rejected during maintenance", src)
+		fail(tftpErrUndef, "Down for maintenance")
+		return
+	}
+	inFlight.Add(1)
+	defer inFlight.Done()
+
+	/* Work out options, and what we'll send back first */
+	bs := tftpBlockSize
+	var opts []byte
+	for i := 2; i+1 < len(fields); i += 2 {
+		switch o, v := strings.ToLower(fields[i]), fields[i+1]; o {
+		case "blksize":
+			n, err := strconv.Atoi(v)
+			if nil != err || 8 > n {
+				continue
+			}
+			bs = min(n, tftpMaxBlock)
+			v = strconv.Itoa(bs)
+			opts = append(opts, o+"\x00"+v+"\x00"...)
+		case "tsize":
+			opts = append(opts, o+"\x00"+v+"\x00"...)
+		}
+	}
+	first := binary.BigEndian.AppendUint16(nil, tftpOpACK)
+	first = binary.BigEndian.AppendUint16(first, 0)
+	if 0 != len(opts) {
+		first = append(
+			binary.BigEndian.AppendUint16(nil, tftpOpOACK),
+			opts...,
+		)
+	}
+
+	/* Save the file */
+	m := &Meta{
+		Source: src.String(),
+		Path:   path.Join("/", name),
+		Time:   time.Now(),
+	}
+	u, err := store.Open(m)
+	if nil != err {
+		noteFailure()
+		log.Printf("[%s] Unable to open storage: %v", src, err)
+		fail(tftpErrUndef, "Unable to store file")
+		return
+	}
+	n, err := receiveTFTP(pc, src, u, bs, first)
+	if nil == err {
+		err = u.Commit()
+	} else {
+		u.Abort()
+	}
+	if nil != err {
+		noteFailure()
+		log.Printf(
+			"[%s] Error after writing %v bytes to %q: %v",
+			src,
+			n,
+			u.Name(),
+			err,
+		)
+		fail(tftpErrUndef, "Unable to store file")
+		return
+	}
+	log.Printf("[%s] Wrote %v bytes from TFTP to %q", src, n, u.Name())
+	noteUpload(m, u.Name(), n)
+}
+
+// receiveTFTP sends first, then writes DATA packets from src to u, ACKing
+// each, until a short packet ends the file.  Packets from anywhere else get
+// an error.
+func receiveTFTP(
+	pc *net.UDPConn,
+	src *net.UDPAddr,
+	u Upload,
+	bs int,
+	first []byte,
+) (int64, error) {
+	var (
+		n     int64
+		ack   = first /* Last thing we sent */
+		block uint16  /* Last block we got */
+		buf   = make([]byte, 4+bs+1)
+		tries int
+		done  bool /* Got a short block */
+	)
+	for {
+		if _, err := pc.WriteToUDP(ack, src); nil != err {
+			return n, fmt.Errorf("sending ACK: %w", err)
+		}
+		if done {
+			return n, nil
+		}
+
+		/* Wait for the next block */
+		if err := pc.SetReadDeadline(
+			time.Now().Add(tftpTimeout),
+		); nil != err {
+			return n, err
+		}
+		nr, a, err := pc.ReadFromUDP(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return n, err
+		} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			if tries++; tftpRetries <= tries {
+				return n, fmt.Errorf(
+					"timed out waiting for block %d",
+					block+1,
+				)
+			}
+			continue
+		} else if nil != err {
+			return n, err
+		}
+		if !a.IP.Equal(src.IP) || a.Port != src.Port {
+			tftpError(
+				pc,
+				a,
+				tftpErrUnknowID,
+				"Unknown transfer ID",
+			)
+			continue
+		}
+		pkt := buf[:nr]
+		if 4 > len(pkt) {
+			continue
+		}
+		switch binary.BigEndian.Uint16(pkt) {
+		case tftpOpDATA: /* Good */
+		case tftpOpERROR:
+			return n, fmt.Errorf(
+				"client sent error: %q",
+				strings.TrimRight(string(pkt[4:]), "\x00"),
+			)
+		default:
+			tftpError(pc, src, tftpErrIllegal, "Expected DATA")
+			return n, fmt.Errorf("got non-DATA packet")
+		}
+
+		/* Old blocks just get ACKed again */
+		if binary.BigEndian.Uint16(pkt[2:]) != block+1 {
+			continue
+		}
+		data := pkt[4:]
+		if bs < len(data) {
+			tftpError(pc, src, tftpErrIllegal, "Block too large")
+			return n, fmt.Errorf("block %d too large", block+1)
+		}
+		nw, err := u.Write(data)
+		n += int64(nw)
+		if nil != err {
+			return n, err
+		}
+		block++
+		tries = 0
+		ack = binary.BigEndian.AppendUint16(nil, tftpOpACK)
+		ack = binary.BigEndian.AppendUint16(ack, block)
+		done = bs > len(data)
+	}
+}
+
+/* tftpError sends a TFTP error to a. */
+func tftpError(pc net.PacketConn, a net.Addr, code uint16, msg string) {
+	b := binary.BigEndian.AppendUint16(nil, tftpOpERROR)
+	b = binary.BigEndian.AppendUint16(b, code)
+	b = append(b, msg+"\x00"...)
+	pc.WriteTo(b, a)
+}
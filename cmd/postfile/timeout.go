@@ -0,0 +1,152 @@
+package main
+
+/*
+ * timeout.go
+ * Deadlines for request bodies
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// firstByteTimeout is how long we wait for the first byte of a body
+	// and idleTimeout is how long we wait between bytes after that.
+	// Zero means forever.
+	firstByteTimeout time.Duration
+	idleTimeout      time.Duration
+
+	// minRate is the slowest, in bytes per second, we let a body come
+	// in, averaged over minRatePeriod.  Zero means any speed is fine.
+	minRate       int64
+	minRatePeriod time.Duration
+
+	/* Counters */
+	firstByteTimeouts atomic.Int64
+	idleTimeouts      atomic.Int64
+	slowTimeouts      atomic.Int64
+)
+
+// rateWindow keeps track of how much of a body's been read in the current
+// minRatePeriod.
+type rateWindow struct {
+	start time.Time
+	n     int64
+}
+
+// check starts a new window if the current one's over.  It returns the end
+// of the window if not enough has been read in it yet, the zero time if
+// enough has, or an error if the window's over and not enough was read.
+func (w *rateWindow) check(now time.Time) (time.Time, error) {
+	if 0 == minRate {
+		return time.Time{}, nil
+	}
+	need := int64(float64(minRate) * minRatePeriod.Seconds())
+	if w.start.IsZero() {
+		w.start = now
+	} else if end := w.start.Add(minRatePeriod); !now.Before(end) {
+		if w.n < need {
+			return time.Time{}, w.slow(os.ErrDeadlineExceeded)
+		}
+		w.start, w.n = now, 0
+	}
+	if need <= w.n {
+		return time.Time{}, nil
+	}
+	return w.start.Add(minRatePeriod), nil
+}
+
+/* slow counts a too-slow body and wraps err to say so. */
+func (w *rateWindow) slow(err error) error {
+	slowTimeouts.Add(1)
+	return fmt.Errorf(
+		"slower than %d bytes/second for %s: %w",
+		minRate,
+		minRatePeriod,
+		err,
+	)
+}
+
+// readDeadline works out the read deadline for the next read, given the
+// inactivity timeout d.  It returns the deadline, whether it's the end of w,
+// and an error if the body's too slow.
+func (w *rateWindow) readDeadline(d time.Duration) (time.Time, bool, error) {
+	now := time.Now()
+	var dl time.Time
+	if 0 != d {
+		dl = now.Add(d)
+	}
+	end, err := w.check(now)
+	if nil != err {
+		return time.Time{}, false, err
+	}
+	if !end.IsZero() && (dl.IsZero() || end.Before(dl)) {
+		return end, true, nil
+	}
+	return dl, false, nil
+}
+
+// deadlineBody wraps a request body and sets read deadlines on the
+// underlying connection: firstByteTimeout until the first byte arrives and
+// idleTimeout after that, or sooner if the body's coming in slower than
+// minRate.
+type deadlineBody struct {
+	io.ReadCloser
+	rc      *http.ResponseController
+	started bool
+	rw      rateWindow
+}
+
+// withDeadlines wraps r's body in a deadlineBody, if we have timeouts.
+func withDeadlines(w http.ResponseWriter, r *http.Request) {
+	if 0 == firstByteTimeout && 0 == idleTimeout && 0 == minRate {
+		return
+	}
+	r.Body = &deadlineBody{
+		ReadCloser: r.Body,
+		rc:         http.NewResponseController(w),
+	}
+}
+
+/* Read implements io.Reader. */
+func (b *deadlineBody) Read(p []byte) (int, error) {
+	d := idleTimeout
+	if !b.started {
+		d = firstByteTimeout
+	}
+	dl, isSlow, err := b.rw.readDeadline(d)
+	if nil != err {
+		/* Make sure the connection goes away */
+		b.rc.SetReadDeadline(time.Now())
+		return 0, fmt.Errorf("body %w", err)
+	}
+	b.rc.SetReadDeadline(dl) /* Not supported by FastCGI. */
+
+	n, err := b.ReadCloser.Read(p)
+	b.rw.n += int64(n)
+	if 0 != n {
+		b.started = true
+	}
+	switch {
+	case errors.Is(err, os.ErrDeadlineExceeded) && isSlow:
+		err = fmt.Errorf("body %w", b.rw.slow(err))
+	case errors.Is(err, os.ErrDeadlineExceeded) && !b.started:
+		firstByteTimeouts.Add(1)
+		err = fmt.Errorf("no body after %s: %w", d, err)
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		idleTimeouts.Add(1)
+		err = fmt.Errorf("body idle for %s: %w", d, err)
+	case nil != err:
+		b.rc.SetReadDeadline(time.Time{})
+	}
+	return n, err
+}
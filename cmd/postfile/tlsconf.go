@@ -0,0 +1,165 @@
+package main
+
+/*
+ * tlsconf.go
+ * TLS versions, cipher suites, and curves
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+)
+
+// tlsVersions are the TLS versions which may be given to -tls-min and
+// -tls-max.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// tlsCurves are the key exchanges which may be given to -tls-curves.
+var tlsCurves = []tls.CurveID{
+	tls.X25519MLKEM768,
+	tls.SecP256r1MLKEM768,
+	tls.SecP384r1MLKEM1024,
+	tls.X25519,
+	tls.CurveP256,
+	tls.CurveP384,
+	tls.CurveP521,
+}
+
+// tlsSettings are the TLS settings which can be tightened from the command
+// line.  Zero values leave crypto/tls's defaults alone.
+type tlsSettings struct {
+	minVersion uint16
+	maxVersion uint16
+	ciphers    []uint16
+	curves     []tls.CurveID
+}
+
+// parseTLSSettings parses the -tls-min, -tls-max, -tls-ciphers, and
+// -tls-curves flags.  Lists are comma-separated.
+func parseTLSSettings(
+	minV, maxV, ciphers, curves string,
+) (tlsSettings, error) {
+	var (
+		ts  tlsSettings
+		err error
+	)
+	if ts.minVersion, err = parseTLSVersion(minV); nil != err {
+		return tlsSettings{}, fmt.Errorf("minimum version: %w", err)
+	}
+	if ts.maxVersion, err = parseTLSVersion(maxV); nil != err {
+		return tlsSettings{}, fmt.Errorf("maximum version: %w", err)
+	}
+	if 0 != ts.minVersion && 0 != ts.maxVersion &&
+		ts.minVersion > ts.maxVersion {
+		return tlsSettings{}, fmt.Errorf(
+			"minimum version %s is after maximum version %s",
+			minV,
+			maxV,
+		)
+	}
+	for _, n := range splitList(ciphers) {
+		c, err := parseCipherSuite(n)
+		if nil != err {
+			return tlsSettings{}, err
+		}
+		ts.ciphers = append(ts.ciphers, c)
+	}
+	for _, n := range splitList(curves) {
+		c, err := parseCurve(n)
+		if nil != err {
+			return tlsSettings{}, err
+		}
+		ts.curves = append(ts.curves, c)
+	}
+	return ts, nil
+}
+
+/* parseTLSVersion turns a version like 1.2 into a tls.VersionTLS* constant. */
+func parseTLSVersion(s string) (uint16, error) {
+	if "" == s {
+		return 0, nil
+	}
+	v, ok := tlsVersions[strings.TrimPrefix(strings.ToUpper(s), "TLS")]
+	if !ok {
+		return 0, fmt.Errorf("unknown version %q (not 1.0-1.3)", s)
+	}
+	return v, nil
+}
+
+// parseCipherSuite returns the ID of the cipher suite with the given name,
+// as in tls.CipherSuiteName.  Insecure suites aren't allowed.
+func parseCipherSuite(s string) (uint16, error) {
+	for _, c := range tls.CipherSuites() {
+		if strings.EqualFold(s, c.Name) {
+			return c.ID, nil
+		}
+	}
+	for _, c := range tls.InsecureCipherSuites() {
+		if strings.EqualFold(s, c.Name) {
+			return 0, fmt.Errorf("cipher suite %s is insecure", c.Name)
+		}
+	}
+	var ns []string
+	for _, c := range tls.CipherSuites() {
+		ns = append(ns, c.Name)
+	}
+	return 0, fmt.Errorf(
+		"unknown cipher suite %q (not one of %s)",
+		s,
+		strings.Join(ns, ", "),
+	)
+}
+
+// parseCurve returns the curve or other key exchange with the given name,
+// with or without a leading Curve (e.g. P256 or CurveP256).
+func parseCurve(s string) (tls.CurveID, error) {
+	var ns []string
+	for _, c := range tlsCurves {
+		n := strings.TrimPrefix(c.String(), "Curve")
+		if strings.EqualFold(s, n) || strings.EqualFold(s, c.String()) {
+			return c, nil
+		}
+		ns = append(ns, n)
+	}
+	return 0, fmt.Errorf(
+		"unknown curve %q (not one of %s)",
+		s,
+		strings.Join(ns, ", "),
+	)
+}
+
+/* splitList splits a comma-separated list, ignoring empty elements. */
+func splitList(s string) []string {
+	var l []string
+	for _, e := range strings.Split(s, ",") {
+		if e = strings.TrimSpace(e); "" != e {
+			l = append(l, e)
+		}
+	}
+	return l
+}
+
+/* apply sets conf's versions, cipher suites, and curves from ts. */
+func (ts tlsSettings) apply(conf *tls.Config) {
+	if 0 != ts.minVersion {
+		conf.MinVersion = ts.minVersion
+	}
+	if 0 != ts.maxVersion {
+		conf.MaxVersion = ts.maxVersion
+	}
+	if 0 != len(ts.ciphers) {
+		conf.CipherSuites = ts.ciphers
+	}
+	if 0 != len(ts.curves) {
+		conf.CurvePreferences = ts.curves
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+/*
+ * tokendir.go
+ * Separate directories and quotas per token
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/magisterquis/postfile"
+)
+
+// errQuotaExceeded is returned when an upload would put a token over its
+// quota.  HTTP clients get a 507.
+var errQuotaExceeded = &postfile.StatusError{
+	Status:  http.StatusInsufficientStorage,
+	Message: "Over quota",
+	Err:     errors.New("quota exceeded"),
+}
+
+var (
+	// tokenOpts holds the options from the tokens file, keyed by token
+	// name.
+	tokenOpts = make(map[string]tokenOptions)
+)
+
+/* tokenOptions are a token's options from the tokens file. */
+type tokenOptions struct {
+	dir   string /* Subdirectory, with -token-dirs */
+	quota int64  /* Bytes, 0 for unlimited */
+}
+
+/* parseTokenOptions parses a token's key=value options. */
+func parseTokenOptions(fs []string) (tokenOptions, error) {
+	var o tokenOptions
+	for _, f := range fs {
+		k, v, _ := strings.Cut(f, "=")
+		switch k {
+		case "dir":
+			if !filepath.IsLocal(v) {
+				return tokenOptions{}, fmt.Errorf(
+					"dir %q isn't a relative path inside "+
+						"the output directory",
+					v,
+				)
+			}
+			o.dir = filepath.Clean(v)
+		case "quota":
+			n, err := strconv.ParseInt(v, 0, 64)
+			if nil != err || 0 >= n {
+				return tokenOptions{}, fmt.Errorf(
+					"invalid quota %q",
+					v,
+				)
+			}
+			o.quota = n
+		default:
+			return tokenOptions{}, fmt.Errorf("unknown option %q", k)
+		}
+	}
+	return o, nil
+}
+
+// tokenDir returns the subdirectory for m's token, for subdirStorage: the
+// dir option from the tokens file or the token's name.  Uploads without a
+// token go in unauthenticated.
+func tokenDir(m *Meta) string {
+	if "" == m.Token {
+		return "unauthenticated"
+	}
+	if d := tokenOpts[m.Token].dir; "" != d {
+		return d
+	}
+	if !filepath.IsLocal(m.Token) {
+		return strings.NewReplacer("/", "_", `\`, "_", ".", "_").
+			Replace(m.Token)
+	}
+	return m.Token
+}
+
+/* haveQuotas returns true if any token has a quota. */
+func haveQuotas() bool {
+	for _, o := range tokenOpts {
+		if 0 != o.quota {
+			return true
+		}
+	}
+	return false
+}
+
+// quotaStorage keeps tokens with quotas from storing more than their quota
+// in their directories.  Usage is worked out when each upload starts, so
+// simultaneous uploads may go over a bit.
+type quotaStorage struct{ Storage }
+
+/* Open opens the upload, if the token's not already over quota. */
+func (s quotaStorage) Open(m *Meta) (Upload, error) {
+	q := tokenOpts[m.Token].quota
+	if "" == m.Token || 0 == q {
+		return s.Storage.Open(m)
+	}
+	used, err := dirSize(tokenDir(m))
+	if nil != err {
+		return nil, fmt.Errorf("working out quota usage: %w", err)
+	}
+	if q <= used {
+		return nil, errQuotaExceeded
+	}
+	u, err := s.Storage.Open(m)
+	if nil != err {
+		return nil, err
+	}
+	return &quotaUpload{Upload: u, left: q - used}, nil
+}
+
+/* quotaUpload is an upload which stops at the end of its token's quota. */
+type quotaUpload struct {
+	Upload
+	left int64
+}
+
+/* Write writes b, or as much of it as fits in the quota. */
+func (u *quotaUpload) Write(b []byte) (int, error) {
+	if int64(len(b)) <= u.left {
+		n, err := u.Upload.Write(b)
+		u.left -= int64(n)
+		return n, err
+	}
+	n, err := u.Upload.Write(b[:u.left])
+	u.left -= int64(n)
+	if nil == err {
+		err = errQuotaExceeded
+	}
+	return n, err
+}
+
+// dirSize returns the total size of the files under dir, which needn't
+// exist.
+func dirSize(dir string) (int64, error) {
+	var n int64
+	err := filepath.WalkDir(dir, func(
+		_ string,
+		d fs.DirEntry,
+		err error,
+	) error {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		} else if nil != err {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		fi, err := d.Info()
+		if nil != err {
+			return err
+		}
+		n += fi.Size()
+		return nil
+	})
+	return n, err
+}
@@ -0,0 +1,293 @@
+package main
+
+/*
+ * tor.go
+ * Publish the listener as an onion service
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/textproto"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The onion service is added with ADD_ONION over Tor's control port and
+// lasts as long as the control connection, so it goes away when we do.
+// Authentication is with whichever of no auth, SAFECOOKIE, COOKIE, or, if
+// torPasswordEnv is set, HASHEDPASSWORD Tor offers.  The control protocol
+// is described at https://spec.torproject.org/control-spec.
+const (
+	torTimeout     = time.Minute
+	torPasswordEnv = "TOR_CONTROL_PASSWORD"
+	torKeyType     = "ED25519-V3"
+)
+
+/* SAFECOOKIE HMAC keys */
+const (
+	torServerKey = "Tor safe cookie authentication server-to-controller hash"
+	torClientKey = "Tor safe cookie authentication controller-to-server hash"
+)
+
+/* torConn is a connection to Tor's control port. */
+type torConn struct {
+	tp *textproto.Conn
+}
+
+// publishOnion asks the Tor control port at ctrl, either an address or a
+// unix socket path, to forward the onion service's port to target and
+// returns the onion service's hostname.  If keyFile isn't empty, the
+// service's key is read from it or, if it doesn't exist, a new key is
+// saved to it.
+func publishOnion(
+	ctrl string,
+	keyFile string,
+	port int,
+	target string,
+) (string, error) {
+	/* Connect and log in */
+	network := "tcp"
+	if strings.Contains(ctrl, "/") {
+		network = "unix"
+	}
+	c, err := net.DialTimeout(network, ctrl, torTimeout)
+	if nil != err {
+		return "", err
+	}
+	tc := &torConn{tp: textproto.NewConn(c)}
+	c.SetDeadline(time.Now().Add(torTimeout))
+	if err := tc.auth(); nil != err {
+		c.Close()
+		return "", fmt.Errorf("authenticating: %w", err)
+	}
+
+	/* Work out which key to use */
+	key := "NEW:" + torKeyType
+	flags := " Flags=DiscardPK"
+	if "" != keyFile {
+		b, err := os.ReadFile(keyFile)
+		if nil == err {
+			key = strings.TrimSpace(string(b))
+			flags = ""
+		} else if errors.Is(err, os.ErrNotExist) {
+			flags = ""
+		} else {
+			c.Close()
+			return "", fmt.Errorf("reading key: %w", err)
+		}
+	}
+
+	/* Make the service */
+	lines, err := tc.cmd(fmt.Sprintf(
+		"ADD_ONION %s%s Port=%d,%s",
+		key,
+		flags,
+		port,
+		target,
+	))
+	if nil != err {
+		c.Close()
+		return "", fmt.Errorf("adding onion service: %w", err)
+	}
+	var id string
+	for _, l := range lines {
+		if v, ok := strings.CutPrefix(l, "ServiceID="); ok {
+			id = v
+		} else if v, ok := strings.CutPrefix(
+			l,
+			"PrivateKey=",
+		); ok && "" != keyFile {
+			if err := os.WriteFile(
+				keyFile,
+				[]byte(v+"\n"),
+				0600,
+			); nil != err {
+				c.Close()
+				return "", fmt.Errorf("saving key: %w", err)
+			}
+			log.Printf("Saved onion service key to %s", keyFile)
+		}
+	}
+	if "" == id {
+		c.Close()
+		return "", fmt.Errorf("no service ID in response")
+	}
+
+	/* Hold the connection open, to keep the service */
+	c.SetDeadline(time.Time{})
+	go func() {
+		defer c.Close()
+		io.Copy(io.Discard, c)
+		if !shuttingDown.Load() {
+			log.Printf(
+				"Lost connection to Tor, onion service "+
+					"%s.onion is gone",
+				id,
+			)
+		}
+	}()
+	return id + ".onion", nil
+}
+
+/* auth authenticates to Tor with the best method it offers. */
+func (tc *torConn) auth() error {
+	/* Find out what's on offer */
+	lines, err := tc.cmd("PROTOCOLINFO 1")
+	if nil != err {
+		return err
+	}
+	var (
+		methods = make(map[string]bool)
+		cookie  string
+	)
+	for _, l := range lines {
+		rest, ok := strings.CutPrefix(l, "AUTH METHODS=")
+		if !ok {
+			continue
+		}
+		ms, rest, _ := strings.Cut(rest, " ")
+		for _, m := range strings.Split(ms, ",") {
+			methods[m] = true
+		}
+		if v, ok := strings.CutPrefix(rest, "COOKIEFILE="); ok {
+			if cookie, err = strconv.Unquote(v); nil != err {
+				return fmt.Errorf(
+					"parsing cookie file: %w",
+					err,
+				)
+			}
+		}
+	}
+
+	/* Try them in order of preference */
+	switch {
+	case methods["NULL"]:
+		_, err = tc.cmd("AUTHENTICATE")
+	case methods["SAFECOOKIE"]:
+		err = tc.safeCookie(cookie)
+	case methods["COOKIE"]:
+		var b []byte
+		if b, err = os.ReadFile(cookie); nil == err {
+			_, err = tc.cmd(
+				"AUTHENTICATE " + hex.EncodeToString(b),
+			)
+		}
+	case methods["HASHEDPASSWORD"]:
+		p, ok := os.LookupEnv(torPasswordEnv)
+		if !ok {
+			return fmt.Errorf(
+				"need a password in %s",
+				torPasswordEnv,
+			)
+		}
+		_, err = tc.cmd("AUTHENTICATE " + strconv.Quote(p))
+	default:
+		return fmt.Errorf("no supported auth methods")
+	}
+	return err
+}
+
+/* safeCookie authenticates with the cookie in the file fn. */
+func (tc *torConn) safeCookie(fn string) error {
+	cookie, err := os.ReadFile(fn)
+	if nil != err {
+		return err
+	}
+	cn := make([]byte, 32)
+	rand.Read(cn)
+	lines, err := tc.cmd(
+		"AUTHCHALLENGE SAFECOOKIE " + hex.EncodeToString(cn),
+	)
+	if nil != err {
+		return err
+	}
+
+	/* Make sure Tor knows the cookie, too */
+	var sh, sn []byte
+	for _, f := range strings.Fields(strings.Join(lines, " ")) {
+		if v, ok := strings.CutPrefix(f, "SERVERHASH="); ok {
+			sh, err = hex.DecodeString(v)
+		} else if v, ok := strings.CutPrefix(f, "SERVERNONCE="); ok {
+			sn, err = hex.DecodeString(v)
+		}
+		if nil != err {
+			return fmt.Errorf("parsing challenge: %w", err)
+		}
+	}
+	msg := append(append(append([]byte{}, cookie...), cn...), sn...)
+	mac := hmac.New(sha256.New, []byte(torServerKey))
+	mac.Write(msg)
+	if !hmac.Equal(sh, mac.Sum(nil)) {
+		return fmt.Errorf("server hash incorrect")
+	}
+
+	/* Prove we do */
+	mac = hmac.New(sha256.New, []byte(torClientKey))
+	mac.Write(msg)
+	_, err = tc.cmd("AUTHENTICATE " + hex.EncodeToString(mac.Sum(nil)))
+	return err
+}
+
+// cmd sends a command and returns the lines of the reply, without the
+// status codes, if it was successful.
+func (tc *torConn) cmd(c string) ([]string, error) {
+	if err := tc.tp.PrintfLine("%s", c); nil != err {
+		return nil, err
+	}
+	var lines []string
+	for {
+		l, err := tc.tp.ReadLine()
+		if nil != err {
+			return nil, err
+		}
+		if 4 > len(l) {
+			return nil, fmt.Errorf("short reply %q", l)
+		}
+		if !strings.HasPrefix(l, "250") {
+			return nil, fmt.Errorf("%s", l)
+		}
+		switch l[3] {
+		case ' ':
+			return append(lines, l[4:]), nil
+		case '-':
+			lines = append(lines, l[4:])
+		case '+': /* Data follows, which we don't use */
+			lines = append(lines, l[4:])
+			if _, err := tc.tp.ReadDotLines(); nil != err {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("unexpected reply %q", l)
+		}
+	}
+}
+
+// onionTarget returns the address Tor should forward to for a listener on
+// a.  If a is every address, loopback is used.
+func onionTarget(a net.Addr) (string, error) {
+	if ua, ok := a.(*net.UnixAddr); ok {
+		return "unix:" + ua.Name, nil
+	}
+	ta, ok := a.(*net.TCPAddr)
+	if !ok {
+		return "", fmt.Errorf("not listening on TCP or a unix socket")
+	}
+	ip := ta.IP
+	if ip.IsUnspecified() {
+		ip = net.IPv4(127, 0, 0, 1)
+	}
+	return net.JoinHostPort(ip.String(), strconv.Itoa(ta.Port)), nil
+}
@@ -0,0 +1,253 @@
+package main
+
+/*
+ * transcode.go
+ * Store UTF-8 copies of text uploads in other encodings
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+const (
+	/* transcodeMax is the largest upload we'll try to transcode */
+	transcodeMax = 64 * 1024 * 1024
+	/* transcodeSuffix is added to the path of the transcoded copy */
+	transcodeSuffix = ".utf8"
+)
+
+/* cp1251 maps the top half of Windows-1251 to Unicode */
+var cp1251 = [128]rune{
+	0x0402, 0x0403, 0x201A, 0x0453, 0x201E, 0x2026, 0x2020, 0x2021,
+	0x20AC, 0x2030, 0x0409, 0x2039, 0x040A, 0x040C, 0x040B, 0x040F,
+	0x0452, 0x2018, 0x2019, 0x201C, 0x201D, 0x2022, 0x2013, 0x2014,
+	0xFFFD, 0x2122, 0x0459, 0x203A, 0x045A, 0x045C, 0x045B, 0x045F,
+	0x00A0, 0x040E, 0x045E, 0x0408, 0x00A4, 0x0490, 0x00A6, 0x00A7,
+	0x0401, 0x00A9, 0x0404, 0x00AB, 0x00AC, 0x00AD, 0x00AE, 0x0407,
+	0x00B0, 0x00B1, 0x0406, 0x0456, 0x0491, 0x00B5, 0x00B6, 0x00B7,
+	0x0451, 0x2116, 0x0454, 0x00BB, 0x0458, 0x0405, 0x0455, 0x0457,
+	/* 0xC0-0xFF are А-я, filled in by init */
+}
+
+/* init fills in the Cyrillic letters in cp1251. */
+func init() {
+	for i := 0x40; i < 0x80; i++ {
+		cp1251[i] = rune(0x0410 + i - 0x40)
+	}
+}
+
+// transcodeStorage stores uploads in another Storage and, for uploads which
+// look like non-UTF-8 text or have CRLF line endings, also stores a copy
+// converted to UTF-8 with LF line endings.  The original is always kept.
+// Uploads are copied to temporary files in dir while they're checked.
+type transcodeStorage struct {
+	Storage
+	dir string
+}
+
+/* Open opens an upload which is also copied to a temporary file. */
+func (s transcodeStorage) Open(m *Meta) (Upload, error) {
+	u, err := s.Storage.Open(m)
+	if nil != err {
+		return nil, err
+	}
+	f, err := os.CreateTemp(s.dir, "postfile-transcode-*")
+	if nil != err {
+		u.Abort()
+		return nil, err
+	}
+	return &transcodeUpload{Upload: u, s: s, m: m, f: f}, nil
+}
+
+/* transcodeUpload is an upload which may be transcoded when it's done. */
+type transcodeUpload struct {
+	Upload
+	s   transcodeStorage
+	m   *Meta
+	f   *os.File
+	n   int64
+	big bool /* Too big to bother */
+}
+
+/* Write writes b to the upload and, if there's room, the temporary file. */
+func (u *transcodeUpload) Write(b []byte) (int, error) {
+	if !u.big {
+		if transcodeMax < u.n+int64(len(b)) {
+			u.big = true
+		} else if _, err := u.f.Write(b); nil != err {
+			log.Printf("Error saving upload for transcoding: %v", err)
+			u.big = true
+		}
+		u.n += int64(len(b))
+	}
+	return u.Upload.Write(b)
+}
+
+/* Commit commits the upload and stores a transcoded copy, if needed. */
+func (u *transcodeUpload) Commit() error {
+	defer u.cleanup()
+	if err := u.Upload.Commit(); nil != err {
+		return err
+	}
+	if u.big {
+		return nil
+	}
+
+	/* See if it's something we can make better */
+	b, err := os.ReadFile(u.f.Name())
+	if nil != err {
+		log.Printf("Error reading upload for transcoding: %v", err)
+		return nil
+	}
+	t, enc := transcode(b)
+	if "" == enc {
+		return nil
+	}
+
+	/* Store the copy alongside the original */
+	m := *u.m
+	m.Path += transcodeSuffix
+	c, err := u.s.Storage.Open(&m)
+	if nil != err {
+		log.Printf("Unable to store transcoded %v: %v", u.Name(), err)
+		return nil
+	}
+	if _, err := c.Write(t); nil != err {
+		c.Abort()
+		log.Printf("Error transcoding %v: %v", u.Name(), err)
+		return nil
+	}
+	if err := c.Commit(); nil != err {
+		log.Printf("Error transcoding %v: %v", u.Name(), err)
+		return nil
+	}
+	log.Printf("Transcoded %v from %v to %q", u.Name(), enc, c.Name())
+	return nil
+}
+
+/* Abort aborts the upload. */
+func (u *transcodeUpload) Abort() error {
+	defer u.cleanup()
+	return u.Upload.Abort()
+}
+
+/* cleanup removes the temporary file. */
+func (u *transcodeUpload) cleanup() {
+	u.f.Close()
+	os.Remove(u.f.Name())
+}
+
+// transcode converts b to UTF-8 with LF line endings.  It returns the
+// converted text and the name of the original encoding, or an empty encoding
+// name if b isn't text or is already normalized.
+func transcode(b []byte) ([]byte, string) {
+	var (
+		s   []rune
+		enc string
+	)
+	switch {
+	case bytes.HasPrefix(b, []byte{0xEF, 0xBB, 0xBF}):
+		s, enc = bytes.Runes(b[3:]), "UTF-8 with BOM"
+	case bytes.HasPrefix(b, []byte{0xFF, 0xFE}):
+		s, enc = decodeUTF16(b[2:], false), "UTF-16LE"
+	case bytes.HasPrefix(b, []byte{0xFE, 0xFF}):
+		s, enc = decodeUTF16(b[2:], true), "UTF-16BE"
+	case looksUTF16(b, 1):
+		s, enc = decodeUTF16(b, false), "UTF-16LE"
+	case looksUTF16(b, 0):
+		s, enc = decodeUTF16(b, true), "UTF-16BE"
+	case -1 != bytes.IndexByte(b, 0):
+		return nil, "" /* Binary */
+	case utf8.Valid(b):
+		if !bytes.Contains(b, []byte("\r")) {
+			return nil, "" /* Already fine */
+		}
+		s, enc = bytes.Runes(b), "UTF-8 with CRLF"
+	case looksCP1251(b):
+		s, enc = make([]rune, len(b)), "CP1251"
+		for i, c := range b {
+			if 0x80 > c {
+				s[i] = rune(c)
+			} else {
+				s[i] = cp1251[c-0x80]
+			}
+		}
+	default:
+		return nil, ""
+	}
+
+	/* Make sure it's really text and normalize line endings */
+	out := make([]byte, 0, len(s))
+	for i, r := range s {
+		switch {
+		case '\r' == r:
+			if i+1 < len(s) && '\n' == s[i+1] {
+				continue
+			}
+			r = '\n'
+		case 0x20 > r && '\t' != r && '\n' != r && '\f' != r:
+			return nil, ""
+		}
+		out = utf8.AppendRune(out, r)
+	}
+	return out, enc
+}
+
+/* decodeUTF16 decodes UTF-16 in b. */
+func decodeUTF16(b []byte, bigEndian bool) []rune {
+	u := make([]uint16, len(b)/2)
+	for i := range u {
+		if bigEndian {
+			u[i] = uint16(b[2*i])<<8 | uint16(b[2*i+1])
+		} else {
+			u[i] = uint16(b[2*i+1])<<8 | uint16(b[2*i])
+		}
+	}
+	return utf16.Decode(u)
+}
+
+// looksUTF16 guesses whether b is BOMless UTF-16 by checking that most of the
+// bytes at offset high in each pair are NULs, as they are for ASCII, and the
+// others aren't.
+func looksUTF16(b []byte, high int) bool {
+	if 2 > len(b) || 0 != len(b)%2 {
+		return false
+	}
+	var hz, lz int
+	for i := 0; i+1 < len(b); i += 2 {
+		if 0 == b[i+high] {
+			hz++
+		}
+		if 0 == b[i+1-high] {
+			lz++
+		}
+	}
+	pairs := len(b) / 2
+	return hz*10 >= pairs*8 && 0 == lz
+}
+
+// looksCP1251 guesses whether b, which isn't UTF-8, is Windows-1251 text by
+// checking that most of the high bytes are Cyrillic letters.
+func looksCP1251(b []byte) bool {
+	var high, cyr int
+	for _, c := range b {
+		if 0x98 == c {
+			return false /* Unused */
+		}
+		if 0x80 > c {
+			continue
+		}
+		high++
+		if 0xC0 <= c || 0xA8 == c || 0xB8 == c {
+			cyr++
+		}
+	}
+	return 0 != high && cyr*10 >= high*7
+}
@@ -0,0 +1,136 @@
+package main
+
+/*
+ * ttl.go
+ * Uploads which expire, with callbacks
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	/* ttlHeader asks for an upload to be removed after a while */
+	ttlHeader = "X-Postfile-Ttl"
+	/* callbackHeader gives a URL to tell when the upload's gone */
+	callbackHeader = "X-Postfile-Callback"
+	/* ttlSweepInterval is how often we look for expired uploads */
+	ttlSweepInterval = time.Minute
+)
+
+/* allowCallbacks is true if clients may ask for expiry callbacks */
+var allowCallbacks bool
+
+// parseTTL gets the TTL and callback URL from r's headers, if r has them.
+// The returned time is zero if r doesn't have a TTL.
+func parseTTL(r *http.Request) (time.Time, string, error) {
+	var (
+		exp time.Time
+		cb  = r.Header.Get(callbackHeader)
+	)
+	if h := r.Header.Get(ttlHeader); "" != h {
+		d, err := time.ParseDuration(h)
+		if nil != err || 0 >= d {
+			return exp, "", fmt.Errorf("invalid TTL %q", h)
+		}
+		exp = time.Now().Add(d)
+	}
+	if "" == cb {
+		return exp, "", nil
+	}
+	if !allowCallbacks {
+		return exp, "", fmt.Errorf("callbacks not allowed")
+	}
+	if u, err := url.Parse(cb); nil != err ||
+		("http" != u.Scheme && "https" != u.Scheme) {
+		return exp, "", fmt.Errorf("invalid callback URL %q", cb)
+	}
+	return exp, cb, nil
+}
+
+// registerTTL notes in the upload's sidecar when it expires and who to tell
+// when it's gone.  A zero exp means the upload doesn't expire.
+func registerTTL(e uploadEvent, exp time.Time, cb string) error {
+	return updateSidecar(e, func(s *sidecar) {
+		if !exp.IsZero() {
+			s.Expires = &exp
+		}
+		s.Callback = cb
+	})
+}
+
+/* sweepExpired removes expired uploads every ttlSweepInterval. */
+func sweepExpired() {
+	for {
+		time.Sleep(ttlSweepInterval)
+		fns, err := filepath.Glob(filepath.Join(metaDir, "*.json"))
+		if nil != err {
+			log.Printf("Error finding expiring uploads: %v", err)
+			continue
+		}
+		for _, fn := range fns {
+			expireOne(fn)
+		}
+	}
+}
+
+/* expireOne removes the upload described by sidecar fn, if it's expired. */
+func expireOne(fn string) {
+	metaL.Lock()
+	b, err := os.ReadFile(fn)
+	metaL.Unlock()
+	if nil != err {
+		return
+	}
+	var s sidecar
+	if err := json.Unmarshal(b, &s); nil != err ||
+		nil == s.Expires || time.Now().Before(*s.Expires) {
+		return
+	}
+	if err := os.Remove(s.Upload.Name); nil != err && !os.IsNotExist(err) {
+		log.Printf("Error removing expired %q: %v", s.Upload.Name, err)
+		return
+	}
+	metaL.Lock()
+	os.Remove(fn)
+	metaL.Unlock()
+	log.Printf("Removed expired %q", s.Upload.Name)
+	uploadGone(s, "expired")
+}
+
+// uploadGone tells the uploader that the upload's gone, if they asked to
+// know.  Event says why.
+func uploadGone(s sidecar, event string) {
+	if "" == s.Callback {
+		return
+	}
+	go sendNotification(callback{url: s.Callback, event: event}, s.Upload)
+}
+
+/* callback tells an uploader what happened to their upload. */
+type callback struct {
+	url   string
+	event string
+}
+
+/* String returns the callback's URL. */
+func (c callback) String() string { return "callback " + c.url }
+
+/* Notify sends the event and e to the callback. */
+func (c callback) Notify(e uploadEvent) error {
+	return postJSON(c.url, struct {
+		Event  string      `json:"event"`
+		Time   time.Time   `json:"time"`
+		Upload uploadEvent `json:"upload"`
+	}{c.event, time.Now(), e})
+}
@@ -0,0 +1,175 @@
+package main
+
+/*
+ * udp.go
+ * Capture UDP datagrams
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"encoding/binary"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// Datagrams are appended to a file, either one for all sources or one per
+// source.  A file's finished after udpIdle without a datagram or when we
+// shut down, and the next datagram starts a new one.  Files are stored
+// with a path of /udp.
+const (
+	udpIdle       = time.Minute
+	udpMaxPending = 1024 /* Files at once */
+)
+
+/* udpReceiver appends datagrams to files. */
+type udpReceiver struct {
+	local     string /* Source for all datagrams, if not per-source */
+	prefix    bool   /* Length-prefix datagrams */
+	perSource bool
+	files     map[string]*udpFile
+	l         sync.Mutex
+}
+
+/* udpFile is a file being appended to. */
+type udpFile struct {
+	m    *Meta
+	u    Upload
+	n    int64
+	msgs int
+	last time.Time
+}
+
+// listenUDP appends datagrams received on addr to files.  If prefix is true,
+// each datagram is preceded by its length as a 32-bit big-endian integer.
+// If perSource is true, each source gets its own file.
+func listenUDP(addr string, prefix, perSource bool) (net.PacketConn, error) {
+	pc, err := net.ListenPacket("udp", addr)
+	if nil != err {
+		return nil, err
+	}
+	ur := &udpReceiver{
+		local:     pc.LocalAddr().String(),
+		prefix:    prefix,
+		perSource: perSource,
+		files:     make(map[string]*udpFile),
+	}
+	go ur.receive(pc)
+	go ur.reap()
+	return pc, nil
+}
+
+/* receive reads datagrams from pc. */
+func (ur *udpReceiver) receive(pc net.PacketConn) {
+	buf := make([]byte, 65536)
+	for {
+		n, a, err := pc.ReadFrom(buf)
+		if nil != err {
+			log.Fatalf("Error receiving UDP datagrams: %v", err)
+		}
+		ur.handle(a.String(), buf[:n])
+	}
+}
+
+/* handle appends a datagram to its file. */
+func (ur *udpReceiver) handle(src string, dgram []byte) {
+	k := ur.local
+	if ur.perSource {
+		k = src
+	}
+	ur.l.Lock()
+	defer ur.l.Unlock()
+
+	/* Start a new file, if we've room */
+	f, ok := ur.files[k]
+	if !ok {
+		if shuttingDown.Load() || expired() ||
+			maintenanceFeature.Enabled() {
+			return
+		}
+		if udpMaxPending <= len(ur.files) {
+			log.Printf(
+				"[%s] Too many UDP files, dropping datagram",
+				src,
+			)
+			return
+		}
+		f = &udpFile{m: &Meta{Source: k, Path: "/udp", Time: time.Now()}}
+		var err error
+		if f.u, err = store.Open(f.m); nil != err {
+			noteFailure()
+			log.Printf("[%s] Unable to open storage: %v", src, err)
+			return
+		}
+		inFlight.Add(1)
+		ur.files[k] = f
+	}
+
+	/* Save the datagram */
+	if ur.prefix {
+		dgram = append(
+			binary.BigEndian.AppendUint32(nil, uint32(len(dgram))),
+			dgram...,
+		)
+	}
+	n, err := f.u.Write(dgram)
+	f.n += int64(n)
+	f.msgs++
+	f.last = time.Now()
+	if nil != err {
+		noteFailure()
+		log.Printf(
+			"[%s] Error after writing %v bytes to %q: %v",
+			src,
+			f.n,
+			f.u.Name(),
+			err,
+		)
+		f.u.Abort()
+		delete(ur.files, k)
+		inFlight.Done()
+	}
+}
+
+// reap finishes files which haven't gotten a datagram in udpIdle, or all of
+// them when we're shutting down.
+func (ur *udpReceiver) reap() {
+	for range time.Tick(time.Second) {
+		stopping := shuttingDown.Load()
+		ur.l.Lock()
+		for k, f := range ur.files {
+			if stopping || udpIdle < time.Since(f.last) {
+				delete(ur.files, k)
+				go f.finish()
+			}
+		}
+		ur.l.Unlock()
+	}
+}
+
+/* finish commits the file. */
+func (f *udpFile) finish() {
+	defer inFlight.Done()
+	if err := f.u.Commit(); nil != err {
+		noteFailure()
+		log.Printf(
+			"[%s] Error finishing %v-byte UDP file %q: %v",
+			f.m.Source,
+			f.n,
+			f.u.Name(),
+			err,
+		)
+		return
+	}
+	log.Printf(
+		"[%s] Wrote %v bytes from %d UDP datagrams to %q",
+		f.m.Source,
+		f.n,
+		f.msgs,
+		f.u.Name(),
+	)
+	noteUpload(f.m, f.u.Name(), f.n)
+}
@@ -0,0 +1,272 @@
+package main
+
+/*
+ * ui.go
+ * Web interface for browsing uploads
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"bufio"
+	"fmt"
+	"html/template"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	/* uiPrefix is the path under which the UI lives, if we have one */
+	uiPrefix string
+
+	/* uiUsers holds the UI's usernames and bcrypt password hashes */
+	uiUsers = make(map[string][]byte)
+)
+
+// uiDummyHash is checked against passwords for unknown users, so they take
+// as long to refuse as wrong passwords.
+var uiDummyHash = sync.OnceValue(func() []byte {
+	h, err := bcrypt.GenerateFromPassword(
+		[]byte("not a password"),
+		bcrypt.DefaultCost,
+	)
+	if nil != err {
+		log.Fatalf("Unable to make dummy password hash: %v", err)
+	}
+	return h
+})
+
+/* uiTemplate is the UI's one page */
+var uiTemplate = template.Must(template.New("ui").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>postfile</title>
+<style>
+body { font-family: sans-serif; margin: 1em; }
+table { border-collapse: collapse; }
+td, th { padding: 0.2em 0.6em; text-align: left; border-bottom: 1px solid #ddd; }
+td.n { text-align: right; }
+</style>
+</head>
+<body>
+<h1>postfile</h1>
+<form method="GET" action="{{.Prefix}}">
+<input name="q" value="{{.Query}}" placeholder="Search name, source, path, or instance">
+<input type="submit" value="Search">
+</form>
+<h2>Files ({{len .Files}})</h2>
+<table>
+<tr><th>Time</th>{{if .Federated}}<th>Instance</th>{{end}}<th>Source</th><th>Path</th><th>Size</th><th>Name</th></tr>
+{{range .Files}}<tr>
+<td>{{.ModTime.UTC.Format "2006-01-02 15:04:05"}}</td>
+{{if $.Federated}}<td>{{if .Instance}}{{.Instance}}{{else}}(here){{end}}</td>{{end}}
+<td>{{.Source}}</td>
+<td>{{.Path}}</td>
+<td class="n">{{.Size}}</td>
+<td>{{if .Instance}}{{.Name}}{{else}}<a href="{{$.Prefix}}file?name={{.Name}}">{{.Name}}</a>{{end}}</td>
+</tr>{{end}}
+</table>
+<h2>Recent activity</h2>
+<table>
+<tr><th>Time</th><th>Source</th><th>Path</th><th>Size</th><th>Stored as</th></tr>
+{{range .Recent}}<tr>
+<td>{{.Time.UTC.Format "2006-01-02 15:04:05"}}</td>
+<td>{{.Source}}</td>
+<td>{{.Path}}</td>
+<td class="n">{{.Size}}</td>
+<td>{{.Name}}</td>
+</tr>{{end}}
+</table>
+</body>
+</html>
+`))
+
+// loadUIUsers loads "username hash" lines from the named file.  Hashes are
+// bcrypt hashes, e.g. from htpasswd -nB username, whose username:hash output
+// is also accepted.
+func loadUIUsers(fn string) error {
+	f, err := os.Open(fn)
+	if nil != err {
+		return err
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fs := strings.Fields(s.Text())
+		if 0 == len(fs) || strings.HasPrefix(fs[0], "#") {
+			continue
+		}
+		if u, h, ok := strings.Cut(fs[0], ":"); 1 == len(fs) && ok {
+			fs = []string{u, h}
+		}
+		if 2 != len(fs) {
+			return fmt.Errorf("invalid line %q", s.Text())
+		}
+		if _, err := bcrypt.Cost([]byte(fs[1])); nil != err {
+			return fmt.Errorf(
+				"invalid password hash for %q: %w",
+				fs[0],
+				err,
+			)
+		}
+		uiUsers[fs[0]] = []byte(fs[1])
+	}
+	if nil != s.Err() {
+		return s.Err()
+	}
+	if 0 == len(uiUsers) {
+		return fmt.Errorf("no users found in %s", fn)
+	}
+	return nil
+}
+
+/* isUIRequest returns true if r is for the UI. */
+func isUIRequest(r *http.Request) bool {
+	return "" != uiPrefix && strings.HasPrefix(r.URL.Path, uiPrefix)
+}
+
+/* uiUser returns the name of r's UI user, or "" if r isn't authenticated. */
+func uiUser(r *http.Request) string {
+	u, p, ok := r.BasicAuth()
+	if !ok {
+		return ""
+	}
+	h, ok := uiUsers[u]
+	if !ok {
+		h = uiDummyHash() /* Still compare, for timing */
+	}
+	if nil != bcrypt.CompareHashAndPassword(h, []byte(p)) || !ok {
+		return ""
+	}
+	return u
+}
+
+/* handleUI serves the web UI. */
+func handleUI(w http.ResponseWriter, r *http.Request, rl reqLog) {
+	user := uiUser(r)
+	if "" == user {
+		rl.Printf("UI: unauthorized")
+		w.Header().Set("WWW-Authenticate", `Basic realm="postfile"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if http.MethodGet != r.Method && http.MethodHead != r.Method {
+		http.Error(w, "Invalid method", http.StatusMethodNotAllowed)
+		return
+	}
+	if !localFiles {
+		http.Error(
+			w,
+			"The UI needs files stored locally",
+			http.StatusNotImplemented,
+		)
+		return
+	}
+	switch strings.TrimPrefix(r.URL.Path, uiPrefix) {
+	case "":
+		uiIndex(w, r)
+	case "file":
+		name := r.FormValue("name")
+		rl.Printf("UI: %s requested %q", user, name)
+		serveStoredFile(w, r, name)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// uiIndex lists the stored files matching the search, if any, including
+// files stored by federated peers.
+func uiIndex(w http.ResponseWriter, r *http.Request) {
+	fs, err := listFiles()
+	if nil != err {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	ffs := federatedFiles()
+	if 0 != len(ffs) {
+		fs = append(fs, ffs...)
+		sort.SliceStable(fs, func(i, j int) bool {
+			return fs[i].ModTime.After(fs[j].ModTime)
+		})
+	}
+	q := r.FormValue("q")
+	if "" != q {
+		var ms []storedFile
+		for _, f := range fs {
+			if strings.Contains(f.Name, q) ||
+				strings.Contains(f.Source, q) ||
+				strings.Contains(f.Path, q) ||
+				strings.Contains(f.Instance, q) {
+				ms = append(ms, f)
+			}
+		}
+		fs = ms
+	}
+	recentL.Lock()
+	rs := make([]recentUpload, len(recent))
+	for i, u := range recent {
+		rs[len(rs)-1-i] = u
+	}
+	recentL.Unlock()
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := uiTemplate.Execute(w, map[string]any{
+		"Prefix":    uiPrefix,
+		"Query":     q,
+		"Files":     fs,
+		"Federated": federating(),
+		"Recent":    rs,
+	}); nil != err {
+		log.Printf("UI: error rendering page: %v", err)
+	}
+}
+
+/* serveStoredFile sends the stored file named name as an attachment. */
+func serveStoredFile(w http.ResponseWriter, r *http.Request, name string) {
+	if !storedFileName(name) {
+		http.Error(w, "Invalid name", http.StatusBadRequest)
+		return
+	}
+	f, err := os.Open(name)
+	if os.IsNotExist(err) {
+		http.NotFound(w, r)
+		return
+	} else if nil != err {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	sendStoredFile(w, r, f, name)
+}
+
+// sendStoredFile sends f as an attachment named name.  It returns false if
+// f isn't a regular file.
+func sendStoredFile(
+	w http.ResponseWriter,
+	r *http.Request,
+	f *os.File,
+	name string,
+) bool {
+	fi, err := f.Stat()
+	if nil != err || !fi.Mode().IsRegular() {
+		http.NotFound(w, r)
+		return false
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set(
+		"Content-Disposition",
+		mime.FormatMediaType("attachment", map[string]string{
+			"filename": name,
+		}),
+	)
+	http.ServeContent(w, r, name, fi.ModTime(), f)
+	return true
+}
@@ -0,0 +1,98 @@
+package main
+
+/*
+ * ui_test.go
+ * Tests for ui.go
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestUIUser(t *testing.T) {
+	t.Chdir(t.TempDir())
+	defer func(us map[string][]byte) { uiUsers = us }(uiUsers)
+	uiUsers = make(map[string][]byte)
+
+	/* One from Go, one from htpasswd -B style $2y$ */
+	h, err := bcrypt.GenerateFromPassword([]byte("kittens"), bcrypt.MinCost)
+	if nil != err {
+		t.Fatalf("Hashing password: %s", err)
+	}
+	const (
+		fn      = "users"
+		bobHash = "$2y$07$BCryptRequires22Chrcte/" +
+			"VlQH0piJtjXl.0t1XkA8pw9dMXTpOq" /* rasmuslerdorf */
+	)
+	if err := os.WriteFile(fn, []byte(
+		"# Comment\n"+
+			"alice "+string(h)+"\n"+
+			"\n"+
+			"bob:"+bobHash+"\n",
+	), 0600); nil != err {
+		t.Fatalf("Writing %s: %s", fn, err)
+	}
+	if err := loadUIUsers(fn); nil != err {
+		t.Fatalf("Loading users: %s", err)
+	}
+
+	for _, c := range []struct {
+		user string
+		pass string
+		want string
+	}{
+		{"alice", "kittens", "alice"},
+		{"alice", "moose", ""},
+		{"alice", string(h), ""},
+		{"bob", "rasmuslerdorf", "bob"},
+		{"bob", "kittens", ""},
+		{"eve", "kittens", ""},
+		{"", "", ""},
+	} {
+		t.Run(c.user+"/"+c.pass, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			if "" != c.user {
+				r.SetBasicAuth(c.user, c.pass)
+			}
+			if got := uiUser(r); got != c.want {
+				t.Errorf("Got %q, want %q", got, c.want)
+			}
+		})
+	}
+}
+
+func TestLoadUIUsersInvalid(t *testing.T) {
+	t.Chdir(t.TempDir())
+	defer func(us map[string][]byte) { uiUsers = us }(uiUsers)
+	for _, c := range []struct {
+		name  string
+		users string
+	}{
+		{"plaintext", "alice kittens\n"},
+		{"no_hash", "alice\n"},
+		{"extra_field", "alice $2y$07$x y\n"},
+		{"empty", "# Nobody\n"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			uiUsers = make(map[string][]byte)
+			const fn = "users"
+			if err := os.WriteFile(
+				fn,
+				[]byte(c.users),
+				0600,
+			); nil != err {
+				t.Fatalf("Writing %s: %s", fn, err)
+			}
+			if err := loadUIUsers(fn); nil == err {
+				t.Errorf("Loaded users without error")
+			}
+		})
+	}
+}
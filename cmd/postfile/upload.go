@@ -0,0 +1,168 @@
+package main
+
+/*
+ * upload.go
+ * Store uploads which made it through the chain
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/magisterquis/postfile"
+)
+
+// newUploadHandler returns the postfile.Handler at the end of the chain
+// built by uploadChain, which stores uploads in store.  By the time
+// requests get to it, they've been authorized and checked by the rest of
+// the chain.
+func newUploadHandler() *postfile.Handler {
+	return &postfile.Handler{
+		Storage: store,
+		Methods: []string{http.MethodPost, http.MethodPut},
+		Authorize: func(r *http.Request) (string, bool) {
+			return tokenName(r), true
+		},
+		Prepare:  prepareUpload,
+		Copy:     copyBody,
+		Uploaded: noteUpload,
+		Failed:   uploadFailed,
+		Respond:  uploadSucceeded,
+		Log: func(
+			r *http.Request,
+			res postfile.Result,
+			err error,
+			msg string,
+		) {
+			requestLog(r).With(res.Bytes, res.Name, err).Printf(
+				"%s",
+				msg,
+			)
+		},
+	}
+}
+
+// prepareUpload checks r's TTL and digests, adds r's TLS fingerprints to m,
+// and returns the body to store, with the request line and headers if
+// we're saving raw requests.
+func prepareUpload(
+	r *http.Request,
+	m *Meta,
+	body io.Reader,
+) (io.Reader, error) {
+	/* Make sure we can expire the upload, if it's meant to expire */
+	exp, cb, err := parseTTL(r)
+	if nil != err {
+		return nil, &postfile.StatusError{
+			Status:  http.StatusBadRequest,
+			Message: err.Error(),
+			Err:     fmt.Errorf("bad TTL: %w", err),
+		}
+	}
+	if (!exp.IsZero() || "" != cb) && !localFiles {
+		return nil, &postfile.StatusError{
+			Status:  http.StatusBadRequest,
+			Message: "TTLs not supported",
+			Err:     errors.New("TTL without local storage"),
+		}
+	}
+
+	/* Check the body against its digests, if the client sent any */
+	bd, err := newBodyDigests(r)
+	if nil != err {
+		return nil, &postfile.StatusError{
+			Status:  http.StatusBadRequest,
+			Message: err.Error(),
+			Err:     fmt.Errorf("bad digest: %w", err),
+		}
+	}
+	if nil != bd {
+		body = bd.wrap(body)
+	}
+
+	/* Save the request line and headers too, if we're meant to */
+	if rawFeature.Enabled() {
+		if body, err = withRequestHead(r, body); nil != err {
+			return nil, fmt.Errorf("getting headers: %w", err)
+		}
+	}
+
+	m.JA3, m.JA4 = requestFingerprint(r)
+	return body, nil
+}
+
+// uploadFailed notes a failed upload.  Uploads which didn't match their
+// digests are quarantined, if we're meant to.
+func uploadFailed(r *http.Request, res postfile.Result, err error) {
+	var se *postfile.StatusError
+	if !errors.As(err, &se) {
+		noteFailure()
+	}
+	if !quarantineMismatches || "" == res.Name ||
+		!errors.Is(err, errChecksumMismatch) {
+		return
+	}
+	rl := requestLog(r)
+	if qn, err := quarantine(res.Name); nil != err {
+		rl.Printf("Unable to quarantine: %v", err)
+	} else {
+		rl.Printf("Quarantined %q as %q", res.Name, qn)
+	}
+}
+
+// uploadSucceeded notes when a stored upload expires, remembers the result
+// for retries, and tells the client how it went.
+func uploadSucceeded(
+	w http.ResponseWriter,
+	r *http.Request,
+	res postfile.Result,
+) {
+	/* Note when it expires or who to tell when it's gone.  The TTL
+	starts once the upload's stored. */
+	m := res.Meta
+	if exp, cb, _ := parseTTL(r); !exp.IsZero() || "" != cb {
+		if err := registerTTL(uploadEvent{
+			Source: m.Source,
+			Path:   m.Path,
+			Host:   m.Host,
+			Time:   m.Time,
+			Token:  m.Token,
+			JA3:    m.JA3,
+			JA4:    m.JA4,
+			TLS:    m.TLS,
+			Geo:    lookupGeo(m.Source),
+			PTR:    lookupPTR(m.Source),
+			Name:   res.Name,
+			Size:   res.Bytes,
+		}, exp, cb); nil != err {
+			requestLog(r).With(res.Bytes, res.Name, err).Printf(
+				"Unable to save TTL for %q: %v",
+				res.Name,
+				err,
+			)
+		}
+	}
+
+	/* Remember how it went, for retries */
+	ur := uploadResponse{
+		Bytes:  res.Bytes,
+		File:   res.Name,
+		SHA256: res.SHA256,
+	}
+	noteIdempotentResult(r, ur)
+
+	/* WebDAV clients just want to know it worked */
+	if isWebDAVPut(r) {
+		noteWebDAVPut(r, res.Bytes)
+		w.WriteHeader(http.StatusCreated)
+		return
+	}
+
+	/* Return the number of bytes written */
+	respondUpload(w, r, ur)
+}
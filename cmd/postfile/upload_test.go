@@ -0,0 +1,138 @@
+package main
+
+/*
+ * upload_test.go
+ * Tests for upload.go
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/magisterquis/postfile"
+)
+
+func TestUploadHandler(t *testing.T) {
+	t.Chdir(t.TempDir())
+	defer func(s Storage, q bool) {
+		store, quarantineMismatches = s, q
+	}(store, quarantineMismatches)
+	store = postfile.LocalStorage{}
+	quarantineMismatches = true
+	h := withReqLog(newUploadHandler())
+
+	const sha256Hex = "c81a7b1e755bdf87160ff008f94c8ecc" +
+		"21bc2a710a23bf5e1351300edc0231a1"
+	for _, c := range []struct {
+		name    string
+		method  string
+		headers map[string]string
+		want    int
+		body    string /* Empty to not check */
+	}{{
+		name:   "post",
+		method: http.MethodPost,
+		want:   http.StatusOK,
+		body:   "7\n",
+	}, {
+		name:    "checksum",
+		method:  http.MethodPost,
+		headers: map[string]string{checksumSHA256Header: sha256Hex},
+		want:    http.StatusOK,
+		body:    "7\n",
+	}, {
+		name:   "checksum_mismatch",
+		method: http.MethodPost,
+		headers: map[string]string{
+			checksumSHA256Header: strings.Repeat("0", 64),
+		},
+		want: http.StatusUnprocessableEntity,
+		body: "Checksum mismatch\n",
+	}, {
+		name:    "bad_digest",
+		method:  http.MethodPost,
+		headers: map[string]string{"Content-MD5": "kittens"},
+		want:    http.StatusBadRequest,
+	}, {
+		name:    "bad_ttl",
+		method:  http.MethodPost,
+		headers: map[string]string{ttlHeader: "-1s"},
+		want:    http.StatusBadRequest,
+	}, {
+		name:   "get",
+		method: http.MethodGet,
+		want:   http.StatusMethodNotAllowed,
+	}} {
+		t.Run(c.name, func(t *testing.T) {
+			r := httptest.NewRequest(
+				c.method,
+				"/"+c.name,
+				strings.NewReader("kittens"),
+			)
+			for k, v := range c.headers {
+				r.Header.Set(k, v)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if c.want != w.Code {
+				t.Fatalf(
+					"Got %d, want %d: %s",
+					w.Code,
+					c.want,
+					w.Body,
+				)
+			}
+			if "" != c.body && c.body != w.Body.String() {
+				t.Errorf("Got %q, want %q", w.Body, c.body)
+			}
+		})
+	}
+
+	/* The mismatched upload should be quarantined. */
+	qs, err := filepath.Glob(
+		filepath.Join(quarantineDir, "*checksum_mismatch_000000"),
+	)
+	if nil != err || 1 != len(qs) {
+		t.Errorf("Quarantined uploads: %v (err %v)", qs, err)
+	}
+	if _, err := os.Stat(
+		"192.0.2.1:1234_checksum_mismatch_000000",
+	); !os.IsNotExist(err) {
+		t.Errorf("Mismatched upload not moved: %v", err)
+	}
+}
+
+func TestUploadHandlerJSON(t *testing.T) {
+	t.Chdir(t.TempDir())
+	defer func(s Storage) { store = s }(store)
+	store = postfile.LocalStorage{}
+	r := httptest.NewRequest(
+		http.MethodPost,
+		"/foo",
+		strings.NewReader("kittens"),
+	)
+	r.Header.Set("Accept", "application/json")
+	w := httptest.NewRecorder()
+	withReqLog(newUploadHandler()).ServeHTTP(w, r)
+	var res uploadResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &res); nil != err {
+		t.Fatalf("Error decoding %q: %v", w.Body, err)
+	}
+	want := uploadResponse{
+		Bytes: 7,
+		File:  "192.0.2.1:1234_foo_000000",
+		SHA256: "c81a7b1e755bdf87160ff008f94c8ecc" +
+			"21bc2a710a23bf5e1351300edc0231a1",
+	}
+	if want != res {
+		t.Errorf("Got %+v, want %+v", res, want)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+/*
+ * vhost.go
+ * Keep uploads to different hostnames apart
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/magisterquis/postfile"
+)
+
+// vhostName turns an upload's Host header into something safe to use in a
+// file or directory name: lowercase, without a port, and with anything but
+// letters, digits, dots, and hyphens turned into underscores.  Uploads
+// without a usable Host get unknown.
+func vhostName(host string) string {
+	if h, _, err := net.SplitHostPort(host); nil == err {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if "" == strings.Trim(host, ".") { /* No "", ., or .. */
+		return "unknown"
+	}
+	return strings.Map(func(r rune) rune {
+		if ('a' <= r && 'z' >= r) || ('0' <= r && '9' >= r) ||
+			'.' == r || '-' == r {
+			return r
+		}
+		return '_'
+	}, host)
+}
+
+/* vhostDir returns the vhost subdirectory for m, for subdirStorage. */
+func vhostDir(m *Meta) string { return vhostName(m.Host) }
+
+// vhostStorage puts the upload's Host at the start of the upload's name.
+type vhostStorage struct{ Storage }
+
+/* Open opens the upload as if the client's source started with the Host. */
+func (s vhostStorage) Open(m *Meta) (Upload, error) {
+	mm := *m
+	mm.Source = vhostName(m.Host) + "_" + m.Source
+	return s.Storage.Open(&mm)
+}
+
+// subdirStorage stores uploads as local files in nested subdirectories,
+// named by each of subdirs in turn.  Other than the directory, files are
+// stored as by local.
+type subdirStorage struct {
+	subdirs []func(m *Meta) string
+	local   postfile.LocalStorage
+}
+
+/* Open opens a new file for the upload in the right subdirectory. */
+func (s subdirStorage) Open(m *Meta) (Upload, error) {
+	ds := make([]string, len(s.subdirs))
+	for i, f := range s.subdirs {
+		ds[i] = f(m)
+	}
+	dir := filepath.Join(ds...)
+	if err := os.MkdirAll(dir, 0700); nil != err {
+		return nil, err
+	}
+	ls := s.local
+	ls.Dir = dir
+	return ls.Open(m)
+}
@@ -0,0 +1,368 @@
+package main
+
+/*
+ * webdav.go
+ * Just enough WebDAV to mount us as a drive
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// With -webdav, PUTs are uploads like POSTs and we answer OPTIONS, PROPFIND,
+// PROPPATCH, MKCOL, LOCK, and UNLOCK well enough for Windows, Finder, and
+// davfs to mount us and copy files in.  Nothing stored is ever listed;
+// PROPFIND only shows what the same token (or, without tokens, anybody) has
+// made or PUT since we started, so clients can check their copies worked.
+// Locks are handed out but not enforced.
+const (
+	davMaxEntries = 4096 /* Remembered files and directories */
+	davLockTime   = time.Hour
+)
+
+/* webDAV enables WebDAV */
+var webDAV bool
+
+/* davMethods are the methods, other than PUT, we handle for WebDAV. */
+var davMethods = map[string]bool{
+	http.MethodOptions: true,
+	"PROPFIND":         true,
+	"PROPPATCH":        true,
+	"MKCOL":            true,
+	"LOCK":             true,
+	"UNLOCK":           true,
+}
+
+// davSeen holds what clients have made or PUT, keyed by token name and
+// path.
+var (
+	davSeen  = make(map[string]davEntry)
+	davSeenL sync.Mutex
+)
+
+/* davEntry is a file or directory a client's made. */
+type davEntry struct {
+	dir  bool
+	size int64
+	time time.Time
+}
+
+/* isWebDAV returns true if r is a WebDAV request other than an upload. */
+func isWebDAV(r *http.Request) bool {
+	/* Windows PUTs an empty file before the real one */
+	return webDAV && (davMethods[r.Method] ||
+		(http.MethodPut == r.Method && 0 == r.ContentLength))
+}
+
+/* isWebDAVPut returns true if r is a WebDAV upload. */
+func isWebDAVPut(r *http.Request) bool {
+	return webDAV && http.MethodPut == r.Method
+}
+
+/* davChallenge asks the client to log in with a token as the password. */
+func davChallenge(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", `Basic realm="postfile"`)
+}
+
+/* noteWebDAVPut remembers that the client sending r PUT n bytes. */
+func noteWebDAVPut(r *http.Request, n int64) {
+	davRemember(r, davPath(r), davEntry{size: n, time: time.Now()})
+}
+
+/* handleWebDAV handles the WebDAV requests which aren't uploads. */
+func handleWebDAV(w http.ResponseWriter, r *http.Request, rl reqLog) {
+	/* Clients ask what we can do before logging in */
+	if http.MethodOptions == r.Method {
+		w.Header().Set("Allow", strings.Join([]string{
+			http.MethodOptions,
+			http.MethodPut,
+			"PROPFIND",
+			"PROPPATCH",
+			"MKCOL",
+			"LOCK",
+			"UNLOCK",
+		}, ", "))
+		w.Header().Set("DAV", "1, 2")
+		w.Header().Set("MS-Author-Via", "DAV")
+		return
+	}
+
+	/* Same rules as uploads */
+	if expired() {
+		rl.Printf("Expired")
+		http.Error(w, "Gone", http.StatusGone)
+		return
+	}
+	if maintenanceFeature.Enabled() {
+		handleMaintenance(w, r, rl)
+		return
+	}
+	if !authorized(r) {
+		rl.Printf("Unauthorized")
+		davChallenge(w)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	p := davPath(r)
+	switch r.Method {
+	case http.MethodPut:
+		noteWebDAVPut(r, 0)
+		w.WriteHeader(http.StatusCreated)
+	case "MKCOL":
+		if 0 != r.ContentLength {
+			http.Error(
+				w,
+				"MKCOL bodies not supported",
+				http.StatusUnsupportedMediaType,
+			)
+			return
+		}
+		davRemember(r, p, davEntry{dir: true, time: time.Now()})
+		rl.Printf("Made directory")
+		w.WriteHeader(http.StatusCreated)
+	case "PROPFIND":
+		davPropfind(w, r, p)
+	case "PROPPATCH":
+		davProppatch(w, r, p)
+	case "LOCK":
+		davLock(w, r, p)
+	case "UNLOCK":
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+/* davPath returns r's cleaned path, without a trailing slash. */
+func davPath(r *http.Request) string {
+	return path.Clean("/" + r.URL.Path)
+}
+
+/* davKey returns the key in davSeen for p for r's token. */
+func davKey(r *http.Request, p string) string {
+	return tokenName(r) + "\x00" + p
+}
+
+// davRemember notes that the client sending r made e at p, as well as the
+// directories above it.
+func davRemember(r *http.Request, p string, e davEntry) {
+	davSeenL.Lock()
+	defer davSeenL.Unlock()
+	for "/" != p {
+		k := davKey(r, p)
+		if _, ok := davSeen[k]; !ok &&
+			davMaxEntries <= len(davSeen) {
+			/* Forget the oldest */
+			var (
+				oldest string
+				ot     time.Time
+			)
+			for k, v := range davSeen {
+				if "" == oldest || v.time.Before(ot) {
+					oldest, ot = k, v.time
+				}
+			}
+			delete(davSeen, oldest)
+		}
+		davSeen[k] = e
+		p = path.Dir(p)
+		e = davEntry{dir: true, time: e.time}
+	}
+}
+
+/* WebDAV XML, with the DAV: namespace as D */
+type (
+	davMultistatus struct {
+		XMLName   xml.Name      `xml:"D:multistatus"`
+		NS        string        `xml:"xmlns:D,attr"`
+		Responses []davResponse `xml:"D:response"`
+	}
+	davResponse struct {
+		Href     string      `xml:"D:href"`
+		Propstat davPropstat `xml:"D:propstat"`
+	}
+	davPropstat struct {
+		Prop   any    `xml:"D:prop"`
+		Status string `xml:"D:status"`
+	}
+	davProp struct {
+		XMLName      xml.Name `xml:"D:prop"`
+		DisplayName  string   `xml:"D:displayname"`
+		ResourceType struct {
+			Collection *struct{} `xml:"D:collection"`
+		} `xml:"D:resourcetype"`
+		ContentLength *int64 `xml:"D:getcontentlength,omitempty"`
+		LastModified  string `xml:"D:getlastmodified"`
+		CreationDate  string `xml:"D:creationdate"`
+		SupportedLock struct {
+			LockEntry struct {
+				Scope struct {
+					Exclusive struct{} `xml:"D:exclusive"`
+				} `xml:"D:lockscope"`
+				Type struct {
+					Write struct{} `xml:"D:write"`
+				} `xml:"D:locktype"`
+			} `xml:"D:lockentry"`
+		} `xml:"D:supportedlock"`
+	}
+	davNames struct {
+		XMLName xml.Name  `xml:"D:prop"`
+		Names   []davName /* Element names only */
+	}
+	davName struct {
+		XMLName xml.Name
+	}
+)
+
+/* davResponseFor returns the PROPFIND response for p. */
+func davResponseFor(p string, e davEntry) davResponse {
+	href := (&url.URL{Path: p}).EscapedPath()
+	prop := davProp{DisplayName: path.Base(p)}
+	if e.dir {
+		if "/" != p {
+			href += "/"
+		}
+		prop.ResourceType.Collection = &struct{}{}
+	} else {
+		prop.ContentLength = &e.size
+	}
+	prop.LastModified = e.time.UTC().Format(http.TimeFormat)
+	prop.CreationDate = e.time.UTC().Format(time.RFC3339)
+	return davResponse{
+		Href: href,
+		Propstat: davPropstat{
+			Prop:   prop,
+			Status: "HTTP/1.1 200 OK",
+		},
+	}
+}
+
+// davPropfind tells the client about p and, unless it asked for Depth 0,
+// whatever it's made in p.  The root always exists, as does anything which
+// looks like a directory.
+func davPropfind(w http.ResponseWriter, r *http.Request, p string) {
+	io.Copy(io.Discard, r.Body) /* We always send everything */
+
+	/* Make sure it exists */
+	davSeenL.Lock()
+	defer davSeenL.Unlock()
+	e, ok := davSeen[davKey(r, p)]
+	if !ok && ("/" == p || strings.HasSuffix(r.URL.Path, "/")) {
+		e, ok = davEntry{dir: true, time: startTime}, true
+	}
+	if !ok {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	/* Work out what to send back */
+	ms := davMultistatus{
+		NS:        "DAV:",
+		Responses: []davResponse{davResponseFor(p, e)},
+	}
+	if e.dir && "0" != r.Header.Get("Depth") {
+		pre := davKey(r, p)
+		if "/" != p {
+			pre += "/"
+		}
+		for k, v := range davSeen {
+			c, ok := strings.CutPrefix(k, pre)
+			if !ok || "" == c || strings.Contains(c, "/") {
+				continue
+			}
+			ms.Responses = append(
+				ms.Responses,
+				davResponseFor(path.Join(p, c), v),
+			)
+		}
+	}
+	davSend(w, ms)
+}
+
+// davProppatch tells the client every property it tried to set or remove
+// on p was set or removed.  Nothing's actually kept.
+func davProppatch(w http.ResponseWriter, r *http.Request, p string) {
+	var (
+		names davNames
+		depth int
+		d     = xml.NewDecoder(r.Body)
+	)
+	/* The properties are the children of prop elements */
+	for {
+		t, err := d.Token()
+		if nil != err {
+			break
+		}
+		switch t := t.(type) {
+		case xml.StartElement:
+			if 3 == depth {
+				names.Names = append(names.Names, davName{t.Name})
+			}
+			depth++
+		case xml.EndElement:
+			depth--
+		}
+	}
+	io.Copy(io.Discard, r.Body)
+	href := (&url.URL{Path: p}).EscapedPath()
+	davSend(w, davMultistatus{
+		NS: "DAV:",
+		Responses: []davResponse{{
+			Href: href,
+			Propstat: davPropstat{
+				Prop:   names,
+				Status: "HTTP/1.1 200 OK",
+			},
+		}},
+	})
+}
+
+/* davLock gives the client a lock on p, which is never checked. */
+func davLock(w http.ResponseWriter, r *http.Request, p string) {
+	io.Copy(io.Discard, r.Body)
+	tok := "opaquelocktoken:" + rand.Text()
+	var href bytes.Buffer
+	xml.EscapeText(&href, []byte((&url.URL{Path: p}).EscapedPath()))
+	w.Header().Set("Content-Type", `application/xml; charset="utf-8"`)
+	w.Header().Set("Lock-Token", "<"+tok+">")
+	fmt.Fprintf(
+		w,
+		"%s<D:prop xmlns:D=\"DAV:\"><D:lockdiscovery><D:activelock>"+
+			"<D:locktype><D:write/></D:locktype>"+
+			"<D:lockscope><D:exclusive/></D:lockscope>"+
+			"<D:depth>0</D:depth>"+
+			"<D:timeout>Second-%d</D:timeout>"+
+			"<D:locktoken><D:href>%s</D:href></D:locktoken>"+
+			"<D:lockroot><D:href>%s</D:href></D:lockroot>"+
+			"</D:activelock></D:lockdiscovery></D:prop>\n",
+		xml.Header,
+		int(davLockTime.Seconds()),
+		tok,
+		href.String(),
+	)
+}
+
+/* davSend sends ms as a 207 Multi-Status. */
+func davSend(w http.ResponseWriter, ms davMultistatus) {
+	b, err := xml.Marshal(ms)
+	if nil != err {
+		http.Error(w, "XML", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", `application/xml; charset="utf-8"`)
+	w.WriteHeader(http.StatusMultiStatus)
+	io.WriteString(w, xml.Header)
+	w.Write(b)
+}
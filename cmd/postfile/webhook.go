@@ -0,0 +1,53 @@
+package main
+
+/*
+ * webhook.go
+ * POST upload details to a URL
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+/* webhookTimeout is how long we wait for a webhook request to finish */
+const webhookTimeout = 30 * time.Second
+
+/* webhookClient makes webhook requests */
+var webhookClient = &http.Client{Timeout: webhookTimeout}
+
+/* webhook POSTs a JSON object describing each upload to a URL. */
+type webhook struct {
+	url string
+}
+
+/* String returns the webhook's URL. */
+func (w webhook) String() string { return w.url }
+
+/* Notify sends e to the webhook. */
+func (w webhook) Notify(e uploadEvent) error { return postJSON(w.url, e) }
+
+/* postJSON POSTs v as JSON to u and makes sure it worked. */
+func postJSON(u string, v any) error {
+	b, err := json.Marshal(v)
+	if nil != err {
+		return err
+	}
+	res, err := webhookClient.Post(u, "application/json", bytes.NewReader(b))
+	if nil != err {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(res.Body, 4096))
+	if 2 != res.StatusCode/100 {
+		return fmt.Errorf("unexpected status %s", res.Status)
+	}
+	return nil
+}
@@ -0,0 +1,363 @@
+package main
+
+/*
+ * websocket.go
+ * Uploads via WebSocket
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/magisterquis/postfile"
+)
+
+/* wsGUID is appended to the client's key to make the accept header */
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+/* WebSocket opcodes */
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xA
+)
+
+/* wsMaxControl is the largest allowed control frame payload */
+const wsMaxControl = 125
+
+/* wsPath is where clients connect with WebSockets */
+var wsPath string
+
+/* errWSClosed is returned by wsConn.next when the client closes cleanly. */
+var errWSClosed = errors.New("closed by client")
+
+/* isWebSocket returns true if r is for the WebSocket endpoint. */
+func isWebSocket(r *http.Request) bool {
+	return "" != wsPath && wsPath == r.URL.Path &&
+		http.MethodGet == r.Method
+}
+
+// handleWebSocket upgrades the connection to a WebSocket and appends the
+// payload of every text and binary message to a file for the connection.
+// Pings are answered and the file's finished when the client closes the
+// connection.
+func handleWebSocket(w http.ResponseWriter, r *http.Request, rl reqLog) {
+	/* Make sure it's really a WebSocket */
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if b, err := base64.StdEncoding.DecodeString(key); nil != err ||
+		16 != len(b) ||
+		!headerHas(r.Header, "Connection", "upgrade") ||
+		!headerHas(r.Header, "Upgrade", "websocket") {
+		rl.Printf("Invalid WebSocket handshake")
+		http.Error(w, "WebSocket upgrade required", http.StatusBadRequest)
+		return
+	}
+	if "13" != r.Header.Get("Sec-WebSocket-Version") {
+		rl.Printf(
+			"Unsupported WebSocket version %q",
+			r.Header.Get("Sec-WebSocket-Version"),
+		)
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "Unsupported version", http.StatusUpgradeRequired)
+		return
+	}
+
+	// Messages don't have content types, so without sniffing, the
+	// handshake's Content-Type has to do.
+	if ct := r.Header.Get("Content-Type"); 0 != len(contentTypes) &&
+		!sniffContentTypes && !allowedContentType(ct) {
+		err := contentTypeError(ct)
+		rl.Printf("Refused WebSocket: %v", err)
+		sendStatusError(w, err)
+		return
+	}
+
+	/* Somewhere to put the messages */
+	m := &Meta{
+		Source: r.RemoteAddr,
+		Path:   r.URL.Path,
+		Host:   r.Host,
+		Time:   time.Now(),
+		Token:  tokenName(r),
+	}
+	m.JA3, m.JA4 = requestFingerprint(r)
+	m.TLS = postfile.NewTLSInfo(r.TLS)
+	u, err := store.Open(m)
+	if nil != err {
+		noteFailure()
+		rl.With(0, "", err).Printf("Unable to open storage: %v", err)
+		http.Error(w, "open", http.StatusInternalServerError)
+		return
+	}
+
+	/* Take over the connection */
+	c, brw, err := http.NewResponseController(w).Hijack()
+	if nil != err {
+		u.Abort()
+		rl.Printf("Unable to take over connection: %v", err)
+		http.Error(w, "WebSocket needs HTTP/1.1", http.StatusBadRequest)
+		return
+	}
+	defer c.Close()
+	c.SetDeadline(time.Time{})
+	sum := sha1.Sum([]byte(key + wsGUID))
+	fmt.Fprintf(
+		brw,
+		"HTTP/1.1 101 Switching Protocols\r\n"+
+			"Upgrade: websocket\r\n"+
+			"Connection: Upgrade\r\n"+
+			"Sec-WebSocket-Accept: %s\r\n\r\n",
+		base64.StdEncoding.EncodeToString(sum[:]),
+	)
+	if err := brw.Flush(); nil != err {
+		u.Abort()
+		rl.Printf("Error finishing WebSocket handshake: %v", err)
+		return
+	}
+
+	/* Save messages until the client's done */
+	ws := &wsConn{c: c, brw: brw}
+	var (
+		n    int64
+		msgs int
+	)
+	for {
+		var nw int64
+		nw, err = ws.nextChecked(u)
+		n += nw
+		if nil != err {
+			break
+		}
+		msgs++
+	}
+	var se *postfile.StatusError
+	switch {
+	case errors.Is(err, errWSClosed) || io.EOF == err:
+		err = u.Commit()
+	case errors.As(err, &se): /* Unsupported type */
+		u.Abort()
+		ws.close(1003)
+	default:
+		u.Abort()
+		ws.close(1002)
+	}
+	if nil != se {
+		rl.With(n, u.Name(), err).Printf(
+			"Rejected WebSocket message %d to %q: %v",
+			msgs,
+			u.Name(),
+			err,
+		)
+		return
+	}
+	if nil != err && !errors.Is(err, errWSClosed) {
+		noteFailure()
+		rl.With(n, u.Name(), err).Printf(
+			"Error after writing %v bytes from %d WebSocket "+
+				"messages to %q: %v",
+			n,
+			msgs,
+			u.Name(),
+			err,
+		)
+		return
+	}
+	rl.With(n, u.Name(), nil).Printf(
+		"Wrote %v bytes from %d WebSocket messages to %q",
+		n,
+		msgs,
+		u.Name(),
+	)
+	noteUpload(m, u.Name(), n)
+}
+
+/* wsConn is the server side of a WebSocket. */
+type wsConn struct {
+	c   net.Conn
+	brw *bufio.ReadWriter
+}
+
+// next writes the payload of the next message to w.  Control frames before
+// and within the message are handled.  errWSClosed is returned when the
+// client closes the connection and io.EOF if the connection's closed
+// between messages.
+func (ws *wsConn) next(w io.Writer) (int64, error) {
+	var (
+		n       int64
+		started bool
+	)
+	for {
+		fin, op, pr, err := ws.frame(!started)
+		if nil != err {
+			return n, err
+		}
+		switch op {
+		case wsContinuation, wsText, wsBinary:
+			if started == (wsContinuation != op) {
+				return n, fmt.Errorf("unexpected opcode %d", op)
+			}
+			started = true
+			nw, err := io.Copy(w, pr)
+			n += nw
+			if nil == err && 0 != pr.N {
+				err = io.ErrUnexpectedEOF
+			}
+			if nil != err {
+				return n, err
+			}
+			if fin {
+				return n, nil
+			}
+			continue
+		}
+
+		/* Control frames are small and not fragmented */
+		if !fin || wsMaxControl < pr.N {
+			return n, fmt.Errorf("invalid control frame")
+		}
+		b, err := io.ReadAll(pr)
+		if nil != err {
+			return n, err
+		}
+		switch op {
+		case wsClose:
+			code := uint16(1000)
+			if 2 <= len(b) {
+				code = binary.BigEndian.Uint16(b)
+			}
+			ws.close(code)
+			return n, errWSClosed
+		case wsPing:
+			if err := ws.send(wsPong, b); nil != err {
+				return n, err
+			}
+		case wsPong:
+		default:
+			return n, fmt.Errorf("unknown opcode %d", op)
+		}
+	}
+}
+
+// nextChecked is like next, but if we're sniffing content types, each
+// message's type is checked against contentTypes.  A message of a type
+// which isn't allowed isn't written and gets a StatusError.
+func (ws *wsConn) nextChecked(w io.Writer) (int64, error) {
+	if 0 == len(contentTypes) || !sniffContentTypes {
+		return ws.next(w)
+	}
+	cw := &ctypeWriter{w: w}
+	n, err := ws.next(cw)
+	if nil == err {
+		err = cw.check()
+	}
+	return n, err
+}
+
+// frame reads a frame header and returns whether it's the final fragment,
+// its opcode, and a reader for its unmasked payload.  If first is true and
+// the connection's closed before the header, io.EOF is returned.
+func (ws *wsConn) frame(first bool) (bool, byte, *io.LimitedReader, error) {
+	if 0 != idleTimeout {
+		ws.c.SetReadDeadline(time.Now().Add(idleTimeout))
+	}
+	var h [2]byte
+	if _, err := io.ReadFull(ws.brw, h[:]); nil != err {
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			idleTimeouts.Add(1)
+			err = fmt.Errorf("idle for %s: %w", idleTimeout, err)
+		} else if !first || !errors.Is(err, io.EOF) {
+			err = fmt.Errorf("reading frame: %w", err)
+		}
+		return false, 0, nil, err
+	}
+	fin, op := 0 != h[0]&0x80, h[0]&0x0F
+	if 0 != h[0]&0x70 {
+		return false, 0, nil, fmt.Errorf("reserved bits set")
+	}
+	if 0 == h[1]&0x80 {
+		return false, 0, nil, fmt.Errorf("unmasked frame")
+	}
+
+	/* Work out how much payload there is */
+	size := uint64(h[1] & 0x7F)
+	var err error
+	switch size {
+	case 126:
+		var s uint16
+		err = binary.Read(ws.brw, binary.BigEndian, &s)
+		size = uint64(s)
+	case 127:
+		err = binary.Read(ws.brw, binary.BigEndian, &size)
+	}
+	if nil == err && 1<<63 <= size {
+		err = fmt.Errorf("frame too large")
+	}
+	var mk wsMasked
+	if nil == err {
+		_, err = io.ReadFull(ws.brw, mk.key[:])
+	}
+	if nil != err {
+		return false, 0, nil, fmt.Errorf("reading frame header: %w", err)
+	}
+	mk.r = ws.brw
+	return fin, op, &io.LimitedReader{R: &mk, N: int64(size)}, nil
+}
+
+/* send sends a single unmasked frame. */
+func (ws *wsConn) send(op byte, payload []byte) error {
+	ws.brw.WriteByte(0x80 | op)
+	ws.brw.WriteByte(byte(len(payload))) /* Only control frames */
+	ws.brw.Write(payload)
+	return ws.brw.Flush()
+}
+
+/* close sends a close frame with the given status code. */
+func (ws *wsConn) close(code uint16) {
+	ws.send(wsClose, binary.BigEndian.AppendUint16(nil, code))
+}
+
+/* wsMasked unmasks a frame's payload as it's read. */
+type wsMasked struct {
+	r   io.Reader
+	key [4]byte
+	i   int
+}
+
+/* Read implements io.Reader. */
+func (m *wsMasked) Read(b []byte) (int, error) {
+	n, err := m.r.Read(b)
+	for i := range b[:n] {
+		b[i] ^= m.key[m.i%4]
+		m.i++
+	}
+	return n, err
+}
+
+// headerHas returns true if one of the comma-separated values of the header
+// in h named name is v, case-insensitively.
+func headerHas(h http.Header, name, v string) bool {
+	for _, hv := range h.Values(name) {
+		for _, t := range strings.Split(hv, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), v) {
+				return true
+			}
+		}
+	}
+	return false
+}
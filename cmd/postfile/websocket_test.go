@@ -0,0 +1,332 @@
+package main
+
+/*
+ * websocket_test.go
+ * Tests for websocket.go
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/magisterquis/postfile"
+)
+
+/* testWSKey masks frames sent by tests. */
+var testWSKey = [4]byte{1, 2, 3, 4}
+
+/* errAny is used by tests which expect an error, but not which one. */
+var errAny = errors.New("any error")
+
+/* testWSFrame makes a masked frame, as a client would send. */
+func testWSFrame(fin bool, op byte, payload string) []byte {
+	b := []byte{op}
+	if fin {
+		b[0] |= 0x80
+	}
+	switch n := len(payload); {
+	case 126 > n:
+		b = append(b, 0x80|byte(n))
+	case 0x10000 > n:
+		b = append(b, 0x80|126)
+		b = binary.BigEndian.AppendUint16(b, uint16(n))
+	default:
+		b = append(b, 0x80|127)
+		b = binary.BigEndian.AppendUint64(b, uint64(n))
+	}
+	b = append(b, testWSKey[:]...)
+	for i := range len(payload) {
+		b = append(b, payload[i]^testWSKey[i%4])
+	}
+	return b
+}
+
+/* testWSConn returns a wsConn which reads in and writes to out. */
+func testWSConn(in []byte, out *bytes.Buffer) *wsConn {
+	return &wsConn{brw: bufio.NewReadWriter(
+		bufio.NewReader(bytes.NewReader(in)),
+		bufio.NewWriter(out),
+	)}
+}
+
+func TestWSConnNext(t *testing.T) {
+	long := strings.Repeat("x", 300)
+	for _, c := range []struct {
+		name   string
+		frames [][]byte
+		want   string
+		sent   []byte /* Sent back to the client */
+		err    error  /* Or, errAny */
+	}{{
+		name:   "text",
+		frames: [][]byte{testWSFrame(true, wsText, "kittens")},
+		want:   "kittens",
+	}, {
+		name:   "long",
+		frames: [][]byte{testWSFrame(true, wsBinary, long)},
+		want:   long,
+	}, {
+		name: "64bit_length",
+		frames: [][]byte{
+			{0x80 | wsBinary, 0x80 | 127, 0, 0, 0, 0, 0, 0, 0, 2},
+			testWSKey[:],
+			{'h' ^ 1, 'i' ^ 2},
+		},
+		want: "hi",
+	}, {
+		name: "fragmented_with_ping",
+		frames: [][]byte{
+			testWSFrame(false, wsBinary, "kit"),
+			testWSFrame(true, wsPing, "hello"),
+			testWSFrame(false, wsContinuation, "te"),
+			testWSFrame(true, wsPong, ""),
+			testWSFrame(true, wsContinuation, "ns"),
+		},
+		want: "kittens",
+		sent: []byte{0x80 | wsPong, 5, 'h', 'e', 'l', 'l', 'o'},
+	}, {
+		name:   "close",
+		frames: [][]byte{testWSFrame(true, wsClose, "\x03\xe9")},
+		sent:   []byte{0x80 | wsClose, 2, 0x03, 0xe9},
+		err:    errWSClosed,
+	}, {
+		name:   "close_without_code",
+		frames: [][]byte{testWSFrame(true, wsClose, "")},
+		sent:   []byte{0x80 | wsClose, 2, 0x03, 0xe8},
+		err:    errWSClosed,
+	}, {
+		name: "eof",
+		err:  io.EOF,
+	}, {
+		name:   "truncated_payload",
+		frames: [][]byte{testWSFrame(true, wsText, "kittens")[:8]},
+		want:   "ki",
+		err:    io.ErrUnexpectedEOF,
+	}, {
+		name:   "truncated_header",
+		frames: [][]byte{testWSFrame(true, wsText, "kittens")[:4]},
+		err:    io.ErrUnexpectedEOF,
+	}, {
+		name: "unmasked",
+		frames: [][]byte{
+			{0x80 | wsText, 2, 'h', 'i'},
+		},
+		err: errAny,
+	}, {
+		name: "reserved_bits",
+		frames: [][]byte{
+			{0xc0 | wsText, 0x80 | 2},
+			testWSKey[:],
+			{'h' ^ 1, 'i' ^ 2},
+		},
+		err: errAny,
+	}, {
+		name: "too_large",
+		frames: [][]byte{{
+			0x80 | wsBinary, 0x80 | 127,
+			0x80, 0, 0, 0, 0, 0, 0, 0,
+			1, 2, 3, 4,
+		}},
+		err: errAny,
+	}, {
+		name: "lone_continuation",
+		frames: [][]byte{
+			testWSFrame(true, wsContinuation, "hi"),
+		},
+		err: errAny,
+	}, {
+		name: "interrupted_message",
+		frames: [][]byte{
+			testWSFrame(false, wsText, "hi"),
+			testWSFrame(true, wsText, "hi"),
+		},
+		want: "hi",
+		err:  errAny,
+	}, {
+		name: "fragmented_control",
+		frames: [][]byte{
+			testWSFrame(false, wsPing, "hi"),
+		},
+		err: errAny,
+	}, {
+		name: "huge_control",
+		frames: [][]byte{
+			testWSFrame(true, wsPing, long),
+		},
+		err: errAny,
+	}, {
+		name: "unknown_opcode",
+		frames: [][]byte{
+			testWSFrame(true, 0xB, ""),
+		},
+		err: errAny,
+	}} {
+		t.Run(c.name, func(t *testing.T) {
+			var (
+				got bytes.Buffer
+				out bytes.Buffer
+			)
+			ws := testWSConn(bytes.Join(c.frames, nil), &out)
+			n, err := ws.next(&got)
+			switch {
+			case nil == c.err && nil != err:
+				t.Errorf("Error: %s", err)
+			case errAny == c.err && nil == err:
+				t.Errorf("Expected error")
+			case errAny != c.err && !errors.Is(err, c.err):
+				t.Errorf("Got error %v, want %v", err, c.err)
+			}
+			if gs := got.String(); c.want != gs {
+				t.Errorf("Got %q, want %q", gs, c.want)
+			}
+			if gn := int64(got.Len()); gn != n {
+				t.Errorf("Wrote %d bytes, returned %d", gn, n)
+			}
+			if sent := out.Bytes(); !bytes.Equal(c.sent, sent) {
+				t.Errorf("Sent %v, want %v", sent, c.sent)
+			}
+		})
+	}
+}
+
+func TestHeaderHas(t *testing.T) {
+	h := http.Header{}
+	h.Add("Connection", "keep-alive, Upgrade")
+	h.Add("Upgrade", "h2c")
+	h.Add("Upgrade", "WebSocket")
+	for _, c := range []struct {
+		name string
+		v    string
+		want bool
+	}{
+		{"Connection", "upgrade", true},
+		{"Connection", "keep-alive", true},
+		{"Connection", "close", false},
+		{"Upgrade", "websocket", true},
+		{"Upgrade", "web", false},
+		{"Missing", "", false},
+	} {
+		if got := headerHas(h, c.name, c.v); got != c.want {
+			t.Errorf("%s: %s: got %v", c.name, c.v, got)
+		}
+	}
+}
+
+func TestHandleWebSocket(t *testing.T) {
+	t.Chdir(t.TempDir())
+	defer func(s Storage) { store = s }(store)
+	store = postfile.LocalStorage{}
+	s := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			handleWebSocket(w, r, newReqLog(r))
+		},
+	))
+	defer s.Close()
+
+	/* Bad handshakes shouldn't get upgraded */
+	for _, c := range []struct {
+		name    string
+		headers map[string]string
+		want    int
+	}{{
+		name: "no_key",
+		headers: map[string]string{
+			"Connection": "Upgrade",
+			"Upgrade":    "websocket",
+		},
+		want: http.StatusBadRequest,
+	}, {
+		name: "old_version",
+		headers: map[string]string{
+			"Connection":            "Upgrade",
+			"Upgrade":               "websocket",
+			"Sec-WebSocket-Key":     "dGhlIHNhbXBsZSBub25jZQ==",
+			"Sec-WebSocket-Version": "8",
+		},
+		want: http.StatusUpgradeRequired,
+	}} {
+		t.Run(c.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, s.URL, nil)
+			if nil != err {
+				t.Fatalf("Making request: %s", err)
+			}
+			for k, v := range c.headers {
+				req.Header.Set(k, v)
+			}
+			res, err := http.DefaultClient.Do(req)
+			if nil != err {
+				t.Fatalf("Request: %s", err)
+			}
+			res.Body.Close()
+			if c.want != res.StatusCode {
+				t.Errorf("Got %s, want %d", res.Status, c.want)
+			}
+		})
+	}
+
+	/* A real one should store what's sent, with RFC 6455's example key */
+	c, err := net.Dial("tcp", s.Listener.Addr().String())
+	if nil != err {
+		t.Fatalf("Dial: %s", err)
+	}
+	defer c.Close()
+	io.WriteString(c, "GET /ws HTTP/1.1\r\n"+
+		"Host: example.com\r\n"+
+		"Connection: Upgrade\r\n"+
+		"Upgrade: websocket\r\n"+
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n"+
+		"Sec-WebSocket-Version: 13\r\n\r\n",
+	)
+	br := bufio.NewReader(c)
+	res, err := http.ReadResponse(br, nil)
+	if nil != err {
+		t.Fatalf("Reading handshake response: %s", err)
+	}
+	if http.StatusSwitchingProtocols != res.StatusCode {
+		t.Fatalf("Got %s", res.Status)
+	}
+	if got, want := res.Header.Get("Sec-WebSocket-Accept"),
+		"s3pPLMBiTxaQ9kYGzzhZRbK+xOo="; want != got {
+		t.Errorf("Got accept key %q, want %q", got, want)
+	}
+	c.Write(bytes.Join([][]byte{
+		testWSFrame(true, wsText, "kit"),
+		testWSFrame(true, wsBinary, "tens"),
+		testWSFrame(true, wsClose, ""),
+	}, nil))
+	if b, err := io.ReadAll(br); nil != err {
+		t.Errorf("Reading close: %s", err)
+	} else if want := []byte{0x80 | wsClose, 2, 0x03, 0xe8}; !bytes.Equal(
+		b,
+		want,
+	) {
+		t.Errorf("Got close %v, want %v", b, want)
+	}
+
+	/* Connection's closed after the upload's done */
+	ms, err := filepath.Glob("*")
+	if nil != err {
+		t.Fatalf("Glob: %s", err)
+	}
+	if 1 != len(ms) {
+		t.Fatalf("Expected one file, got %q", ms)
+	}
+	if b, err := os.ReadFile(ms[0]); nil != err {
+		t.Errorf("Reading %s: %s", ms[0], err)
+	} else if "kittens" != string(b) {
+		t.Errorf("Got %q", b)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+/*
+ * yara.go
+ * Check uploads against YARA rules
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+/* yaraTimeout is how long we let yara run on one upload. */
+const yaraTimeout = 5 * time.Minute
+
+// yaraScanner runs the yara binary with the rules in a directory against
+// each upload, and logs any matching rules.  If there's matches, uploads'
+// details and the matching rules are sent to notifiers as well.  It's
+// meant to be used as a notifier itself.
+type yaraScanner struct {
+	bin       string   /* yara binary */
+	rules     []string /* Rules files */
+	notifiers []notifier
+}
+
+// newYARAScanner returns a yaraScanner which uses the .yar and .yara files
+// in dir and the yara binary bin, which will be found in the PATH if need
+// be.  Paths are made absolute, so it's safe to change directories
+// afterwards.
+func newYARAScanner(dir string, bin string) (yaraScanner, error) {
+	var (
+		ys  yaraScanner
+		err error
+	)
+	if ys.bin, err = exec.LookPath(bin); nil != err {
+		return yaraScanner{}, err
+	}
+	if ys.bin, err = filepath.Abs(ys.bin); nil != err {
+		return yaraScanner{}, err
+	}
+	des, err := os.ReadDir(dir)
+	if nil != err {
+		return yaraScanner{}, err
+	}
+	for _, de := range des {
+		switch strings.ToLower(filepath.Ext(de.Name())) {
+		case ".yar", ".yara":
+		default:
+			continue
+		}
+		p, err := filepath.Abs(filepath.Join(dir, de.Name()))
+		if nil != err {
+			return yaraScanner{}, err
+		}
+		ys.rules = append(ys.rules, p)
+	}
+	if 0 == len(ys.rules) {
+		return yaraScanner{}, fmt.Errorf("no .yar or .yara files in %s", dir)
+	}
+	return ys, nil
+}
+
+/* String returns "YARA scanner". */
+func (ys yaraScanner) String() string { return "YARA scanner" }
+
+/* Notify checks e's upload against the rules. */
+func (ys yaraScanner) Notify(e uploadEvent) error {
+	ms, err := ys.scan(e.Name)
+	if nil != err {
+		return err
+	}
+	if 0 == len(ms) {
+		return nil
+	}
+	log.Printf("YARA rules matched %s: %s", e.Name, strings.Join(ms, ", "))
+	e.YARA = ms
+	for _, n := range ys.notifiers {
+		go sendNotification(n, e)
+	}
+	return nil
+}
+
+// scan runs yara against the file named fn and returns the names of the
+// rules which matched, sorted.
+func (ys yaraScanner) scan(fn string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), yaraTimeout)
+	defer cancel()
+	args := append([]string{"--no-warnings"}, ys.rules...)
+	args = append(args, fn)
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, ys.bin, args...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if nil != err {
+		return nil, fmt.Errorf(
+			"%w (%s)",
+			err,
+			strings.TrimSpace(stderr.String()),
+		)
+	}
+
+	/* Each line's a rule name and the file */
+	var ms []string
+	s := bufio.NewScanner(bytes.NewReader(out))
+	for s.Scan() {
+		if r, _, ok := strings.Cut(s.Text(), " "); ok &&
+			!slices.Contains(ms, r) {
+			ms = append(ms, r)
+		}
+	}
+	slices.Sort(ms)
+	return ms, nil
+}
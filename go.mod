@@ -0,0 +1,15 @@
+module github.com/magisterquis/postfile
+
+go 1.26.0
+
+require (
+	github.com/quic-go/quic-go v0.59.1
+	golang.org/x/crypto v0.48.0
+)
+
+require (
+	github.com/quic-go/qpack v0.6.0 // indirect
+	golang.org/x/net v0.49.0 // indirect
+	golang.org/x/sys v0.41.0 // indirect
+	golang.org/x/text v0.34.0 // indirect
+)
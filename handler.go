@@ -0,0 +1,265 @@
+package postfile
+
+/*
+ * handler.go
+ * Save POSTed bodies
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// Handler is an http.Handler which saves the bodies of POST requests to
+// Storage and sends back the number of bytes saved.  Its other fields, all
+// optional, change how uploads are checked, saved, logged, and answered.
+type Handler struct {
+	// Storage is where uploads go.  If it's nil, uploads go to files in
+	// the current directory.
+	Storage Storage
+
+	// Methods are the request methods which upload.  If it's empty,
+	// only POST requests upload.
+	Methods []string
+
+	// Authorize, if not nil, is called before each upload and returns a
+	// name for the client's credentials, which is saved in Meta.Token,
+	// and whether the upload is allowed.
+	Authorize func(r *http.Request) (token string, ok bool)
+
+	// Prepare, if not nil, is called after Authorize with the upload's
+	// metadata, which it may change, and the request body.  It returns
+	// the body to save, which may wrap the request body, or an error if
+	// the upload shouldn't happen.  Returning a *StatusError controls
+	// what the client is told.
+	Prepare func(r *http.Request, m *Meta, b io.Reader) (io.Reader, error)
+
+	// Copy, if not nil, is used instead of io.Copy to write bodies to
+	// Storage.  It should return the number of bytes read from src.
+	Copy func(dst io.Writer, src io.Reader) (int64, error)
+
+	// Uploaded, if not nil, is called after each successful upload with
+	// the upload's metadata, name, and size.
+	Uploaded func(m *Meta, name string, n int64)
+
+	// Failed, if not nil, is called after an upload fails and, if it
+	// was opened, is aborted.  res.Name is empty if the upload wasn't
+	// opened.
+	Failed func(r *http.Request, res Result, err error)
+
+	// Respond, if not nil, is called after each successful upload to
+	// send the client a response, instead of the number of bytes saved.
+	Respond func(w http.ResponseWriter, r *http.Request, res Result)
+
+	// Log, if not nil, is called to log messages about uploads, instead
+	// of ErrorLog.  The error may be nil.
+	Log func(r *http.Request, res Result, err error, msg string)
+
+	// ErrorLog, if not nil, is used to log messages about uploads.  If
+	// it's nil, the log package's standard logger is used.
+	ErrorLog *log.Logger
+}
+
+// Result describes an upload, as much as is known.
+type Result struct {
+	Meta   *Meta
+	Name   string /* From Upload.Name */
+	Bytes  int64
+	SHA256 string /* Hex-encoded */
+}
+
+// StatusError is an error which comes with what to tell the client.  It may
+// be returned by a Handler's Prepare function, Storage, or an Upload.
+type StatusError struct {
+	Status  int    /* HTTP status code */
+	Message string /* Sent to the client */
+	Err     error
+}
+
+/* Error returns e.Err's message. */
+func (e *StatusError) Error() string { return e.Err.Error() }
+
+/* Unwrap returns e.Err. */
+func (e *StatusError) Unwrap() error { return e.Err }
+
+/* ServeHTTP implements http.Handler. */
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	if !h.uploads(r.Method) {
+		http.Error(w, "Invalid method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	/* Make sure the client's allowed to upload */
+	m := &Meta{
+		Source: r.RemoteAddr,
+		Path:   r.URL.Path,
+		Host:   r.Host,
+		Time:   time.Now(),
+		TLS:    NewTLSInfo(r.TLS),
+	}
+	res := Result{Meta: m}
+	if nil != h.Authorize {
+		var ok bool
+		if m.Token, ok = h.Authorize(r); !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+	var (
+		body io.Reader = r.Body
+		err  error
+	)
+	if nil != h.Prepare {
+		if body, err = h.Prepare(r, m, body); nil != err {
+			h.fail(w, r, res, err, "prepare")
+			return
+		}
+	}
+
+	/* Save the body */
+	var s Storage = LocalStorage{}
+	if nil != h.Storage {
+		s = h.Storage
+	}
+	u, err := s.Open(m)
+	if nil != err {
+		h.fail(w, r, res, err, "open")
+		return
+	}
+	res.Name = u.Name()
+	cp := io.Copy
+	if nil != h.Copy {
+		cp = h.Copy
+	}
+	sum := sha256.New()
+	if res.Bytes, err = cp(io.MultiWriter(u, sum), body); nil != err {
+		u.Abort()
+		h.fail(w, r, res, err, "write")
+		return
+	}
+	if err := u.Commit(); nil != err {
+		h.fail(w, r, res, err, "commit")
+		return
+	}
+	res.SHA256 = hex.EncodeToString(sum.Sum(nil))
+	h.log(r, res, nil, "Wrote %v bytes to %q", res.Bytes, res.Name)
+	if nil != h.Uploaded {
+		h.Uploaded(m, res.Name, res.Bytes)
+	}
+
+	/* Tell the client how it went */
+	if nil != h.Respond {
+		h.Respond(w, r, res)
+		return
+	}
+	fmt.Fprintf(w, "%v\n", res.Bytes)
+}
+
+/* uploads returns true if requests with the given method upload. */
+func (h *Handler) uploads(method string) bool {
+	if 0 == len(h.Methods) {
+		return http.MethodPost == method
+	}
+	return slices.Contains(h.Methods, method)
+}
+
+// fail logs a failed upload, calls h.Failed, and tells the client.  The
+// client gets a StatusError's status and message, a 413 for too-large
+// bodies, or a 500 with the name of the step which failed: prepare, open,
+// write, or commit.
+func (h *Handler) fail(
+	w http.ResponseWriter,
+	r *http.Request,
+	res Result,
+	err error,
+	step string,
+) {
+	var (
+		se  *StatusError
+		mbe *http.MaxBytesError
+	)
+	isSE := errors.As(err, &se)
+	switch {
+	case isSE && "" == res.Name:
+		h.log(r, res, err, "Refused upload: %v", err)
+	case isSE:
+		h.log(
+			r,
+			res,
+			err,
+			"Rejected %v-byte upload to %q: %v",
+			res.Bytes,
+			res.Name,
+			err,
+		)
+	case "" == res.Name:
+		h.log(r, res, err, "Unable to %s upload: %v", step, err)
+	case "commit" == step:
+		h.log(
+			r,
+			res,
+			err,
+			"Error finishing %v-byte upload to %q: %v",
+			res.Bytes,
+			res.Name,
+			err,
+		)
+	default:
+		h.log(
+			r,
+			res,
+			err,
+			"Error after writing %v bytes to %q: %v",
+			res.Bytes,
+			res.Name,
+			err,
+		)
+	}
+	if nil != h.Failed {
+		h.Failed(r, res, err)
+	}
+	switch {
+	case isSE:
+		http.Error(w, se.Message, se.Status)
+	case errors.As(err, &mbe):
+		http.Error(w, "Too large", http.StatusRequestEntityTooLarge)
+	default:
+		http.Error(w, step, http.StatusInternalServerError)
+	}
+}
+
+/* log logs a message about an upload with h.Log or h.logf. */
+func (h *Handler) log(
+	r *http.Request,
+	res Result,
+	err error,
+	format string,
+	a ...any,
+) {
+	msg := fmt.Sprintf(format, a...)
+	if nil != h.Log {
+		h.Log(r, res, err, msg)
+		return
+	}
+	h.logf("[%s] %s", r.RemoteAddr, msg)
+}
+
+/* logf logs to h.ErrorLog, or the standard logger. */
+func (h *Handler) logf(f string, a ...any) {
+	if nil != h.ErrorLog {
+		h.ErrorLog.Printf(f, a...)
+		return
+	}
+	log.Printf(f, a...)
+}
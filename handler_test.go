@@ -0,0 +1,210 @@
+package postfile
+
+/*
+ * handler_test.go
+ * Tests for handler.go
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+// errStorage is a Storage which returns its error from Open, or, if Write
+// is set, from its uploads' Write.
+type errStorage struct {
+	err   error
+	write bool
+}
+
+/* Open returns s.err or an upload which returns s.err. */
+func (s errStorage) Open(m *Meta) (Upload, error) {
+	if !s.write {
+		return nil, s.err
+	}
+	return errUpload{s.err}, nil
+}
+
+/* errUpload is an Upload whose writes fail. */
+type errUpload struct{ err error }
+
+func (u errUpload) Write([]byte) (int, error) { return 0, u.err }
+func (u errUpload) Name() string              { return "kittens" }
+func (u errUpload) Commit() error             { return nil }
+func (u errUpload) Abort() error              { return nil }
+
+func TestHandler(t *testing.T) {
+	dir := t.TempDir()
+	var uploaded string
+	h := &Handler{
+		Storage: LocalStorage{Dir: dir},
+		Uploaded: func(m *Meta, name string, n int64) {
+			uploaded = name
+		},
+		ErrorLog: log.New(io.Discard, "", 0),
+	}
+	r := httptest.NewRequest(
+		http.MethodPost,
+		"/foo",
+		strings.NewReader("kittens"),
+	)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if http.StatusOK != w.Code || "7\n" != w.Body.String() {
+		t.Fatalf("Got %d %q, want 200 %q", w.Code, w.Body, "7\n")
+	}
+	if b, err := os.ReadFile(uploaded); nil != err {
+		t.Fatalf("Error reading upload: %v", err)
+	} else if "kittens" != string(b) {
+		t.Errorf("Upload has %q, want %q", b, "kittens")
+	}
+
+	/* Only POSTs upload by default. */
+	r = httptest.NewRequest(http.MethodPut, "/foo", nil)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if http.StatusMethodNotAllowed != w.Code {
+		t.Errorf("PUT: got %d, want 405", w.Code)
+	}
+}
+
+func TestHandlerHooks(t *testing.T) {
+	var (
+		failed error
+		res    Result
+	)
+	h := &Handler{
+		Storage: LocalStorage{Dir: t.TempDir()},
+		Methods: []string{http.MethodPut},
+		Authorize: func(r *http.Request) (string, bool) {
+			return "tok", "" != r.Header.Get("Authorization")
+		},
+		Prepare: func(
+			r *http.Request,
+			m *Meta,
+			b io.Reader,
+		) (io.Reader, error) {
+			if "" != r.Header.Get("X-Refuse") {
+				return nil, &StatusError{
+					Status:  http.StatusTeapot,
+					Message: "No",
+					Err:     errors.New("refused"),
+				}
+			}
+			m.Ext = ".txt"
+			return io.MultiReader(strings.NewReader(">"), b), nil
+		},
+		Failed: func(r *http.Request, _ Result, err error) {
+			failed = err
+		},
+		Respond: func(
+			w http.ResponseWriter,
+			r *http.Request,
+			rs Result,
+		) {
+			res = rs
+			w.WriteHeader(http.StatusCreated)
+		},
+		Log: func(*http.Request, Result, error, string) {},
+	}
+	for _, c := range []struct {
+		name   string
+		auth   bool
+		refuse bool
+		want   int
+	}{
+		{"unauthorized", false, false, http.StatusUnauthorized},
+		{"refused", true, true, http.StatusTeapot},
+		{"ok", true, false, http.StatusCreated},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			failed, res = nil, Result{}
+			r := httptest.NewRequest(
+				http.MethodPut,
+				"/foo",
+				strings.NewReader("kittens"),
+			)
+			if c.auth {
+				r.Header.Set("Authorization", "x")
+			}
+			if c.refuse {
+				r.Header.Set("X-Refuse", "x")
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if c.want != w.Code {
+				t.Fatalf("Got %d, want %d", w.Code, c.want)
+			}
+			if c.refuse && nil == failed {
+				t.Errorf("Failed not called")
+			}
+			if http.StatusCreated != c.want {
+				return
+			}
+			if "tok" != res.Meta.Token ||
+				!strings.HasSuffix(res.Name, "_000000.txt") ||
+				8 != res.Bytes ||
+				64 != len(res.SHA256) {
+				t.Errorf("Bad result %+v", res)
+			}
+		})
+	}
+}
+
+func TestHandlerErrors(t *testing.T) {
+	se := &StatusError{
+		Status:  http.StatusInsufficientStorage,
+		Message: "Full",
+		Err:     errors.New("full"),
+	}
+	for _, c := range []struct {
+		name string
+		s    Storage
+		want int
+		body string
+	}{
+		{"open", errStorage{err: errors.New("x")}, 500, "open\n"},
+		{"open_status", errStorage{err: se}, 507, "Full\n"},
+		{"write", errStorage{errors.New("x"), true}, 500, "write\n"},
+		{"write_status", errStorage{se, true}, 507, "Full\n"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			var failed bool
+			h := &Handler{
+				Storage: c.s,
+				Failed: func(*http.Request, Result, error) {
+					failed = true
+				},
+				ErrorLog: log.New(io.Discard, "", 0),
+			}
+			r := httptest.NewRequest(
+				http.MethodPost,
+				"/foo",
+				strings.NewReader("kittens"),
+			)
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if c.want != w.Code || c.body != w.Body.String() {
+				t.Errorf(
+					"Got %d %q, want %d %q",
+					w.Code,
+					w.Body,
+					c.want,
+					c.body,
+				)
+			}
+			if !failed {
+				t.Errorf("Failed not called")
+			}
+		})
+	}
+}
@@ -0,0 +1,204 @@
+package postfile
+
+/*
+ * name.go
+ * Name uploaded files
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+)
+
+// MaxFileNum is the maximum number of files of the sameish name to keep
+const MaxFileNum = 65535
+
+// MaxNameLen is the longest name, in bytes, a sanitized name can have, with
+// MakeName's suffix and an extension.  It's NAME_MAX on most filesystems.
+const MaxNameLen = 255
+
+// MaxExtLen is the longest extension, including the dot, which can be put
+// on the end of a name.
+const MaxExtLen = 8
+
+/* nameSuffixLen is the length of MakeName's suffix. */
+const nameSuffixLen = len("_000000")
+
+// NamePolicy is how names are made safe for filesystems.  Other than
+// NameAsIs, policies make names safe on Windows as well as Unix, which
+// means no control characters or any of <>:"/\|?*, and no longer than
+// MaxNameLen bytes.
+type NamePolicy int
+
+const (
+	// NameAsIs leaves names as BaseName makes them.
+	NameAsIs NamePolicy = iota
+
+	// NamePercent percent-encodes unsafe characters, including %, and
+	// truncates long names.
+	NamePercent
+
+	// NameTruncate replaces unsafe characters with underscores and
+	// truncates long names.
+	NameTruncate
+
+	// NameHash is like NameTruncate, but truncated names end with a
+	// hash of the whole name, so long names which start the same stay
+	// distinct.
+	NameHash
+)
+
+/* namePolicies are NamePolicy's names. */
+var namePolicies = []string{"none", "percent", "truncate", "hash"}
+
+/* String returns p's name, as understood by ParseNamePolicy. */
+func (p NamePolicy) String() string {
+	if 0 > p || int(p) >= len(namePolicies) {
+		return fmt.Sprintf("NamePolicy(%d)", int(p))
+	}
+	return namePolicies[p]
+}
+
+// ParseNamePolicy returns the NamePolicy with the given name: none,
+// percent, truncate, or hash.
+func ParseNamePolicy(s string) (NamePolicy, error) {
+	for i, n := range namePolicies {
+		if s == n {
+			return NamePolicy(i), nil
+		}
+	}
+	return 0, fmt.Errorf(
+		"unknown name policy %q (not %s)",
+		s,
+		strings.Join(namePolicies, ", "),
+	)
+}
+
+// Sanitize makes name, from BaseName, safe according to p.  There's room
+// left for MakeName's suffix and an extension.
+func (p NamePolicy) Sanitize(name string) string {
+	if NameAsIs == p {
+		return name
+	}
+
+	/* Get rid of the unsafe bits */
+	var sb strings.Builder
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if !unsafeNameChar(c) && (NamePercent != p || '%' != c) {
+			sb.WriteByte(c)
+		} else if NamePercent == p {
+			fmt.Fprintf(&sb, "%%%02X", c)
+		} else {
+			sb.WriteByte('_')
+		}
+	}
+	s := sb.String()
+
+	/* Make it short enough */
+	n := MaxNameLen - nameSuffixLen - MaxExtLen
+	if len(s) <= n {
+		return s
+	}
+	var sum string
+	if NameHash == p {
+		h := sha256.Sum256([]byte(name))
+		sum = "-" + hex.EncodeToString(h[:8])
+		n -= len(sum)
+	}
+	for 0 < n && !utf8.RuneStart(s[n]) { /* Don't split runes */
+		n--
+	}
+	s = s[:n]
+	if NamePercent == p { /* Or escapes */
+		if i := strings.LastIndexByte(s, '%'); -1 != i && len(s)-3 < i {
+			s = s[:i]
+		}
+	}
+	return s + sum
+}
+
+// unsafeNameChar returns true if c is a control character or can't be in a
+// name on Windows.
+func unsafeNameChar(c byte) bool {
+	return 0x20 > c || 0x7f == c || -1 != strings.IndexByte(`<>:"/\|?*`, c)
+}
+
+// OpenFile opens a new file in dir for an upload with the given base name.
+// The file's name is the first unused name made by MakeName.  There's no
+// lock; O_EXCL makes sure two uploads never get the same file, and whoever
+// loses the race tries the next name.
+func OpenFile(dir, base string) (*os.File, error) {
+	return OpenFileExt(dir, base, "")
+}
+
+// OpenFileExt is like OpenFile, but the file's name ends with the extension
+// ext, which should include the dot and be no longer than MaxExtLen.
+func OpenFileExt(dir, base, ext string) (*os.File, error) {
+	if MaxExtLen < len(ext) {
+		return nil, fmt.Errorf("extension %q too long", ext)
+	}
+	var (
+		f   *os.File
+		err error
+	)
+	for num := 0; num < MaxFileNum; num++ {
+		f, err = os.OpenFile(
+			filepath.Join(dir, MakeName(base, num)+ext),
+			os.O_WRONLY|os.O_APPEND|os.O_CREATE|os.O_EXCL,
+			0600,
+		)
+		if !errors.Is(err, fs.ErrExist) {
+			return f, err
+		}
+	}
+	return nil, err
+}
+
+// AppendFile opens the file in dir for an upload with the given base name
+// and extension for appending, creating it if need be.  The file's name is
+// MakeName's first name, plus ext.  Writes from simultaneous uploads to the
+// same file may be interleaved.
+func AppendFile(dir, base, ext string) (*os.File, error) {
+	if MaxExtLen < len(ext) {
+		return nil, fmt.Errorf("extension %q too long", ext)
+	}
+	return os.OpenFile(
+		filepath.Join(dir, MakeName(base, 0)+ext),
+		os.O_WRONLY|os.O_APPEND|os.O_CREATE,
+		0600,
+	)
+}
+
+/* MakeName makes a name from the given base name and number */
+func MakeName(base string, num int) string {
+	return fmt.Sprintf("%s_%06v", base, num)
+}
+
+// BaseName makes a name from the given upload's source and path, with
+// slashes in the path turned into underscores.
+func BaseName(m *Meta) string {
+	return fmt.Sprintf(
+		"%s_%s",
+		m.Source,
+		strings.Replace(
+			strings.TrimPrefix(
+				filepath.Clean(m.Path),
+				"/",
+			),
+			"/",
+			"_",
+			-1,
+		),
+	)
+}
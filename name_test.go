@@ -0,0 +1,85 @@
+package postfile
+
+/*
+ * name_test.go
+ * Tests for name.go
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestBaseName(t *testing.T) {
+	for _, c := range []struct {
+		source string
+		path   string
+		want   string
+	}{
+		{"127.0.0.1:1234", "/foo", "127.0.0.1:1234_foo"},
+		{"1.2.3.4:5", "/foo/bar/baz", "1.2.3.4:5_foo_bar_baz"},
+		{"127.0.0.1:1234", "/", "127.0.0.1:1234_"},
+		{"127.0.0.1:1234", "", "127.0.0.1:1234_."},
+		{"127.0.0.1:1234", "/foo//bar/", "127.0.0.1:1234_foo_bar"},
+		{"1.2.3.4:5", "/../../etc/passwd", "1.2.3.4:5_etc_passwd"},
+		{"127.0.0.1:1234", "/foo/./../bar", "127.0.0.1:1234_bar"},
+		{"[::1]:1234", "/a/b", "[::1]:1234_a_b"},
+	} {
+		got := BaseName(&Meta{Source: c.source, Path: c.path})
+		if got != c.want {
+			t.Errorf(
+				"BaseName(%q, %q): got %q, want %q",
+				c.source,
+				c.path,
+				got,
+				c.want,
+			)
+		}
+		if strings.Contains(got, "/") {
+			t.Errorf(
+				"BaseName(%q, %q): %q has a slash",
+				c.source,
+				c.path,
+				got,
+			)
+		}
+	}
+}
+
+func TestSanitize(t *testing.T) {
+	long := strings.Repeat("a", 2*MaxNameLen)
+	for _, c := range []struct {
+		policy NamePolicy
+		name   string
+		want   string
+	}{
+		{NameAsIs, "a:b|c", "a:b|c"},
+		{NamePercent, "a:b%c", "a%3Ab%25c"},
+		{NameTruncate, "a:b\x00c", "a_b_c"},
+		{NameHash, "a<b>c", "a_b_c"},
+		{NameTruncate, long, long[:MaxNameLen-nameSuffixLen-MaxExtLen]},
+	} {
+		if got := c.policy.Sanitize(c.name); got != c.want {
+			t.Errorf(
+				"%s.Sanitize(%q): got %q, want %q",
+				c.policy,
+				c.name,
+				got,
+				c.want,
+			)
+		}
+	}
+
+	/* Long hashed names which start the same shouldn't collide. */
+	a := NameHash.Sanitize(long + "a")
+	b := NameHash.Sanitize(long + "b")
+	if a == b {
+		t.Errorf("Long names hashed to the same name %q", a)
+	}
+	if n := MaxNameLen - nameSuffixLen - MaxExtLen; n < len(a) {
+		t.Errorf("Hashed name is %d bytes, want at most %d", len(a), n)
+	}
+}
@@ -0,0 +1,141 @@
+package postfile
+
+/*
+ * storage.go
+ * Interchangeable places to put uploads
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"crypto/tls"
+	"io"
+	"os"
+	"time"
+)
+
+// Storage is somewhere uploads are stored.
+type Storage interface {
+	// Open starts a new upload.  The upload will be named based on
+	// BaseName(m), though possibly with a suffix to keep it unique, and
+	// m.Ext, if it's set.
+	Open(m *Meta) (Upload, error)
+}
+
+// Meta is metadata about an upload.
+type Meta struct {
+	Source string    `json:"source"` /* Client address */
+	Path   string    `json:"path"`
+	Host   string    `json:"host,omitempty"`
+	Time   time.Time `json:"time"`
+	Token  string    `json:"token,omitempty"` /* Token name */
+	JA3    string    `json:"ja3,omitempty"`   /* TLS client fingerprints */
+	JA4    string    `json:"ja4,omitempty"`
+	TLS    *TLSInfo  `json:"tls,omitempty"`
+	Type   string    `json:"type,omitempty"` /* Content type */
+	Ext    string    `json:"ext,omitempty"`  /* Added to file names */
+}
+
+// TLSInfo describes the TLS connection over which an upload was sent.
+type TLSInfo struct {
+	Version     string `json:"version"`
+	CipherSuite string `json:"cipher_suite"`
+	ALPN        string `json:"alpn,omitempty"`
+	SNI         string `json:"sni,omitempty"`
+	ClientCert  string `json:"client_cert,omitempty"` /* Subject */
+}
+
+/* NewTLSInfo returns a TLSInfo for cs, or nil if cs is nil. */
+func NewTLSInfo(cs *tls.ConnectionState) *TLSInfo {
+	if nil == cs {
+		return nil
+	}
+	ti := &TLSInfo{
+		Version:     tls.VersionName(cs.Version),
+		CipherSuite: tls.CipherSuiteName(cs.CipherSuite),
+		ALPN:        cs.NegotiatedProtocol,
+		SNI:         cs.ServerName,
+	}
+	if 0 != len(cs.PeerCertificates) {
+		ti.ClientCert = cs.PeerCertificates[0].Subject.String()
+	}
+	return ti
+}
+
+// String returns ti as space-separated fields, suitable for logging.  Empty
+// fields are left out.
+func (ti *TLSInfo) String() string {
+	if nil == ti {
+		return ""
+	}
+	s := ti.Version + " " + ti.CipherSuite
+	if "" != ti.ALPN {
+		s += " ALPN:" + ti.ALPN
+	}
+	if "" != ti.SNI {
+		s += " SNI:" + ti.SNI
+	}
+	if "" != ti.ClientCert {
+		s += " Client:" + ti.ClientCert
+	}
+	return s
+}
+
+// Upload is a single upload in progress.  Exactly one of Commit or Abort
+// should be called when the body's been written.
+type Upload interface {
+	io.Writer
+
+	// Name returns a name for where the upload is going, suitable for
+	// logging.
+	Name() string
+
+	// Commit finishes the upload.
+	Commit() error
+
+	// Abort gives up on the upload.
+	Abort() error
+}
+
+// LocalStorage stores uploads as files in a directory.  Files are never
+// overwritten; each upload gets the first unused name made by MakeName from
+// BaseName(m), sanitized according to Names, unless Append is set.
+type LocalStorage struct {
+	// Dir is the directory in which to store files.  If it's empty, the
+	// current directory is used.
+	Dir string
+
+	// Names is how names are made safe for the filesystem.  The zero
+	// value, NameAsIs, doesn't change them.
+	Names NamePolicy
+
+	// Append, if set, appends uploads to the file with the first name
+	// made by MakeName, so uploads with the same base name all end up
+	// in one file.  Callers will probably want to take the port off of
+	// Meta.Source.
+	Append bool
+}
+
+/* Open opens a new file for the upload, or an old one if s.Append is set. */
+func (s LocalStorage) Open(m *Meta) (Upload, error) {
+	open := OpenFileExt
+	if s.Append {
+		open = AppendFile
+	}
+	f, err := open(s.Dir, s.Names.Sanitize(BaseName(m)), m.Ext)
+	if nil != err {
+		return nil, err
+	}
+	return localUpload{f}, nil
+}
+
+// localUpload is an upload to a local file.  Partial data is better than
+// none, so Abort keeps whatever was written.
+type localUpload struct{ *os.File }
+
+/* Commit closes the file. */
+func (u localUpload) Commit() error { return u.Close() }
+
+/* Abort also closes the file. */
+func (u localUpload) Abort() error { return u.Close() }
@@ -0,0 +1,106 @@
+package postfile
+
+/*
+ * storage_test.go
+ * Tests for storage.go
+ * By J. Stuart McMurray
+ * Created 20261015
+ * Last Modified 20261015
+ */
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestLocalStorageOpenCollisions(t *testing.T) {
+	const nUpload = 50
+	s := LocalStorage{Dir: t.TempDir()}
+	m := &Meta{Source: "127.0.0.1:1234", Path: "/foo", Ext: ".txt"}
+
+	/* A file which was already there shouldn't be touched. */
+	old := filepath.Join(s.Dir, MakeName(BaseName(m), 0)+m.Ext)
+	if err := os.WriteFile(old, []byte("old"), 0600); nil != err {
+		t.Fatalf("Error making old file: %v", err)
+	}
+
+	/* Lots of uploads at once should all get their own files. */
+	var (
+		wg    sync.WaitGroup
+		names sync.Map
+	)
+	for i := range nUpload {
+		wg.Go(func() {
+			u, err := s.Open(m)
+			if nil != err {
+				t.Errorf("Open %d: %v", i, err)
+				return
+			}
+			fmt.Fprintf(u, "%d", i)
+			if err := u.Commit(); nil != err {
+				t.Errorf("Commit %d: %v", i, err)
+			}
+			if o, dup := names.LoadOrStore(u.Name(), i); dup {
+				t.Errorf(
+					"Uploads %d and %d both got %s",
+					o,
+					i,
+					u.Name(),
+				)
+			}
+		})
+	}
+	wg.Wait()
+
+	/* Make sure nothing got mixed up. */
+	if b, err := os.ReadFile(old); nil != err {
+		t.Errorf("Error reading old file: %v", err)
+	} else if "old" != string(b) {
+		t.Errorf("Old file overwritten with %q", b)
+	}
+	n := 0
+	names.Range(func(k, v any) bool {
+		n++
+		b, err := os.ReadFile(k.(string))
+		if nil != err {
+			t.Errorf("Error reading %s: %v", k, err)
+		} else if want := fmt.Sprint(v); want != string(b) {
+			t.Errorf("File %s has %q, want %q", k, b, want)
+		}
+		return true
+	})
+	if nUpload != n {
+		t.Errorf("Got %d files, want %d", n, nUpload)
+	}
+}
+
+func TestLocalStorageOpenAppend(t *testing.T) {
+	s := LocalStorage{Dir: t.TempDir(), Append: true}
+	m := &Meta{Source: "127.0.0.1", Path: "/foo"}
+	var name string
+	for _, b := range []string{"foo", "bar"} {
+		u, err := s.Open(m)
+		if nil != err {
+			t.Fatalf("Open: %v", err)
+		}
+		if "" == name {
+			name = u.Name()
+		} else if name != u.Name() {
+			t.Errorf("Appended to %s, then %s", name, u.Name())
+		}
+		if _, err := u.Write([]byte(b)); nil != err {
+			t.Fatalf("Write: %v", err)
+		}
+		if err := u.Commit(); nil != err {
+			t.Fatalf("Commit: %v", err)
+		}
+	}
+	if b, err := os.ReadFile(name); nil != err {
+		t.Fatalf("Error reading %s: %v", name, err)
+	} else if "foobar" != string(b) {
+		t.Errorf("Got %q, want %q", b, "foobar")
+	}
+}